@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -9,11 +12,14 @@ import (
 	clientset "github.com/openshift/client-go/machine/clientset/versioned"
 	"github.com/openshift/cluster-api-provider-libvirt/pkg/apis"
 	"github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	clusteractuator "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/actuators/cluster"
 	machineactuator "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/actuators/machine"
 	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
 	"github.com/openshift/cluster-api-provider-libvirt/pkg/controller"
 	"github.com/openshift/machine-api-operator/pkg/metrics"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/klog"
@@ -59,6 +65,85 @@ func main() {
 		"The duration that non-leader candidates will wait after observing a leadership renewal until attempting to acquire leadership of a led but unrenewed leader slot. This is effectively the maximum duration that a leader can be stopped before it is replaced by another candidate. This is only applicable if leader election is enabled.",
 	)
 
+	libvirtURI := flag.String(
+		"libvirt-uri",
+		"",
+		"URI of the libvirt daemon hosting the storage pool given by --storage-pool-name.",
+	)
+
+	storagePoolName := flag.String(
+		"storage-pool-name",
+		"",
+		"Name of a dir-type libvirt storage pool which is created if missing and validated on startup. If unspecified, storage pools are not managed at startup.",
+	)
+
+	storagePoolPath := flag.String(
+		"storage-pool-path",
+		"/var/lib/libvirt/cluster-api-provider-libvirt",
+		"Directory of the storage pool given by --storage-pool-name. The manager refuses to start if another storage pool uses it, like the stock default pool uses /var/lib/libvirt/images.",
+	)
+
+	storagePoolPermissions := flag.String(
+		"storage-pool-permissions",
+		"0711",
+		"Octal mode of the directory of the storage pool given by --storage-pool-name.",
+	)
+
+	storagePoolAutostart := flag.Bool(
+		"storage-pool-autostart",
+		true,
+		"Start the storage pool given by --storage-pool-name together with the libvirt daemon.",
+	)
+
+	storagePoolMinimumAvailable := flag.String(
+		"storage-pool-minimum-available",
+		"0",
+		"Space the storage pool given by --storage-pool-name must have available on startup, e.g. 50Gi.",
+	)
+
+	downloadOptions := libvirtclient.DefaultDownloadOptions()
+	flag.StringVar(
+		&downloadOptions.StagingDir,
+		"image-download-staging-dir",
+		downloadOptions.StagingDir,
+		"Directory http(s) images are downloaded to before they are imported, so interrupted downloads can be resumed.",
+	)
+	flag.IntVar(
+		&downloadOptions.Retries,
+		"image-download-retries",
+		downloadOptions.Retries,
+		"Number of times a failed http(s) image download is resumed before the import fails.",
+	)
+	flag.DurationVar(
+		&downloadOptions.RetryBackoff,
+		"image-download-retry-backoff",
+		downloadOptions.RetryBackoff,
+		"Delay before resuming a failed http(s) image download, doubled for every further retry.",
+	)
+	flag.DurationVar(
+		&downloadOptions.Timeout,
+		"image-download-timeout",
+		downloadOptions.Timeout,
+		"Maximum time to connect, to wait for a response or to wait for further data while downloading http(s) images.",
+	)
+	flag.StringVar(
+		&downloadOptions.ProxyURL,
+		"image-download-proxy",
+		"",
+		"Proxy for downloading http(s) images. If unspecified, the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.",
+	)
+	flag.StringVar(
+		&downloadOptions.CAFile,
+		"image-download-ca-file",
+		"",
+		"PEM bundle of CAs trusted in addition to the system CAs when downloading https images.",
+	)
+	plainHTTPRegistries := flag.String(
+		"image-registry-plain-http",
+		"",
+		"Comma separated registries, as host or host:port, registry:// and docker:// images are pulled from over plain http instead of https.",
+	)
+
 	flag.Parse()
 	flag.VisitAll(func(f1 *flag.Flag) {
 		f2 := klogFlags.Lookup(f1.Name)
@@ -68,6 +153,31 @@ func main() {
 		}
 	})
 
+	if *plainHTTPRegistries != "" {
+		downloadOptions.PlainHTTPRegistries = strings.Split(*plainHTTPRegistries, ",")
+	}
+	if err := libvirtclient.SetDownloadOptions(downloadOptions); err != nil {
+		glog.Fatalf("Invalid image download options: %v", err)
+	}
+
+	if *storagePoolName != "" {
+		minimumAvailable, err := resource.ParseQuantity(*storagePoolMinimumAvailable)
+		if err != nil {
+			glog.Fatalf("Invalid storage pool minimum available space %q: %v", *storagePoolMinimumAvailable, err)
+		}
+		if *libvirtURI == "" {
+			glog.Fatal("--libvirt-uri is required to manage a storage pool")
+		}
+		size, _ := minimumAvailable.AsInt64()
+		go ensureStoragePool(*libvirtURI, libvirtclient.CreateStoragePoolInput{
+			Name:             *storagePoolName,
+			Path:             *storagePoolPath,
+			Permissions:      *storagePoolPermissions,
+			Autostart:        *storagePoolAutostart,
+			MinimumAvailable: uint64(size),
+		})
+	}
+
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
@@ -157,4 +267,46 @@ func initActuator(m manager.Manager) {
 	if err != nil {
 		glog.Fatalf("Could not create Libvirt machine actuator: %v", err)
 	}
+
+	clusteractuator.ClusterActuator, err = clusteractuator.NewActuator(clusteractuator.ActuatorParams{
+		ClientBuilder: libvirtclient.NewClient,
+	})
+	if err != nil {
+		glog.Fatalf("Could not create Libvirt cluster actuator: %v", err)
+	}
+}
+
+// ensureStoragePool creates or validates the storage pool in the background
+// and retries with backoff until it succeeds, so a libvirt host which is not
+// reachable at startup does not keep the controllers from running
+func ensureStoragePool(uri string, input libvirtclient.CreateStoragePoolInput) {
+	backoff := wait.Backoff{
+		Duration: 5 * time.Second,
+		Factor:   2,
+		Steps:    math.MaxInt32,
+		Cap:      5 * time.Minute,
+	}
+	for {
+		uuid, err := tryEnsureStoragePool(uri, input)
+		if err == nil {
+			glog.Infof("Storage pool %s (%s) is ready", input.Name, uuid)
+			return
+		}
+		if _, ok := err.(*libvirtclient.PoolPathInUseError); ok {
+			glog.Fatalf("Storage pool %s can't be set up: %v", input.Name, err)
+		}
+		delay := backoff.Step()
+		glog.Errorf("Storage pool %s is not usable, retrying in %s: %v", input.Name, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func tryEnsureStoragePool(uri string, input libvirtclient.CreateStoragePoolInput) (string, error) {
+	client, err := libvirtclient.NewClient(uri, "")
+	if err != nil {
+		return "", fmt.Errorf("could not create libvirt client: %v", err)
+	}
+	defer client.Close()
+
+	return client.EnsureStoragePool(input)
 }
@@ -15,30 +15,121 @@ const (
 	MachineTypeLabel = "machine.openshift.io/cluster-api-machine-type"
 )
 
+// Cluster ConfigMap constants
+const (
+	// ClusterProviderSpecKey is the key of the cluster ConfigMap holding the
+	// LibvirtClusterProviderConfig. The ConfigMap is named after the cluster ID
+	// and lives in the namespace of the cluster's machines.
+	ClusterProviderSpecKey = "providerSpec"
+	// ClusterProviderStatusKey is the key of the cluster ConfigMap holding the
+	// LibvirtClusterProviderStatus
+	ClusterProviderStatusKey = "providerStatus"
+)
+
 // LibvirtMachineProviderConfig is the type that will be embedded in a Machine.Spec.ProviderSpec field
 // for an Libvirt instance.
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type LibvirtMachineProviderConfig struct {
 	metav1.TypeMeta `json:",inline"`
 
-	DomainMemory             int        `json:"domainMemory"`
-	DomainVcpu               int        `json:"domainVcpu"`
-	IgnKey                   string     `json:"ignKey"`
-	Ignition                 *Ignition  `json:"ignition"`
-	CloudInit                *CloudInit `json:"cloudInit"`
-	Volume                   *Volume    `json:"volume"`
-	NetworkInterfaceName     string     `json:"networkInterfaceName"`
-	NetworkInterfaceHostname string     `json:"networkInterfaceHostname"`
-	NetworkInterfaceAddress  string     `json:"networkInterfaceAddress"`
-	NetworkUUID              string     `json:"networkUUID"`
-	Autostart                bool       `json:"autostart"`
-	URI                      string     `json:"uri"`
+	DomainMemory                int        `json:"domainMemory"`
+	DomainVcpu                  int        `json:"domainVcpu"`
+	IgnKey                      string     `json:"ignKey"`
+	Ignition                    *Ignition  `json:"ignition"`
+	CloudInit                   *CloudInit `json:"cloudInit"`
+	Volume                      *Volume    `json:"volume"`
+	NetworkInterfaceName        string     `json:"networkInterfaceName"`
+	NetworkInterfaceHostname    string     `json:"networkInterfaceHostname"`
+	NetworkInterfaceHostAliases []string   `json:"networkInterfaceHostAliases,omitempty"`
+	NetworkInterfaceAddress     string     `json:"networkInterfaceAddress"`
+	NetworkUUID                 string     `json:"networkUUID"`
+	Autostart                   bool       `json:"autostart"`
+	URI                         string     `json:"uri"`
+	Disks                       []Disk     `json:"disks,omitempty"`
+	Backup                      *Backup    `json:"backup,omitempty"`
+
+	// NetworkInterfaceConfig configures the network interface in the guest
+	// with a cloud init network-config, e.g. on networks without DHCP
+	NetworkInterfaceConfig *NetworkInterfaceConfig `json:"networkInterfaceConfig,omitempty"`
+}
+
+// NetworkInterfaceConfig is the configuration of the network interface of a
+// machine inside the guest. Interfaces without addresses use DHCP.
+type NetworkInterfaceConfig struct {
+	// Addresses are static IPv4 or IPv6 addresses in CIDR notation,
+	// e.g. 192.168.126.51/24
+	Addresses []string `json:"addresses,omitempty"`
+	// Gateways are the default gateways, at most one per IP family
+	Gateways []string `json:"gateways,omitempty"`
+	// Nameservers are the addresses of the DNS servers
+	Nameservers []string `json:"nameservers,omitempty"`
+	// SearchDomains are the DNS search domains
+	SearchDomains []string `json:"searchDomains,omitempty"`
+	// MTU of the interface, also set on the libvirt interface
+	MTU int `json:"mtu,omitempty"`
+}
+
+// Backup configures where the volumes of a machine are stored when a backup
+// is requested with the backup annotation
+type Backup struct {
+	// URL is the file:///path directory of the machine controller or the
+	// s3://bucket/prefix the volumes are stored under
+	URL string `json:"url"`
+	// Endpoint is the URL of the S3 compatible object store, AWS S3 if empty
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region of the bucket, us-east-1 if empty
+	Region string `json:"region,omitempty"`
+	// CredentialsSecret is the name of a secret in the namespace of the machine
+	// with the aws_access_key_id and aws_secret_access_key of the object store
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+	// PauseDomain pauses a running machine while its volumes are copied, so
+	// the copies are consistent with each other
+	PauseDomain bool `json:"pauseDomain,omitempty"`
 }
 
 // Ignition contains location of ignition to be run during bootstrapping
 type Ignition struct {
 	// Ignition config to be run during bootstrapping
 	UserDataSecret string `json:"userDataSecret"`
+	// Storage pool of the ignition volume, defaults to the pool of the root volume
+	PoolName string `json:"poolName,omitempty"`
+	// Delivery selects how the ignition config is passed to the machine,
+	// defaults to Disk on s390x and ppc64 and to QEMUCommandLine otherwise
+	Delivery IgnitionDelivery `json:"delivery,omitempty"`
+	// SetHostname writes the hostname of the machine to /etc/hostname
+	SetHostname bool `json:"setHostname,omitempty"`
+	// SSHAuthorizedKeys are added to the authorized keys of the core user
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	// Files are added to the config with contents from ConfigMaps or Secrets
+	Files []IgnitionFile `json:"files,omitempty"`
+}
+
+// IgnitionDelivery defines how the ignition config is passed to a machine
+type IgnitionDelivery string
+
+const (
+	// IgnitionDeliveryQEMUCommandLine adds the config to the firmware
+	// configuration device with -fw_cfg QEMU command line arguments
+	IgnitionDeliveryQEMUCommandLine IgnitionDelivery = "QEMUCommandLine"
+	// IgnitionDeliveryFirmwareConfig adds the config to the firmware
+	// configuration device with a fwcfg sysinfo entry, needs libvirt 6.5
+	IgnitionDeliveryFirmwareConfig IgnitionDelivery = "FirmwareConfig"
+	// IgnitionDeliveryDisk attaches the config as a read-only virtio-blk disk
+	// with the serial "ignition"
+	IgnitionDeliveryDisk IgnitionDelivery = "Disk"
+)
+
+// IgnitionFile is a file added to the Ignition config of a machine, with the
+// contents of a key of either a ConfigMap or a Secret
+type IgnitionFile struct {
+	// Path of the file on the machine
+	Path string `json:"path"`
+	// Mode are the permissions of the file, 0644 if unset
+	Mode *int32 `json:"mode,omitempty"`
+	// ConfigMapRef selects a key of a ConfigMap in the namespace of the machine
+	ConfigMapRef *corev1.ConfigMapKeySelector `json:"configMapRef,omitempty"`
+	// SecretRef selects a key of a Secret in the namespace of the machine
+	SecretRef *corev1.SecretKeySelector `json:"secretRef,omitempty"`
 }
 
 // CloudInit contains location of user data to be run during bootstrapping
@@ -47,6 +138,73 @@ type CloudInit struct {
 	UserDataSecret string `json:"userDataSecret"`
 	// Allow to ssh into instance
 	SSHAccess bool `json:"sshAccess"`
+	// SSHAuthorizedKeys are authorized for the default user if sshAccess is set
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	// SSHAuthorizedKeysSecret is the name of a secret in the namespace of the
+	// machine with more keys, one per line, in its authorized_keys key
+	SSHAuthorizedKeysSecret string `json:"sshAuthorizedKeysSecret,omitempty"`
+	// DefaultUser is the name of the default user, defaults to the user
+	// configured in the image
+	DefaultUser string `json:"defaultUser,omitempty"`
+	// Storage pool of the cloud init volume, defaults to the pool of the root volume
+	PoolName string `json:"poolName,omitempty"`
+}
+
+// Disk is an additional disk of a machine, either an empty volume or a
+// block device exported over the network
+type Disk struct {
+	// Name is appended to the machine name to name the volume of the disk
+	// as <machine name>_<name>. It is a DNS label other than "cloud-init".
+	Name string `json:"name"`
+	// PoolName is the storage pool of the volume. It defaults to the pool of
+	// the root volume.
+	PoolName string `json:"poolName,omitempty"`
+	// Size is the capacity of the disk
+	Size resource.Quantity `json:"size,omitempty"`
+	// Network attaches a network block device instead of creating a volume
+	Network *NetworkDiskSource `json:"network,omitempty"`
+}
+
+// NetworkDiskProtocol is the protocol a network disk is accessed with
+type NetworkDiskProtocol string
+
+const (
+	// NetworkDiskProtocolNBD accesses an export of a network block device server
+	NetworkDiskProtocolNBD NetworkDiskProtocol = "nbd"
+	// NetworkDiskProtocolISCSI accesses a LUN of an iSCSI target
+	NetworkDiskProtocolISCSI NetworkDiskProtocol = "iscsi"
+	// NetworkDiskProtocolRBD accesses an image of a Ceph cluster
+	NetworkDiskProtocolRBD NetworkDiskProtocol = "rbd"
+)
+
+// NetworkDiskSource is a block device exported over the network
+type NetworkDiskSource struct {
+	// Protocol is one of nbd, iscsi or rbd
+	Protocol NetworkDiskProtocol `json:"protocol"`
+	// Name is the NBD export, the iSCSI target with its LUN as <iqn>/<lun>
+	// or the RBD image as <pool>/<image>
+	Name string `json:"name,omitempty"`
+	// Hosts serving the device, the monitors of RBD
+	Hosts []NetworkDiskHost `json:"hosts"`
+	// Auth authenticates with CHAP to iSCSI targets and with cephx to RBD
+	Auth *NetworkDiskAuth `json:"auth,omitempty"`
+}
+
+// NetworkDiskHost is a server of a network disk
+type NetworkDiskHost struct {
+	// Name is the host name or address
+	Name string `json:"name"`
+	// Port defaults to the port of the protocol
+	Port string `json:"port,omitempty"`
+}
+
+// NetworkDiskAuth are the credentials of a network disk
+type NetworkDiskAuth struct {
+	// Username to authenticate as
+	Username string `json:"username"`
+	// SecretName is the name of a secret in the namespace of the machine
+	// with the CHAP password or the cephx key in its "key" key
+	SecretName string `json:"secretName"`
 }
 
 // Volume contains the info for the actuator to create a volume
@@ -55,12 +213,136 @@ type Volume struct {
 	BaseVolumeID string             `json:"baseVolumeID"`
 	VolumeName   string             `json:"volumeName"`
 	VolumeSize   *resource.Quantity `json:"volumeSize,omitempty"`
+	// BaseVolumePoolName is the storage pool of the base volume and of
+	// images imported from ImageURL. It defaults to PoolName.
+	BaseVolumePoolName string `json:"baseVolumePoolName,omitempty"`
+	// ImageURL is the http(s) or file URL of a base image, or a registry://
+	// or docker:// reference to an OCI artifact or containerDisk image
+	// holding it. It is imported once into a base volume shared by all
+	// machines using the same image and cannot be combined with BaseVolumeID.
+	ImageURL string `json:"imageURL,omitempty"`
+	// ImageChecksum is the sha256 or sha512 digest of the image at ImageURL,
+	// optionally prefixed with its algorithm ("sha256:<hex>"), or the URL of
+	// a checksum file listing it. The import fails on a mismatch.
+	ImageChecksum string `json:"imageChecksum,omitempty"`
+	// ImagePullSecret is the name of a kubernetes.io/dockerconfigjson secret
+	// in the namespace of the machine with credentials for registry images.
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
+	// CloneMode defines how the volume is created from its base volume. It
+	// defaults to Overlay.
+	CloneMode VolumeCloneMode `json:"cloneMode,omitempty"`
+	// Format is the format of the volume. It defaults to qcow2. A raw volume
+	// is always a full copy of its base volume.
+	Format VolumeFormat `json:"format,omitempty"`
+	// Preallocation defines how much of the volume is allocated when it is
+	// created. It defaults to none.
+	Preallocation VolumePreallocation `json:"preallocation,omitempty"`
+	// LazyRefcounts enables lazy refcounts of qcow2 volumes
+	LazyRefcounts bool `json:"lazyRefcounts,omitempty"`
+	// ClusterSize is the cluster size of qcow2 volumes
+	ClusterSize *resource.Quantity `json:"clusterSize,omitempty"`
+	// Encryption encrypts the volume with LUKS
+	Encryption *VolumeEncryption `json:"encryption,omitempty"`
+}
+
+// VolumeEncryption configures the LUKS encryption of a volume
+type VolumeEncryption struct {
+	// SecretName is the name of a secret in the namespace of the machine
+	// with the passphrase of the volume in its "passphrase" key
+	SecretName string `json:"secretName"`
 }
 
+// VolumeFormat is the format of a machine volume
+type VolumeFormat string
+
+const (
+	// VolumeFormatQcow2 is the qcow2 format
+	VolumeFormatQcow2 VolumeFormat = "qcow2"
+	// VolumeFormatRaw is the raw format
+	VolumeFormatRaw VolumeFormat = "raw"
+)
+
+// VolumePreallocation defines how much of a machine volume is allocated
+// when it is created
+type VolumePreallocation string
+
+const (
+	// VolumePreallocationNone allocates space on the first write
+	VolumePreallocationNone VolumePreallocation = "none"
+	// VolumePreallocationMetadata allocates the qcow2 metadata
+	VolumePreallocationMetadata VolumePreallocation = "metadata"
+	// VolumePreallocationFull allocates the whole capacity
+	VolumePreallocationFull VolumePreallocation = "full"
+)
+
+// VolumeCloneMode defines how a machine volume is created from its base volume
+type VolumeCloneMode string
+
+const (
+	// VolumeCloneModeOverlay creates a qcow2 overlay backed by the base
+	// volume, which has to outlive the machine
+	VolumeCloneModeOverlay VolumeCloneMode = "Overlay"
+	// VolumeCloneModeClone copies the base volume. The copy keeps the
+	// backing store of the base volume, if it has one.
+	VolumeCloneModeClone VolumeCloneMode = "Clone"
+	// VolumeCloneModeFlatClone copies the base volume including its backing
+	// chain into a standalone volume
+	VolumeCloneModeFlatClone VolumeCloneMode = "FlatClone"
+)
+
 // LibvirtClusterProviderConfig is the type that will be embedded in a Cluster.Spec.ProviderSpec field.
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type LibvirtClusterProviderConfig struct {
 	metav1.TypeMeta `json:",inline"`
+
+	// URI of the libvirt daemon hosting the cluster
+	URI string `json:"uri"`
+
+	// Network is the libvirt network shared by all machines of the cluster
+	Network *Network `json:"network,omitempty"`
+
+	// StoragePool is the libvirt storage pool holding the volumes of the cluster
+	StoragePool *StoragePool `json:"storagePool,omitempty"`
+}
+
+// Network describes a libvirt network managed by the provider
+type Network struct {
+	// Name of the libvirt network
+	Name string `json:"name"`
+	// Bridge is the name of the host bridge device, libvirt picks one if empty
+	Bridge string `json:"bridge,omitempty"`
+	// CIDRs are the IPv4 and IPv6 address ranges of the network
+	CIDRs []string `json:"cidrs"`
+	// ForwardMode is one of nat, route, bridge or none, defaults to nat
+	ForwardMode string `json:"forwardMode,omitempty"`
+	// DNSDomain is the DNS domain served by the network's DNS server
+	DNSDomain string `json:"dnsDomain,omitempty"`
+	// DHCPRange is the address range leased by the network's DHCP server
+	DHCPRange *DHCPRange `json:"dhcpRange,omitempty"`
+}
+
+// StoragePool describes a dir-type libvirt storage pool managed by the provider
+type StoragePool struct {
+	// Name of the libvirt storage pool
+	Name string `json:"name"`
+	// Path of the pool directory on the libvirt host
+	Path string `json:"path"`
+	// Permissions is the octal mode of the pool directory, e.g. 0711
+	Permissions string `json:"permissions,omitempty"`
+	// Owner is the user ID owning the pool directory
+	Owner string `json:"owner,omitempty"`
+	// Group is the group ID owning the pool directory
+	Group string `json:"group,omitempty"`
+	// Autostart starts the pool together with the libvirt daemon
+	Autostart bool `json:"autostart,omitempty"`
+	// MinimumAvailable is the space the pool must have available
+	MinimumAvailable *resource.Quantity `json:"minimumAvailable,omitempty"`
+}
+
+// DHCPRange is a range of addresses leased by DHCP
+type DHCPRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
 }
 
 // LibvirtMachineProviderStatus is the type that will be embedded in a Machine.Status.ProviderStatus field.
@@ -78,8 +360,50 @@ type LibvirtMachineProviderStatus struct {
 	// Conditions is a set of conditions associated with the Machine to indicate
 	// errors or other status
 	Conditions []LibvirtMachineProviderCondition `json:"conditions"`
+
+	// Snapshots are the names of the snapshots of the Libvirt instance,
+	// parents before their children
+	Snapshots []string `json:"snapshots,omitempty"`
+
+	// RevertedSnapshot is the snapshot the instance was reverted to as
+	// requested by the revert annotation
+	RevertedSnapshot string `json:"revertedSnapshot,omitempty"`
+
+	// Backup is the last backup requested by the backup annotation
+	Backup *LibvirtMachineBackupStatus `json:"backup,omitempty"`
+
+	// VolumeSize is the volumeSize the root volume was created or last
+	// resized with. A root volume created larger, because its base volume
+	// is larger, keeps its size as long as this size is requested.
+	VolumeSize *resource.Quantity `json:"volumeSize,omitempty"`
+}
+
+// LibvirtMachineBackupStatus is a backup of the volumes of a machine
+type LibvirtMachineBackupStatus struct {
+	// Name is the value of the backup annotation the backup was taken for
+	Name string `json:"name"`
+	// Phase is Running while the volumes are stored, then Completed or
+	// Failed. Failed backups are not retried.
+	Phase LibvirtMachineBackupPhase `json:"phase"`
+	// Locations are the URLs the volumes were stored at so far
+	Locations []string `json:"locations,omitempty"`
+	// StartTime is the time the backup started
+	StartTime metav1.Time `json:"startTime"`
+	// CompletionTime is the time the backup completed or failed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
 }
 
+// LibvirtMachineBackupPhase is the phase of a backup of the volumes of a machine
+type LibvirtMachineBackupPhase string
+
+// Valid phases of a backup
+const (
+	BackupPhaseRunning   LibvirtMachineBackupPhase = "Running"
+	BackupPhaseCompleted LibvirtMachineBackupPhase = "Completed"
+	BackupPhaseFailed    LibvirtMachineBackupPhase = "Failed"
+)
+
 // LibvirtMachineProviderConditionType is a valid value for LibvirtMachineProviderCondition.Type
 type LibvirtMachineProviderConditionType string
 
@@ -88,6 +412,13 @@ const (
 	// MachineCreated indicates whether the machine has been created or not. If not,
 	// it should include a reason and message for the failure.
 	MachineCreated LibvirtMachineProviderConditionType = "MachineCreated"
+	// VolumeResized indicates whether the root volume has the size requested in
+	// the spec. If not, it should include a reason and message for the failure.
+	VolumeResized LibvirtMachineProviderConditionType = "VolumeResized"
+	// BackupCompleted indicates whether the backup requested with the backup
+	// annotation completed. If not, it should include a reason and message for
+	// the failure.
+	BackupCompleted LibvirtMachineProviderConditionType = "BackupCompleted"
 )
 
 // LibvirtMachineProviderCondition is a condition in a LibvirtMachineProviderStatus
@@ -114,6 +445,17 @@ type LibvirtMachineProviderCondition struct {
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type LibvirtClusterProviderStatus struct {
 	metav1.TypeMeta `json:",inline"`
+
+	// NetworkUUID is the UUID of the libvirt network managed for the cluster
+	NetworkUUID *string `json:"networkUUID,omitempty"`
+
+	// NetworkRestartPending is set while changes to the network, like its
+	// forward mode, addresses or DNS domain, only take effect once the network
+	// is restarted. Changed DHCP ranges are applied to the running network.
+	NetworkRestartPending bool `json:"networkRestartPending,omitempty"`
+
+	// StoragePoolUUID is the UUID of the libvirt storage pool managed for the cluster
+	StoragePoolUUID *string `json:"storagePoolUUID,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -126,5 +468,6 @@ type LibvirtMachineProviderConfigList struct {
 }
 
 func init() {
-	SchemeBuilder.Register(&LibvirtMachineProviderConfig{}, &LibvirtMachineProviderConfigList{}, &LibvirtMachineProviderStatus{})
+	SchemeBuilder.Register(&LibvirtMachineProviderConfig{}, &LibvirtMachineProviderConfigList{}, &LibvirtMachineProviderStatus{},
+		&LibvirtClusterProviderConfig{}, &LibvirtClusterProviderStatus{})
 }
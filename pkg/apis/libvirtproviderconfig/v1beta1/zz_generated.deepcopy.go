@@ -22,12 +22,34 @@ limitations under the License.
 package v1beta1
 
 import (
+	v1 "k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Backup) DeepCopyInto(out *Backup) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Backup.
+func (in *Backup) DeepCopy() *Backup {
+	if in == nil {
+		return nil
+	}
+	out := new(Backup)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CloudInit) DeepCopyInto(out *CloudInit) {
 	*out = *in
+	if in.SSHAuthorizedKeys != nil {
+		in, out := &in.SSHAuthorizedKeys, &out.SSHAuthorizedKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -41,9 +63,59 @@ func (in *CloudInit) DeepCopy() *CloudInit {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DHCPRange) DeepCopyInto(out *DHCPRange) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DHCPRange.
+func (in *DHCPRange) DeepCopy() *DHCPRange {
+	if in == nil {
+		return nil
+	}
+	out := new(DHCPRange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Disk) DeepCopyInto(out *Disk) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	if in.Network != nil {
+		in, out := &in.Network, &out.Network
+		*out = new(NetworkDiskSource)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Disk.
+func (in *Disk) DeepCopy() *Disk {
+	if in == nil {
+		return nil
+	}
+	out := new(Disk)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Ignition) DeepCopyInto(out *Ignition) {
 	*out = *in
+	if in.SSHAuthorizedKeys != nil {
+		in, out := &in.SSHAuthorizedKeys, &out.SSHAuthorizedKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Files != nil {
+		in, out := &in.Files, &out.Files
+		*out = make([]IgnitionFile, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -57,10 +129,51 @@ func (in *Ignition) DeepCopy() *Ignition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IgnitionFile) DeepCopyInto(out *IgnitionFile) {
+	*out = *in
+	if in.Mode != nil {
+		in, out := &in.Mode, &out.Mode
+		*out = new(int32)
+		**out = **in
+	}
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IgnitionFile.
+func (in *IgnitionFile) DeepCopy() *IgnitionFile {
+	if in == nil {
+		return nil
+	}
+	out := new(IgnitionFile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LibvirtClusterProviderConfig) DeepCopyInto(out *LibvirtClusterProviderConfig) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
+	if in.Network != nil {
+		in, out := &in.Network, &out.Network
+		*out = new(Network)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.StoragePool != nil {
+		in, out := &in.StoragePool, &out.StoragePool
+		*out = new(StoragePool)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -86,6 +199,16 @@ func (in *LibvirtClusterProviderConfig) DeepCopyObject() runtime.Object {
 func (in *LibvirtClusterProviderStatus) DeepCopyInto(out *LibvirtClusterProviderStatus) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
+	if in.NetworkUUID != nil {
+		in, out := &in.NetworkUUID, &out.NetworkUUID
+		*out = new(string)
+		**out = **in
+	}
+	if in.StoragePoolUUID != nil {
+		in, out := &in.StoragePoolUUID, &out.StoragePoolUUID
+		*out = new(string)
+		**out = **in
+	}
 	return
 }
 
@@ -107,6 +230,32 @@ func (in *LibvirtClusterProviderStatus) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LibvirtMachineBackupStatus) DeepCopyInto(out *LibvirtMachineBackupStatus) {
+	*out = *in
+	if in.Locations != nil {
+		in, out := &in.Locations, &out.Locations
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.StartTime.DeepCopyInto(&out.StartTime)
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LibvirtMachineBackupStatus.
+func (in *LibvirtMachineBackupStatus) DeepCopy() *LibvirtMachineBackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(LibvirtMachineBackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LibvirtMachineProviderCondition) DeepCopyInto(out *LibvirtMachineProviderCondition) {
 	*out = *in
@@ -132,18 +281,40 @@ func (in *LibvirtMachineProviderConfig) DeepCopyInto(out *LibvirtMachineProvider
 	if in.Ignition != nil {
 		in, out := &in.Ignition, &out.Ignition
 		*out = new(Ignition)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	if in.CloudInit != nil {
 		in, out := &in.CloudInit, &out.CloudInit
 		*out = new(CloudInit)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	if in.Volume != nil {
 		in, out := &in.Volume, &out.Volume
 		*out = new(Volume)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.NetworkInterfaceHostAliases != nil {
+		in, out := &in.NetworkInterfaceHostAliases, &out.NetworkInterfaceHostAliases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]Disk, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(Backup)
+		**out = **in
+	}
+	if in.NetworkInterfaceConfig != nil {
+		in, out := &in.NetworkInterfaceConfig, &out.NetworkInterfaceConfig
+		*out = new(NetworkInterfaceConfig)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -219,6 +390,21 @@ func (in *LibvirtMachineProviderStatus) DeepCopyInto(out *LibvirtMachineProvider
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Snapshots != nil {
+		in, out := &in.Snapshots, &out.Snapshots
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(LibvirtMachineBackupStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VolumeSize != nil {
+		in, out := &in.VolumeSize, &out.VolumeSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
 	return
 }
 
@@ -240,6 +426,147 @@ func (in *LibvirtMachineProviderStatus) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Network) DeepCopyInto(out *Network) {
+	*out = *in
+	if in.CIDRs != nil {
+		in, out := &in.CIDRs, &out.CIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DHCPRange != nil {
+		in, out := &in.DHCPRange, &out.DHCPRange
+		*out = new(DHCPRange)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Network.
+func (in *Network) DeepCopy() *Network {
+	if in == nil {
+		return nil
+	}
+	out := new(Network)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkDiskAuth) DeepCopyInto(out *NetworkDiskAuth) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NetworkDiskAuth.
+func (in *NetworkDiskAuth) DeepCopy() *NetworkDiskAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkDiskAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkDiskHost) DeepCopyInto(out *NetworkDiskHost) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NetworkDiskHost.
+func (in *NetworkDiskHost) DeepCopy() *NetworkDiskHost {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkDiskHost)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkDiskSource) DeepCopyInto(out *NetworkDiskSource) {
+	*out = *in
+	if in.Hosts != nil {
+		in, out := &in.Hosts, &out.Hosts
+		*out = make([]NetworkDiskHost, len(*in))
+		copy(*out, *in)
+	}
+	if in.Auth != nil {
+		in, out := &in.Auth, &out.Auth
+		*out = new(NetworkDiskAuth)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NetworkDiskSource.
+func (in *NetworkDiskSource) DeepCopy() *NetworkDiskSource {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkDiskSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NetworkInterfaceConfig) DeepCopyInto(out *NetworkInterfaceConfig) {
+	*out = *in
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Gateways != nil {
+		in, out := &in.Gateways, &out.Gateways
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Nameservers != nil {
+		in, out := &in.Nameservers, &out.Nameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SearchDomains != nil {
+		in, out := &in.SearchDomains, &out.SearchDomains
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NetworkInterfaceConfig.
+func (in *NetworkInterfaceConfig) DeepCopy() *NetworkInterfaceConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkInterfaceConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StoragePool) DeepCopyInto(out *StoragePool) {
+	*out = *in
+	if in.MinimumAvailable != nil {
+		in, out := &in.MinimumAvailable, &out.MinimumAvailable
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StoragePool.
+func (in *StoragePool) DeepCopy() *StoragePool {
+	if in == nil {
+		return nil
+	}
+	out := new(StoragePool)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Volume) DeepCopyInto(out *Volume) {
 	*out = *in
@@ -248,6 +575,16 @@ func (in *Volume) DeepCopyInto(out *Volume) {
 		x := (*in).DeepCopy()
 		*out = &x
 	}
+	if in.ClusterSize != nil {
+		in, out := &in.ClusterSize, &out.ClusterSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Encryption != nil {
+		in, out := &in.Encryption, &out.Encryption
+		*out = new(VolumeEncryption)
+		**out = **in
+	}
 	return
 }
 
@@ -260,3 +597,19 @@ func (in *Volume) DeepCopy() *Volume {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VolumeEncryption) DeepCopyInto(out *VolumeEncryption) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VolumeEncryption.
+func (in *VolumeEncryption) DeepCopy() *VolumeEncryption {
+	if in == nil {
+		return nil
+	}
+	out := new(VolumeEncryption)
+	in.DeepCopyInto(out)
+	return out
+}
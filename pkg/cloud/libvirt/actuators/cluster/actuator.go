@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
+
+	machinev1 "github.com/openshift/api/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var ClusterActuator *Actuator
+
+// Actuator is responsible for reconciling the libvirt resources shared
+// by all machines of a cluster
+type Actuator struct {
+	clientBuilder libvirtclient.LibvirtClientBuilderFuncType
+}
+
+// ActuatorParams holds parameter information for Actuator
+type ActuatorParams struct {
+	ClientBuilder libvirtclient.LibvirtClientBuilderFuncType
+}
+
+// NewActuator creates a new Actuator
+func NewActuator(params ActuatorParams) (*Actuator, error) {
+	return &Actuator{
+		clientBuilder: params.ClientBuilder,
+	}, nil
+}
+
+// Reconcile creates or updates the cluster network and storage pool and
+// updates the provider status in-place
+func (a *Actuator) Reconcile(clusterName string, config *providerconfigv1.LibvirtClusterProviderConfig, status *providerconfigv1.LibvirtClusterProviderStatus) error {
+	glog.Infof("Reconciling cluster %q", clusterName)
+
+	if config.Network == nil {
+		status.NetworkUUID = nil
+		status.NetworkRestartPending = false
+	}
+	if config.StoragePool == nil {
+		status.StoragePoolUUID = nil
+	}
+	if config.Network == nil && config.StoragePool == nil {
+		return nil
+	}
+
+	client, err := a.clientBuilder(config.URI, "")
+	if err != nil {
+		return fmt.Errorf("%s: error creating libvirt client: %v", clusterName, err)
+	}
+	defer client.Close()
+
+	if config.Network != nil {
+		uuid, restartPending, err := client.CreateOrUpdateNetwork(createNetworkInput(config.Network))
+		if err != nil {
+			return fmt.Errorf("%s: error reconciling network %q: %v", clusterName, config.Network.Name, err)
+		}
+		if restartPending {
+			glog.Warningf("%s: changes to network %q take effect once it is restarted", clusterName, config.Network.Name)
+		}
+		status.NetworkUUID = &uuid
+		status.NetworkRestartPending = restartPending
+	}
+
+	if config.StoragePool != nil {
+		uuid, err := client.EnsureStoragePool(createStoragePoolInput(config.StoragePool))
+		if err != nil {
+			return fmt.Errorf("%s: error reconciling storage pool %q: %v", clusterName, config.StoragePool.Name, err)
+		}
+		status.StoragePoolUUID = &uuid
+	}
+
+	return nil
+}
+
+// Delete tears down the cluster network. The storage pool is kept as it
+// may hold base images shared with other clusters.
+func (a *Actuator) Delete(clusterName string, config *providerconfigv1.LibvirtClusterProviderConfig) error {
+	glog.Infof("Deleting cluster %q", clusterName)
+
+	if config.Network == nil {
+		return nil
+	}
+
+	client, err := a.clientBuilder(config.URI, "")
+	if err != nil {
+		return fmt.Errorf("%s: error creating libvirt client: %v", clusterName, err)
+	}
+	defer client.Close()
+
+	if err := client.DeleteNetwork(config.Network.Name); err != nil && err != libvirtclient.ErrNetworkNotFound {
+		return fmt.Errorf("%s: error deleting network %q: %v", clusterName, config.Network.Name, err)
+	}
+
+	return nil
+}
+
+func createNetworkInput(network *providerconfigv1.Network) libvirtclient.CreateNetworkInput {
+	input := libvirtclient.CreateNetworkInput{
+		Name:        network.Name,
+		Bridge:      network.Bridge,
+		CIDRs:       network.CIDRs,
+		ForwardMode: network.ForwardMode,
+		DNSDomain:   network.DNSDomain,
+	}
+	if network.DHCPRange != nil {
+		input.DHCPRangeStart = network.DHCPRange.Start
+		input.DHCPRangeEnd = network.DHCPRange.End
+	}
+	return input
+}
+
+func createStoragePoolInput(pool *providerconfigv1.StoragePool) libvirtclient.CreateStoragePoolInput {
+	input := libvirtclient.CreateStoragePoolInput{
+		Name:        pool.Name,
+		Path:        pool.Path,
+		Permissions: pool.Permissions,
+		Owner:       pool.Owner,
+		Group:       pool.Group,
+		Autostart:   pool.Autostart,
+	}
+	if pool.MinimumAvailable != nil {
+		size, _ := pool.MinimumAvailable.AsInt64()
+		input.MinimumAvailable = uint64(size)
+	}
+	return input
+}
+
+type codec interface {
+	DecodeFromProviderSpec(machinev1.ProviderSpec, runtime.Object) error
+	DecodeProviderStatus(*runtime.RawExtension, runtime.Object) error
+	EncodeProviderStatus(runtime.Object) (*runtime.RawExtension, error)
+}
+
+// ProviderConfigCluster gets the cluster provider config from the
+// specified cluster ConfigMap.
+func ProviderConfigCluster(codec codec, cm *corev1.ConfigMap) (*providerconfigv1.LibvirtClusterProviderConfig, error) {
+	data, ok := cm.Data[providerconfigv1.ClusterProviderSpecKey]
+	if !ok {
+		return nil, fmt.Errorf("no %q key in ConfigMap %s/%s", providerconfigv1.ClusterProviderSpecKey, cm.Namespace, cm.Name)
+	}
+
+	var config providerconfigv1.LibvirtClusterProviderConfig
+	providerSpec := machinev1.ProviderSpec{Value: &runtime.RawExtension{Raw: []byte(data)}}
+	if err := codec.DecodeFromProviderSpec(providerSpec, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// ProviderStatusFromCluster deserializes a libvirt cluster provider status
+// from a cluster ConfigMap.
+func ProviderStatusFromCluster(codec codec, cm *corev1.ConfigMap) (*providerconfigv1.LibvirtClusterProviderStatus, error) {
+	status := &providerconfigv1.LibvirtClusterProviderStatus{}
+	var err error
+	if data, ok := cm.Data[providerconfigv1.ClusterProviderStatusKey]; ok {
+		err = codec.DecodeProviderStatus(&runtime.RawExtension{Raw: []byte(data)}, status)
+	}
+
+	return status, err
+}
+
+// EncodeProviderStatus encodes a libvirt cluster provider status for
+// inclusion in a cluster ConfigMap.
+func EncodeProviderStatus(codec codec, status *providerconfigv1.LibvirtClusterProviderStatus) (string, error) {
+	raw, err := codec.EncodeProviderStatus(status)
+	if err != nil {
+		return "", err
+	}
+	return string(raw.Raw), nil
+}
@@ -0,0 +1,209 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
+	mocklibvirt "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client/mock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func stubClusterProviderConfig() *providerconfigv1.LibvirtClusterProviderConfig {
+	return &providerconfigv1.LibvirtClusterProviderConfig{
+		URI: "qemu:///system",
+		Network: &providerconfigv1.Network{
+			Name:      "libvirt-actuator-cluster",
+			CIDRs:     []string{"192.168.126.0/24"},
+			DNSDomain: "libvirt-actuator-cluster.example.com",
+			DHCPRange: &providerconfigv1.DHCPRange{
+				Start: "192.168.126.50",
+				End:   "192.168.126.250",
+			},
+		},
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	cases := []struct {
+		name             string
+		config           *providerconfigv1.LibvirtClusterProviderConfig
+		networkUUID      string
+		restartPending   bool
+		networkErr       error
+		expectedUUID     *string
+		poolUUID         string
+		expectedPoolUUID *string
+		expectErr        bool
+	}{
+		{
+			name:         "Network is created",
+			config:       stubClusterProviderConfig(),
+			networkUUID:  "6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43",
+			expectedUUID: stringPtr("6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43"),
+		},
+		{
+			name:           "Network restart is pending",
+			config:         stubClusterProviderConfig(),
+			networkUUID:    "6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43",
+			restartPending: true,
+			expectedUUID:   stringPtr("6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43"),
+		},
+		{
+			name:       "Network creation fails",
+			config:     stubClusterProviderConfig(),
+			networkErr: fmt.Errorf("error"),
+			expectErr:  true,
+		},
+		{
+			name:   "No network",
+			config: &providerconfigv1.LibvirtClusterProviderConfig{URI: "qemu:///system"},
+		},
+		{
+			name: "Storage pool is ensured",
+			config: &providerconfigv1.LibvirtClusterProviderConfig{
+				URI: "qemu:///system",
+				StoragePool: &providerconfigv1.StoragePool{
+					Name: "libvirt-actuator-cluster",
+					Path: "/var/lib/libvirt/libvirt-actuator-cluster",
+				},
+			},
+			poolUUID:         "0f5f2cc8-0b7c-4bd5-93a1-3c1c5e0a2b01",
+			expectedPoolUUID: stringPtr("0f5f2cc8-0b7c-4bd5-93a1-3c1c5e0a2b01"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			if tc.config.Network != nil || tc.config.StoragePool != nil {
+				mockLibvirtClient.EXPECT().Close()
+			}
+			if tc.config.Network != nil {
+				mockLibvirtClient.EXPECT().CreateOrUpdateNetwork(createNetworkInput(tc.config.Network)).Return(tc.networkUUID, tc.restartPending, tc.networkErr)
+			}
+			if tc.config.StoragePool != nil {
+				mockLibvirtClient.EXPECT().EnsureStoragePool(createStoragePoolInput(tc.config.StoragePool)).Return(tc.poolUUID, nil)
+			}
+
+			actuator, _ := NewActuator(ActuatorParams{
+				ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+					return mockLibvirtClient, nil
+				},
+			})
+
+			status := &providerconfigv1.LibvirtClusterProviderStatus{}
+			err := actuator.Reconcile("libvirt-actuator-cluster", tc.config, status)
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("expected error: %v, got %v", tc.expectErr, err)
+			}
+			if tc.expectedUUID == nil && status.NetworkUUID != nil || tc.expectedUUID != nil && (status.NetworkUUID == nil || *status.NetworkUUID != *tc.expectedUUID) {
+				t.Errorf("expected network UUID %v, got %v", tc.expectedUUID, status.NetworkUUID)
+			}
+			if status.NetworkRestartPending != tc.restartPending {
+				t.Errorf("expected network restart pending %v, got %v", tc.restartPending, status.NetworkRestartPending)
+			}
+			if tc.expectedPoolUUID == nil && status.StoragePoolUUID != nil || tc.expectedPoolUUID != nil && (status.StoragePoolUUID == nil || *status.StoragePoolUUID != *tc.expectedPoolUUID) {
+				t.Errorf("expected storage pool UUID %v, got %v", tc.expectedPoolUUID, status.StoragePoolUUID)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cases := []struct {
+		name       string
+		networkErr error
+		expectErr  bool
+	}{
+		{
+			name: "Network is deleted",
+		},
+		{
+			name:       "Network is already gone",
+			networkErr: libvirtclient.ErrNetworkNotFound,
+		},
+		{
+			name:       "Network deletion fails",
+			networkErr: fmt.Errorf("error"),
+			expectErr:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			mockLibvirtClient.EXPECT().Close()
+			mockLibvirtClient.EXPECT().DeleteNetwork("libvirt-actuator-cluster").Return(tc.networkErr)
+
+			actuator, _ := NewActuator(ActuatorParams{
+				ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+					return mockLibvirtClient, nil
+				},
+			})
+
+			err := actuator.Delete("libvirt-actuator-cluster", stubClusterProviderConfig())
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("expected error: %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestProviderConfigCluster(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "libvirt-actuator-cluster",
+			Namespace: "default",
+		},
+		Data: map[string]string{
+			providerconfigv1.ClusterProviderSpecKey: `
+uri: qemu:///system
+network:
+  name: libvirt-actuator-cluster
+  cidrs:
+  - 192.168.126.0/24
+  dhcpRange:
+    start: 192.168.126.50
+    end: 192.168.126.250
+`,
+		},
+	}
+
+	config, err := ProviderConfigCluster(codec, cm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Network == nil || config.Network.Name != "libvirt-actuator-cluster" || config.Network.DHCPRange == nil || config.Network.DHCPRange.End != "192.168.126.250" {
+		t.Errorf("unexpected config: %+v", config)
+	}
+
+	status := &providerconfigv1.LibvirtClusterProviderStatus{NetworkUUID: stringPtr("6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43")}
+	rawStatus, err := EncodeProviderStatus(codec, status)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cm.Data[providerconfigv1.ClusterProviderStatusKey] = rawStatus
+
+	decoded, err := ProviderStatusFromCluster(codec, cm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded.NetworkUUID == nil || *decoded.NetworkUUID != *status.NetworkUUID {
+		t.Errorf("expected network UUID %v, got %v", *status.NetworkUUID, decoded.NetworkUUID)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -15,7 +15,11 @@ package machine
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -23,11 +27,15 @@ import (
 	libvirt "github.com/libvirt/libvirt-go"
 
 	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	clusteractuator "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/actuators/cluster"
 	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
 
 	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 
@@ -62,6 +70,7 @@ type Actuator struct {
 	clientBuilder  libvirtclient.LibvirtClientBuilderFuncType
 	codec          codec
 	eventRecorder  record.EventRecorder
+	backups        backupJobs
 }
 
 type codec interface {
@@ -118,6 +127,10 @@ func (a *Actuator) Create(context context.Context, machine *machinev1.Machine) e
 		return a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("error getting machineProviderConfig from spec: %v", err), createEventAction)
 	}
 
+	if err := a.applyClusterNetwork(context, machine, machineProviderConfig); err != nil {
+		return a.handleMachineError(machine, apierrors.CreateMachine("error getting cluster network: %v", err), createEventAction)
+	}
+
 	client, err := a.clientBuilder(machineProviderConfig.URI, machineProviderConfig.Volume.PoolName)
 	if err != nil {
 		return a.handleMachineError(machine, apierrors.CreateMachine("error creating libvirt client: %v", err), createEventAction)
@@ -125,6 +138,10 @@ func (a *Actuator) Create(context context.Context, machine *machinev1.Machine) e
 
 	defer client.Close()
 
+	if err := resolveNetworkUUID(client, machineProviderConfig); err != nil {
+		return a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("error looking up network %q: %v", machineProviderConfig.NetworkUUID, err), createEventAction)
+	}
+
 	// fill researvedLeases on the first call to the create method
 	if a.reservedLeases == nil {
 		a.reservedLeases = &libvirtclient.Leases{Items: map[string]string{}}
@@ -137,6 +154,9 @@ func (a *Actuator) Create(context context.Context, machine *machinev1.Machine) e
 
 	dom, err := a.createVolumeAndDomain(context, machine, machineProviderConfig, client)
 	if err != nil {
+		if _, ok := err.(*apierrors.RequeueAfterError); ok {
+			return err
+		}
 		return errWrapper.WithLog(err, "error creating libvirt machine")
 	}
 
@@ -146,7 +166,11 @@ func (a *Actuator) Create(context context.Context, machine *machinev1.Machine) e
 		}
 	}()
 
-	updated, err := a.updateStatus(context, machine, dom, client)
+	var updates []statusUpdate
+	if machineProviderConfig.Volume.VolumeSize != nil {
+		updates = append(updates, withVolumeSize(*machineProviderConfig.Volume.VolumeSize))
+	}
+	updated, err := a.updateStatus(context, machine, machineProviderConfig, dom, client, updates...)
 	if err != nil {
 		return errWrapper.WithLog(err, "error updating machine status")
 	}
@@ -166,6 +190,16 @@ func (a *Actuator) Delete(context context.Context, machine *machinev1.Machine) e
 		return a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("error getting machineProviderConfig from spec: %v", err), deleteEventAction)
 	}
 
+	// the volumes are deleted once a running backup gave up on them
+	if a.backups.stop(machineKey(machine)) {
+		glog.Infof("Waiting for the backup of machine %q to stop", machine.Name)
+		return &apierrors.RequeueAfterError{RequeueAfter: time.Second}
+	}
+
+	if err := a.applyClusterNetwork(context, machine, machineProviderConfig); err != nil {
+		return a.handleMachineError(machine, apierrors.DeleteMachine("error getting cluster network: %v", err), deleteEventAction)
+	}
+
 	client, err := a.clientBuilder(machineProviderConfig.URI, machineProviderConfig.Volume.PoolName)
 	if err != nil {
 		return a.handleMachineError(machine, apierrors.DeleteMachine("error creating libvirt client: %v", err), deleteEventAction)
@@ -173,15 +207,26 @@ func (a *Actuator) Delete(context context.Context, machine *machinev1.Machine) e
 
 	defer client.Close()
 
+	if err := resolveNetworkUUID(client, machineProviderConfig); err != nil {
+		if err != libvirtclient.ErrNetworkNotFound {
+			return a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("error looking up network %q: %v", machineProviderConfig.NetworkUUID, err), deleteEventAction)
+		}
+		// the network may have been torn down with the cluster already,
+		// taking the DNS host records of the machine with it
+		glog.Infof("Network %s of machine %s not found, skipping network cleanup", machineProviderConfig.NetworkUUID, machine.Name)
+		machineProviderConfig.NetworkInterfaceName = ""
+	}
+
 	exists, err := client.DomainExists(machine.Name)
 	if err != nil {
 		return a.handleMachineError(machine, apierrors.DeleteMachine("error checking for domain existence: %v", err), deleteEventAction)
 	}
 	if exists {
-		return a.deleteVolumeAndDomain(machine, client)
+		return a.deleteVolumeAndDomain(machine, machineProviderConfig, client)
 	}
 	glog.Infof("Domain %s does not exist. Skipping deletion...", machine.Name)
-	return nil
+	// the records outlive a domain deleted outside of the actuator
+	return a.deleteNetworkRecords(machine, machineProviderConfig, client)
 }
 
 // Update updates a machine and is invoked by the Machine Controller
@@ -194,6 +239,10 @@ func (a *Actuator) Update(context context.Context, machine *machinev1.Machine) e
 		return a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("error getting machineProviderConfig from spec: %v", err), updateEventAction)
 	}
 
+	if err := a.applyClusterNetwork(context, machine, machineProviderConfig); err != nil {
+		return a.handleMachineError(machine, apierrors.UpdateMachine("error getting cluster network: %v", err), updateEventAction)
+	}
+
 	client, err := a.clientBuilder(machineProviderConfig.URI, machineProviderConfig.Volume.PoolName)
 	if err != nil {
 		return a.handleMachineError(machine, apierrors.UpdateMachine("error creating libvirt client: %v", err), updateEventAction)
@@ -201,6 +250,10 @@ func (a *Actuator) Update(context context.Context, machine *machinev1.Machine) e
 
 	defer client.Close()
 
+	if err := resolveNetworkUUID(client, machineProviderConfig); err != nil {
+		return a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("error looking up network %q: %v", machineProviderConfig.NetworkUUID, err), updateEventAction)
+	}
+
 	dom, err := client.LookupDomainByName(machine.Name)
 	if err != nil {
 		return a.handleMachineError(machine, apierrors.UpdateMachine("failed to look up domain by name: %v", err), updateEventAction)
@@ -208,17 +261,116 @@ func (a *Actuator) Update(context context.Context, machine *machinev1.Machine) e
 
 	defer dom.Free()
 
-	updated, err := a.updateStatus(context, machine, dom, client)
+	status, err := ProviderStatusFromMachine(a.codec, machine)
+	if err != nil {
+		return a.handleMachineError(machine, apierrors.UpdateMachine("error getting machine provider status: %v", err), updateEventAction)
+	}
+
+	// the condition is recorded even if the resize failed
+	resizeCondition, resizeErr := resizeRootVolume(machine, machineProviderConfig, status.VolumeSize, client)
+
+	var updates []statusUpdate
+	if resizeCondition != nil {
+		updates = append(updates, withCondition(*resizeCondition))
+		if resizeErr == nil {
+			updates = append(updates, withVolumeSize(*machineProviderConfig.Volume.VolumeSize))
+		}
+	}
+
+	snapshotUpdate, snapshotErr := a.applySnapshots(machine, client)
+	if snapshotUpdate != nil {
+		updates = append(updates, snapshotUpdate)
+	}
+
+	backupUpdate, backupInProgress, backupErr := a.backupVolumes(machine, machineProviderConfig)
+	if backupUpdate != nil {
+		updates = append(updates, backupUpdate)
+	}
+
+	updated, err := a.updateStatus(context, machine, machineProviderConfig, dom, client, updates...)
 	if err != nil {
 		return errWrapper.WithLog(err, "error updating machine status")
 	}
+	if resizeErr != nil {
+		return a.handleMachineError(machine, resizeErr, updateEventAction)
+	}
+	if snapshotErr != nil {
+		return a.handleMachineError(machine, snapshotErr, updateEventAction)
+	}
+	if backupErr != nil {
+		return a.handleMachineError(machine, backupErr, updateEventAction)
+	}
 	if updated {
 		a.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Updated", "Updated Machine %v", machine.Name)
 	}
+	if backupInProgress {
+		return &apierrors.RequeueAfterError{RequeueAfter: backupPollInterval}
+	}
 
 	return nil
 }
 
+// resizeRootVolume grows the root volume to the size requested in the spec
+// and returns a condition with the result, or nil if no size is requested.
+// The volume is left as it is while the size it was created or last resized
+// with is requested, since it is created with the size of its base volume if
+// that is larger.
+func resizeRootVolume(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, appliedSize *resource.Quantity, client libvirtclient.Client) (*providerconfigv1.LibvirtMachineProviderCondition, *apierrors.MachineError) {
+	if machineProviderConfig.Volume == nil || machineProviderConfig.Volume.VolumeSize == nil {
+		return nil, nil
+	}
+	volumeName := rootVolumeName(machine, machineProviderConfig)
+	size, ok := machineProviderConfig.Volume.VolumeSize.AsInt64()
+	if !ok || size <= 0 {
+		return nil, apierrors.InvalidMachineConfiguration("invalid volumeSize %v", machineProviderConfig.Volume.VolumeSize)
+	}
+	if appliedSize != nil && appliedSize.Cmp(*machineProviderConfig.Volume.VolumeSize) == 0 {
+		return &providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.VolumeResized,
+			Status:  corev1.ConditionTrue,
+			Reason:  "VolumeResized",
+			Message: fmt.Sprintf("volume %s has the requested size of %d bytes", volumeName, size),
+		}, nil
+	}
+
+	resized, err := client.ResizeVolume(machine.Name, machineProviderConfig.Volume.PoolName, volumeName, uint64(size))
+	var shrinkErr *libvirtclient.VolumeShrinkError
+	var snapshotsErr *libvirtclient.VolumeSnapshotsError
+	switch {
+	case errors.As(err, &shrinkErr):
+		return &providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.VolumeResized,
+			Status:  corev1.ConditionFalse,
+			Reason:  "VolumeShrinkRejected",
+			Message: err.Error(),
+		}, apierrors.InvalidMachineConfiguration("error resizing volume: %v", err)
+	case errors.As(err, &snapshotsErr):
+		// the resize goes through once the snapshots are deleted
+		return &providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.VolumeResized,
+			Status:  corev1.ConditionFalse,
+			Reason:  "SnapshotsExist",
+			Message: err.Error(),
+		}, apierrors.InvalidMachineConfiguration("error resizing volume: %v", err)
+	case err != nil:
+		return &providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.VolumeResized,
+			Status:  corev1.ConditionFalse,
+			Reason:  "VolumeResizeFailed",
+			Message: err.Error(),
+		}, apierrors.UpdateMachine("error resizing volume: %v", err)
+	}
+	if resized {
+		glog.Infof("Resized volume %s of machine %s to %d bytes", volumeName, machine.Name, size)
+	}
+	return &providerconfigv1.LibvirtMachineProviderCondition{
+		Type:    providerconfigv1.VolumeResized,
+		Status:  corev1.ConditionTrue,
+		Reason:  "VolumeResized",
+		Message: fmt.Sprintf("volume %s has the requested size of %d bytes", volumeName, size),
+	}, nil
+}
+
 // Exists test for the existance of a machine and is invoked by the Machine Controller
 func (a *Actuator) Exists(context context.Context, machine *machinev1.Machine) (bool, error) {
 	glog.Infof("Checking if machine %v exists.", machine.Name)
@@ -239,6 +391,245 @@ func (a *Actuator) Exists(context context.Context, machine *machinev1.Machine) (
 	return client.DomainExists(machine.Name)
 }
 
+// rootVolumeName returns the name of the machine's root volume
+func rootVolumeName(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) string {
+	if machineProviderConfig.Volume != nil && machineProviderConfig.Volume.VolumeName != "" {
+		return machineProviderConfig.Volume.VolumeName
+	}
+	return machine.Name
+}
+
+// validateVolume checks the volume options which can't be combined
+func validateVolume(volume *providerconfigv1.Volume) error {
+	if volume.ImageChecksum != "" && volume.ImageURL == "" {
+		return fmt.Errorf("imageChecksum requires imageURL")
+	}
+	if volume.ImageURL != "" && volume.BaseVolumeID != "" {
+		return fmt.Errorf("baseVolumeID and imageURL are mutually exclusive")
+	}
+
+	switch volume.CloneMode {
+	case "", providerconfigv1.VolumeCloneModeOverlay, providerconfigv1.VolumeCloneModeClone, providerconfigv1.VolumeCloneModeFlatClone:
+	default:
+		return fmt.Errorf("unsupported cloneMode %q", volume.CloneMode)
+	}
+
+	switch volume.Preallocation {
+	case "", providerconfigv1.VolumePreallocationNone, providerconfigv1.VolumePreallocationMetadata, providerconfigv1.VolumePreallocationFull:
+	default:
+		return fmt.Errorf("unsupported preallocation %q", volume.Preallocation)
+	}
+
+	switch volume.Format {
+	case "", providerconfigv1.VolumeFormatQcow2:
+	case providerconfigv1.VolumeFormatRaw:
+		if volume.CloneMode == providerconfigv1.VolumeCloneModeOverlay || volume.CloneMode == providerconfigv1.VolumeCloneModeClone {
+			return fmt.Errorf("raw volumes can't have a backing store, use cloneMode %s", providerconfigv1.VolumeCloneModeFlatClone)
+		}
+		if volume.Preallocation == providerconfigv1.VolumePreallocationMetadata {
+			return fmt.Errorf("metadata preallocation requires the qcow2 format")
+		}
+		if volume.LazyRefcounts || volume.ClusterSize != nil {
+			return fmt.Errorf("lazyRefcounts and clusterSize require the qcow2 format")
+		}
+	default:
+		return fmt.Errorf("unsupported format %q", volume.Format)
+	}
+
+	if volume.Encryption != nil && volume.Encryption.SecretName == "" {
+		return fmt.Errorf("encryption requires a secretName")
+	}
+
+	if volume.ClusterSize != nil {
+		// qcow2 clusters are a power of two between 512 bytes and 2 MiB
+		size, ok := volume.ClusterSize.AsInt64()
+		if !ok || size < 512 || size > 2<<20 || size&(size-1) != 0 {
+			return fmt.Errorf("clusterSize %v must be a power of two between 512 and 2Mi", volume.ClusterSize)
+		}
+	}
+	return nil
+}
+
+// hostName returns the name of the machine in DHCP and DNS entries
+func hostName(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) string {
+	if machineProviderConfig.NetworkInterfaceHostname != "" {
+		return machineProviderConfig.NetworkInterfaceHostname
+	}
+	return machine.Name
+}
+
+// cleanupVolumes deletes the volumes created for a machine and logs errors
+func cleanupVolumes(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, client libvirtclient.Client) {
+	if err := client.DeleteVolume(machineProviderConfig.Volume.PoolName, rootVolumeName(machine, machineProviderConfig)); err != nil && err != libvirtclient.ErrVolumeNotFound {
+		glog.Errorf("Error cleaning up volume: %v", err)
+	}
+	for _, disk := range machineProviderConfig.Disks {
+		if disk.Network != nil {
+			continue
+		}
+		if err := client.DeleteVolume(disk.PoolName, diskVolumeName(machine.Name, disk.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
+			glog.Errorf("Error cleaning up volume of disk %s: %v", disk.Name, err)
+		}
+	}
+	if err := client.DeleteVolume(cloudInitPoolName(machineProviderConfig), cloudInitVolumeName(machine.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
+		glog.Errorf("Error cleaning up cloud-init volume: %v", err)
+	}
+	if err := client.DeleteVolume(ignitionPoolName(machineProviderConfig), ignitionVolumeName(machine.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
+		glog.Errorf("Error cleaning up ignition volume: %v", err)
+	}
+}
+
+// validateDisks checks that additional disks have unique names and either a
+// size or a network source
+func validateDisks(disks []providerconfigv1.Disk) error {
+	names := map[string]bool{}
+	for _, disk := range disks {
+		if disk.Name == "" {
+			return fmt.Errorf("disk name is empty")
+		}
+		if errs := validation.IsDNS1123Label(disk.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid disk name %q: %s", disk.Name, strings.Join(errs, ", "))
+		}
+		// the volume would be named like the cloud init volume
+		if disk.Name == "cloud-init" {
+			return fmt.Errorf("disk name %q is reserved", disk.Name)
+		}
+		if names[disk.Name] {
+			return fmt.Errorf("duplicate disk name %q", disk.Name)
+		}
+		names[disk.Name] = true
+		if disk.Network != nil {
+			if disk.PoolName != "" || !disk.Size.IsZero() {
+				return fmt.Errorf("network disk %s can't have a pool or size", disk.Name)
+			}
+			if err := validateNetworkDiskSource(disk.Network); err != nil {
+				return fmt.Errorf("network disk %s: %v", disk.Name, err)
+			}
+			continue
+		}
+		if disk.Size.Sign() <= 0 {
+			return fmt.Errorf("disk %s has no size", disk.Name)
+		}
+	}
+	return nil
+}
+
+// validateNetworkDiskSource checks the protocol, name, hosts and credentials of a network disk
+func validateNetworkDiskSource(source *providerconfigv1.NetworkDiskSource) error {
+	switch source.Protocol {
+	case providerconfigv1.NetworkDiskProtocolNBD:
+		if source.Auth != nil {
+			return fmt.Errorf("nbd does not support authentication")
+		}
+	case providerconfigv1.NetworkDiskProtocolISCSI, providerconfigv1.NetworkDiskProtocolRBD:
+		if source.Name == "" {
+			return fmt.Errorf("%s needs a name", source.Protocol)
+		}
+	default:
+		return fmt.Errorf("unsupported protocol %q", source.Protocol)
+	}
+	if len(source.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	for _, host := range source.Hosts {
+		if host.Name == "" {
+			return fmt.Errorf("host name is empty")
+		}
+	}
+	if source.Auth != nil && (source.Auth.Username == "" || source.Auth.SecretName == "") {
+		return fmt.Errorf("auth needs a username and secretName")
+	}
+	return nil
+}
+
+// validateIgnition checks the delivery of the Ignition config and that files
+// added to it have an absolute path and exactly one source
+func validateIgnition(ignition *providerconfigv1.Ignition) error {
+	if ignition == nil {
+		return nil
+	}
+	switch ignition.Delivery {
+	case "", providerconfigv1.IgnitionDeliveryQEMUCommandLine, providerconfigv1.IgnitionDeliveryFirmwareConfig, providerconfigv1.IgnitionDeliveryDisk:
+	default:
+		return fmt.Errorf("unsupported delivery %q", ignition.Delivery)
+	}
+	for _, file := range ignition.Files {
+		if !path.IsAbs(file.Path) {
+			return fmt.Errorf("file path %q is not absolute", file.Path)
+		}
+		if (file.ConfigMapRef == nil) == (file.SecretRef == nil) {
+			return fmt.Errorf("file %s needs either a configMapRef or a secretRef", file.Path)
+		}
+	}
+	return nil
+}
+
+// validateNetworkInterfaceConfig checks the addresses, gateways, nameservers
+// and MTU of the network interface configuration, which needs cloud init
+func validateNetworkInterfaceConfig(machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) error {
+	config := machineProviderConfig.NetworkInterfaceConfig
+	if config == nil {
+		return nil
+	}
+	if machineProviderConfig.CloudInit == nil {
+		return fmt.Errorf("networkInterfaceConfig is only supported with cloudInit")
+	}
+	if len(config.Addresses) > 0 && machineProviderConfig.NetworkInterfaceAddress != "" {
+		return fmt.Errorf("networkInterfaceConfig.addresses can't be combined with networkInterfaceAddress")
+	}
+	for _, address := range config.Addresses {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("invalid address %q, expected CIDR notation", address)
+		}
+	}
+	var ipv4Gateway, ipv6Gateway bool
+	for _, gateway := range config.Gateways {
+		ip := net.ParseIP(gateway)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid gateway %q", gateway)
+		case ip.To4() != nil && ipv4Gateway, ip.To4() == nil && ipv6Gateway:
+			return fmt.Errorf("more than one gateway for the IP family of %s", gateway)
+		case ip.To4() != nil:
+			ipv4Gateway = true
+		default:
+			ipv6Gateway = true
+		}
+	}
+	for _, nameserver := range config.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("invalid nameserver %q", nameserver)
+		}
+	}
+	if config.MTU != 0 && (config.MTU < 68 || config.MTU > 65535) {
+		return fmt.Errorf("invalid MTU %d", config.MTU)
+	}
+	return nil
+}
+
+// cloudInitPoolName returns the storage pool of the cloud init volume, empty for the default pool
+func cloudInitPoolName(machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) string {
+	if machineProviderConfig.CloudInit != nil {
+		return machineProviderConfig.CloudInit.PoolName
+	}
+	return ""
+}
+
+// ignitionPoolName returns the storage pool of the ignition volume, empty for the default pool
+func ignitionPoolName(machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) string {
+	if machineProviderConfig.Ignition != nil {
+		return machineProviderConfig.Ignition.PoolName
+	}
+	return ""
+}
+
+// diskVolumeName returns the name of the volume of a disk. Machine names
+// can't contain underscores, so the volumes of different machines can't
+// share a name.
+func diskVolumeName(machineName string, diskName string) string {
+	return fmt.Sprintf("%v_%v", machineName, diskName)
+}
+
 func cloudInitVolumeName(volumeName string) string {
 	return fmt.Sprintf("%v_cloud-init", volumeName)
 }
@@ -252,30 +643,124 @@ func ignitionVolumeName(volumeName string) string {
 // is the caller's responsiblity to free this.
 func (a *Actuator) createVolumeAndDomain(ctx context.Context, machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, client libvirtclient.Client) (*libvirt.Domain, error) {
 	domainName := machine.Name
+	volumeName := rootVolumeName(machine, machineProviderConfig)
+
+	// the spec is validated before the base image is imported, which can take a while
+	if err := validateVolume(machineProviderConfig.Volume); err != nil {
+		return nil, a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("invalid volume: %v", err), createEventAction)
+	}
+	if err := validateDisks(machineProviderConfig.Disks); err != nil {
+		return nil, a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("invalid disks: %v", err), createEventAction)
+	}
+	if err := validateIgnition(machineProviderConfig.Ignition); err != nil {
+		return nil, a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("invalid ignition: %v", err), createEventAction)
+	}
+	if err := validateNetworkInterfaceConfig(machineProviderConfig); err != nil {
+		return nil, a.handleMachineError(machine, apierrors.InvalidMachineConfiguration("invalid network interface config: %v", err), createEventAction)
+	}
+
+	baseVolumeName := machineProviderConfig.Volume.BaseVolumeID
+	if machineProviderConfig.Volume.ImageURL != "" {
+		name, err := client.EnsureBaseVolume(ctx, libvirtclient.BaseVolumeInput{
+			Source:           machineProviderConfig.Volume.ImageURL,
+			PoolName:         machineProviderConfig.Volume.BaseVolumePoolName,
+			SourceChecksum:   machineProviderConfig.Volume.ImageChecksum,
+			PullSecret:       machineProviderConfig.Volume.ImagePullSecret,
+			KubeClient:       a.kubeClient,
+			MachineNamespace: machine.Namespace,
+		})
+		if err != nil {
+			if retry, ok := err.(*libvirtclient.RetryError); ok {
+				glog.Infof("Machine %s waits for its base image: %v", machine.Name, retry)
+				return nil, &apierrors.RequeueAfterError{RequeueAfter: retry.After}
+			}
+			return nil, a.handleMachineError(machine, apierrors.CreateMachine("error importing base image %v", err), createEventAction)
+		}
+		baseVolumeName = name
+	}
+
+	volumeFormat := providerconfigv1.VolumeFormatQcow2
+	if machineProviderConfig.Volume.Format != "" {
+		volumeFormat = machineProviderConfig.Volume.Format
+	}
+	var clusterSize int64
+	if machineProviderConfig.Volume.ClusterSize != nil {
+		clusterSize, _ = machineProviderConfig.Volume.ClusterSize.AsInt64()
+	}
+	var encryptionSecretUUID string
+	if machineProviderConfig.Volume.Encryption != nil {
+		uuid, err := client.EnsureVolumeSecret(ctx, libvirtclient.VolumeSecretInput{
+			VolumeName:       volumeName,
+			PoolName:         machineProviderConfig.Volume.PoolName,
+			SecretName:       machineProviderConfig.Volume.Encryption.SecretName,
+			KubeClient:       a.kubeClient,
+			MachineNamespace: machine.Namespace,
+		})
+		if err != nil {
+			return nil, a.handleMachineError(machine, apierrors.CreateMachine("error registering volume passphrase %v", err), createEventAction)
+		}
+		encryptionSecretUUID = uuid
+	}
 
 	// Create volume
 	if err := client.CreateVolume(
 		libvirtclient.CreateVolumeInput{
-			VolumeName:     domainName,
-			BaseVolumeName: machineProviderConfig.Volume.BaseVolumeID,
-			VolumeFormat:   "qcow2",
-			VolumeSize:     machineProviderConfig.Volume.VolumeSize,
+			VolumeName:           volumeName,
+			PoolName:             machineProviderConfig.Volume.PoolName,
+			BaseVolumeName:       baseVolumeName,
+			BaseVolumePoolName:   machineProviderConfig.Volume.BaseVolumePoolName,
+			VolumeFormat:         string(volumeFormat),
+			VolumeSize:           machineProviderConfig.Volume.VolumeSize,
+			CloneMode:            machineProviderConfig.Volume.CloneMode,
+			Preallocation:        string(machineProviderConfig.Volume.Preallocation),
+			LazyRefcounts:        machineProviderConfig.Volume.LazyRefcounts,
+			ClusterSize:          uint64(clusterSize),
+			EncryptionSecretUUID: encryptionSecretUUID,
 		}); err != nil {
 		return nil, a.handleMachineError(machine, apierrors.CreateMachine("error creating volume %v", err), createEventAction)
 	}
 
+	// Create additional disks
+	var additionalDisks []libvirtclient.DiskInput
+	for _, disk := range machineProviderConfig.Disks {
+		if disk.Network != nil {
+			additionalDisks = append(additionalDisks, libvirtclient.DiskInput{Network: disk.Network})
+			continue
+		}
+		diskInput := libvirtclient.DiskInput{
+			VolumeName: diskVolumeName(machine.Name, disk.Name),
+			PoolName:   disk.PoolName,
+		}
+		size := disk.Size
+		if err := client.CreateVolume(libvirtclient.CreateVolumeInput{
+			VolumeName:   diskInput.VolumeName,
+			PoolName:     diskInput.PoolName,
+			VolumeFormat: string(providerconfigv1.VolumeFormatQcow2),
+			VolumeSize:   &size,
+		}); err != nil {
+			// Clean up the created volumes, otherwise subsequent runs will fail.
+			cleanupVolumes(machine, machineProviderConfig, client)
+			return nil, a.handleMachineError(machine, apierrors.CreateMachine("error creating volume of disk %s %v", disk.Name, err), createEventAction)
+		}
+		additionalDisks = append(additionalDisks, diskInput)
+	}
+
 	// Create domain
 	if err := client.CreateDomain(ctx, libvirtclient.CreateDomainInput{
 		DomainName:              domainName,
 		IgnKey:                  machineProviderConfig.IgnKey,
 		Ignition:                machineProviderConfig.Ignition,
-		VolumeName:              domainName,
+		VolumeName:              volumeName,
+		VolumePoolName:          machineProviderConfig.Volume.PoolName,
+		AdditionalDisks:         additionalDisks,
 		CloudInitVolumeName:     cloudInitVolumeName(domainName),
 		IgnitionVolumeName:      ignitionVolumeName(domainName),
 		NetworkInterfaceName:    machineProviderConfig.NetworkInterfaceName,
 		NetworkInterfaceAddress: machineProviderConfig.NetworkInterfaceAddress,
+		NetworkInterfaceConfig:  machineProviderConfig.NetworkInterfaceConfig,
 		ReservedLeases:          a.reservedLeases,
-		HostName:                domainName,
+		HostName:                hostName(machine, machineProviderConfig),
+		HostAliases:             machineProviderConfig.NetworkInterfaceHostAliases,
 		Autostart:               machineProviderConfig.Autostart,
 		DomainMemory:            machineProviderConfig.DomainMemory,
 		DomainVcpu:              machineProviderConfig.DomainVcpu,
@@ -283,17 +768,9 @@ func (a *Actuator) createVolumeAndDomain(ctx context.Context, machine *machinev1
 		KubeClient:              a.kubeClient,
 		MachineNamespace:        machine.Namespace,
 	}); err != nil {
-		// Clean up the created volume if domain creation fails,
+		// Clean up the created volumes if domain creation fails,
 		// otherwise subsequent runs will fail.
-		if err := client.DeleteVolume(domainName); err != nil && err != libvirtclient.ErrVolumeNotFound {
-			glog.Errorf("Error cleaning up volume: %v", err)
-		}
-		if err := client.DeleteVolume(cloudInitVolumeName(domainName)); err != nil && err != libvirtclient.ErrVolumeNotFound {
-			glog.Errorf("Error cleaning up cloud-init volume: %v", err)
-		}
-		if err := client.DeleteVolume(ignitionVolumeName(domainName)); err != nil && err != libvirtclient.ErrVolumeNotFound {
-			glog.Errorf("Error cleaning up ignition volume: %v", err)
-		}
+		cleanupVolumes(machine, machineProviderConfig, client)
 
 		return nil, a.handleMachineError(machine, apierrors.CreateMachine("error creating domain %v", err), createEventAction)
 	}
@@ -308,33 +785,39 @@ func (a *Actuator) createVolumeAndDomain(ctx context.Context, machine *machinev1
 }
 
 // deleteVolumeAndDomain deletes a domain and its referenced volume
-func (a *Actuator) deleteVolumeAndDomain(machine *machinev1.Machine, client libvirtclient.Client) error {
+func (a *Actuator) deleteVolumeAndDomain(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, client libvirtclient.Client) error {
 	if err := client.DeleteDomain(machine.Name); err != nil && err != libvirtclient.ErrDomainNotFound {
 		return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q domain %v", machine.Name, err), deleteEventAction)
 	}
 
-	if a.reservedLeases != nil {
-		for _, addr := range machine.Status.Addresses {
-			if addr.Type == corev1.NodeInternalIP {
-				if _, ok := a.reservedLeases.Items[addr.Address]; ok {
-					delete(a.reservedLeases.Items, addr.Address)
-				}
-			}
-		}
+	if err := a.deleteNetworkRecords(machine, machineProviderConfig, client); err != nil {
+		return err
 	}
 
 	// Delete machine volume
-	if err := client.DeleteVolume(machine.Name); err != nil && err != libvirtclient.ErrVolumeNotFound {
-		return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q volume %v", machine.Name, err), deleteEventAction)
+	volumeName := rootVolumeName(machine, machineProviderConfig)
+	if err := client.DeleteVolume(machineProviderConfig.Volume.PoolName, volumeName); err != nil && err != libvirtclient.ErrVolumeNotFound {
+		return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q volume %v", volumeName, err), deleteEventAction)
+	}
+
+	// Delete volumes of additional disks
+	for _, disk := range machineProviderConfig.Disks {
+		if disk.Network != nil {
+			continue
+		}
+		diskVolume := diskVolumeName(machine.Name, disk.Name)
+		if err := client.DeleteVolume(disk.PoolName, diskVolume); err != nil && err != libvirtclient.ErrVolumeNotFound {
+			return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q disk volume %v", diskVolume, err), deleteEventAction)
+		}
 	}
 
 	// Delete cloud init volume if exists
-	if err := client.DeleteVolume(cloudInitVolumeName(machine.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
+	if err := client.DeleteVolume(cloudInitPoolName(machineProviderConfig), cloudInitVolumeName(machine.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
 		return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q cloud init volume %v", cloudInitVolumeName(machine.Name), err), deleteEventAction)
 	}
 
 	// Delete cloud init volume if exists
-	if err := client.DeleteVolume(ignitionVolumeName(machine.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
+	if err := client.DeleteVolume(ignitionPoolName(machineProviderConfig), ignitionVolumeName(machine.Name)); err != nil && err != libvirtclient.ErrVolumeNotFound {
 		return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q ignition volume %v", ignitionVolumeName(machine.Name), err), deleteEventAction)
 	}
 
@@ -343,6 +826,78 @@ func (a *Actuator) deleteVolumeAndDomain(machine *machinev1.Machine, client libv
 	return nil
 }
 
+// deleteNetworkRecords deletes the DNS host records of the machine and
+// releases the DHCP leases reserved for its addresses
+func (a *Actuator) deleteNetworkRecords(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, client libvirtclient.Client) error {
+	if machineProviderConfig.NetworkInterfaceName != "" {
+		if err := client.DeleteDNSHost(machineProviderConfig.NetworkInterfaceName, hostName(machine, machineProviderConfig)); err != nil {
+			return a.handleMachineError(machine, apierrors.DeleteMachine("error deleting %q DNS host records %v", hostName(machine, machineProviderConfig), err), deleteEventAction)
+		}
+	}
+
+	if a.reservedLeases != nil {
+		a.reservedLeases.Lock()
+		defer a.reservedLeases.Unlock()
+		for _, addr := range machine.Status.Addresses {
+			if addr.Type == corev1.NodeInternalIP {
+				delete(a.reservedLeases.Items, addr.Address)
+			}
+		}
+	}
+	return nil
+}
+
+// applyClusterNetwork makes machines which do not name a network use the
+// network managed for their cluster, if any.
+func (a *Actuator) applyClusterNetwork(ctx context.Context, machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) error {
+	if machineProviderConfig.NetworkInterfaceName != "" || machineProviderConfig.NetworkUUID != "" {
+		return nil
+	}
+
+	clusterID, ok := machine.Labels[providerconfigv1.ClusterIDLabel]
+	if !ok {
+		return nil
+	}
+
+	cm, err := a.kubeClient.CoreV1().ConfigMaps(machine.Namespace).Get(ctx, clusterID, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := cm.Data[providerconfigv1.ClusterProviderSpecKey]; !ok {
+		return nil
+	}
+
+	clusterProviderConfig, err := clusteractuator.ProviderConfigCluster(a.codec, cm)
+	if err != nil {
+		return err
+	}
+	if clusterProviderConfig.Network != nil {
+		machineProviderConfig.NetworkInterfaceName = clusterProviderConfig.Network.Name
+	}
+	return nil
+}
+
+// resolveNetworkUUID sets the network name of machines which refer to
+// their network by UUID.
+func resolveNetworkUUID(client libvirtclient.Client, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) error {
+	if machineProviderConfig.NetworkUUID == "" {
+		return nil
+	}
+
+	networkName, err := client.LookupNetworkNameByUUID(machineProviderConfig.NetworkUUID)
+	if err != nil {
+		return err
+	}
+	if machineProviderConfig.NetworkInterfaceName != "" && machineProviderConfig.NetworkInterfaceName != networkName {
+		return fmt.Errorf("networkInterfaceName %q does not match the name %q of the network", machineProviderConfig.NetworkInterfaceName, networkName)
+	}
+	machineProviderConfig.NetworkInterfaceName = networkName
+	return nil
+}
+
 // ProviderConfigMachine gets the machine provider config MachineSetSpec from the
 // specified cluster-api MachineSpec.
 func ProviderConfigMachine(codec codec, ms *machinev1.MachineSpec) (*providerconfigv1.LibvirtMachineProviderConfig, error) {
@@ -360,7 +915,7 @@ func ProviderConfigMachine(codec codec, ms *machinev1.MachineSpec) (*providercon
 }
 
 // updateStatus updates a machine object's status.
-func (a *Actuator) updateStatus(context context.Context, machine *machinev1.Machine, dom *libvirt.Domain, client libvirtclient.Client) (bool, error) {
+func (a *Actuator) updateStatus(context context.Context, machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, dom *libvirt.Domain, client libvirtclient.Client, updates ...statusUpdate) (bool, error) {
 	glog.Infof("Updating status for %s", machine.Name)
 
 	status, err := ProviderStatusFromMachine(a.codec, machine)
@@ -374,13 +929,11 @@ func (a *Actuator) updateStatus(context context.Context, machine *machinev1.Mach
 		glog.Errorf("Unable to update provider status: %v", err)
 		return false, err
 	}
-
-	machineProviderConfig, err := ProviderConfigMachine(a.codec, &machine.Spec)
-	if err != nil {
-		glog.Errorf("Unable to get provider config from the machine %s", machine.Name)
+	for _, update := range updates {
+		update(status)
 	}
 
-	addrs, err := NodeAddresses(client, dom, machineProviderConfig.NetworkInterfaceName)
+	addrs, err := NodeAddresses(client, dom, machineProviderConfig)
 	if err != nil {
 		glog.Errorf("Unable to get node addresses: %v", err)
 		return false, err
@@ -486,9 +1039,53 @@ func UpdateProviderStatus(status *providerconfigv1.LibvirtMachineProviderStatus,
 	return nil
 }
 
+// statusUpdate changes the provider status before it is applied to the machine
+type statusUpdate func(status *providerconfigv1.LibvirtMachineProviderStatus)
+
+// withVolumeSize returns a status update recording the size the root volume
+// was created or resized with
+func withVolumeSize(size resource.Quantity) statusUpdate {
+	return func(status *providerconfigv1.LibvirtMachineProviderStatus) {
+		status.VolumeSize = &size
+	}
+}
+
+// withCondition returns a status update setting the condition
+func withCondition(condition providerconfigv1.LibvirtMachineProviderCondition) statusUpdate {
+	return func(status *providerconfigv1.LibvirtMachineProviderStatus) {
+		status.Conditions = setCondition(status.Conditions, condition)
+	}
+}
+
+// setCondition sets a condition in the list. The probe and transition times
+// only change with the condition, so unchanged conditions do not update the
+// machine status.
+func setCondition(conditions []providerconfigv1.LibvirtMachineProviderCondition, condition providerconfigv1.LibvirtMachineProviderCondition) []providerconfigv1.LibvirtMachineProviderCondition {
+	now := metav1.Now()
+	condition.LastProbeTime = now
+	condition.LastTransitionTime = now
+	for i, existing := range conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+			return conditions
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		conditions[i] = condition
+		return conditions
+	}
+	return append(conditions, condition)
+}
+
 // NodeAddresses returns a slice of corev1.NodeAddress objects for a
-// given libvirt domain.
-func NodeAddresses(client libvirtclient.Client, dom *libvirt.Domain, networkInterfaceName string) ([]corev1.NodeAddress, error) {
+// given libvirt domain. The static addresses of the network interface
+// configuration are reported as they are. Otherwise the addresses are taken
+// from the DHCP leases of the libvirt network, or from the ARP table of the
+// host on networks without libvirt DHCP.
+func NodeAddresses(client libvirtclient.Client, dom *libvirt.Domain, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) ([]corev1.NodeAddress, error) {
 	addrs := []corev1.NodeAddress{}
 
 	// If the domain is nil, return an empty address array.
@@ -496,11 +1093,23 @@ func NodeAddresses(client libvirtclient.Client, dom *libvirt.Domain, networkInte
 		return addrs, nil
 	}
 
-	ifaceSource := libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE
-	ifaces, err := dom.ListAllInterfaceAddresses(ifaceSource)
+	if config := machineProviderConfig.NetworkInterfaceConfig; config != nil && len(config.Addresses) > 0 {
+		return staticNodeAddresses(config.Addresses), nil
+	}
+
+	networkInterfaceName := machineProviderConfig.NetworkInterfaceName
+	ifaces, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
 	if err != nil {
 		return nil, err
 	}
+	if len(ifaces) == 0 {
+		ifaces, err = dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP)
+		if err != nil {
+			return nil, err
+		}
+		// there is no DHCP lease to look up the hostname with
+		networkInterfaceName = ""
+	}
 
 	if len(ifaces) == 0 {
 		glog.Infof("The domain does not have any network interfaces")
@@ -535,6 +1144,24 @@ func NodeAddresses(client libvirtclient.Client, dom *libvirt.Domain, networkInte
 	return addrs, nil
 }
 
+// staticNodeAddresses returns the internal IPs of the static addresses in
+// CIDR notation of the network interface configuration
+func staticNodeAddresses(addresses []string) []corev1.NodeAddress {
+	addrs := []corev1.NodeAddress{}
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			// validated before the domain is created
+			continue
+		}
+		addrs = append(addrs, corev1.NodeAddress{
+			Type:    corev1.NodeInternalIP,
+			Address: ip.String(),
+		})
+	}
+	return addrs
+}
+
 // DomainStateString returns a human-readable string for the given
 // libvirt domain state.
 func DomainStateString(state libvirt.DomainState) string {
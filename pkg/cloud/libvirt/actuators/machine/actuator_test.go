@@ -3,7 +3,9 @@ package machine
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	libvirt "github.com/libvirt/libvirt-go"
@@ -12,6 +14,10 @@ import (
 	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
 	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
 	mocklibvirt "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client/mock"
+	apierrors "github.com/openshift/machine-api-operator/pkg/controller/machine"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 
 	"k8s.io/client-go/kubernetes/scheme"
@@ -192,12 +198,13 @@ func TestMachineEvents(t *testing.T) {
 
 			mockLibvirtClient.EXPECT().Close()
 			mockLibvirtClient.EXPECT().CreateVolume(gomock.Any()).Return(tc.createVolumeErr).AnyTimes()
-			mockLibvirtClient.EXPECT().DeleteVolume(gomock.Any()).Return(tc.deleteVolumeErr).AnyTimes()
+			mockLibvirtClient.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(tc.deleteVolumeErr).AnyTimes()
 			mockLibvirtClient.EXPECT().CreateDomain(context.TODO(), gomock.Any()).Return(tc.createDomainErr).AnyTimes()
 			mockLibvirtClient.EXPECT().DeleteDomain(gomock.Any()).Return(tc.deleteDomainErr).AnyTimes()
 			mockLibvirtClient.EXPECT().GetDHCPLeasesByNetwork(gomock.Any())
 			mockLibvirtClient.EXPECT().LookupDomainByName(gomock.Any()).Return(tc.lookupDomainOutput, tc.lookupDomainErr).AnyTimes()
 			mockLibvirtClient.EXPECT().DomainExists(gomock.Any()).Return(tc.domainExists, tc.domainExistsErr).AnyTimes()
+			mockLibvirtClient.EXPECT().DeleteDNSHost(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
 			actuator, err := NewActuator(params)
 			if err != nil {
@@ -216,3 +223,1190 @@ func TestMachineEvents(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveNetworkUUID(t *testing.T) {
+	cases := []struct {
+		name        string
+		networkUUID string
+		networkName string
+		lookupName  string
+		lookupErr   error
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "no network UUID",
+			expected: "",
+		},
+		{
+			name:        "network name resolved from UUID",
+			networkUUID: "3b4e2d5c-8e5a-4a47-9f5b-2f1c7c9c0a1e",
+			lookupName:  "default",
+			expected:    "default",
+		},
+		{
+			name:        "matching network name",
+			networkUUID: "3b4e2d5c-8e5a-4a47-9f5b-2f1c7c9c0a1e",
+			networkName: "default",
+			lookupName:  "default",
+			expected:    "default",
+		},
+		{
+			name:        "conflicting network name",
+			networkUUID: "3b4e2d5c-8e5a-4a47-9f5b-2f1c7c9c0a1e",
+			networkName: "other",
+			lookupName:  "default",
+			expectError: true,
+		},
+		{
+			name:        "network not found",
+			networkUUID: "3b4e2d5c-8e5a-4a47-9f5b-2f1c7c9c0a1e",
+			lookupErr:   libvirtclient.ErrNetworkNotFound,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			if tc.networkUUID != "" {
+				mockLibvirtClient.EXPECT().LookupNetworkNameByUUID(tc.networkUUID).Return(tc.lookupName, tc.lookupErr)
+			}
+
+			config := &providerconfigv1.LibvirtMachineProviderConfig{
+				NetworkUUID:          tc.networkUUID,
+				NetworkInterfaceName: tc.networkName,
+			}
+			err := resolveNetworkUUID(mockLibvirtClient, config)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if config.NetworkInterfaceName != tc.expected {
+				t.Errorf("Expected network %q, got %q", tc.expected, config.NetworkInterfaceName)
+			}
+		})
+	}
+}
+
+func TestDeleteWithoutNetwork(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	machine, err := stubMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := stubProviderConfig()
+	config.NetworkInterfaceName = ""
+	config.NetworkUUID = "3b4e2d5c-8e5a-4a47-9f5b-2f1c7c9c0a1e"
+	providerSpec, err := codec.EncodeToProviderSpec(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.Spec.ProviderSpec = *providerSpec
+
+	mockCtrl := gomock.NewController(t)
+	mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+	mockLibvirtClient.EXPECT().Close()
+	mockLibvirtClient.EXPECT().LookupNetworkNameByUUID(config.NetworkUUID).Return("", libvirtclient.ErrNetworkNotFound)
+	mockLibvirtClient.EXPECT().DomainExists(machine.Name).Return(true, nil)
+	mockLibvirtClient.EXPECT().DeleteDomain(machine.Name).Return(nil)
+	mockLibvirtClient.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	eventRecorder := record.NewFakeRecorder(1)
+	actuator, err := NewActuator(ActuatorParams{
+		ClusterClient: fakeclusterclientset.NewSimpleClientset(machine),
+		KubeClient:    kubernetesfake.NewSimpleClientset(),
+		ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+			return mockLibvirtClient, nil
+		},
+		Codec:         codec,
+		EventRecorder: eventRecorder,
+	})
+	if err != nil {
+		t.Fatalf("Could not create machine actuator: %v", err)
+	}
+
+	if err := actuator.Delete(context.TODO(), machine); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event := <-eventRecorder.Events; event != "Normal Deleted Deleted Machine libvirt-actuator-testing-machine" {
+		t.Errorf("Unexpected event %q", event)
+	}
+}
+
+func TestDeleteWithoutDomain(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	machine, err := stubMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.124.51"}}
+
+	mockCtrl := gomock.NewController(t)
+	mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+	mockLibvirtClient.EXPECT().Close()
+	mockLibvirtClient.EXPECT().DomainExists(machine.Name).Return(false, nil)
+	mockLibvirtClient.EXPECT().DeleteDNSHost("default", machine.Name).Return(nil)
+
+	actuator, err := NewActuator(ActuatorParams{
+		ClusterClient: fakeclusterclientset.NewSimpleClientset(machine),
+		KubeClient:    kubernetesfake.NewSimpleClientset(),
+		ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+			return mockLibvirtClient, nil
+		},
+		Codec:         codec,
+		EventRecorder: record.NewFakeRecorder(1),
+	})
+	if err != nil {
+		t.Fatalf("Could not create machine actuator: %v", err)
+	}
+	actuator.reservedLeases = &libvirtclient.Leases{Items: map[string]string{"192.168.124.51": ""}}
+
+	if err := actuator.Delete(context.TODO(), machine); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := actuator.reservedLeases.Items["192.168.124.51"]; ok {
+		t.Errorf("Expected the reserved lease of the machine to be released")
+	}
+}
+
+func TestCreateWaitsForBaseImage(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	machine, err := stubMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := stubProviderConfig()
+	config.Volume.BaseVolumeID = ""
+	config.Volume.ImageURL = "https://example.com/fedora.qcow2"
+	providerSpec, err := codec.EncodeToProviderSpec(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.Spec.ProviderSpec = *providerSpec
+
+	mockCtrl := gomock.NewController(t)
+	mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+	mockLibvirtClient.EXPECT().Close()
+	mockLibvirtClient.EXPECT().GetDHCPLeasesByNetwork("default")
+	mockLibvirtClient.EXPECT().EnsureBaseVolume(gomock.Any(), gomock.Any()).Return("", &libvirtclient.RetryError{After: 10 * time.Second, Err: fmt.Errorf("image is being imported")})
+
+	eventRecorder := record.NewFakeRecorder(1)
+	actuator, err := NewActuator(ActuatorParams{
+		ClusterClient: fakeclusterclientset.NewSimpleClientset(machine),
+		KubeClient:    kubernetesfake.NewSimpleClientset(),
+		ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+			return mockLibvirtClient, nil
+		},
+		Codec:         codec,
+		EventRecorder: eventRecorder,
+	})
+	if err != nil {
+		t.Fatalf("Could not create machine actuator: %v", err)
+	}
+
+	err = actuator.Create(context.TODO(), machine)
+	if requeue, ok := err.(*apierrors.RequeueAfterError); !ok || requeue.RequeueAfter != 10*time.Second {
+		t.Fatalf("Expected requeue after 10s, got %v", err)
+	}
+	select {
+	case event := <-eventRecorder.Events:
+		t.Errorf("Unexpected event %q", event)
+	default:
+	}
+}
+
+func TestCreateValidatesBeforeImport(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	machine, err := stubMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := stubProviderConfig()
+	config.Volume.BaseVolumeID = ""
+	config.Volume.ImageURL = "https://example.com/fedora.qcow2"
+	config.NetworkInterfaceConfig = &providerconfigv1.NetworkInterfaceConfig{MTU: 20}
+	providerSpec, err := codec.EncodeToProviderSpec(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.Spec.ProviderSpec = *providerSpec
+
+	// the base image must not be imported for an invalid spec
+	mockCtrl := gomock.NewController(t)
+	mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+	mockLibvirtClient.EXPECT().Close()
+	mockLibvirtClient.EXPECT().GetDHCPLeasesByNetwork("default")
+
+	actuator, err := NewActuator(ActuatorParams{
+		ClusterClient: fakeclusterclientset.NewSimpleClientset(machine),
+		KubeClient:    kubernetesfake.NewSimpleClientset(),
+		ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+			return mockLibvirtClient, nil
+		},
+		Codec:         codec,
+		EventRecorder: record.NewFakeRecorder(1),
+	})
+	if err != nil {
+		t.Fatalf("Could not create machine actuator: %v", err)
+	}
+
+	if err := actuator.Create(context.TODO(), machine); err == nil {
+		t.Fatalf("Expected error for invalid network interface config")
+	}
+}
+
+func TestResizeRootVolume(t *testing.T) {
+	size := resource.MustParse("20Gi")
+	smallerSize := resource.MustParse("10Gi")
+
+	cases := []struct {
+		name           string
+		volumeSize     *resource.Quantity
+		appliedSize    *resource.Quantity
+		expectResize   bool
+		resized        bool
+		resizeErr      error
+		expectedStatus corev1.ConditionStatus
+		expectedReason string
+		expectError    bool
+	}{
+		{
+			name: "no volume size",
+		},
+		{
+			name:           "volume grown",
+			volumeSize:     &size,
+			appliedSize:    &smallerSize,
+			expectResize:   true,
+			resized:        true,
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: "VolumeResized",
+		},
+		{
+			name:           "volume has requested size",
+			volumeSize:     &size,
+			expectResize:   true,
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: "VolumeResized",
+		},
+		{
+			// the volume was created with the larger size of its base volume
+			name:           "volume was created with requested size",
+			volumeSize:     &size,
+			appliedSize:    &size,
+			expectedStatus: corev1.ConditionTrue,
+			expectedReason: "VolumeResized",
+		},
+		{
+			name:           "shrinking rejected",
+			volumeSize:     &size,
+			expectResize:   true,
+			resizeErr:      &libvirtclient.VolumeShrinkError{Name: "worker", Capacity: 30 << 30, Size: 20 << 30},
+			expectedStatus: corev1.ConditionFalse,
+			expectedReason: "VolumeShrinkRejected",
+			expectError:    true,
+		},
+		{
+			name:           "snapshots exist",
+			volumeSize:     &size,
+			appliedSize:    &smallerSize,
+			expectResize:   true,
+			resizeErr:      &libvirtclient.VolumeSnapshotsError{Name: "worker", Domain: "worker", Snapshots: []string{"installed"}},
+			expectedStatus: corev1.ConditionFalse,
+			expectedReason: "SnapshotsExist",
+			expectError:    true,
+		},
+		{
+			name:           "resize failed",
+			volumeSize:     &size,
+			expectResize:   true,
+			resizeErr:      fmt.Errorf("error"),
+			expectedStatus: corev1.ConditionFalse,
+			expectedReason: "VolumeResizeFailed",
+			expectError:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			if tc.expectResize {
+				mockLibvirtClient.EXPECT().ResizeVolume("worker", "", "worker", uint64(20<<30)).Return(tc.resized, tc.resizeErr)
+			}
+
+			machine := &machinev1beta1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "worker"}}
+			config := &providerconfigv1.LibvirtMachineProviderConfig{
+				Volume: &providerconfigv1.Volume{VolumeSize: tc.volumeSize},
+			}
+			condition, err := resizeRootVolume(machine, config, tc.appliedSize, mockLibvirtClient)
+			if tc.expectError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if tc.volumeSize == nil {
+				if condition != nil {
+					t.Errorf("Expected no condition, got %+v", condition)
+				}
+				return
+			}
+			if condition == nil {
+				t.Fatalf("Expected condition, got none")
+			}
+			if condition.Type != providerconfigv1.VolumeResized || condition.Status != tc.expectedStatus || condition.Reason != tc.expectedReason {
+				t.Errorf("Expected %s condition with status %s and reason %s, got %+v", providerconfigv1.VolumeResized, tc.expectedStatus, tc.expectedReason, condition)
+			}
+		})
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	transition := metav1.NewTime(time.Now().Add(-time.Hour))
+	existing := providerconfigv1.LibvirtMachineProviderCondition{
+		Type:               providerconfigv1.VolumeResized,
+		Status:             corev1.ConditionTrue,
+		Reason:             "VolumeResized",
+		Message:            "volume worker has the requested size of 10 bytes",
+		LastProbeTime:      transition,
+		LastTransitionTime: transition,
+	}
+
+	unchanged := setCondition([]providerconfigv1.LibvirtMachineProviderCondition{existing}, existing)
+	if len(unchanged) != 1 || unchanged[0] != existing {
+		t.Errorf("Expected unchanged condition, got %+v", unchanged)
+	}
+
+	grown := existing
+	grown.Message = "volume worker has the requested size of 20 bytes"
+	conditions := setCondition([]providerconfigv1.LibvirtMachineProviderCondition{existing}, grown)
+	if len(conditions) != 1 || conditions[0].Message != grown.Message || conditions[0].LastTransitionTime != transition || conditions[0].LastProbeTime == transition {
+		t.Errorf("Expected updated message with the same transition time, got %+v", conditions)
+	}
+
+	failed := existing
+	failed.Status = corev1.ConditionFalse
+	conditions = setCondition([]providerconfigv1.LibvirtMachineProviderCondition{existing}, failed)
+	if len(conditions) != 1 || conditions[0].Status != corev1.ConditionFalse || conditions[0].LastTransitionTime == transition {
+		t.Errorf("Expected new status with a new transition time, got %+v", conditions)
+	}
+
+	conditions = setCondition(nil, existing)
+	if len(conditions) != 1 || conditions[0].Type != providerconfigv1.VolumeResized {
+		t.Errorf("Expected added condition, got %+v", conditions)
+	}
+}
+
+func TestValidateVolume(t *testing.T) {
+	clusterSize := resource.MustParse("64Ki")
+	invalidClusterSize := resource.MustParse("100Ki")
+
+	cases := []struct {
+		name        string
+		volume      providerconfigv1.Volume
+		expectError bool
+	}{
+		{
+			name:   "defaults",
+			volume: providerconfigv1.Volume{},
+		},
+		{
+			name: "image with checksum",
+			volume: providerconfigv1.Volume{
+				ImageURL:      "https://example.com/rhcos.qcow2",
+				ImageChecksum: "sha256:6c2e8f3b1a9d4e5f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f",
+			},
+		},
+		{
+			name:        "checksum without image",
+			volume:      providerconfigv1.Volume{ImageChecksum: "sha256:6c2e8f3b1a9d4e5f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f"},
+			expectError: true,
+		},
+		{
+			name: "image and base volume",
+			volume: providerconfigv1.Volume{
+				ImageURL:     "https://example.com/rhcos.qcow2",
+				BaseVolumeID: "fedora_base",
+			},
+			expectError: true,
+		},
+		{
+			name: "qcow2 options",
+			volume: providerconfigv1.Volume{
+				Format:        providerconfigv1.VolumeFormatQcow2,
+				Preallocation: providerconfigv1.VolumePreallocationMetadata,
+				LazyRefcounts: true,
+				ClusterSize:   &clusterSize,
+			},
+		},
+		{
+			name: "fully allocated raw copy",
+			volume: providerconfigv1.Volume{
+				Format:        providerconfigv1.VolumeFormatRaw,
+				Preallocation: providerconfigv1.VolumePreallocationFull,
+				CloneMode:     providerconfigv1.VolumeCloneModeFlatClone,
+			},
+		},
+		{
+			name: "raw overlay",
+			volume: providerconfigv1.Volume{
+				Format:    providerconfigv1.VolumeFormatRaw,
+				CloneMode: providerconfigv1.VolumeCloneModeOverlay,
+			},
+			expectError: true,
+		},
+		{
+			name: "raw with metadata preallocation",
+			volume: providerconfigv1.Volume{
+				Format:        providerconfigv1.VolumeFormatRaw,
+				Preallocation: providerconfigv1.VolumePreallocationMetadata,
+			},
+			expectError: true,
+		},
+		{
+			name: "raw with lazy refcounts",
+			volume: providerconfigv1.Volume{
+				Format:        providerconfigv1.VolumeFormatRaw,
+				LazyRefcounts: true,
+			},
+			expectError: true,
+		},
+		{
+			name:        "unsupported format",
+			volume:      providerconfigv1.Volume{Format: "vmdk"},
+			expectError: true,
+		},
+		{
+			name:        "unsupported preallocation",
+			volume:      providerconfigv1.Volume{Preallocation: "falloc"},
+			expectError: true,
+		},
+		{
+			name:        "unsupported clone mode",
+			volume:      providerconfigv1.Volume{CloneMode: "Snapshot"},
+			expectError: true,
+		},
+		{
+			name:        "encryption without secret",
+			volume:      providerconfigv1.Volume{Encryption: &providerconfigv1.VolumeEncryption{}},
+			expectError: true,
+		},
+		{
+			name:        "cluster size not a power of two",
+			volume:      providerconfigv1.Volume{ClusterSize: &invalidClusterSize},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateVolume(&tc.volume)
+			if tc.expectError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestValidateDisks(t *testing.T) {
+	cases := []struct {
+		name        string
+		disks       []providerconfigv1.Disk
+		expectError bool
+	}{
+		{
+			name: "no disks",
+		},
+		{
+			name: "disks in pools",
+			disks: []providerconfigv1.Disk{
+				{Name: "data", PoolName: "nvme", Size: resource.MustParse("10Gi")},
+				{Name: "logs", Size: resource.MustParse("1Gi")},
+			},
+		},
+		{
+			name:        "missing name",
+			disks:       []providerconfigv1.Disk{{Size: resource.MustParse("10Gi")}},
+			expectError: true,
+		},
+		{
+			name: "duplicate name",
+			disks: []providerconfigv1.Disk{
+				{Name: "data", Size: resource.MustParse("10Gi")},
+				{Name: "data", Size: resource.MustParse("1Gi")},
+			},
+			expectError: true,
+		},
+		{
+			name:        "missing size",
+			disks:       []providerconfigv1.Disk{{Name: "data"}},
+			expectError: true,
+		},
+		{
+			name:        "invalid name",
+			disks:       []providerconfigv1.Disk{{Name: "Data_1", Size: resource.MustParse("10Gi")}},
+			expectError: true,
+		},
+		{
+			name:        "reserved name",
+			disks:       []providerconfigv1.Disk{{Name: "cloud-init", Size: resource.MustParse("10Gi")}},
+			expectError: true,
+		},
+		{
+			name: "network disks",
+			disks: []providerconfigv1.Disk{
+				{Name: "nbd", Network: &providerconfigv1.NetworkDiskSource{
+					Protocol: providerconfigv1.NetworkDiskProtocolNBD,
+					Hosts:    []providerconfigv1.NetworkDiskHost{{Name: "192.168.126.1", Port: "10809"}},
+				}},
+				{Name: "rbd", Network: &providerconfigv1.NetworkDiskSource{
+					Protocol: providerconfigv1.NetworkDiskProtocolRBD,
+					Name:     "rbd/worker-data",
+					Hosts:    []providerconfigv1.NetworkDiskHost{{Name: "mon1"}, {Name: "mon2"}},
+					Auth:     &providerconfigv1.NetworkDiskAuth{Username: "libvirt", SecretName: "ceph-key"},
+				}},
+			},
+		},
+		{
+			name: "network disk with size",
+			disks: []providerconfigv1.Disk{{Name: "nbd", Size: resource.MustParse("10Gi"), Network: &providerconfigv1.NetworkDiskSource{
+				Protocol: providerconfigv1.NetworkDiskProtocolNBD,
+				Hosts:    []providerconfigv1.NetworkDiskHost{{Name: "192.168.126.1"}},
+			}}},
+			expectError: true,
+		},
+		{
+			name: "nbd with auth",
+			disks: []providerconfigv1.Disk{{Name: "nbd", Network: &providerconfigv1.NetworkDiskSource{
+				Protocol: providerconfigv1.NetworkDiskProtocolNBD,
+				Hosts:    []providerconfigv1.NetworkDiskHost{{Name: "192.168.126.1"}},
+				Auth:     &providerconfigv1.NetworkDiskAuth{Username: "user", SecretName: "nbd-key"},
+			}}},
+			expectError: true,
+		},
+		{
+			name: "iscsi without target",
+			disks: []providerconfigv1.Disk{{Name: "iscsi", Network: &providerconfigv1.NetworkDiskSource{
+				Protocol: providerconfigv1.NetworkDiskProtocolISCSI,
+				Hosts:    []providerconfigv1.NetworkDiskHost{{Name: "192.168.126.1"}},
+			}}},
+			expectError: true,
+		},
+		{
+			name: "network disk without hosts",
+			disks: []providerconfigv1.Disk{{Name: "iscsi", Network: &providerconfigv1.NetworkDiskSource{
+				Protocol: providerconfigv1.NetworkDiskProtocolISCSI,
+				Name:     "iqn.2013-06.com.example:storage/1",
+			}}},
+			expectError: true,
+		},
+		{
+			name: "unsupported protocol",
+			disks: []providerconfigv1.Disk{{Name: "http", Network: &providerconfigv1.NetworkDiskSource{
+				Protocol: "http",
+				Hosts:    []providerconfigv1.NetworkDiskHost{{Name: "192.168.126.1"}},
+			}}},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateDisks(tc.disks)
+			if tc.expectError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestValidateIgnition(t *testing.T) {
+	configMapRef := &corev1.ConfigMapKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "chrony"},
+		Key:                  "chrony.conf",
+	}
+	secretRef := &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "pull-secret"},
+		Key:                  "config.json",
+	}
+
+	cases := []struct {
+		name        string
+		ignition    *providerconfigv1.Ignition
+		expectError bool
+	}{
+		{
+			name: "no ignition",
+		},
+		{
+			name: "files from config map and secret",
+			ignition: &providerconfigv1.Ignition{Files: []providerconfigv1.IgnitionFile{
+				{Path: "/etc/chrony.conf", ConfigMapRef: configMapRef},
+				{Path: "/var/lib/kubelet/config.json", SecretRef: secretRef},
+			}},
+		},
+		{
+			name:     "firmware config delivery",
+			ignition: &providerconfigv1.Ignition{Delivery: providerconfigv1.IgnitionDeliveryFirmwareConfig},
+		},
+		{
+			name:        "unsupported delivery",
+			ignition:    &providerconfigv1.Ignition{Delivery: "Floppy"},
+			expectError: true,
+		},
+		{
+			name: "relative path",
+			ignition: &providerconfigv1.Ignition{Files: []providerconfigv1.IgnitionFile{
+				{Path: "etc/chrony.conf", ConfigMapRef: configMapRef},
+			}},
+			expectError: true,
+		},
+		{
+			name: "file without source",
+			ignition: &providerconfigv1.Ignition{Files: []providerconfigv1.IgnitionFile{
+				{Path: "/etc/chrony.conf"},
+			}},
+			expectError: true,
+		},
+		{
+			name: "file with two sources",
+			ignition: &providerconfigv1.Ignition{Files: []providerconfigv1.IgnitionFile{
+				{Path: "/etc/chrony.conf", ConfigMapRef: configMapRef, SecretRef: secretRef},
+			}},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateIgnition(tc.ignition)
+			if tc.expectError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestValidateNetworkInterfaceConfig(t *testing.T) {
+	cases := []struct {
+		name                    string
+		config                  *providerconfigv1.NetworkInterfaceConfig
+		networkInterfaceAddress string
+		noCloudInit             bool
+		expectError             bool
+	}{
+		{
+			name: "no config",
+		},
+		{
+			name: "static dual stack",
+			config: &providerconfigv1.NetworkInterfaceConfig{
+				Addresses:   []string{"192.168.126.51/24", "fd00::51/64"},
+				Gateways:    []string{"192.168.126.1", "fd00::1"},
+				Nameservers: []string{"192.168.126.1"},
+				MTU:         9000,
+			},
+		},
+		{
+			name:                    "static address with networkInterfaceAddress",
+			config:                  &providerconfigv1.NetworkInterfaceConfig{Addresses: []string{"192.168.126.51/24"}},
+			networkInterfaceAddress: "192.168.126.0/24",
+			expectError:             true,
+		},
+		{
+			name:                    "DHCP with networkInterfaceAddress",
+			config:                  &providerconfigv1.NetworkInterfaceConfig{MTU: 1400},
+			networkInterfaceAddress: "192.168.126.0/24",
+		},
+		{
+			name:        "without cloud init",
+			config:      &providerconfigv1.NetworkInterfaceConfig{MTU: 1400},
+			noCloudInit: true,
+			expectError: true,
+		},
+		{
+			name:        "address without prefix",
+			config:      &providerconfigv1.NetworkInterfaceConfig{Addresses: []string{"192.168.126.51"}},
+			expectError: true,
+		},
+		{
+			name:        "two IPv4 gateways",
+			config:      &providerconfigv1.NetworkInterfaceConfig{Gateways: []string{"192.168.126.1", "192.168.126.2"}},
+			expectError: true,
+		},
+		{
+			name:        "invalid nameserver",
+			config:      &providerconfigv1.NetworkInterfaceConfig{Nameservers: []string{"dns.example.com"}},
+			expectError: true,
+		},
+		{
+			name:        "invalid MTU",
+			config:      &providerconfigv1.NetworkInterfaceConfig{MTU: 20},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			machineProviderConfig := stubProviderConfig()
+			machineProviderConfig.NetworkInterfaceConfig = tc.config
+			machineProviderConfig.NetworkInterfaceAddress = tc.networkInterfaceAddress
+			if tc.noCloudInit {
+				machineProviderConfig.CloudInit = nil
+			}
+			err := validateNetworkInterfaceConfig(machineProviderConfig)
+			if tc.expectError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestStaticNodeAddresses(t *testing.T) {
+	addrs := staticNodeAddresses([]string{"192.168.126.51/24", "fd00::51/64"})
+	expected := []corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: "192.168.126.51"},
+		{Type: corev1.NodeInternalIP, Address: "fd00::51"},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected addresses %v, got %v", expected, addrs)
+	}
+}
+
+func TestApplySnapshots(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	cases := []struct {
+		name                     string
+		annotations              map[string]string
+		revertedSnapshot         string
+		snapshots                []string
+		expectCreate             bool
+		expectExternal           bool
+		expectRevert             bool
+		expectedSnapshots        []string
+		expectedRevertedSnapshot string
+		expectError              bool
+	}{
+		{
+			name:              "no annotations",
+			snapshots:         []string{"installed"},
+			expectedSnapshots: []string{"installed"},
+		},
+		{
+			name:              "snapshot created",
+			annotations:       map[string]string{snapshotAnnotation: "installed"},
+			expectCreate:      true,
+			expectedSnapshots: []string{"installed"},
+		},
+		{
+			name:              "internal snapshot created",
+			annotations:       map[string]string{snapshotAnnotation: "installed", snapshotTypeAnnotation: snapshotTypeInternal},
+			expectCreate:      true,
+			expectedSnapshots: []string{"installed"},
+		},
+		{
+			name:              "external snapshot created",
+			annotations:       map[string]string{snapshotAnnotation: "installed", snapshotTypeAnnotation: snapshotTypeExternal},
+			expectCreate:      true,
+			expectExternal:    true,
+			expectedSnapshots: []string{"installed"},
+		},
+		{
+			name:              "snapshot exists",
+			annotations:       map[string]string{snapshotAnnotation: "installed"},
+			snapshots:         []string{"installed"},
+			expectedSnapshots: []string{"installed"},
+		},
+		{
+			name:        "unsupported snapshot type",
+			annotations: map[string]string{snapshotAnnotation: "installed", snapshotTypeAnnotation: "memory"},
+			expectError: true,
+		},
+		{
+			name:                     "reverted",
+			annotations:              map[string]string{revertAnnotation: "installed"},
+			snapshots:                []string{"installed"},
+			expectRevert:             true,
+			expectedSnapshots:        []string{"installed"},
+			expectedRevertedSnapshot: "installed",
+		},
+		{
+			name:                     "already reverted",
+			annotations:              map[string]string{revertAnnotation: "installed"},
+			revertedSnapshot:         "installed",
+			snapshots:                []string{"installed"},
+			expectedSnapshots:        []string{"installed"},
+			expectedRevertedSnapshot: "installed",
+		},
+		{
+			name:              "revert annotation removed",
+			revertedSnapshot:  "installed",
+			snapshots:         []string{"installed"},
+			expectedSnapshots: []string{"installed"},
+		},
+		{
+			name:        "revert to missing snapshot",
+			annotations: map[string]string{revertAnnotation: "installed"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			mockLibvirtClient.EXPECT().ListSnapshots("worker").Return(tc.snapshots, nil)
+			if tc.expectCreate {
+				mockLibvirtClient.EXPECT().CreateSnapshot("worker", "installed", tc.expectExternal).Return(nil)
+			}
+			if tc.expectRevert {
+				mockLibvirtClient.EXPECT().RevertSnapshot("worker", "installed").Return(nil)
+			}
+
+			rawStatus, err := codec.EncodeProviderStatus(&providerconfigv1.LibvirtMachineProviderStatus{RevertedSnapshot: tc.revertedSnapshot})
+			if err != nil {
+				t.Fatal(err)
+			}
+			machine := &machinev1beta1.Machine{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker", Annotations: tc.annotations},
+				Status:     machinev1beta1.MachineStatus{ProviderStatus: rawStatus},
+			}
+			actuator := &Actuator{codec: codec, eventRecorder: record.NewFakeRecorder(2)}
+
+			update, machineErr := actuator.applySnapshots(machine, mockLibvirtClient)
+			if tc.expectError {
+				if machineErr == nil {
+					t.Errorf("Expected error, got none")
+				}
+				return
+			}
+			if machineErr != nil {
+				t.Fatalf("Unexpected error: %v", machineErr)
+			}
+			status := &providerconfigv1.LibvirtMachineProviderStatus{}
+			update(status)
+			if fmt.Sprint(status.Snapshots) != fmt.Sprint(tc.expectedSnapshots) {
+				t.Errorf("Expected snapshots %v, got %v", tc.expectedSnapshots, status.Snapshots)
+			}
+			if status.RevertedSnapshot != tc.expectedRevertedSnapshot {
+				t.Errorf("Expected reverted snapshot %q, got %q", tc.expectedRevertedSnapshot, status.RevertedSnapshot)
+			}
+		})
+	}
+}
+
+func TestBackupVolumes(t *testing.T) {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+
+	cases := []struct {
+		name              string
+		annotation        string
+		lastBackup        *providerconfigv1.LibvirtMachineBackupStatus
+		backup            *providerconfigv1.Backup
+		backupErr         error
+		expectStart       bool
+		expectedVolumes   []string
+		expectedPhase     providerconfigv1.LibvirtMachineBackupPhase
+		expectedCondition corev1.ConditionStatus
+		expectedReason    string
+		expectedLocations []string
+		expectError       bool
+	}{
+		{
+			name: "no backup requested",
+		},
+		{
+			name:       "backup already taken",
+			annotation: "crash",
+			lastBackup: &providerconfigv1.LibvirtMachineBackupStatus{Name: "crash", Phase: providerconfigv1.BackupPhaseCompleted},
+			backup:     &providerconfigv1.Backup{URL: "s3://backups"},
+		},
+		{
+			name:       "failed backup is not retried",
+			annotation: "crash",
+			lastBackup: &providerconfigv1.LibvirtMachineBackupStatus{Name: "crash", Phase: providerconfigv1.BackupPhaseFailed},
+			backup:     &providerconfigv1.Backup{URL: "s3://backups"},
+		},
+		{
+			name:              "interrupted backup",
+			annotation:        "crash",
+			lastBackup:        &providerconfigv1.LibvirtMachineBackupStatus{Name: "crash", Phase: providerconfigv1.BackupPhaseRunning},
+			backup:            &providerconfigv1.Backup{URL: "s3://backups"},
+			expectedPhase:     providerconfigv1.BackupPhaseFailed,
+			expectedCondition: corev1.ConditionFalse,
+			expectedReason:    "BackupInterrupted",
+		},
+		{
+			name:              "backup taken",
+			annotation:        "crash",
+			lastBackup:        &providerconfigv1.LibvirtMachineBackupStatus{Name: "before", Phase: providerconfigv1.BackupPhaseCompleted},
+			backup:            &providerconfigv1.Backup{URL: "s3://backups/cluster"},
+			expectStart:       true,
+			expectedVolumes:   []string{"worker", "worker_data"},
+			expectedPhase:     providerconfigv1.BackupPhaseCompleted,
+			expectedCondition: corev1.ConditionTrue,
+			expectedReason:    "BackupCompleted",
+			expectedLocations: []string{"s3://backups/cluster/worker/crash/worker", "s3://backups/cluster/worker/crash/worker_data"},
+		},
+		{
+			name:              "backup failed",
+			annotation:        "crash",
+			backup:            &providerconfigv1.Backup{URL: "s3://backups"},
+			backupErr:         fmt.Errorf("error"),
+			expectStart:       true,
+			expectedVolumes:   []string{"worker", "worker_data"},
+			expectedPhase:     providerconfigv1.BackupPhaseFailed,
+			expectedCondition: corev1.ConditionFalse,
+			expectedReason:    "BackupFailed",
+		},
+		{
+			name:              "backup not configured",
+			annotation:        "crash",
+			expectedPhase:     providerconfigv1.BackupPhaseFailed,
+			expectedCondition: corev1.ConditionFalse,
+			expectedReason:    "BackupNotConfigured",
+			expectError:       true,
+		},
+		{
+			name:              "invalid backup name",
+			annotation:        "../crash",
+			backup:            &providerconfigv1.Backup{URL: "s3://backups"},
+			expectedPhase:     providerconfigv1.BackupPhaseFailed,
+			expectedCondition: corev1.ConditionFalse,
+			expectedReason:    "InvalidBackupName",
+			expectError:       true,
+		},
+		{
+			name:              "backup taken to files with paused domain",
+			annotation:        "crash",
+			backup:            &providerconfigv1.Backup{URL: "file:///var/lib/backups", PauseDomain: true},
+			expectStart:       true,
+			expectedVolumes:   []string{"worker", "worker_data"},
+			expectedPhase:     providerconfigv1.BackupPhaseCompleted,
+			expectedCondition: corev1.ConditionTrue,
+			expectedReason:    "BackupCompleted",
+			expectedLocations: []string{"file:///var/lib/backups/worker/crash/worker", "file:///var/lib/backups/worker/crash/worker_data"},
+		},
+		{
+			name:              "unsupported URL",
+			annotation:        "crash",
+			backup:            &providerconfigv1.Backup{URL: "ftp://backups"},
+			expectedPhase:     providerconfigv1.BackupPhaseFailed,
+			expectedCondition: corev1.ConditionFalse,
+			expectedReason:    "InvalidBackupURL",
+			expectError:       true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			var volumes []string
+			if tc.expectStart {
+				mockLibvirtClient.EXPECT().BackupVolumes(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, input libvirtclient.BackupVolumesInput) error {
+					if input.PauseDomain != tc.backup.PauseDomain {
+						t.Errorf("Expected pause domain %v, got %v", tc.backup.PauseDomain, input.PauseDomain)
+					}
+					for _, volume := range input.Volumes {
+						volumes = append(volumes, volume.VolumeName)
+						if tc.backupErr == nil {
+							input.Progress(volume)
+						}
+					}
+					return tc.backupErr
+				})
+				mockLibvirtClient.EXPECT().Close()
+			}
+
+			status := &providerconfigv1.LibvirtMachineProviderStatus{Backup: tc.lastBackup}
+			rawStatus, err := codec.EncodeProviderStatus(status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			machine := &machinev1beta1.Machine{
+				ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "default"},
+				Status:     machinev1beta1.MachineStatus{ProviderStatus: rawStatus},
+			}
+			if tc.annotation != "" {
+				machine.Annotations = map[string]string{backupAnnotation: tc.annotation}
+			}
+			config := &providerconfigv1.LibvirtMachineProviderConfig{
+				Volume: &providerconfigv1.Volume{},
+				Disks: []providerconfigv1.Disk{
+					{Name: "data", Size: resource.MustParse("10Gi")},
+					{Name: "shared", Network: &providerconfigv1.NetworkDiskSource{Protocol: providerconfigv1.NetworkDiskProtocolNBD}},
+				},
+				Backup: tc.backup,
+			}
+			actuator := &Actuator{
+				codec:         codec,
+				eventRecorder: record.NewFakeRecorder(4),
+				clientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+					return mockLibvirtClient, nil
+				},
+			}
+
+			update, running, machineErr := actuator.backupVolumes(machine, config)
+			if tc.expectStart {
+				if !running || machineErr != nil {
+					t.Fatalf("Expected running backup, got running %v, error %v", running, machineErr)
+				}
+				newStatus := &providerconfigv1.LibvirtMachineProviderStatus{}
+				update(newStatus)
+				if newStatus.Backup == nil || newStatus.Backup.Name != tc.annotation || newStatus.Backup.Phase != providerconfigv1.BackupPhaseRunning {
+					t.Errorf("Expected running backup %s, got %+v", tc.annotation, newStatus.Backup)
+				}
+
+				job := actuator.backups.get(machineKey(machine))
+				select {
+				case <-job.finished:
+				case <-time.After(10 * time.Second):
+					t.Fatalf("Backup did not finish")
+				}
+				update, running, machineErr = actuator.backupVolumes(machine, config)
+				if actuator.backups.get(machineKey(machine)) != nil {
+					t.Errorf("Expected finished backup to be forgotten")
+				}
+			}
+			if running {
+				t.Errorf("Expected no running backup")
+			}
+			if tc.expectError != (machineErr != nil) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, machineErr)
+			}
+			if fmt.Sprint(volumes) != fmt.Sprint(tc.expectedVolumes) {
+				t.Errorf("Expected volumes %v, got %v", tc.expectedVolumes, volumes)
+			}
+			if tc.expectedCondition == "" {
+				if update != nil {
+					t.Errorf("Expected no status update")
+				}
+				return
+			}
+			if update == nil {
+				t.Fatalf("Expected status update, got none")
+			}
+			newStatus := &providerconfigv1.LibvirtMachineProviderStatus{}
+			update(newStatus)
+			if len(newStatus.Conditions) != 1 || newStatus.Conditions[0].Status != tc.expectedCondition || newStatus.Conditions[0].Reason != tc.expectedReason {
+				t.Errorf("Expected %s condition with status %s and reason %s, got %+v", providerconfigv1.BackupCompleted, tc.expectedCondition, tc.expectedReason, newStatus.Conditions)
+			}
+			if newStatus.Backup == nil || newStatus.Backup.Name != tc.annotation || newStatus.Backup.Phase != tc.expectedPhase || newStatus.Backup.CompletionTime == nil {
+				t.Fatalf("Expected %s backup %s, got %+v", tc.expectedPhase, tc.annotation, newStatus.Backup)
+			}
+			if fmt.Sprint(newStatus.Backup.Locations) != fmt.Sprint(tc.expectedLocations) {
+				t.Errorf("Expected locations %v, got %v", tc.expectedLocations, newStatus.Backup.Locations)
+			}
+
+			// the recorded backup is not taken again
+			machine.Status.ProviderStatus, err = codec.EncodeProviderStatus(newStatus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if update, _, _ := actuator.backupVolumes(machine, config); update != nil {
+				t.Errorf("Expected no status update once the backup is recorded")
+			}
+		})
+	}
+}
+
+func TestBackupLocation(t *testing.T) {
+	cases := []struct {
+		backupURL   string
+		expected    string
+		expectError bool
+	}{
+		{
+			backupURL: "s3://backups/cluster",
+			expected:  "s3://backups/cluster/worker/crash/worker",
+		},
+		{
+			backupURL: "s3://backups",
+			expected:  "s3://backups/worker/crash/worker",
+		},
+		{
+			backupURL: "file:///var/lib/backups",
+			expected:  "file:///var/lib/backups/worker/crash/worker",
+		},
+		{
+			backupURL:   "file://backups/cluster",
+			expectError: true,
+		},
+		{
+			backupURL:   "s3:///cluster",
+			expectError: true,
+		},
+		{
+			backupURL:   "/var/lib/backups",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.backupURL, func(t *testing.T) {
+			location, err := backupLocation(tc.backupURL, "worker", "crash", "worker")
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %s", location)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if location != tc.expected {
+				t.Errorf("Expected location %s, got %s", tc.expected, location)
+			}
+		})
+	}
+}
+
+func TestBackupJobsStop(t *testing.T) {
+	var backups backupJobs
+	if backups.stop("default/worker") {
+		t.Errorf("Expected no running backup")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &backupJob{name: "crash", cancel: cancel, finished: make(chan struct{})}
+	backups.add("default/worker", job)
+	if !backups.stop("default/worker") {
+		t.Errorf("Expected running backup")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("Expected backup to be canceled")
+	}
+	job.finish(ctx.Err())
+	if backups.stop("default/worker") || backups.get("default/worker") != nil {
+		t.Errorf("Expected finished backup to be forgotten")
+	}
+}
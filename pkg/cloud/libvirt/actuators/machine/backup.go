@@ -0,0 +1,305 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
+
+	machinev1 "github.com/openshift/api/machine/v1beta1"
+	apierrors "github.com/openshift/machine-api-operator/pkg/controller/machine"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// backupAnnotation names a backup of the volumes of the machine which is
+	// taken if the last backup has another name
+	backupAnnotation = "libvirt.openshift.io/backup"
+
+	// backupPollInterval is the delay after which a machine with a running
+	// backup is updated again to record the progress of the backup
+	backupPollInterval = 30 * time.Second
+)
+
+// backupJob is a backup of the volumes of a machine running in the background
+type backupJob struct {
+	name      string
+	total     int
+	startTime metav1.Time
+	cancel    context.CancelFunc
+	// finished is closed once the backup completed or failed
+	finished chan struct{}
+
+	lock      sync.Mutex
+	locations []string
+	err       error
+}
+
+func (job *backupJob) stored(volume libvirtclient.BackupVolume) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.locations = append(job.locations, volume.Destination)
+}
+
+func (job *backupJob) finish(err error) {
+	job.lock.Lock()
+	job.err = err
+	job.lock.Unlock()
+	close(job.finished)
+}
+
+// isFinished reports whether the backup completed or failed
+func (job *backupJob) isFinished() bool {
+	select {
+	case <-job.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+// result returns the volumes stored so far and the error of a failed backup
+func (job *backupJob) result() ([]string, error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return append([]string(nil), job.locations...), job.err
+}
+
+// backupJobs are the backups running in the background by machine
+type backupJobs struct {
+	lock sync.Mutex
+	jobs map[string]*backupJob
+}
+
+func (b *backupJobs) get(key string) *backupJob {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.jobs[key]
+}
+
+func (b *backupJobs) add(key string, job *backupJob) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.jobs == nil {
+		b.jobs = map[string]*backupJob{}
+	}
+	b.jobs[key] = job
+}
+
+func (b *backupJobs) remove(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.jobs, key)
+}
+
+// stop cancels the backup of a machine and reports whether it is still
+// running. Finished backups are forgotten.
+func (b *backupJobs) stop(key string) bool {
+	job := b.get(key)
+	if job == nil {
+		return false
+	}
+	job.cancel()
+	if !job.isFinished() {
+		return true
+	}
+	b.remove(key)
+	return false
+}
+
+func machineKey(machine *machinev1.Machine) string {
+	return fmt.Sprintf("%s/%s", machine.Namespace, machine.Name)
+}
+
+// backupVolumes starts a backup of the root volume and the volumes of the
+// additional disks in the background when the backup annotation requests a
+// new backup, and records the progress and the result of the backup. It
+// returns a status update and whether a backup is running. Failed backups are
+// recorded and not retried.
+func (a *Actuator) backupVolumes(machine *machinev1.Machine, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig) (statusUpdate, bool, *apierrors.MachineError) {
+	name := machine.GetAnnotations()[backupAnnotation]
+	key := machineKey(machine)
+	if job := a.backups.get(key); job != nil {
+		if !job.isFinished() {
+			locations, _ := job.result()
+			return backupRunning(job, locations), true, nil
+		}
+		a.backups.remove(key)
+		locations, err := job.result()
+		if err != nil {
+			glog.Errorf("Backup %s of machine %s failed: %v", job.name, machine.Name, err)
+			a.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "BackupFailed", "Backup %s of Machine %v failed: %v", job.name, machine.Name, err)
+			return backupFailed(job.name, job.startTime, locations, "BackupFailed", err.Error()), false, nil
+		}
+		glog.Infof("Backed up volumes of machine %s to %v", machine.Name, locations)
+		a.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "BackupCompleted", "Backed up Machine %v as %s", machine.Name, job.name)
+		// a backup requested in the meantime is started on the next update
+		return backupCompleted(job, locations), name != "" && name != job.name, nil
+	}
+
+	if name == "" {
+		return nil, false, nil
+	}
+	status, err := ProviderStatusFromMachine(a.codec, machine)
+	if err != nil {
+		return nil, false, apierrors.UpdateMachine("error getting provider status: %v", err)
+	}
+	if status.Backup != nil && status.Backup.Name == name {
+		if status.Backup.Phase == providerconfigv1.BackupPhaseRunning {
+			// the controller restarted while the backup was running
+			return backupFailed(name, status.Backup.StartTime, status.Backup.Locations, "BackupInterrupted", "backup was interrupted"), false, nil
+		}
+		return nil, false, nil
+	}
+
+	now := metav1.Now()
+	if machineProviderConfig.Backup == nil || machineProviderConfig.Backup.URL == "" {
+		return backupFailed(name, now, nil, "BackupNotConfigured", "no backup URL configured"), false, apierrors.InvalidMachineConfiguration("backup %s requested without backup URL", name)
+	}
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return backupFailed(name, now, nil, "InvalidBackupName", fmt.Sprintf("invalid backup name %q", name)), false, apierrors.InvalidMachineConfiguration("invalid backup name %q", name)
+	}
+
+	volumes := []libvirtclient.BackupVolume{{
+		VolumeName: rootVolumeName(machine, machineProviderConfig),
+		PoolName:   machineProviderConfig.Volume.PoolName,
+	}}
+	for _, disk := range machineProviderConfig.Disks {
+		if disk.Network == nil {
+			volumes = append(volumes, libvirtclient.BackupVolume{
+				VolumeName: diskVolumeName(machine.Name, disk.Name),
+				PoolName:   disk.PoolName,
+			})
+		}
+	}
+	for i := range volumes {
+		destination, err := backupLocation(machineProviderConfig.Backup.URL, machine.Name, name, volumes[i].VolumeName)
+		if err != nil {
+			return backupFailed(name, now, nil, "InvalidBackupURL", err.Error()), false, apierrors.InvalidMachineConfiguration("invalid backup URL: %v", err)
+		}
+		volumes[i].Destination = destination
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &backupJob{
+		name:      name,
+		total:     len(volumes),
+		startTime: now,
+		cancel:    cancel,
+		finished:  make(chan struct{}),
+	}
+	a.backups.add(key, job)
+	go a.runBackup(ctx, job, machineProviderConfig, libvirtclient.BackupVolumesInput{
+		DomainName:        machine.Name,
+		PauseDomain:       machineProviderConfig.Backup.PauseDomain,
+		Volumes:           volumes,
+		Endpoint:          machineProviderConfig.Backup.Endpoint,
+		Region:            machineProviderConfig.Backup.Region,
+		CredentialsSecret: machineProviderConfig.Backup.CredentialsSecret,
+		KubeClient:        a.kubeClient,
+		MachineNamespace:  machine.Namespace,
+		Progress:          job.stored,
+	})
+
+	glog.Infof("Started backup %s of machine %s", name, machine.Name)
+	a.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "BackupStarted", "Started backup %s of Machine %v", name, machine.Name)
+	return backupRunning(job, nil), true, nil
+}
+
+// runBackup stores the volumes of a backup with its own libvirt client, as
+// the client of the update is closed before the backup is done
+func (a *Actuator) runBackup(ctx context.Context, job *backupJob, machineProviderConfig *providerconfigv1.LibvirtMachineProviderConfig, input libvirtclient.BackupVolumesInput) {
+	defer job.cancel()
+	client, err := a.clientBuilder(machineProviderConfig.URI, machineProviderConfig.Volume.PoolName)
+	if err != nil {
+		job.finish(fmt.Errorf("error creating libvirt client: %v", err))
+		return
+	}
+	defer client.Close()
+	job.finish(client.BackupVolumes(ctx, input))
+}
+
+// backupRunning returns a status update recording the progress of a backup
+func backupRunning(job *backupJob, locations []string) statusUpdate {
+	return func(status *providerconfigv1.LibvirtMachineProviderStatus) {
+		status.Conditions = setCondition(status.Conditions, providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.BackupCompleted,
+			Status:  corev1.ConditionFalse,
+			Reason:  "BackupRunning",
+			Message: fmt.Sprintf("backup %s stored %d of %d volumes", job.name, len(locations), job.total),
+		})
+		status.Backup = &providerconfigv1.LibvirtMachineBackupStatus{
+			Name:      job.name,
+			Phase:     providerconfigv1.BackupPhaseRunning,
+			Locations: locations,
+			StartTime: job.startTime,
+		}
+	}
+}
+
+// backupCompleted returns a status update recording a completed backup
+func backupCompleted(job *backupJob, locations []string) statusUpdate {
+	now := metav1.Now()
+	return func(status *providerconfigv1.LibvirtMachineProviderStatus) {
+		status.Conditions = setCondition(status.Conditions, providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.BackupCompleted,
+			Status:  corev1.ConditionTrue,
+			Reason:  "BackupCompleted",
+			Message: fmt.Sprintf("backup %s stored %d volumes", job.name, len(locations)),
+		})
+		status.Backup = &providerconfigv1.LibvirtMachineBackupStatus{
+			Name:           job.name,
+			Phase:          providerconfigv1.BackupPhaseCompleted,
+			Locations:      locations,
+			StartTime:      job.startTime,
+			CompletionTime: &now,
+		}
+	}
+}
+
+// backupFailed returns a status update recording a failed backup, which is
+// not retried
+func backupFailed(name string, startTime metav1.Time, locations []string, reason, message string) statusUpdate {
+	now := metav1.Now()
+	return func(status *providerconfigv1.LibvirtMachineProviderStatus) {
+		status.Conditions = setCondition(status.Conditions, providerconfigv1.LibvirtMachineProviderCondition{
+			Type:    providerconfigv1.BackupCompleted,
+			Status:  corev1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		})
+		status.Backup = &providerconfigv1.LibvirtMachineBackupStatus{
+			Name:           name,
+			Phase:          providerconfigv1.BackupPhaseFailed,
+			Locations:      locations,
+			StartTime:      startTime,
+			CompletionTime: &now,
+		}
+	}
+}
+
+// backupLocation returns the URL a volume of a backup is stored at,
+// <backup URL>/<machine name>/<backup name>/<volume name>
+func backupLocation(backupURL, machineName, backupName, volumeName string) (string, error) {
+	u, err := url.Parse(backupURL)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case u.Scheme == "file" && u.Host == "" && path.IsAbs(u.Path):
+	case u.Scheme == "s3" && u.Host != "":
+	default:
+		return "", fmt.Errorf("unsupported backup URL %q, expected a file:///path or s3://bucket/prefix URL", backupURL)
+	}
+	u.Path = path.Join("/", u.Path, machineName, backupName, volumeName)
+	return u.String(), nil
+}
@@ -0,0 +1,83 @@
+package machine
+
+import (
+	"github.com/golang/glog"
+
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
+
+	machinev1 "github.com/openshift/api/machine/v1beta1"
+	apierrors "github.com/openshift/machine-api-operator/pkg/controller/machine"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// snapshotAnnotation names a snapshot of the machine which is created if missing
+	snapshotAnnotation = "libvirt.openshift.io/snapshot"
+	// snapshotTypeAnnotation selects the type of the snapshots, internal
+	// snapshots by default or external ones
+	snapshotTypeAnnotation = "libvirt.openshift.io/snapshot-type"
+	// revertAnnotation names a snapshot the machine is reverted to, once for
+	// every time the annotation is set
+	revertAnnotation = "libvirt.openshift.io/revert"
+
+	snapshotTypeInternal = "internal"
+	snapshotTypeExternal = "external"
+)
+
+// applySnapshots creates and reverts to the snapshots requested by the
+// annotations of the machine and returns a status update listing the
+// snapshots of the domain
+func (a *Actuator) applySnapshots(machine *machinev1.Machine, client libvirtclient.Client) (statusUpdate, *apierrors.MachineError) {
+	status, err := ProviderStatusFromMachine(a.codec, machine)
+	if err != nil {
+		return nil, apierrors.UpdateMachine("error getting provider status: %v", err)
+	}
+	snapshots, err := client.ListSnapshots(machine.Name)
+	if err != nil {
+		return nil, apierrors.UpdateMachine("error listing snapshots: %v", err)
+	}
+
+	annotations := machine.GetAnnotations()
+	if name := annotations[snapshotAnnotation]; name != "" && !containsString(snapshots, name) {
+		var external bool
+		switch annotations[snapshotTypeAnnotation] {
+		case "", snapshotTypeInternal:
+		case snapshotTypeExternal:
+			external = true
+		default:
+			return nil, apierrors.InvalidMachineConfiguration("unsupported snapshot type %q", annotations[snapshotTypeAnnotation])
+		}
+		if err := client.CreateSnapshot(machine.Name, name, external); err != nil {
+			return nil, apierrors.UpdateMachine("error creating snapshot %s: %v", name, err)
+		}
+		a.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "SnapshotCreated", "Created snapshot %s of Machine %v", name, machine.Name)
+		snapshots = append(snapshots, name)
+	}
+
+	revertedSnapshot := annotations[revertAnnotation]
+	if revertedSnapshot != "" && revertedSnapshot != status.RevertedSnapshot {
+		if !containsString(snapshots, revertedSnapshot) {
+			return nil, apierrors.InvalidMachineConfiguration("snapshot %s does not exist", revertedSnapshot)
+		}
+		if err := client.RevertSnapshot(machine.Name, revertedSnapshot); err != nil {
+			return nil, apierrors.UpdateMachine("error reverting to snapshot %s: %v", revertedSnapshot, err)
+		}
+		glog.Infof("Reverted machine %s to snapshot %s", machine.Name, revertedSnapshot)
+		a.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "SnapshotReverted", "Reverted Machine %v to snapshot %s", machine.Name, revertedSnapshot)
+	}
+
+	return func(status *providerconfigv1.LibvirtMachineProviderStatus) {
+		status.Snapshots = snapshots
+		status.RevertedSnapshot = revertedSnapshot
+	}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
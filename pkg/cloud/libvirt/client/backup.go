@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	// s3AccessKeyIDKey and s3SecretAccessKeyKey are the keys of the
+	// credentials in object store secrets
+	s3AccessKeyIDKey     = "aws_access_key_id"
+	s3SecretAccessKeyKey = "aws_secret_access_key"
+)
+
+// backupVolumeName returns the name of the copy of a volume which is stored
+// by a backup
+func backupVolumeName(volumeName string) string {
+	return fmt.Sprintf("%v.backup", volumeName)
+}
+
+// newDefBackupVolume returns the definition of the copy of a volume stored by
+// a backup. The copy has no backing store, so qcow2 volumes are flattened and
+// the copy holds all data of the volume. Encrypted volumes are copied with the
+// encryption and secret of the volume, so their data stays encrypted.
+func newDefBackupVolume(volumeDef libvirtxml.StorageVolume) libvirtxml.StorageVolume {
+	copyDef := newDefVolume(backupVolumeName(volumeDef.Name))
+	copyDef.Capacity = volumeDef.Capacity
+	copyDef.Target.Format = nil
+	if volumeDef.Target != nil && volumeDef.Target.Format != nil {
+		copyDef.Target.Format = &libvirtxml.StorageVolumeTargetFormat{Type: volumeDef.Target.Format.Type}
+	}
+	if volumeDef.Target != nil && volumeDef.Target.Encryption != nil {
+		encryption := *volumeDef.Target.Encryption
+		copyDef.Target.Encryption = &encryption
+	}
+	return copyDef
+}
+
+// backupDestination is a file:///path or s3://bucket/key URL a volume is
+// stored at
+type backupDestination struct {
+	scheme string
+	// bucket of s3 destinations
+	bucket string
+	// path of the file or key of the object
+	path string
+}
+
+// parseBackupDestination returns the parts of a file:///path or
+// s3://bucket/key URL
+func parseBackupDestination(destination string) (backupDestination, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return backupDestination{}, fmt.Errorf("invalid destination %q: %v", destination, err)
+	}
+	switch {
+	case u.Scheme == "file" && u.Host == "" && filepath.IsAbs(u.Path) && filepath.Base(u.Path) != "/":
+		return backupDestination{scheme: u.Scheme, path: u.Path}, nil
+	case u.Scheme == "s3" && u.Host != "" && strings.TrimPrefix(u.Path, "/") != "":
+		return backupDestination{scheme: u.Scheme, bucket: u.Host, path: strings.TrimPrefix(u.Path, "/")}, nil
+	}
+	return backupDestination{}, fmt.Errorf("unsupported destination %q, expected a file:///path or s3://bucket/key URL", destination)
+}
+
+// writeFile stores the content of the reader in a file. The content is
+// written to a .part file next to it which is renamed once it is complete, so
+// the file only appears once it is complete.
+func writeFile(ctx context.Context, path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path + ".part")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, &contextReader{ctx: ctx, r: r}); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// contextReader stops reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// activeDiskFile returns the file a domain writes the content of a volume to.
+// External snapshots freeze the volume and put overlays on top of it, so this
+// is the current file of the disk which had the volume as file when the first
+// external snapshot was taken, or the file of the volume itself.
+func activeDiskFile(domainDef libvirtxml.Domain, snapshotDefs []libvirtxml.DomainSnapshot, path string) string {
+	if domainDef.Devices == nil {
+		return path
+	}
+	for _, snapshotDef := range snapshotDefs {
+		states, err := externalSnapshotStates(snapshotDef)
+		if err != nil {
+			continue
+		}
+		for dev, state := range states {
+			if state != path {
+				continue
+			}
+			for _, disk := range domainDef.Devices.Disks {
+				if disk.Target != nil && disk.Target.Dev == dev && disk.Source != nil && disk.Source.File != nil {
+					return disk.Source.File.File
+				}
+			}
+		}
+	}
+	return path
+}
+
+// copyVolumesForBackup copies the volumes of a backup in their pools. The
+// volumes of a domain with external snapshots are copied from the overlays
+// the domain writes to. A running domain is only paused while its volumes are
+// copied if pause is set, so the copies are consistent with each other like
+// the disks of a crashed machine; otherwise every copy is taken while the
+// domain keeps writing. The caller is responsible for deleting and freeing the
+// copies, also on errors.
+func (client *libvirtClient) copyVolumesForBackup(domainName string, volumes []BackupVolume, pause bool) ([]*libvirt.StorageVol, error) {
+	var domainDef libvirtxml.Domain
+	var snapshotDefs []libvirtxml.DomainSnapshot
+	domain, err := client.connection.LookupDomainByName(domainName)
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); !ok || virErr.Code != libvirt.ERR_NO_DOMAIN {
+			return nil, fmt.Errorf("Error looking up domain %s: %v", domainName, err)
+		}
+	} else {
+		defer domain.Free()
+		if domainDef, err = newDefDomainFromLibvirt(domain); err != nil {
+			return nil, err
+		}
+		if snapshotDefs, err = listSnapshotDefs(domain); err != nil {
+			return nil, err
+		}
+		state, _, err := domain.GetState()
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving state of domain %s: %v", domainName, err)
+		}
+		if pause && state == libvirt.DOMAIN_RUNNING {
+			glog.Infof("Pausing domain %s to copy its volumes", domainName)
+			if err := domain.Suspend(); err != nil {
+				return nil, fmt.Errorf("Can't pause domain %s: %v", domainName, err)
+			}
+			defer func() {
+				glog.Infof("Resuming domain %s", domainName)
+				if err := domain.Resume(); err != nil {
+					glog.Errorf("Can't resume domain %s: %v", domainName, err)
+				}
+			}()
+		}
+	}
+
+	var copies []*libvirt.StorageVol
+	for _, volume := range volumes {
+		volumeCopy, err := client.copyVolumeForBackup(volume, domainDef, snapshotDefs)
+		if err != nil {
+			return copies, err
+		}
+		copies = append(copies, volumeCopy)
+	}
+	return copies, nil
+}
+
+// copyVolumeForBackup creates the flattened copy of a volume next to it,
+// replacing a copy left behind by an earlier backup
+func (client *libvirtClient) copyVolumeForBackup(volume BackupVolume, domainDef libvirtxml.Domain, snapshotDefs []libvirtxml.DomainSnapshot) (*libvirt.StorageVol, error) {
+	original, err := client.getVolume(volume.PoolName, volume.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Free()
+
+	path, err := original.GetPath()
+	if err != nil {
+		return nil, fmt.Errorf("Can't retrieve path of volume %s: %v", volume.VolumeName, err)
+	}
+	if active := activeDiskFile(domainDef, snapshotDefs, path); active != path {
+		overlay, err := client.lookupVolumeByPath(active)
+		if err != nil {
+			return nil, fmt.Errorf("Can't retrieve overlay %s of volume %s: %v", active, volume.VolumeName, err)
+		}
+		defer overlay.Free()
+		glog.Infof("Backing up volume %s from its overlay %s", volume.VolumeName, active)
+		original = overlay
+	}
+
+	volumeDef, err := newDefVolumeFromLibvirt(original)
+	if err != nil {
+		return nil, err
+	}
+	// the copy is named after the volume, not after its overlay
+	volumeDef.Name = volume.VolumeName
+	copyDef := newDefBackupVolume(volumeDef)
+	copyDefXML, err := xml.Marshal(copyDef)
+	if err != nil {
+		return nil, fmt.Errorf("Error serializing libvirt volume: %v", err)
+	}
+
+	pool, err := original.LookupPoolByVolume()
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving pool of volume %s: %v", volume.VolumeName, err)
+	}
+	defer pool.Free()
+	if stale, err := pool.LookupStorageVolByName(copyDef.Name); err == nil {
+		glog.Infof("Deleting stale backup volume %s", copyDef.Name)
+		err := stale.Delete(0)
+		stale.Free()
+		if err != nil {
+			return nil, fmt.Errorf("Can't delete stale backup volume %s: %v", copyDef.Name, err)
+		}
+	}
+
+	glog.Infof("Copying volume %s to %s", volume.VolumeName, copyDef.Name)
+	volumeCopy, err := pool.StorageVolCreateXMLFrom(string(copyDefXML), original, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error copying volume %s: %v", volume.VolumeName, err)
+	}
+	return volumeCopy, nil
+}
+
+// storeVolume streams the content of a volume to a file or an object store
+func (client *libvirtClient) storeVolume(ctx context.Context, volume *libvirt.StorageVol, destination string, uploader *s3Uploader) error {
+	name, err := volume.GetName()
+	if err != nil {
+		return fmt.Errorf("Error retrieving volume name: %v", err)
+	}
+	location, err := parseBackupDestination(destination)
+	if err != nil {
+		return err
+	}
+
+	stream, err := client.connection.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	glog.Infof("Storing volume %s at %s", name, destination)
+	if err := volume.Download(stream, 0, 0, 0); err != nil {
+		return fmt.Errorf("Error downloading volume %s: %v", name, err)
+	}
+
+	sio := newStreamIO(*stream)
+	counter := &countingReader{r: sio}
+	if location.scheme == "file" {
+		err = writeFile(ctx, location.path, counter)
+	} else {
+		err = uploader.upload(ctx, location.bucket, location.path, counter)
+	}
+	if err != nil {
+		stream.Abort()
+		return fmt.Errorf("Error storing volume %s: %v", name, err)
+	}
+	if err := sio.Close(); err != nil {
+		return fmt.Errorf("Error finishing download of volume %s: %v", name, err)
+	}
+	glog.Infof("%d bytes of volume %s stored at %s", counter.n, name, destination)
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BackupVolumes copies the volumes of a domain and stores the copies in files
+// or an S3 compatible object store
+func (client *libvirtClient) BackupVolumes(ctx context.Context, input BackupVolumesInput) error {
+	var uploader *s3Uploader
+	for _, volume := range input.Volumes {
+		location, err := parseBackupDestination(volume.Destination)
+		if err != nil {
+			return err
+		}
+		if location.scheme != "s3" || uploader != nil {
+			continue
+		}
+		var accessKeyID, secretAccessKey []byte
+		if input.CredentialsSecret != "" {
+			if accessKeyID, err = getSecretData(ctx, input.KubeClient, input.MachineNamespace, input.CredentialsSecret, s3AccessKeyIDKey); err != nil {
+				return err
+			}
+			if secretAccessKey, err = getSecretData(ctx, input.KubeClient, input.MachineNamespace, input.CredentialsSecret, s3SecretAccessKeyKey); err != nil {
+				return err
+			}
+		}
+		s3, err := newS3Uploader(input.Endpoint, input.Region, string(accessKeyID), string(secretAccessKey))
+		if err != nil {
+			return err
+		}
+		uploader = &s3
+	}
+
+	copies, err := client.copyVolumesForBackup(input.DomainName, input.Volumes, input.PauseDomain)
+	defer func() {
+		for _, volumeCopy := range copies {
+			if err := volumeCopy.Delete(0); err != nil {
+				glog.Errorf("Can't delete backup volume: %v", err)
+			}
+			volumeCopy.Free()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	for i, volume := range input.Volumes {
+		if err := client.storeVolume(ctx, copies[i], volume.Destination, uploader); err != nil {
+			return err
+		}
+		if input.Progress != nil {
+			input.Progress(volume)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestNewDefBackupVolume(t *testing.T) {
+	volumeDef := newDefVolume("worker")
+	volumeDef.Capacity = &libvirtxml.StorageVolumeSize{Unit: "bytes", Value: 10 << 30}
+	volumeDef.BackingStore = &libvirtxml.StorageVolumeBackingStore{
+		Path:   "/var/lib/libvirt/images/base-rhcos",
+		Format: &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+	}
+
+	copyDef := newDefBackupVolume(volumeDef)
+	if copyDef.Name != "worker.backup" {
+		t.Errorf("expected name worker.backup, got %s", copyDef.Name)
+	}
+	if copyDef.BackingStore != nil {
+		t.Errorf("expected a flattened copy, got backing store %+v", copyDef.BackingStore)
+	}
+	if copyDef.Target.Format == nil || copyDef.Target.Format.Type != "qcow2" {
+		t.Errorf("expected qcow2 format, got %+v", copyDef.Target.Format)
+	}
+	if copyDef.Capacity == nil || copyDef.Capacity.Value != 10<<30 {
+		t.Errorf("expected capacity of the volume, got %+v", copyDef.Capacity)
+	}
+
+	rawDef := newDefVolume("worker_data")
+	rawDef.Target.Format = nil
+	copyDef = newDefBackupVolume(rawDef)
+	if copyDef.Target.Format != nil {
+		t.Errorf("expected copy without format, got %+v", copyDef.Target.Format)
+	}
+
+	encryptedDef := newDefVolume("worker")
+	encryptedDef.Target.Encryption = newDefVolumeEncryption("3e2f8b34-0c8b-4c56-9c5e-4a1f2d3b6e7a")
+	copyDef = newDefBackupVolume(encryptedDef)
+	if copyDef.Target.Encryption == nil || copyDef.Target.Encryption.Secret == nil || copyDef.Target.Encryption.Secret.UUID != "3e2f8b34-0c8b-4c56-9c5e-4a1f2d3b6e7a" {
+		t.Errorf("expected copy encrypted with the secret of the volume, got %+v", copyDef.Target.Encryption)
+	}
+}
+
+func TestParseBackupDestination(t *testing.T) {
+	cases := []struct {
+		destination string
+		expected    backupDestination
+		expectError bool
+	}{
+		{
+			destination: "s3://backups/cluster/worker/crash/worker",
+			expected:    backupDestination{scheme: "s3", bucket: "backups", path: "cluster/worker/crash/worker"},
+		},
+		{
+			destination: "file:///var/lib/backups/worker/crash/worker",
+			expected:    backupDestination{scheme: "file", path: "/var/lib/backups/worker/crash/worker"},
+		},
+		{
+			destination: "s3://backups",
+			expectError: true,
+		},
+		{
+			destination: "s3:///worker",
+			expectError: true,
+		},
+		{
+			destination: "file://backups/worker",
+			expectError: true,
+		},
+		{
+			destination: "file:///",
+			expectError: true,
+		},
+		{
+			destination: "ftp://backups/worker",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.destination, func(t *testing.T) {
+			location, err := parseBackupDestination(tc.destination)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %+v", location)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if location != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, location)
+			}
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "worker", "crash", "worker")
+	if err := writeFile(context.TODO(), path, bytes.NewReader([]byte("volume"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != "volume" {
+		t.Errorf("expected volume content, got %q, %v", content, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	canceled := filepath.Join(dir, "worker", "crash", "worker_data")
+	if err := writeFile(ctx, canceled, bytes.NewReader([]byte("volume"))); err == nil {
+		t.Errorf("expected error for canceled write")
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the completed file, got %v, %v", entries, err)
+	}
+}
+
+func TestActiveDiskFile(t *testing.T) {
+	domainDef := libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+		fileDisk("vda", "/pool/worker.vda.configured.overlay"),
+		fileDisk("vdb", "/pool/worker_data"),
+	}}}
+	snapshotDefs := []libvirtxml.DomainSnapshot{
+		{
+			Name:  "installed",
+			Disks: &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{{Name: "vda", Snapshot: "external"}}},
+			Domain: &libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+				fileDisk("vda", "/pool/worker"),
+			}}},
+		},
+		{
+			Name:  "configured",
+			Disks: &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{{Name: "vda", Snapshot: "external"}}},
+			Domain: &libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+				fileDisk("vda", "/pool/worker.vda.installed.overlay"),
+			}}},
+		},
+	}
+
+	if active := activeDiskFile(domainDef, snapshotDefs, "/pool/worker"); active != "/pool/worker.vda.configured.overlay" {
+		t.Errorf("expected the overlay of the root volume, got %s", active)
+	}
+	if active := activeDiskFile(domainDef, snapshotDefs, "/pool/worker_data"); active != "/pool/worker_data" {
+		t.Errorf("expected the data volume itself, got %s", active)
+	}
+	if active := activeDiskFile(domainDef, nil, "/pool/worker"); active != "/pool/worker" {
+		t.Errorf("expected the root volume without snapshots, got %s", active)
+	}
+}
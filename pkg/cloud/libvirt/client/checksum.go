@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	checksumSHA256 = "sha256"
+	checksumSHA512 = "sha512"
+
+	// maxChecksumFileSize limits how much of a checksum file is read
+	maxChecksumFileSize = 1 << 20
+)
+
+type checksum struct {
+	algorithm string
+	digest    []byte
+}
+
+// newChecksum parses the expected checksum of an image. The spec is either a
+// digest, optionally prefixed with its algorithm ("sha256:<hex>"), or the URL
+// of a checksum file in the format written by sha256sum and sha512sum.
+func newChecksum(spec string, img image) (*checksum, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	if strings.Contains(spec, "://") {
+		src, err := newImage(spec, nil)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		readChecksumFile := func(r io.Reader) error {
+			data, err = io.ReadAll(io.LimitReader(r, maxChecksumFileSize))
+			return err
+		}
+		if err := src.importImage(readChecksumFile, libvirtxml.StorageVolume{Target: &libvirtxml.StorageVolumeTarget{}}); err != nil {
+			return nil, fmt.Errorf("error reading checksum file %s: %v", spec, err)
+		}
+		digest, err := digestFromChecksumFile(data, path.Base(img.string()))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing checksum file %s: %v", spec, err)
+		}
+		spec = digest
+	}
+
+	algorithm := ""
+	digest := spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		algorithm = strings.ToLower(spec[:i])
+		digest = spec[i+1:]
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum %q: %v", spec, err)
+	}
+
+	// infer the algorithm from the digest length
+	if algorithm == "" {
+		switch len(decoded) {
+		case sha256.Size:
+			algorithm = checksumSHA256
+		case sha512.Size:
+			algorithm = checksumSHA512
+		}
+	}
+
+	c := &checksum{algorithm: algorithm, digest: decoded}
+	h, err := c.newHash()
+	if err != nil {
+		return nil, err
+	}
+	if h.Size() != len(decoded) {
+		return nil, fmt.Errorf("invalid %s checksum %q: expected %d bytes, got %d", algorithm, spec, h.Size(), len(decoded))
+	}
+	return c, nil
+}
+
+// digestFromChecksumFile returns the digest of the file from a checksum file.
+// A checksum file with a single digest and no file names is accepted as well.
+func digestFromChecksumFile(data []byte, fileName string) (string, error) {
+	var digests []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			digests = append(digests, fields[0])
+		default:
+			if strings.TrimPrefix(fields[1], "*") == fileName {
+				return fields[0], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if len(digests) == 1 {
+		return digests[0], nil
+	}
+	return "", fmt.Errorf("no checksum found for %s", fileName)
+}
+
+func (c *checksum) newHash() (hash.Hash, error) {
+	switch c.algorithm {
+	case checksumSHA256:
+		return sha256.New(), nil
+	case checksumSHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", c.algorithm)
+	}
+}
+
+// verify wraps an image copier so that it fails, before the upload is
+// finished, when the copied content does not match the checksum
+func (c *checksum) verify(copier func(io.Reader) error) func(io.Reader) error {
+	return func(src io.Reader) error {
+		h, err := c.newHash()
+		if err != nil {
+			return err
+		}
+		return copier(&verifyingReader{reader: src, hash: h, checksum: c})
+	}
+}
+
+// verifyingReader hashes everything read and returns an error instead of
+// io.EOF when the content does not match the checksum
+type verifyingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	checksum *checksum
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := r.hash.Sum(nil); !bytes.Equal(sum, r.checksum.digest) {
+			return n, &checksumMismatchError{checksum: r.checksum, sum: sum}
+		}
+	}
+	return n, err
+}
+
+// checksumMismatchError is returned when image content does not match its checksum
+type checksumMismatchError struct {
+	checksum *checksum
+	sum      []byte
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %x, got %x", e.checksum.algorithm, e.checksum.digest, e.sum)
+}
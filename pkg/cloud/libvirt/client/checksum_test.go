@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewChecksum(t *testing.T) {
+	content := []byte("image")
+	sha256Digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	sha512Digest := fmt.Sprintf("%x", sha512.Sum512(content))
+
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "image.qcow2")
+	if err := os.WriteFile(imagePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksumFile := filepath.Join(dir, "sha256sum.txt")
+	checksumFileContent := fmt.Sprintf("%064x  other.qcow2\n%s *image.qcow2\n", 0, sha256Digest)
+	if err := os.WriteFile(checksumFile, []byte(checksumFileContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := &localImage{path: imagePath}
+
+	cases := []struct {
+		name              string
+		spec              string
+		expectedAlgorithm string
+		expectError       bool
+	}{
+		{
+			name:              "sha256 digest",
+			spec:              sha256Digest,
+			expectedAlgorithm: checksumSHA256,
+		},
+		{
+			name:              "sha512 digest with prefix",
+			spec:              "sha512:" + sha512Digest,
+			expectedAlgorithm: checksumSHA512,
+		},
+		{
+			name:              "checksum file",
+			spec:              "file://" + checksumFile,
+			expectedAlgorithm: checksumSHA256,
+		},
+		{
+			name:        "algorithm does not match digest",
+			spec:        "sha512:" + sha256Digest,
+			expectError: true,
+		},
+		{
+			name:        "unsupported algorithm",
+			spec:        "md5:" + sha256Digest,
+			expectError: true,
+		},
+		{
+			name:        "invalid digest",
+			spec:        "sha256:not-hex",
+			expectError: true,
+		},
+		{
+			name:        "missing checksum file",
+			spec:        "file://" + filepath.Join(dir, "missing.txt"),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sum, err := newChecksum(tc.spec, img)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if sum.algorithm != tc.expectedAlgorithm {
+				t.Errorf("expected algorithm %q, got %q", tc.expectedAlgorithm, sum.algorithm)
+			}
+		})
+	}
+
+	if sum, err := newChecksum("", img); sum != nil || err != nil {
+		t.Errorf("expected no checksum, got %v, %v", sum, err)
+	}
+}
+
+func TestDigestFromChecksumFile(t *testing.T) {
+	if digest, err := digestFromChecksumFile([]byte("abc\n"), "image.qcow2"); err != nil || digest != "abc" {
+		t.Errorf("expected single digest, got %q, %v", digest, err)
+	}
+	if digest, err := digestFromChecksumFile([]byte("abc  other.qcow2\ndef  image.qcow2\n"), "image.qcow2"); err != nil || digest != "def" {
+		t.Errorf("expected digest of image.qcow2, got %q, %v", digest, err)
+	}
+	if _, err := digestFromChecksumFile([]byte("abc  other.qcow2\n"), "image.qcow2"); err == nil {
+		t.Errorf("expected error for missing file name")
+	}
+}
+
+func TestChecksumVerify(t *testing.T) {
+	content := []byte("image")
+	digest := sha256.Sum256(content)
+	sum := &checksum{algorithm: checksumSHA256, digest: digest[:]}
+
+	var copied bytes.Buffer
+	copier := sum.verify(func(src io.Reader) error {
+		_, err := io.Copy(&copied, src)
+		return err
+	})
+
+	if err := copier(bytes.NewReader(content)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(copied.Bytes(), content) {
+		t.Errorf("expected %q to be copied, got %q", content, copied.Bytes())
+	}
+
+	err := copier(bytes.NewReader([]byte("truncated")))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
@@ -2,14 +2,16 @@ package client
 
 import (
 	"context"
-	"encoding/xml"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	libvirt "github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 )
@@ -33,6 +35,12 @@ type CreateDomainInput struct {
 	// VolumeName of volume to be added to domain definition
 	VolumeName string
 
+	// VolumePoolName as storage pool of the volume, the default pool if empty
+	VolumePoolName string
+
+	// AdditionalDisks as further volumes added to the domain definition
+	AdditionalDisks []DiskInput
+
 	// CloudInitVolumeName of cloud init volume to be added to domain definition
 	CloudInitVolumeName string
 
@@ -45,9 +53,15 @@ type CreateDomainInput struct {
 	// NetworkInterfaceAddress as address of network interface
 	NetworkInterfaceAddress string
 
+	// NetworkInterfaceConfig as configuration of the network interface in the guest
+	NetworkInterfaceConfig *providerconfigv1.NetworkInterfaceConfig
+
 	// HostName as network interface hostname
 	HostName string
 
+	// HostAliases as additional DNS names of the network interface
+	HostAliases []string
+
 	// AddressRange as IP subnet address range
 	ReservedLeases *Leases
 
@@ -67,22 +81,190 @@ type CreateDomainInput struct {
 	MachineNamespace string
 }
 
+// DiskInput specifies a volume or network block device attached to a domain as disk
+type DiskInput struct {
+	// VolumeName of the volume
+	VolumeName string
+
+	// PoolName as storage pool of the volume, the default pool if empty
+	PoolName string
+
+	// Network as source of a network disk, used instead of a volume
+	Network *providerconfigv1.NetworkDiskSource
+}
+
 // CreateVolumeInput specifies input parameters for CreateVolume operation
 type CreateVolumeInput struct {
 	// VolumeName to be created
 	VolumeName string
 
+	// PoolName as storage pool of the volume, the default pool if empty
+	PoolName string
+
 	// BaseVolumeName as name of the base volume
 	BaseVolumeName string
 
+	// BaseVolumePoolName as storage pool of the base volume, the default pool if empty
+	BaseVolumePoolName string
+
 	// Source as location of base volume
 	Source string
 
+	// SourceChecksum as digest or checksum file URL the source is verified against
+	SourceChecksum string
+
+	// SourcePullSecret as .dockerconfigjson content with credentials for registry sources
+	SourcePullSecret []byte
+
 	// VolumeFormat as volume format
 	VolumeFormat string
 
 	// VolumeSize contains the size of the volume
 	VolumeSize *resource.Quantity
+
+	// CloneMode as the way the volume is created from the base volume
+	CloneMode providerconfigv1.VolumeCloneMode
+
+	// Preallocation as preallocation mode of the volume (none, metadata or full)
+	Preallocation string
+
+	// LazyRefcounts enables lazy refcounts of qcow2 volumes
+	LazyRefcounts bool
+
+	// ClusterSize as cluster size of qcow2 volumes in bytes
+	ClusterSize uint64
+
+	// EncryptionSecretUUID as UUID of the libvirt secret with the LUKS passphrase
+	EncryptionSecretUUID string
+}
+
+// VolumeSecretInput specifies input parameters for EnsureVolumeSecret operation
+type VolumeSecretInput struct {
+	// VolumeName of the encrypted volume
+	VolumeName string
+
+	// PoolName as storage pool of the volume, the default pool if empty
+	PoolName string
+
+	// SecretName as name of a secret with the passphrase
+	SecretName string
+
+	// KubeClient as kubernetes client
+	KubeClient kubernetes.Interface
+
+	// MachineNamespace with machine object
+	MachineNamespace string
+}
+
+// BackupVolumesInput specifies input parameters for BackupVolumes operation
+type BackupVolumesInput struct {
+	// DomainName of the domain using the volumes
+	DomainName string
+
+	// PauseDomain pauses the domain while its volumes are copied
+	PauseDomain bool
+
+	// Volumes to back up
+	Volumes []BackupVolume
+
+	// Endpoint as URL of the S3 compatible object store, AWS S3 if empty
+	Endpoint string
+
+	// Region as region of the S3 bucket
+	Region string
+
+	// CredentialsSecret as name of a secret with the access keys of the object store
+	CredentialsSecret string
+
+	// KubeClient as kubernetes client
+	KubeClient kubernetes.Interface
+
+	// MachineNamespace with machine object
+	MachineNamespace string
+
+	// Progress is called for every volume once it is stored
+	Progress func(BackupVolume)
+}
+
+// BackupVolume is a volume of a backup
+type BackupVolume struct {
+	// VolumeName of the volume to back up
+	VolumeName string
+
+	// PoolName as storage pool of the volume, the default pool if empty
+	PoolName string
+
+	// Destination as file:///path or s3://bucket/key URL the volume is stored at
+	Destination string
+}
+
+// BaseVolumeInput specifies input parameters for EnsureBaseVolume operation
+type BaseVolumeInput struct {
+	// Source as location of the image
+	Source string
+
+	// PoolName as storage pool of the base volume, the default pool if empty
+	PoolName string
+
+	// SourceChecksum as digest or checksum file URL the source is verified against
+	SourceChecksum string
+
+	// PullSecret as name of a kubernetes.io/dockerconfigjson secret for registry sources
+	PullSecret string
+
+	// KubeClient as kubernetes client
+	KubeClient kubernetes.Interface
+
+	// MachineNamespace with machine object
+	MachineNamespace string
+}
+
+// CreateNetworkInput specifies input parameters for CreateOrUpdateNetwork operation
+type CreateNetworkInput struct {
+	// Name of the network
+	Name string
+
+	// Bridge as name of the host bridge device
+	Bridge string
+
+	// CIDRs as address ranges of the network
+	CIDRs []string
+
+	// ForwardMode as network forward mode (nat, route, bridge or none)
+	ForwardMode string
+
+	// DNSDomain as domain of the network DNS server
+	DNSDomain string
+
+	// DHCPRangeStart as first address leased by DHCP
+	DHCPRangeStart string
+
+	// DHCPRangeEnd as last address leased by DHCP
+	DHCPRangeEnd string
+}
+
+// CreateStoragePoolInput specifies input parameters for EnsureStoragePool operation
+type CreateStoragePoolInput struct {
+	// Name of the storage pool
+	Name string
+
+	// Path as pool directory on the libvirt host
+	Path string
+
+	// Permissions as octal mode of the pool directory
+	Permissions string
+
+	// Owner as user ID of the pool directory
+	Owner string
+
+	// Group as group ID of the pool directory
+	Group string
+
+	// Autostart as pool autostart
+	Autostart bool
+
+	// MinimumAvailable as bytes the pool must have available
+	MinimumAvailable uint64
 }
 
 // LibvirtClientBuilderFuncType is function type for building aws client
@@ -96,7 +278,7 @@ type Client interface {
 	// CreateDomain creates domain based on CreateDomainInput
 	CreateDomain(context.Context, CreateDomainInput) error
 
-	// DeleteDomain deletes a domain
+	// DeleteDomain deletes a domain together with its snapshots
 	DeleteDomain(name string) error
 
 	// DomainExists checks if domain exists
@@ -105,28 +287,66 @@ type Client interface {
 	// LookupDomainByName looks up a domain based on its name
 	LookupDomainByName(name string) (*libvirt.Domain, error)
 
+	// CreateSnapshot creates an internal or external snapshot of a domain
+	CreateSnapshot(domainName string, snapshotName string, external bool) error
+
+	// RevertSnapshot reverts a domain to an internal or external snapshot
+	// and leaves it running
+	RevertSnapshot(domainName string, snapshotName string) error
+
+	// ListSnapshots returns the names of the snapshots of a domain, parents first
+	ListSnapshots(domainName string) ([]string, error)
+
 	// CreateVolume creates volume based on CreateVolumeInput
 	CreateVolume(CreateVolumeInput) error
 
-	// VolumeExists checks if volume exists
-	VolumeExists(name string) (bool, error)
+	// VolumeExists checks if volume exists in a pool, the default pool if empty
+	VolumeExists(poolName string, name string) (bool, error)
+
+	// DeleteVolume deletes a volume of a pool based on its name, unless other volumes are backed by it
+	DeleteVolume(poolName string, name string) error
+
+	// EnsureVolumeSecret registers the passphrase of an encrypted volume as libvirt secret and returns its UUID
+	EnsureVolumeSecret(context.Context, VolumeSecretInput) (string, error)
+
+	// ResizeVolume grows a volume, through the domain if it is running, and returns whether it was resized
+	ResizeVolume(domainName string, poolName string, volumeName string, size uint64) (bool, error)
+
+	// EnsureBaseVolume imports an image into a shared base volume if missing and returns the volume name.
+	// It returns a RetryError while the image is imported for another machine or its download is retried.
+	EnsureBaseVolume(context.Context, BaseVolumeInput) (string, error)
 
-	// DeleteVolume deletes a domain based on its name
-	DeleteVolume(name string) error
+	// BackupVolumes stores flattened copies of the volumes of a domain in files or an S3 compatible object store
+	BackupVolumes(context.Context, BackupVolumesInput) error
 
 	// GetDHCPLeasesByNetwork get all network DHCP leases by network name
 	GetDHCPLeasesByNetwork(networkName string) ([]libvirt.NetworkDHCPLease, error)
 
 	// LookupDomainHostnameByDHCPLease looks up a domain hostname based on its DHCP lease
 	LookupDomainHostnameByDHCPLease(domIPAddress string, networkName string) (string, error)
+
+	// DeleteDNSHost deletes all network DNS host records which contain the hostname
+	DeleteDNSHost(networkName string, hostname string) error
+
+	// LookupNetworkNameByUUID looks up a network name based on its UUID
+	LookupNetworkNameByUUID(uuid string) (string, error)
+
+	// CreateOrUpdateNetwork creates or updates a network and returns its UUID and
+	// whether changes to the running network wait for a restart of the network
+	CreateOrUpdateNetwork(CreateNetworkInput) (string, bool, error)
+
+	// DeleteNetwork deletes a network
+	DeleteNetwork(name string) error
+
+	// EnsureStoragePool creates a storage pool if missing, validates it and returns its UUID
+	EnsureStoragePool(CreateStoragePoolInput) (string, error)
 }
 
 type libvirtClient struct {
 	connection *libvirt.Connect
 
-	// storage pool that holds all volumes
-	pool *libvirt.StoragePool
-	// cache pool's name so we don't have to call failable GetName() method on pool all the time.
+	// name of the storage pool used for volumes which do not name their own
+	// pool. Pools are looked up and freed for every operation.
 	poolName string
 }
 
@@ -141,26 +361,41 @@ func NewClient(URI string, poolName string) (Client, error) {
 
 	glog.Infof("Created libvirt connection: %p", connection)
 
-	pool, err := connection.LookupStoragePoolByName(poolName)
-	if err != nil {
-		return nil, fmt.Errorf("can't find storage pool %q: %v", poolName, err)
-	}
-
-	return &libvirtClient{
+	client := &libvirtClient{
 		connection: connection,
-		pool:       pool,
 		poolName:   poolName,
-	}, nil
+	}
+
+	// clients which only manage networks do not need a storage pool
+	if poolName != "" {
+		pool, err := client.lookupPool(poolName)
+		if err != nil {
+			return nil, err
+		}
+		pool.Free()
+	}
+
+	return client, nil
 }
 
-// Close closes the client's libvirt connection.
-func (client *libvirtClient) Close() error {
-	glog.Infof("Freeing the client pool")
-	err := client.pool.Free()
+// lookupPool looks up a storage pool by name, or the default pool of the
+// client if the name is empty. The caller is responsible for freeing it.
+func (client *libvirtClient) lookupPool(poolName string) (*libvirt.StoragePool, error) {
+	if poolName == "" {
+		poolName = client.poolName
+	}
+	if poolName == "" {
+		return nil, fmt.Errorf("no storage pool given")
+	}
+	pool, err := client.connection.LookupStoragePoolByName(poolName)
 	if err != nil {
-		glog.Infof("Error freeing the client pool: %v", err)
+		return nil, fmt.Errorf("can't find storage pool %q: %v", poolName, err)
 	}
+	return pool, nil
+}
 
+// Close closes the client's libvirt connection.
+func (client *libvirtClient) Close() error {
 	glog.Infof("Closing libvirt connection: %p", client.connection)
 	remainingRefs, err := client.connection.Close()
 	if err != nil {
@@ -197,23 +432,69 @@ func (client *libvirtClient) CreateDomain(ctx context.Context, input CreateDomai
 	}
 
 	glog.Info("Create volume")
-	diskVolume, err := client.getVolume(input.VolumeName)
-	if err != nil {
-		return fmt.Errorf("can't retrieve volume %s for pool %s: %v", input.VolumeName, client.poolName, err)
+	var diskVolumes []*libvirt.StorageVol
+	defer func() {
+		for _, diskVolume := range diskVolumes {
+			diskVolume.Free()
+		}
+	}()
+	// secrets of network disks must not be deleted before the domain
+	// referencing them is defined
+	networkDiskSecretsLock.RLock()
+	defer networkDiskSecretsLock.RUnlock()
+	// disks are added in the given order, so the root volume is the boot disk
+	for _, disk := range append([]DiskInput{{VolumeName: input.VolumeName, PoolName: input.VolumePoolName}}, input.AdditionalDisks...) {
+		if disk.Network != nil {
+			if err := client.setNetworkDisk(ctx, &domainDef, disk.Network, input.KubeClient, input.MachineNamespace); err != nil {
+				return fmt.Errorf("Failed to set network disk: %v", err)
+			}
+			continue
+		}
+		diskVolume, err := client.getVolume(disk.PoolName, disk.VolumeName)
+		if err != nil {
+			return fmt.Errorf("can't retrieve volume %s: %v", disk.VolumeName, err)
+		}
+		diskVolumes = append(diskVolumes, diskVolume)
+		if err := setDisk(&domainDef, diskVolume); err != nil {
+			return fmt.Errorf("Failed to setDisk: %s", err)
+		}
+	}
+
+	hostName := input.HostName
+	if hostName == "" {
+		hostName = input.DomainName
 	}
-	defer diskVolume.Free()
-	if err := setDisks(&domainDef, diskVolume); err != nil {
-		return fmt.Errorf("Failed to setDisks: %s", err)
+
+	glog.Info("Set up network interface")
+	var waitForLeases []*libvirtxml.DomainInterface
+	// TODO: support more than 1 interface
+	partialNetIfaces := make(map[string]*pendingMapping, 1)
+	if err := setNetworkInterfaces(
+		&domainDef,
+		client.connection,
+		partialNetIfaces,
+		&waitForLeases,
+		hostName,
+		input.HostAliases,
+		input.NetworkInterfaceName,
+		input.NetworkInterfaceAddress,
+		input.ReservedLeases,
+		networkInterfaceMTU(input.NetworkInterfaceConfig),
+	); err != nil {
+		return err
 	}
+	// the cloud init network-config matches the interface by its MAC address
+	mac := domainDef.Devices.Interfaces[0].MAC.Address
 
 	glog.Info("Create ignition configuration")
+	var fwCfg []domainSysInfoFWCfgEntry
 
 	if input.Ignition != nil {
-		if err := setIgnition(ctx, &domainDef, client, input.Ignition, input.KubeClient, input.MachineNamespace, input.IgnitionVolumeName, arch); err != nil {
+		if err := setIgnition(ctx, &domainDef, &fwCfg, client, input.Ignition, input.KubeClient, input.MachineNamespace, input.IgnitionVolumeName, hostName, arch); err != nil {
 			return err
 		}
 	} else if input.IgnKey != "" {
-		ignVolume, err := client.getVolume(input.IgnKey)
+		ignVolume, err := client.getVolume("", input.IgnKey)
 		if err != nil {
 			return fmt.Errorf("error getting ignition volume: %v", err)
 		}
@@ -223,38 +504,17 @@ func (client *libvirtClient) CreateDomain(ctx context.Context, input CreateDomai
 			return fmt.Errorf("error getting ignition volume path: %v", err)
 		}
 
-		if err := setCoreOSIgnition(&domainDef, ignVolumePath, arch); err != nil {
+		if err := setCoreOSIgnition(&domainDef, &fwCfg, ignVolumePath, arch, ""); err != nil {
 			return err
 		}
 	} else if input.CloudInit != nil {
-		if err := setCloudInit(ctx, &domainDef, client, input.CloudInit, input.KubeClient, input.MachineNamespace, input.CloudInitVolumeName, input.DomainName); err != nil {
+		if err := setCloudInit(ctx, &domainDef, client, input.CloudInit, input.NetworkInterfaceConfig, input.KubeClient, input.MachineNamespace, input.CloudInitVolumeName, input.DomainName, hostName, mac); err != nil {
 			return err
 		}
 	} else {
 		return fmt.Errorf("machine does not has a IgnKey nor CloudInit value")
 	}
 
-	glog.Info("Set up network interface")
-	var waitForLeases []*libvirtxml.DomainInterface
-	hostName := input.HostName
-	if hostName == "" {
-		hostName = input.DomainName
-	}
-	// TODO: support more than 1 interface
-	partialNetIfaces := make(map[string]*pendingMapping, 1)
-	if err := setNetworkInterfaces(
-		&domainDef,
-		client.connection,
-		partialNetIfaces,
-		&waitForLeases,
-		hostName,
-		input.NetworkInterfaceName,
-		input.NetworkInterfaceAddress,
-		input.ReservedLeases,
-	); err != nil {
-		return err
-	}
-
 	// TODO: support setFilesystems
 	//if err := setFilesystems(d, &domainDef); err != nil {
 	//	return err
@@ -266,7 +526,7 @@ func (client *libvirtClient) CreateDomain(ctx context.Context, input CreateDomai
 	}
 	glog.Infof("Creating libvirt domain at %s", connectURI)
 
-	data, err := xmlMarshallIndented(domainDef)
+	data, err := xmlMarshallIndented(withFWCfg(domainDef, fwCfg))
 	if err != nil {
 		return fmt.Errorf("error serializing libvirt domain: %v", err)
 	}
@@ -364,7 +624,19 @@ func (client *libvirtClient) DeleteDomain(name string) error {
 		}
 	}
 
-	if err := domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM); err != nil {
+	domainDef, err := newDefDomainFromLibvirt(domain)
+	if err != nil {
+		return err
+	}
+	snapshotDefs, err := listSnapshotDefs(domain)
+	if err != nil {
+		return err
+	}
+
+	// internal snapshots are deleted with the volumes holding them, so only
+	// their metadata is removed together with the domain, and the overlays of
+	// external snapshots right after it
+	if err := domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA); err != nil {
 		if e := err.(libvirt.Error); e.Code == libvirt.ERR_NO_SUPPORT || e.Code == libvirt.ERR_INVALID_ARG {
 			glog.Info("libvirt does not support undefine flags: will try again without flags")
 			if err := domain.Undefine(); err != nil {
@@ -375,19 +647,40 @@ func (client *libvirtClient) DeleteDomain(name string) error {
 		}
 	}
 
+	// the domain is gone, so a failure is not retried and only leaves the
+	// overlays and secrets behind
+	for _, overlay := range snapshotOverlays(name, domainDef, snapshotDefs) {
+		if err := client.deleteVolumeByPath(overlay); err != nil {
+			glog.Errorf("Couldn't delete overlay %s of domain %s: %v", overlay, name, err)
+		}
+	}
+	if err := client.deleteUnusedNetworkDiskSecrets(networkDiskSecretUUIDs(domainDef)); err != nil {
+		glog.Errorf("Couldn't delete network disk secrets of domain %s: %v", name, err)
+	}
+
 	return nil
 }
 
 // CreateVolume creates volume based on CreateVolumeInput
 func (client *libvirtClient) CreateVolume(input CreateVolumeInput) error {
 	var volume *libvirt.StorageVol
-	glog.Infof("Create a libvirt volume with name %s for pool %s from the base volume %s", input.VolumeName, client.poolName, input.BaseVolumeName)
+	var cloneVolume *libvirt.StorageVol
+	pool, err := client.lookupPool(input.PoolName)
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	poolName, err := pool.GetName()
+	if err != nil {
+		return fmt.Errorf("Error retrieving storage pool name: %v", err)
+	}
+	glog.Infof("Create a libvirt volume with name %s for pool %s from the base volume %s", input.VolumeName, poolName, input.BaseVolumeName)
 
 	// TODO: lock pool
-	//client.poolMutexKV.Lock(client.poolName)
-	//defer client.poolMutexKV.Unlock(client.poolName)
+	//client.poolMutexKV.Lock(poolName)
+	//defer client.poolMutexKV.Unlock(poolName)
 
-	volume, err := client.getVolume(input.VolumeName)
+	volume, err = client.getVolume(input.PoolName, input.VolumeName)
 	if err == nil {
 		volume.Free()
 		return fmt.Errorf("storage volume '%s' already exists", input.VolumeName)
@@ -396,28 +689,44 @@ func (client *libvirtClient) CreateVolume(input CreateVolumeInput) error {
 	volumeDef := newDefVolume(input.VolumeName)
 	volumeDef.Target.Format.Type = input.VolumeFormat
 	var img image
+	var sum *checksum
+	var imageSize uint64
 	// an source image was given, this mean we can't choose size
 	if input.Source != "" {
 		if input.BaseVolumeName != "" {
 			return fmt.Errorf("'base_volume_name' can't be specified when also 'source' is given")
 		}
 
-		if img, err = newImage(input.Source); err != nil {
+		if img, err = newImage(input.Source, input.SourcePullSecret); err != nil {
+			return err
+		}
+
+		if sum, err = newChecksum(input.SourceChecksum, img); err != nil {
 			return err
 		}
 
 		// update the image in the description, even if the file has not changed
-		size, err := img.size()
-		if err != nil {
+		if imageSize, err = img.size(); err != nil {
 			return err
 		}
-		glog.Infof("Image %s image is: %d bytes", img, size)
+		format, virtualSize, err := inspectImage(img)
+		if err != nil {
+			if _, ok := err.(*RetryError); ok {
+				return err
+			}
+			return fmt.Errorf("Error inspecting image %s: %v", img.string(), err)
+		}
+		glog.Infof("Image %s is a %s image of %d bytes with a virtual size of %d bytes", img.string(), format, imageSize, virtualSize)
+		volumeDef.Target.Format.Type = format
 		volumeDef.Capacity.Unit = "B"
-		volumeDef.Capacity.Value = size
+		volumeDef.Capacity.Value = imageSize
+		if virtualSize != 0 {
+			volumeDef.Capacity.Value = virtualSize
+		}
 	} else if input.BaseVolumeName != "" {
 		volume = nil
 
-		baseVolume, err := client.getVolume(input.BaseVolumeName)
+		baseVolume, err := client.getVolume(input.BaseVolumePoolName, input.BaseVolumeName)
 
 		if err != nil {
 			return fmt.Errorf("Can't retrieve volume %s", input.BaseVolumeName)
@@ -443,15 +752,45 @@ func (client *libvirtClient) CreateVolume(input CreateVolumeInput) error {
 			volumeDef.Capacity.Value = volumeSize
 		}
 
-		backingStoreDef, err := newDefBackingStoreFromLibvirt(baseVolume)
-		if err != nil {
-			return fmt.Errorf("Could not retrieve backing store %s", input.BaseVolumeName)
+		cloneMode := input.CloneMode
+		// raw volumes can't have a backing store
+		if cloneMode == "" && input.VolumeFormat == string(providerconfigv1.VolumeFormatRaw) {
+			cloneMode = providerconfigv1.VolumeCloneModeFlatClone
 		}
-		volumeDef.BackingStore = &backingStoreDef
+
+		switch cloneMode {
+		case "", providerconfigv1.VolumeCloneModeOverlay:
+			backingStoreDef, err := newDefBackingStoreFromLibvirt(baseVolume)
+			if err != nil {
+				return fmt.Errorf("Could not retrieve backing store %s", input.BaseVolumeName)
+			}
+			volumeDef.BackingStore = &backingStoreDef
+		case providerconfigv1.VolumeCloneModeClone, providerconfigv1.VolumeCloneModeFlatClone:
+			baseVolumeDef, err := newDefVolumeFromLibvirt(baseVolume)
+			if err != nil {
+				return fmt.Errorf("Could not retrieve volume %s: %v", input.BaseVolumeName, err)
+			}
+			volumeDef = newDefCloneVolume(volumeDef, baseVolumeDef, cloneMode == providerconfigv1.VolumeCloneModeFlatClone)
+			cloneVolume = baseVolume
+		default:
+			return fmt.Errorf("unsupported clone mode %q", input.CloneMode)
+		}
+	} else if input.VolumeSize != nil {
+		// an empty volume
+		size, _ := input.VolumeSize.AsInt64()
+		volumeDef.Capacity.Value = uint64(size)
+	}
+
+	createFlags, err := setVolumeOptions(&volumeDef, input.Preallocation, input.LazyRefcounts)
+	if err != nil {
+		return err
+	}
+	if input.EncryptionSecretUUID != "" {
+		volumeDef.Target.Encryption = newDefVolumeEncryption(input.EncryptionSecretUUID)
 	}
 
 	if volume == nil {
-		volumeDefXML, err := xml.Marshal(volumeDef)
+		volumeDefXML, err := marshalVolumeDef(volumeDef, input.ClusterSize)
 		if err != nil {
 			return fmt.Errorf("Error serializing libvirt volume: %s", err)
 		}
@@ -460,14 +799,25 @@ func (client *libvirtClient) CreateVolume(input CreateVolumeInput) error {
 		// Refresh the pool of the volume so that libvirt knows it is
 		// not longer in use.
 		err = waitForSuccess("error refreshing pool for volume", func() error {
-			return client.pool.Refresh(0)
+			return pool.Refresh(0)
 		})
 		if err != nil {
-			return fmt.Errorf("can't find storage pool '%s'", client.poolName)
+			return fmt.Errorf("can't find storage pool '%s'", poolName)
 		}
 
-		v, err := client.pool.StorageVolCreateXML(string(volumeDefXML), 0)
+		var v *libvirt.StorageVol
+		if cloneVolume != nil {
+			glog.Infof("Copying volume %s into %s", input.BaseVolumeName, input.VolumeName)
+			v, err = pool.StorageVolCreateXMLFrom(volumeDefXML, cloneVolume, createFlags)
+		} else {
+			v, err = pool.StorageVolCreateXML(volumeDefXML, createFlags)
+		}
 		if err != nil {
+			if input.EncryptionSecretUUID != "" {
+				if err := client.deleteSecret(input.EncryptionSecretUUID); err != nil {
+					glog.Errorf("Error cleaning up secret of volume %s: %v", input.VolumeName, err)
+				}
+			}
 			return fmt.Errorf("Error creating libvirt volume: %s", err)
 		}
 		volume = v
@@ -481,8 +831,19 @@ func (client *libvirtClient) CreateVolume(input CreateVolumeInput) error {
 	}
 
 	if input.Source != "" {
-		err = img.importImage(newCopier(client.connection, volume, volumeDef.Capacity.Value), volumeDef)
+		copier := newDecompressingCopier(client.connection, volume, imageSize)
+		if sum != nil {
+			copier = sum.verify(copier)
+		}
+		err = img.importImage(copier, volumeDef)
 		if err != nil {
+			// do not leave a partially uploaded volume behind
+			if err := volume.Delete(0); err != nil {
+				glog.Errorf("Error deleting volume %s: %v", input.VolumeName, err)
+			}
+			if _, ok := err.(*RetryError); ok {
+				return err
+			}
 			return fmt.Errorf("Error while uploading source %s: %s", img.string(), err)
 		}
 	}
@@ -491,14 +852,121 @@ func (client *libvirtClient) CreateVolume(input CreateVolumeInput) error {
 	return nil
 }
 
-// VolumeExists checks if a volume exists
-func (client *libvirtClient) VolumeExists(name string) (bool, error) {
+// baseVolumeImportRetry is the delay after which machines waiting for the
+// import of their base volume by another machine check it again
+const baseVolumeImportRetry = 10 * time.Second
+
+var (
+	// baseVolumeImports holds the names of the base volumes being imported,
+	// so machines created at the same time do not pick up a partially
+	// imported image while imports of other images go ahead
+	baseVolumeImportsLock sync.Mutex
+	baseVolumeImports     = map[string]bool{}
+)
+
+// startBaseVolumeImport marks a base volume as being imported and returns
+// false if it already is
+func startBaseVolumeImport(name string) bool {
+	baseVolumeImportsLock.Lock()
+	defer baseVolumeImportsLock.Unlock()
+	if baseVolumeImports[name] {
+		return false
+	}
+	baseVolumeImports[name] = true
+	return true
+}
+
+func finishBaseVolumeImport(name string) {
+	baseVolumeImportsLock.Lock()
+	defer baseVolumeImportsLock.Unlock()
+	delete(baseVolumeImports, name)
+}
+
+// EnsureBaseVolume imports an image into a shared base volume if missing and returns the volume name
+func (client *libvirtClient) EnsureBaseVolume(ctx context.Context, input BaseVolumeInput) (string, error) {
+	var pullSecret []byte
+	if input.PullSecret != "" {
+		var err error
+		pullSecret, err = getSecretData(ctx, input.KubeClient, input.MachineNamespace, input.PullSecret, corev1.DockerConfigJsonKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	img, err := newImage(input.Source, pullSecret)
+	if err != nil {
+		return "", err
+	}
+
+	// the image is downloaded to identify it, which is not done twice at once
+	if !startBaseVolumeImport(img.string()) {
+		return "", &RetryError{After: baseVolumeImportRetry, Err: fmt.Errorf("image %s is being identified", img.string())}
+	}
+	name, checksum, err := baseVolumeName(img, input.SourceChecksum)
+	finishBaseVolumeImport(img.string())
+	if err != nil {
+		if _, ok := err.(*RetryError); ok {
+			return "", err
+		}
+		return "", fmt.Errorf("error identifying image %s: %v", img.string(), err)
+	}
+
+	if !startBaseVolumeImport(name) {
+		return "", &RetryError{After: baseVolumeImportRetry, Err: fmt.Errorf("image %s is being imported into base volume %s", img.string(), name)}
+	}
+	defer finishBaseVolumeImport(name)
+
+	exists, err := client.VolumeExists(input.PoolName, name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		glog.Infof("Reusing base volume %s for image %s", name, img.string())
+		return name, nil
+	}
+
+	glog.Infof("Importing image %s into base volume %s", img.string(), name)
+	if err := client.CreateVolume(CreateVolumeInput{
+		VolumeName:       name,
+		PoolName:         input.PoolName,
+		Source:           input.Source,
+		SourceChecksum:   checksum,
+		SourcePullSecret: pullSecret,
+	}); err != nil {
+		// do not leave a partially imported image behind for other machines
+		if err := client.DeleteVolume(input.PoolName, name); err != nil && err != ErrVolumeNotFound {
+			glog.Errorf("Error cleaning up base volume %s: %v", name, err)
+		}
+		return "", err
+	}
+	return name, nil
+}
+
+// EnsureVolumeSecret registers the passphrase of an encrypted volume as libvirt secret and returns its UUID
+func (client *libvirtClient) EnsureVolumeSecret(ctx context.Context, input VolumeSecretInput) (string, error) {
+	passphrase, err := getSecretData(ctx, input.KubeClient, input.MachineNamespace, input.SecretName, volumePassphraseKey)
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("secret '%v/%v' has an empty passphrase", input.MachineNamespace, input.SecretName)
+	}
+
+	path, err := client.volumePath(input.PoolName, input.VolumeName)
+	if err != nil {
+		return "", err
+	}
+	return client.ensureVolumeSecret(path, passphrase)
+}
+
+// VolumeExists checks if a volume exists in a pool, the default pool if empty
+func (client *libvirtClient) VolumeExists(poolName string, name string) (bool, error) {
 	glog.Infof("Check if %q volume exists", name)
 	if client.connection == nil {
 		return false, ErrLibVirtConIsNil
 	}
 
-	volume, err := client.getVolume(name)
+	volume, err := client.getVolume(poolName, name)
 	if err != nil {
 		return false, nil
 	}
@@ -506,10 +974,16 @@ func (client *libvirtClient) VolumeExists(name string) (bool, error) {
 	return true, nil
 }
 
-func (client *libvirtClient) getVolume(volumeName string) (*libvirt.StorageVol, error) {
+func (client *libvirtClient) getVolume(poolName string, volumeName string) (*libvirt.StorageVol, error) {
+	pool, err := client.lookupPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+
 	// Check whether the storage volume exists. Its name needs to be
 	// unique.
-	volume, err := client.pool.LookupStorageVolByName(volumeName)
+	volume, err := pool.LookupStorageVolByName(volumeName)
 	if err != nil {
 		// Let's try by ID in case of older Installer
 		volume, err = client.connection.LookupStorageVolByKey(volumeName)
@@ -520,9 +994,9 @@ func (client *libvirtClient) getVolume(volumeName string) (*libvirt.StorageVol,
 	return volume, nil
 }
 
-// DeleteVolume deletes a domain based on its name
-func (client *libvirtClient) DeleteVolume(name string) error {
-	exists, err := client.VolumeExists(name)
+// DeleteVolume deletes a volume of a pool based on its name, unless other volumes are backed by it
+func (client *libvirtClient) DeleteVolume(poolName string, name string) error {
+	exists, err := client.VolumeExists(poolName, name)
 	if err != nil {
 		return err
 	}
@@ -532,12 +1006,34 @@ func (client *libvirtClient) DeleteVolume(name string) error {
 	}
 	glog.Infof("Deleting volume %s", name)
 
-	volume, err := client.getVolume(name)
+	volume, err := client.getVolume(poolName, name)
 	if err != nil {
 		return fmt.Errorf("Can't retrieve volume %s", name)
 	}
 	defer volume.Free()
 
+	// only base volumes are shared by the volumes of machines, checking
+	// whether the volumes of a machine are in use would mean reading the
+	// definition of every volume of every pool for each of them
+	if isBaseVolumeName(name) {
+		path, err := volume.GetPath()
+		if err != nil {
+			return fmt.Errorf("Can't retrieve path of volume %s: %v", name, err)
+		}
+		overlays, err := client.volumesBackedBy(path)
+		if err != nil {
+			return fmt.Errorf("Can't check whether volume %s is in use: %v", name, err)
+		}
+		if len(overlays) > 0 {
+			return &VolumeInUseError{Name: name, Overlays: overlays}
+		}
+	}
+
+	volumeDef, err := newDefVolumeFromLibvirt(volume)
+	if err != nil {
+		return err
+	}
+
 	// Refresh the pool of the volume so that libvirt knows it is
 	// not longer in use.
 	volPool, err := volume.LookupPoolByVolume()
@@ -559,6 +1055,186 @@ func (client *libvirtClient) DeleteVolume(name string) error {
 		return fmt.Errorf("Can't delete volume %s: %s", name, err)
 	}
 
+	// the passphrase of an encrypted volume is of no use without it
+	if volumeDef.Target != nil && volumeDef.Target.Encryption != nil && volumeDef.Target.Encryption.Secret != nil {
+		return client.deleteSecret(volumeDef.Target.Encryption.Secret.UUID)
+	}
+
+	return nil
+}
+
+// ResizeVolume grows a volume, through the domain if it is running, and returns whether it was resized
+func (client *libvirtClient) ResizeVolume(domainName string, poolName string, volumeName string, size uint64) (bool, error) {
+	volume, err := client.getVolume(poolName, volumeName)
+	if err != nil {
+		return false, err
+	}
+	defer volume.Free()
+
+	info, err := volume.GetInfo()
+	if err != nil {
+		return false, fmt.Errorf("Can't retrieve volume info %s: %v", volumeName, err)
+	}
+	if size == info.Capacity {
+		return false, nil
+	}
+	if size < info.Capacity {
+		return false, &VolumeShrinkError{Name: volumeName, Capacity: info.Capacity, Size: size}
+	}
+
+	// a running domain has to resize the disk itself so the guest notices
+	domain, err := client.connection.LookupDomainByName(domainName)
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); !ok || virErr.Code != libvirt.ERR_NO_DOMAIN {
+			return false, fmt.Errorf("Error looking up domain %s: %v", domainName, err)
+		}
+	} else {
+		defer domain.Free()
+		snapshots, err := domain.SnapshotListNames(libvirt.DOMAIN_SNAPSHOT_LIST_TOPOLOGICAL)
+		if err != nil {
+			return false, fmt.Errorf("Error listing snapshots of domain %s: %v", domainName, err)
+		}
+		if len(snapshots) > 0 {
+			return false, &VolumeSnapshotsError{Name: volumeName, Domain: domainName, Snapshots: snapshots}
+		}
+		active, err := domain.IsActive()
+		if err != nil {
+			return false, fmt.Errorf("Error retrieving state of domain %s: %v", domainName, err)
+		}
+		if active {
+			path, err := volume.GetPath()
+			if err != nil {
+				return false, fmt.Errorf("Can't retrieve path of volume %s: %v", volumeName, err)
+			}
+			pool, err := volume.LookupPoolByVolume()
+			if err != nil {
+				return false, fmt.Errorf("Can't retrieve pool of volume %s: %v", volumeName, err)
+			}
+			defer pool.Free()
+			volumePoolName, err := pool.GetName()
+			if err != nil {
+				return false, fmt.Errorf("Can't retrieve pool name of volume %s: %v", volumeName, err)
+			}
+			domainDef, err := newDefDomainFromLibvirt(domain)
+			if err != nil {
+				return false, err
+			}
+			target := diskTargetByVolume(domainDef, path, volumePoolName, volumeName)
+			if target == "" {
+				return false, fmt.Errorf("domain %s has no disk with volume %s", domainName, volumeName)
+			}
+			glog.Infof("Resizing disk %s of domain %s from %d to %d bytes", target, domainName, info.Capacity, size)
+			if err := domain.BlockResize(target, size, libvirt.DOMAIN_BLOCK_RESIZE_BYTES); err != nil {
+				return false, fmt.Errorf("Can't resize disk %s of domain %s: %v", target, domainName, err)
+			}
+			return true, nil
+		}
+	}
+
+	glog.Infof("Resizing volume %s from %d to %d bytes", volumeName, info.Capacity, size)
+	if err := volume.Resize(size, 0); err != nil {
+		return false, fmt.Errorf("Can't resize volume %s: %v", volumeName, err)
+	}
+	return true, nil
+}
+
+// volumesBackedBy returns the names of the volumes of all active pools which
+// have the path as backing store. Volumes and pools which vanish while they
+// are listed are skipped.
+func (client *libvirtClient) volumesBackedBy(path string) ([]string, error) {
+	pools, err := client.connection.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("error listing storage pools: %v", err)
+	}
+	defer func() {
+		for i := range pools {
+			pools[i].Free()
+		}
+	}()
+
+	var names []string
+	for i := range pools {
+		volumes, err := pools[i].ListAllStorageVolumes(0)
+		if err != nil {
+			// the pool was stopped or removed in the meantime
+			if virErr, ok := err.(libvirt.Error); ok && (virErr.Code == libvirt.ERR_NO_STORAGE_POOL || virErr.Code == libvirt.ERR_OPERATION_INVALID) {
+				continue
+			}
+			return nil, fmt.Errorf("error listing storage volumes: %v", err)
+		}
+		for j := range volumes {
+			volumeDefXML, err := volumes[j].GetXMLDesc(0)
+			volumes[j].Free()
+			if err != nil {
+				// the volume was deleted in the meantime
+				if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_STORAGE_VOL {
+					continue
+				}
+				return nil, fmt.Errorf("could not get XML description of volume: %v", err)
+			}
+			volumeDef, err := newDefVolumeFromXML(volumeDefXML)
+			if err != nil {
+				return nil, err
+			}
+			if isBackedBy(volumeDef, path) {
+				names = append(names, volumeDef.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// lookupVolumeByPath returns the volume of a file. Files libvirt creates
+// outside of the storage pool API, like the overlays of external snapshots,
+// only become volumes when their pool is refreshed, so the active pools are
+// refreshed once if the file isn't known yet. ErrVolumeNotFound is returned
+// if the file isn't a volume of any of them.
+func (client *libvirtClient) lookupVolumeByPath(path string) (*libvirt.StorageVol, error) {
+	volume, err := client.connection.LookupStorageVolByPath(path)
+	if err == nil {
+		return volume, nil
+	}
+	if virErr, ok := err.(libvirt.Error); !ok || virErr.Code != libvirt.ERR_NO_STORAGE_VOL {
+		return nil, fmt.Errorf("Can't retrieve volume %s: %v", path, err)
+	}
+
+	pools, err := client.connection.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("error listing storage pools: %v", err)
+	}
+	for i := range pools {
+		// a pool failing to refresh can't hold the file either
+		if err := pools[i].Refresh(0); err != nil {
+			glog.Warningf("Couldn't refresh storage pool: %v", err)
+		}
+		pools[i].Free()
+	}
+
+	volume, err = client.connection.LookupStorageVolByPath(path)
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_STORAGE_VOL {
+			return nil, ErrVolumeNotFound
+		}
+		return nil, fmt.Errorf("Can't retrieve volume %s: %v", path, err)
+	}
+	return volume, nil
+}
+
+// deleteVolumeByPath deletes the volume of a file, unless there is none
+func (client *libvirtClient) deleteVolumeByPath(path string) error {
+	volume, err := client.lookupVolumeByPath(path)
+	if err == ErrVolumeNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer volume.Free()
+
+	glog.Infof("Deleting volume %s", path)
+	if err := volume.Delete(0); err != nil {
+		return fmt.Errorf("Can't delete volume %s: %v", path, err)
+	}
 	return nil
 }
 
@@ -590,3 +1266,263 @@ func (client *libvirtClient) LookupDomainHostnameByDHCPLease(domIPAddress string
 	}
 	return "", fmt.Errorf("Failed to find hostname for the DHCP lease with IP %s", domIPAddress)
 }
+
+// LookupNetworkNameByUUID looks up a network name based on its UUID
+func (client *libvirtClient) LookupNetworkNameByUUID(uuid string) (string, error) {
+	network, err := client.connection.LookupNetworkByUUIDString(uuid)
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_NETWORK {
+			return "", ErrNetworkNotFound
+		}
+		return "", fmt.Errorf("can't retrieve network %s: %v", uuid, err)
+	}
+	defer network.Free()
+
+	return network.GetName()
+}
+
+// DeleteDNSHost deletes all network DNS host records which contain the hostname.
+// A missing network has no records left to delete.
+func (client *libvirtClient) DeleteDNSHost(networkName string, hostname string) error {
+	network, err := client.connection.LookupNetworkByName(networkName)
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_NETWORK {
+			glog.Infof("Network %s not found, no DNS host records to delete for %s", networkName, hostname)
+			return nil
+		}
+		return fmt.Errorf("can't retrieve network %s: %v", networkName, err)
+	}
+	defer network.Free()
+
+	targets, err := networkUpdateTargets(network)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		networkDef, err := newDefNetworkfromLibvirtFlags(network, target.xmlFlags)
+		if err != nil {
+			return fmt.Errorf("error retrieving network definition: %v", err)
+		}
+
+		for _, host := range dnsHostsByHostname(networkDef, hostname) {
+			hostnames := make([]string, 0, len(host.Hostnames))
+			for _, h := range host.Hostnames {
+				hostnames = append(hostnames, h.Hostname)
+			}
+			glog.Infof("Removing DNS IP/hosts=%s/%v from %s", host.IP, hostnames, networkName)
+			if err := removeDNSHost(network, host.IP, target.flags); err != nil {
+				return fmt.Errorf("can't remove DNS host %s from network %s: %v", host.IP, networkName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CreateOrUpdateNetwork creates or updates a network and returns its UUID and
+// whether changes to the running network wait for a restart of the network
+func (client *libvirtClient) CreateOrUpdateNetwork(input CreateNetworkInput) (string, bool, error) {
+	desiredDef, err := newDefNetwork(input)
+	if err != nil {
+		return "", false, err
+	}
+
+	network, err := client.connection.LookupNetworkByName(input.Name)
+	existing := err == nil
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); !ok || virErr.Code != libvirt.ERR_NO_NETWORK {
+			return "", false, fmt.Errorf("can't retrieve network %s: %v", input.Name, err)
+		}
+
+		glog.Infof("Creating network %s", input.Name)
+		data, err := xmlMarshallIndented(desiredDef)
+		if err != nil {
+			return "", false, fmt.Errorf("error serializing libvirt network: %v", err)
+		}
+		glog.Infof("Creating libvirt network with XML:\n%s", data)
+		network, err = client.connection.NetworkDefineXML(data)
+		if err != nil {
+			return "", false, fmt.Errorf("error defining libvirt network: %v", err)
+		}
+	} else {
+		networkDef, err := newDefNetworkfromLibvirtFlags(network, libvirt.NETWORK_XML_INACTIVE)
+		if err != nil {
+			network.Free()
+			return "", false, fmt.Errorf("error retrieving network definition: %v", err)
+		}
+		current, err := xmlMarshallIndented(networkDef)
+		if err != nil {
+			network.Free()
+			return "", false, fmt.Errorf("error serializing libvirt network: %v", err)
+		}
+		updateDefNetwork(&networkDef, desiredDef)
+		data, err := xmlMarshallIndented(networkDef)
+		if err != nil {
+			network.Free()
+			return "", false, fmt.Errorf("error serializing libvirt network: %v", err)
+		}
+		if data != current {
+			glog.Infof("Updating libvirt network with XML:\n%s", data)
+			network.Free()
+			network, err = client.connection.NetworkDefineXML(data)
+			if err != nil {
+				return "", false, fmt.Errorf("error updating libvirt network: %v", err)
+			}
+		}
+		desiredDef = networkDef
+	}
+	defer network.Free()
+
+	restartPending := false
+	active, err := network.IsActive()
+	if err != nil {
+		return "", false, fmt.Errorf("error checking whether network %s is active: %v", input.Name, err)
+	}
+	if !active {
+		glog.Infof("Starting network %s", input.Name)
+		if err := network.Create(); err != nil {
+			return "", false, fmt.Errorf("error starting network %s: %v", input.Name, err)
+		}
+	} else if existing {
+		restartPending, err = updateLiveNetwork(network, desiredDef)
+		if err != nil {
+			return "", false, fmt.Errorf("error updating running network %s: %v", input.Name, err)
+		}
+	}
+
+	if err := network.SetAutostart(true); err != nil {
+		return "", false, fmt.Errorf("error setting Autostart: %v", err)
+	}
+
+	uuid, err := network.GetUUIDString()
+	if err != nil {
+		return "", false, err
+	}
+	return uuid, restartPending, nil
+}
+
+// DeleteNetwork deletes a network
+func (client *libvirtClient) DeleteNetwork(name string) error {
+	network, err := client.connection.LookupNetworkByName(name)
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_NETWORK {
+			return ErrNetworkNotFound
+		}
+		return fmt.Errorf("can't retrieve network %s: %v", name, err)
+	}
+	defer network.Free()
+
+	glog.Infof("Deleting network %s", name)
+
+	active, err := network.IsActive()
+	if err != nil {
+		return fmt.Errorf("error checking whether network %s is active: %v", name, err)
+	}
+	if active {
+		if err := network.Destroy(); err != nil {
+			return fmt.Errorf("couldn't destroy libvirt network: %v", err)
+		}
+	}
+
+	if err := network.Undefine(); err != nil {
+		return fmt.Errorf("couldn't undefine libvirt network: %v", err)
+	}
+	return nil
+}
+
+// poolsUsingPath returns the names of the storage pools other than the named
+// one with the path as target
+func (client *libvirtClient) poolsUsingPath(name string, path string) ([]string, error) {
+	pools, err := client.connection.ListAllStoragePools(0)
+	if err != nil {
+		return nil, fmt.Errorf("can't list storage pools: %v", err)
+	}
+	defer func() {
+		for i := range pools {
+			pools[i].Free()
+		}
+	}()
+	var poolDefs []libvirtxml.StoragePool
+	for i := range pools {
+		poolDef, err := newDefPoolFromLibvirt(&pools[i])
+		if err != nil {
+			return nil, err
+		}
+		poolDefs = append(poolDefs, poolDef)
+	}
+	return poolsWithPath(poolDefs, name, path), nil
+}
+
+// EnsureStoragePool creates a storage pool if missing, validates it and returns its UUID
+func (client *libvirtClient) EnsureStoragePool(input CreateStoragePoolInput) (string, error) {
+	poolDef, err := newDefPool(input)
+	if err != nil {
+		return "", err
+	}
+
+	// volumes of two pools in one directory would show up in both
+	if pools, err := client.poolsUsingPath(input.Name, input.Path); err != nil {
+		return "", err
+	} else if len(pools) > 0 {
+		return "", &PoolPathInUseError{Name: input.Name, Path: input.Path, Pools: pools}
+	}
+
+	pool, err := client.connection.LookupStoragePoolByName(input.Name)
+	defined := false
+	if err != nil {
+		if virErr, ok := err.(libvirt.Error); !ok || virErr.Code != libvirt.ERR_NO_STORAGE_POOL {
+			return "", fmt.Errorf("can't retrieve storage pool %s: %v", input.Name, err)
+		}
+
+		data, err := xmlMarshallIndented(poolDef)
+		if err != nil {
+			return "", fmt.Errorf("error serializing libvirt storage pool: %v", err)
+		}
+		glog.Infof("Creating libvirt storage pool with XML:\n%s", data)
+		pool, err = client.connection.StoragePoolDefineXML(data, 0)
+		if err != nil {
+			return "", fmt.Errorf("error defining libvirt storage pool: %v", err)
+		}
+		defined = true
+	}
+	defer pool.Free()
+
+	active, err := pool.IsActive()
+	if err != nil {
+		return "", fmt.Errorf("error checking whether storage pool %s is active: %v", input.Name, err)
+	}
+	if !active {
+		// the directory of an inactive pool may be missing, e.g. if
+		// building it failed before
+		if err := pool.Build(0); err != nil {
+			if defined {
+				// a pool left defined would not be built again
+				if err := pool.Undefine(); err != nil {
+					glog.Errorf("Error undefining storage pool %s: %v", input.Name, err)
+				}
+			}
+			return "", fmt.Errorf("error building libvirt storage pool %s: %v", input.Name, err)
+		}
+		glog.Infof("Starting storage pool %s", input.Name)
+		if err := pool.Create(0); err != nil {
+			return "", fmt.Errorf("error starting storage pool %s: %v", input.Name, err)
+		}
+	}
+
+	if err := pool.SetAutostart(input.Autostart); err != nil {
+		return "", fmt.Errorf("error setting Autostart: %v", err)
+	}
+
+	currentDef, err := newDefPoolFromLibvirt(pool)
+	if err != nil {
+		return "", err
+	}
+	info, err := pool.GetInfo()
+	if err != nil {
+		return "", fmt.Errorf("can't retrieve storage pool info %s: %v", input.Name, err)
+	}
+	if err := validatePool(currentDef, info, input); err != nil {
+		return "", err
+	}
+
+	return pool.GetUUIDString()
+}
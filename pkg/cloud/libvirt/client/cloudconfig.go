@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// cloudConfigHeader starts user data in the cloud-config format
+	cloudConfigHeader = "#cloud-config"
+
+	// cloudConfigMergeHow merges the provider part into the cloud-config of
+	// multipart user data: its values replace those of the user data, nested
+	// settings like the user are merged and lists like the SSH keys are
+	// appended to
+	cloudConfigMergeHow = "dict(replace,recurse_dict,recurse_array)+list(append)"
+)
+
+// cloudConfigAdditions are the provider generated parts merged into
+// cloud-config and multipart user data
+type cloudConfigAdditions struct {
+	hostname          string
+	sshAuthorizedKeys []string
+	defaultUser       string
+}
+
+// isCloudConfig reports whether the user data is a cloud-config
+func isCloudConfig(userData []byte) bool {
+	firstLine := strings.SplitN(string(userData), "\n", 2)[0]
+	return strings.TrimSpace(firstLine) == cloudConfigHeader
+}
+
+// multipartBoundary returns the boundary of multipart MIME user data, empty
+// for other user data
+func multipartBoundary(userData []byte) (string, error) {
+	start := strings.ToLower(string(userData[:minInt(len(userData), 64)]))
+	if !strings.HasPrefix(start, "content-type:") && !strings.HasPrefix(start, "mime-version:") {
+		return "", nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(userData))
+	if err != nil {
+		return "", fmt.Errorf("invalid MIME user data: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return "", fmt.Errorf("invalid MIME user data: %v", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return "", nil
+	}
+	if params["boundary"] == "" {
+		return "", fmt.Errorf("invalid MIME user data: no multipart boundary")
+	}
+	return params["boundary"], nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// set adds the additions to a parsed cloud-config
+func (additions cloudConfigAdditions) set(config map[string]interface{}) {
+	if additions.hostname != "" {
+		config["hostname"] = additions.hostname
+		config["preserve_hostname"] = false
+	}
+	if additions.defaultUser != "" {
+		user, ok := config["user"].(map[string]interface{})
+		if !ok {
+			user = map[string]interface{}{}
+		}
+		user["name"] = additions.defaultUser
+		config["user"] = user
+	}
+	if len(additions.sshAuthorizedKeys) > 0 {
+		keys, _ := config["ssh_authorized_keys"].([]interface{})
+		for _, key := range additions.sshAuthorizedKeys {
+			found := false
+			for _, existing := range keys {
+				if existing == key {
+					found = true
+					break
+				}
+			}
+			if !found {
+				keys = append(keys, key)
+			}
+		}
+		config["ssh_authorized_keys"] = keys
+	}
+}
+
+// marshalCloudConfig returns the cloud-config with its header
+func marshalCloudConfig(config map[string]interface{}) ([]byte, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader+"\n"), data...), nil
+}
+
+// mergeCloudConfig merges the additions into cloud-config user data
+func mergeCloudConfig(userData []byte, additions cloudConfigAdditions) ([]byte, error) {
+	config := map[string]interface{}{}
+	// integers are written back as they are instead of as floats
+	if err := yaml.Unmarshal(userData, &config, func(d *json.Decoder) *json.Decoder {
+		d.UseNumber()
+		return d
+	}); err != nil {
+		return nil, fmt.Errorf("invalid cloud-config user data: %v", err)
+	}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	additions.set(config)
+	return marshalCloudConfig(config)
+}
+
+// appendCloudConfigPart adds a cloud-config part with the additions to
+// multipart user data, leaving the parts of the user data as they are
+func appendCloudConfigPart(userData []byte, boundary string, additions cloudConfigAdditions) ([]byte, error) {
+	end := bytes.LastIndex(userData, []byte("--"+boundary+"--"))
+	if end < 0 {
+		return nil, fmt.Errorf("invalid MIME user data: no closing boundary")
+	}
+
+	config := map[string]interface{}{"merge_how": cloudConfigMergeHow}
+	additions.set(config)
+	part, err := marshalCloudConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(userData[:end])
+	fmt.Fprintf(&buf, "--%s\nContent-Type: text/cloud-config; charset=\"utf-8\"\nMIME-Version: 1.0\nContent-Disposition: attachment; filename=\"provider.cfg\"\n\n", boundary)
+	buf.Write(part)
+	buf.WriteString("\n")
+	buf.Write(userData[end:])
+	return buf.Bytes(), nil
+}
+
+// renderUserData passes cloud-config and multipart user data through with the
+// additions merged in. Other user data is run as a script by the default
+// cloud-config of the provider.
+func renderUserData(userData []byte, sshAccess bool, additions cloudConfigAdditions) (string, error) {
+	if isCloudConfig(userData) {
+		merged, err := mergeCloudConfig(userData, additions)
+		return string(merged), err
+	}
+	boundary, err := multipartBoundary(userData)
+	if err != nil {
+		return "", err
+	}
+	if boundary != "" {
+		merged, err := appendCloudConfigPart(userData, boundary, additions)
+		return string(merged), err
+	}
+	return renderCloudInitStr(userData, sshAccess, additions.sshAuthorizedKeys, additions.defaultUser)
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+const testMultipartUserData = `Content-Type: multipart/mixed; boundary="===============0035287898381899620=="
+MIME-Version: 1.0
+
+--===============0035287898381899620==
+Content-Type: text/cloud-config; charset="us-ascii"
+MIME-Version: 1.0
+
+#cloud-config
+packages:
+  - htop
+
+--===============0035287898381899620==
+Content-Type: text/x-shellscript; charset="us-ascii"
+MIME-Version: 1.0
+
+#!/bin/sh
+echo hello
+
+--===============0035287898381899620==--
+`
+
+func TestRenderUserData(t *testing.T) {
+	additions := cloudConfigAdditions{
+		hostname:          "worker-0",
+		sshAuthorizedKeys: []string{"ssh-ed25519 AAAA admin@example.com", "ssh-ed25519 BBBB ci@example.com"},
+		defaultUser:       "admin",
+	}
+
+	cases := []struct {
+		name            string
+		userData        string
+		additions       cloudConfigAdditions
+		expectError     bool
+		expectTemplate  bool
+		expectMultipart bool
+		expectedConfig  map[string]interface{}
+	}{
+		{
+			name:           "script",
+			userData:       "#!/bin/bash\necho hello\n",
+			additions:      additions,
+			expectTemplate: true,
+		},
+		{
+			name: "cloud-config",
+			userData: `#cloud-config
+hostname: placeholder
+ssh_authorized_keys:
+  - ssh-ed25519 AAAA admin@example.com
+user:
+  name: ubuntu
+  sudo: ALL=(ALL) NOPASSWD:ALL
+write_files:
+  - path: /etc/motd
+    content: hello
+    permissions: '0644'
+swap:
+  size: 1073741824
+`,
+			additions: additions,
+			expectedConfig: map[string]interface{}{
+				"hostname":          "worker-0",
+				"preserve_hostname": false,
+				"ssh_authorized_keys": []interface{}{
+					"ssh-ed25519 AAAA admin@example.com",
+					"ssh-ed25519 BBBB ci@example.com",
+				},
+				"user": map[string]interface{}{
+					"name": "admin",
+					"sudo": "ALL=(ALL) NOPASSWD:ALL",
+				},
+				"write_files": []interface{}{
+					map[string]interface{}{"path": "/etc/motd", "content": "hello", "permissions": "0644"},
+				},
+				"swap": map[string]interface{}{"size": float64(1073741824)},
+			},
+		},
+		{
+			name:     "cloud-config without additions",
+			userData: "#cloud-config\npackages: [htop]\n",
+			expectedConfig: map[string]interface{}{
+				"packages": []interface{}{"htop"},
+			},
+		},
+		{
+			name:        "invalid cloud-config",
+			userData:    "#cloud-config\n- a list\n",
+			expectError: true,
+		},
+		{
+			name:            "multipart",
+			userData:        testMultipartUserData,
+			additions:       additions,
+			expectMultipart: true,
+			expectedConfig: map[string]interface{}{
+				"merge_how":         cloudConfigMergeHow,
+				"hostname":          "worker-0",
+				"preserve_hostname": false,
+				"ssh_authorized_keys": []interface{}{
+					"ssh-ed25519 AAAA admin@example.com",
+					"ssh-ed25519 BBBB ci@example.com",
+				},
+				"user": map[string]interface{}{"name": "admin"},
+			},
+		},
+		{
+			name:        "multipart without closing boundary",
+			userData:    strings.TrimSuffix(testMultipartUserData, "--===============0035287898381899620==--\n"),
+			additions:   additions,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rendered, err := renderUserData([]byte(tc.userData), true, tc.additions)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got:\n%s", rendered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.expectTemplate {
+				if !strings.Contains(rendered, "base64 -d | bash") || !strings.Contains(rendered, "ssh-ed25519 BBBB ci@example.com") {
+					t.Errorf("expected the script to be run by the default cloud-config:\n%s", rendered)
+				}
+				return
+			}
+
+			config := rendered
+			if tc.expectMultipart {
+				parts := readMultipart(t, rendered)
+				if len(parts) != 3 {
+					t.Fatalf("expected 3 parts, got %d:\n%s", len(parts), rendered)
+				}
+				if !strings.Contains(parts[0], "- htop") || !strings.Contains(parts[1], "echo hello") {
+					t.Errorf("parts of the user data were changed:\n%s", rendered)
+				}
+				config = parts[2]
+			}
+			if !strings.HasPrefix(config, "#cloud-config\n") {
+				t.Errorf("cloud-config header is missing:\n%s", config)
+			}
+			var parsed map[string]interface{}
+			if err := yaml.Unmarshal([]byte(config), &parsed); err != nil {
+				t.Fatalf("invalid cloud-config: %v\n%s", err, config)
+			}
+			if !reflect.DeepEqual(parsed, tc.expectedConfig) {
+				t.Errorf("expected cloud-config %v, got %v", tc.expectedConfig, parsed)
+			}
+		})
+	}
+}
+
+// readMultipart returns the contents of the parts of multipart MIME user data
+func readMultipart(t *testing.T, userData string) []string {
+	msg, err := mail.ReadMessage(strings.NewReader(userData))
+	if err != nil {
+		t.Fatalf("invalid MIME user data: %v", err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("invalid content type: %v", err)
+	}
+	var parts []string
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("invalid part: %v", err)
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, part); err != nil {
+			t.Fatalf("invalid part: %v", err)
+		}
+		parts = append(parts, buf.String())
+	}
+}
@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"net"
+	"strings"
 	"text/template"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -20,7 +20,7 @@ import (
 	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
 )
 
-func setCloudInit(ctx context.Context, domainDef *libvirtxml.Domain, client *libvirtClient, cloudInit *providerconfigv1.CloudInit, kubeClient kubernetes.Interface, machineNamespace, volumeName, domainName string) error {
+func setCloudInit(ctx context.Context, domainDef *libvirtxml.Domain, client *libvirtClient, cloudInit *providerconfigv1.CloudInit, networkInterfaceConfig *providerconfigv1.NetworkInterfaceConfig, kubeClient kubernetes.Interface, machineNamespace, volumeName, domainName, hostName, mac string) error {
 
 	// At least user data or ssh access needs to be set to create the cloud init
 	if cloudInit.UserDataSecret == "" && !cloudInit.SSHAccess {
@@ -41,7 +41,22 @@ func setCloudInit(ctx context.Context, domainDef *libvirtxml.Domain, client *lib
 		}
 	}
 
-	userData, err := renderCloudInitStr(userDataSecret, cloudInit.SSHAccess)
+	var sshAuthorizedKeys []string
+	if cloudInit.SSHAccess {
+		var err error
+		if sshAuthorizedKeys, err = getSSHAuthorizedKeys(ctx, cloudInit, kubeClient, machineNamespace); err != nil {
+			return err
+		}
+		if len(sshAuthorizedKeys) == 0 {
+			glog.Warningf("sshAccess is set but no SSH keys are configured for domain %s", domainName)
+		}
+	}
+
+	userData, err := renderUserData(userDataSecret, cloudInit.SSHAccess, cloudConfigAdditions{
+		hostname:          hostName,
+		sshAuthorizedKeys: sshAuthorizedKeys,
+		defaultUser:       cloudInit.DefaultUser,
+	})
 	if err != nil {
 		return fmt.Errorf("can not render cloud init user-data: %v", err)
 	}
@@ -51,15 +66,21 @@ func setCloudInit(ctx context.Context, domainDef *libvirtxml.Domain, client *lib
 		return fmt.Errorf("can not render cloud init meta-data: %v", err)
 	}
 
+	networkConfig, err := renderNetworkConfigStr(networkInterfaceConfig, mac)
+	if err != nil {
+		return fmt.Errorf("can not render cloud init network-config: %v", err)
+	}
+
 	cloudInitISOName := volumeName
 
 	cloudInitDef := newCloudInitDef()
 	cloudInitDef.UserData = string(userData)
 	cloudInitDef.MetaData = string(metaData)
+	cloudInitDef.NetworkConfig = networkConfig
 	cloudInitDef.Name = cloudInitISOName
-	cloudInitDef.PoolName = client.poolName
+	cloudInitDef.PoolName = cloudInit.PoolName
 
-	glog.Infof("cloudInitDef: %+v", cloudInitDef)
+	glog.Infof("Cloud init volume %s in pool %q with %d bytes of user data", cloudInitDef.Name, cloudInitDef.PoolName, len(cloudInitDef.UserData))
 
 	iso, err := cloudInitDef.createISO()
 	if err != nil {
@@ -108,75 +129,29 @@ func newCloudInitDef() defCloudInit {
 	return defCloudInit{}
 }
 
+// cloudInitVolumeID is the volume label NoCloud data sources are found by
+const cloudInitVolumeID = "cidata"
+
 // Create the ISO holding all the cloud-init data
-// Returns a string with the full path to the ISO file
-func (ci *defCloudInit) createISO() (string, error) {
+// Returns the content of the ISO image
+func (ci *defCloudInit) createISO() ([]byte, error) {
 	glog.Info("Creating new ISO")
-	tmpDir, err := ci.createFiles()
-	if err != nil {
-		return "", err
-	}
-
-	isoDestination := filepath.Join(tmpDir, ci.Name)
-	cmd := exec.Command(
-		"mkisofs",
-		"-output",
-		isoDestination,
-		"-volid",
-		"cidata",
-		"-joliet",
-		"-rock",
-		filepath.Join(tmpDir, userDataFileName),
-		filepath.Join(tmpDir, metaDataFileName),
-		filepath.Join(tmpDir, networkConfigFileName))
-
-	glog.Infof("About to execute cmd: %+v", cmd)
-	if err = cmd.Run(); err != nil {
-		return "", fmt.Errorf("error while starting the creation of CloudInit's ISO image: %s", err)
-	}
-	glog.Infof("ISO created at %s", isoDestination)
-
-	return isoDestination, nil
-}
-
-// write user-data,  meta-data network-config in tmp files and dedicated directory
-// Returns a string containing the name of the temporary directory and an error
-// object
-func (ci *defCloudInit) createFiles() (string, error) {
-	glog.Info("Creating ISO contents")
-	tmpDir, err := ioutil.TempDir("", "cloudinit")
+	iso, err := newISO9660(cloudInitVolumeID, []isoFile{
+		{name: userDataFileName, data: []byte(ci.UserData)},
+		{name: metaDataFileName, data: []byte(ci.MetaData)},
+		{name: networkConfigFileName, data: []byte(ci.NetworkConfig)},
+	}, time.Now())
 	if err != nil {
-		return "", fmt.Errorf("Cannot create tmp directory for cloudinit ISO generation: %s",
-			err)
-	}
-	// user-data
-	if err = ioutil.WriteFile(filepath.Join(tmpDir, userDataFileName), []byte(ci.UserData), os.ModePerm); err != nil {
-		return "", fmt.Errorf("Error while writing user-data to file: %s", err)
-	}
-	// meta-data
-	if err = ioutil.WriteFile(filepath.Join(tmpDir, metaDataFileName), []byte(ci.MetaData), os.ModePerm); err != nil {
-		return "", fmt.Errorf("Error while writing meta-data to file: %s", err)
+		return nil, fmt.Errorf("error while creating the CloudInit ISO image: %v", err)
 	}
-	// network-config
-	if err = ioutil.WriteFile(filepath.Join(tmpDir, networkConfigFileName), []byte(ci.NetworkConfig), os.ModePerm); err != nil {
-		return "", fmt.Errorf("Error while writing network-config to file: %s", err)
-	}
-
-	glog.Info("ISO contents created")
-
-	return tmpDir, nil
+	glog.Infof("ISO of %d bytes created", len(iso))
+	return iso, nil
 }
 
-func (ci *defCloudInit) uploadIso(client *libvirtClient, iso string) (string, error) {
+func (ci *defCloudInit) uploadIso(client *libvirtClient, iso []byte) (string, error) {
 	volumeDef := newDefVolume(ci.Name)
 
-	// an existing image was given, this mean we can't choose size
-	img, err := newImage(iso)
-	if err != nil {
-		return "", err
-	}
-
-	defer removeTmpIsoDirectory(iso)
+	img := &memoryImage{name: ci.Name, data: iso}
 
 	size, err := img.size()
 	if err != nil {
@@ -190,28 +165,55 @@ func (ci *defCloudInit) uploadIso(client *libvirtClient, iso string) (string, er
 	return uploadVolume(ci.PoolName, client, volumeDef, img)
 }
 
-func removeTmpIsoDirectory(iso string) {
-	err := os.RemoveAll(filepath.Dir(iso))
-	if err != nil {
-		glog.Infof("Error while removing tmp directory holding the ISO file: %s", err)
+// sshAuthorizedKeysKey is the key of the authorized keys in SSH key secrets
+const sshAuthorizedKeysKey = "authorized_keys"
+
+// getSSHAuthorizedKeys returns the keys listed in the cloud init config
+// followed by the keys of the secret, skipping empty lines and comments
+func getSSHAuthorizedKeys(ctx context.Context, cloudInit *providerconfigv1.CloudInit, kubeClient kubernetes.Interface, machineNamespace string) ([]string, error) {
+	keys := append([]string{}, cloudInit.SSHAuthorizedKeys...)
+	if cloudInit.SSHAuthorizedKeysSecret != "" {
+		data, err := getSecretData(ctx, kubeClient, machineNamespace, cloudInit.SSHAuthorizedKeysSecret, sshAuthorizedKeysKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
 	}
+	return keys, nil
 }
 
 type cloudInitParams struct {
-	UserDataScript string
-	SSHAccess      bool
+	UserDataScript    string
+	SSHAccess         bool
+	SSHAuthorizedKeys []string
+	DefaultUser       string
+}
+
+// cloudInitFuncs are the functions of the cloud init template. quote renders
+// a string as a double quoted YAML scalar, which JSON strings are.
+var cloudInitFuncs = template.FuncMap{
+	"quote": func(s string) (string, error) {
+		quoted, err := json.Marshal(s)
+		return string(quoted), err
+	},
 }
 
-func renderCloudInitStr(userDataScript []byte, sshAccess bool) (string, error) {
+func renderCloudInitStr(userDataScript []byte, sshAccess bool, sshAuthorizedKeys []string, defaultUser string) (string, error) {
 	// The bash script is rendered into cloud init file so it needs to be
 	// base64 encoded to avoid interpretation.
 	userDataEnc := base64.StdEncoding.EncodeToString(userDataScript)
 
 	params := cloudInitParams{
-		UserDataScript: userDataEnc,
-		SSHAccess:      sshAccess,
+		UserDataScript:    userDataEnc,
+		SSHAccess:         sshAccess,
+		SSHAuthorizedKeys: sshAuthorizedKeys,
+		DefaultUser:       defaultUser,
 	}
-	t, err := template.New("cloudinit").Parse(defaultCloudInitStr)
+	t, err := template.New("cloudinit").Funcs(cloudInitFuncs).Parse(defaultCloudInitStr)
 	if err != nil {
 		return "", err
 	}
@@ -243,20 +245,131 @@ runcmd:
 # Configure where output will go
 output:
   all: ">> /var/log/cloud-init.log"
-
+{{ if .DefaultUser }}
+# Rename the default user configured in cloud.cfg in the template
+user:
+  name: {{ quote .DefaultUser }}
+{{ end }}
 {{ if .SSHAccess }}
 # configure interaction with ssh server
 ssh_svcname: ssh
 ssh_deletekeys: True
 ssh_genkeytypes: ['rsa', 'ecdsa']
 
-# Install public ssh key to the first user-defined user configured
-# in cloud.cfg in the template (which is fedpra for Fedora cloud images)
+# Install the public ssh keys to the default user, the first user configured
+# in cloud.cfg in the template (which is fedora for Fedora cloud images)
+{{- if .SSHAuthorizedKeys }}
 ssh_authorized_keys:
-  - ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAACAQCkvgGhhYwEjWjD+ACW8s+DIanHqYJIC7RbgBRrvAqJQuWE87jfTtREHuW+o0qU1eIPPJzebu58VPgy3SscnrN2fKuMT2PAkevmjj4ARQmdsR/BBrmzdibe/Wnd8WEMNX82L+YrkuHoVkgafFkreSZgf/j8glGNl7IQe5gi2XDG1e+BQ+e94dxAExeRlldhQsbFvQJ+qLmDhHE4zdf/d/CqY6PwoIHlrOVLux7/pBV5SGg5eKlGCPi80oEf23LbwHYjkUXzEreBqUrWSwsdp6jIQ9zzADRQJ0+C47K6uwxy1RIe3q6t7f1eJwjmOaYYS2Sc+U1cpPHrWY3OzZJkbIZ3Fva8qVdbqhMW2ASqJ7oGpdwiRp7FTvoKlEktcc6JUK19sZ6dft79PF9nRy8nfz4obKowCZn7aqVBOW41DhaoC5oB9pfBgSPnObGnpkXITWrx/oUQ1zwrPIH150X3XuDdYXfrmDk/k+cQS7hjG328pfJs8oBhqUmyikUxjnXvDX/LQzacwDF3XKCy6Xq98bemFp8lnAG7c3tW8tYpn3Non6M3XaS2W/ece9JRZKOOCaqC52U7sg6nL/Yv11Sg9WSfJtINzNN1cKxZsIaPvorPflwqNlLWH3dPCb4KQry/54HCBvsKm1+s/yud31zk9C/CI5bFV959bLq+6ra6hAMBTw== Libvirt guest key
+{{- range .SSHAuthorizedKeys }}
+  - {{ quote . }}
+{{- end }}
+{{- end }}
 {{ end }}
 `
 
+// cloudInitInterfaceName is the name the network interface is given in the guest
+const cloudInitInterfaceName = "eth0"
+
+type networkConfigParams struct {
+	Name          string
+	MAC           string
+	Addresses     []string
+	Routes        []networkConfigRoute
+	Nameservers   []string
+	SearchDomains []string
+	MTU           int
+}
+
+type networkConfigRoute struct {
+	To  string
+	Via string
+}
+
+// renderNetworkConfigStr returns the network-config of the interface with the
+// MAC address, which is empty without interface configuration so cloud init
+// falls back to DHCP
+func renderNetworkConfigStr(config *providerconfigv1.NetworkInterfaceConfig, mac string) (string, error) {
+	if config == nil {
+		return "", nil
+	}
+	if mac == "" {
+		return "", fmt.Errorf("the network interface has no MAC address")
+	}
+
+	params := networkConfigParams{
+		Name:          cloudInitInterfaceName,
+		MAC:           strings.ToLower(mac),
+		Addresses:     config.Addresses,
+		Nameservers:   config.Nameservers,
+		SearchDomains: config.SearchDomains,
+		MTU:           config.MTU,
+	}
+	for _, gateway := range config.Gateways {
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			return "", fmt.Errorf("invalid gateway %q", gateway)
+		}
+		to := "0.0.0.0/0"
+		if ip.To4() == nil {
+			to = "::/0"
+		}
+		params.Routes = append(params.Routes, networkConfigRoute{To: to, Via: gateway})
+	}
+
+	t, err := template.New("networkconfig").Funcs(cloudInitFuncs).Parse(defaultNetworkConfigStr)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, params); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// defaultNetworkConfigStr is a network-config of version 2. All values are
+// quoted, so YAML 1.1 parsers don't read MAC addresses as numbers.
+const defaultNetworkConfigStr = `version: 2
+ethernets:
+  {{ .Name }}:
+    match:
+      macaddress: {{ quote .MAC }}
+    set-name: {{ quote .Name }}
+{{- if .Addresses }}
+    addresses:
+{{- range .Addresses }}
+      - {{ quote . }}
+{{- end }}
+{{- else }}
+    dhcp4: true
+{{- end }}
+{{- if .Routes }}
+    routes:
+{{- range .Routes }}
+      - to: {{ quote .To }}
+        via: {{ quote .Via }}
+{{- end }}
+{{- end }}
+{{- if or .Nameservers .SearchDomains }}
+    nameservers:
+{{- if .Nameservers }}
+      addresses:
+{{- range .Nameservers }}
+        - {{ quote . }}
+{{- end }}
+{{- end }}
+{{- if .SearchDomains }}
+      search:
+{{- range .SearchDomains }}
+        - {{ quote . }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- if .MTU }}
+    mtu: {{ .MTU }}
+{{- end }}
+`
+
 type metaDataParams struct {
 	InstanceID string
 }
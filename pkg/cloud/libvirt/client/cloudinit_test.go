@@ -0,0 +1,190 @@
+package client
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+)
+
+func TestRenderCloudInitStr(t *testing.T) {
+	cases := []struct {
+		name              string
+		sshAccess         bool
+		sshAuthorizedKeys []string
+		defaultUser       string
+		expectedKeys      []string
+		expectedUser      string
+	}{
+		{
+			name: "no ssh access",
+		},
+		{
+			name:      "ssh access without keys",
+			sshAccess: true,
+		},
+		{
+			name:              "ssh access with keys",
+			sshAccess:         true,
+			sshAuthorizedKeys: []string{"ssh-ed25519 AAAA admin@example.com", `ssh-rsa BBBB "quoted" comment: yes`},
+			expectedKeys:      []string{"ssh-ed25519 AAAA admin@example.com", `ssh-rsa BBBB "quoted" comment: yes`},
+		},
+		{
+			name:         "default user",
+			defaultUser:  "admin",
+			expectedUser: "admin",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rendered, err := renderCloudInitStr([]byte("echo hello"), tc.sshAccess, tc.sshAuthorizedKeys, tc.defaultUser)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Contains(rendered, "Libvirt guest key") {
+				t.Errorf("rendered cloud config contains the shared guest key")
+			}
+
+			var config struct {
+				SSHAuthorizedKeys []string `json:"ssh_authorized_keys"`
+				SSHDeleteKeys     bool     `json:"ssh_deletekeys"`
+				User              struct {
+					Name string `json:"name"`
+				} `json:"user"`
+			}
+			if err := yaml.Unmarshal([]byte(rendered), &config); err != nil {
+				t.Fatalf("rendered cloud config is not valid YAML: %v\n%s", err, rendered)
+			}
+			if !reflect.DeepEqual(config.SSHAuthorizedKeys, tc.expectedKeys) {
+				t.Errorf("expected keys %q, got %q", tc.expectedKeys, config.SSHAuthorizedKeys)
+			}
+			if config.SSHDeleteKeys != tc.sshAccess {
+				t.Errorf("expected ssh configuration %v, got %v", tc.sshAccess, config.SSHDeleteKeys)
+			}
+			if config.User.Name != tc.expectedUser {
+				t.Errorf("expected default user %q, got %q", tc.expectedUser, config.User.Name)
+			}
+		})
+	}
+}
+
+func TestGetSSHAuthorizedKeys(t *testing.T) {
+	kubeClient := kubernetesfake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssh-keys", Namespace: "default"},
+		Data: map[string][]byte{
+			sshAuthorizedKeysKey: []byte("# admins\nssh-ed25519 AAAA alice@example.com\n\n  ssh-rsa BBBB bob@example.com  \n"),
+		},
+	})
+
+	keys, err := getSSHAuthorizedKeys(context.TODO(), &providerconfigv1.CloudInit{
+		SSHAuthorizedKeys:       []string{"ssh-ed25519 CCCC ci@example.com"},
+		SSHAuthorizedKeysSecret: "ssh-keys",
+	}, kubeClient, "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"ssh-ed25519 CCCC ci@example.com", "ssh-ed25519 AAAA alice@example.com", "ssh-rsa BBBB bob@example.com"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %q, got %q", expected, keys)
+	}
+
+	if _, err := getSSHAuthorizedKeys(context.TODO(), &providerconfigv1.CloudInit{SSHAuthorizedKeysSecret: "missing"}, kubeClient, "default"); err == nil {
+		t.Error("expected error for missing secret")
+	}
+}
+
+func TestRenderNetworkConfigStr(t *testing.T) {
+	type ethernet struct {
+		Match struct {
+			MACAddress string `json:"macaddress"`
+		} `json:"match"`
+		SetName     string   `json:"set-name"`
+		DHCP4       bool     `json:"dhcp4"`
+		Addresses   []string `json:"addresses"`
+		Routes      []map[string]string
+		Nameservers struct {
+			Addresses []string `json:"addresses"`
+			Search    []string `json:"search"`
+		} `json:"nameservers"`
+		MTU int `json:"mtu"`
+	}
+	type networkConfig struct {
+		Version   int                 `json:"version"`
+		Ethernets map[string]ethernet `json:"ethernets"`
+	}
+
+	cases := []struct {
+		name     string
+		config   *providerconfigv1.NetworkInterfaceConfig
+		expected func(*ethernet)
+	}{
+		{
+			name: "no config",
+		},
+		{
+			name:   "dhcp with MTU",
+			config: &providerconfigv1.NetworkInterfaceConfig{MTU: 9000},
+			expected: func(e *ethernet) {
+				e.DHCP4 = true
+				e.MTU = 9000
+			},
+		},
+		{
+			name: "static dual stack",
+			config: &providerconfigv1.NetworkInterfaceConfig{
+				Addresses:     []string{"192.168.126.51/24", "fd00::51/64"},
+				Gateways:      []string{"192.168.126.1", "fd00::1"},
+				Nameservers:   []string{"192.168.126.1"},
+				SearchDomains: []string{"example.com"},
+			},
+			expected: func(e *ethernet) {
+				e.Addresses = []string{"192.168.126.51/24", "fd00::51/64"}
+				e.Routes = []map[string]string{{"to": "0.0.0.0/0", "via": "192.168.126.1"}, {"to": "::/0", "via": "fd00::1"}}
+				e.Nameservers.Addresses = []string{"192.168.126.1"}
+				e.Nameservers.Search = []string{"example.com"}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rendered, err := renderNetworkConfigStr(tc.config, "52:54:00:12:34:56")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expected == nil {
+				if rendered != "" {
+					t.Errorf("expected empty network-config, got:\n%s", rendered)
+				}
+				return
+			}
+			// quoted, so YAML 1.1 does not read it as a base 60 number
+			if !strings.Contains(rendered, `macaddress: "52:54:00:12:34:56"`) {
+				t.Errorf("MAC address is not quoted:\n%s", rendered)
+			}
+
+			var config networkConfig
+			if err := yaml.Unmarshal([]byte(rendered), &config); err != nil {
+				t.Fatalf("network-config is not valid YAML: %v\n%s", err, rendered)
+			}
+			expected := ethernet{SetName: "eth0"}
+			expected.Match.MACAddress = "52:54:00:12:34:56"
+			tc.expected(&expected)
+			if config.Version != 2 || len(config.Ethernets) != 1 || !reflect.DeepEqual(config.Ethernets["eth0"], expected) {
+				t.Errorf("unexpected network-config %+v, expected eth0 %+v:\n%s", config, expected, rendered)
+			}
+		})
+	}
+
+	if _, err := renderNetworkConfigStr(&providerconfigv1.NetworkInterfaceConfig{}, ""); err == nil {
+		t.Error("expected error without MAC address")
+	}
+}
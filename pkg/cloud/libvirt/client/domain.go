@@ -17,6 +17,7 @@ import (
 	libvirt "github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 	"github.com/openshift/cluster-api-provider-libvirt/lib/cidr"
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
 )
 
 // ErrLibVirtConIsNil is returned when the libvirt connection is nil.
@@ -204,11 +205,74 @@ func newDomainDefForConnection(virConn *libvirt.Connect) (libvirtxml.Domain, err
 	return d, nil
 }
 
-func setCoreOSIgnition(domainDef *libvirtxml.Domain, ignKey string, arch string) error {
+// fwCfgIgnitionName is the firmware configuration entry Ignition reads its config from
+const fwCfgIgnitionName = "opt/com.coreos/config"
+
+// domainSysInfoFWCfg is a <sysinfo type='fwcfg'> element, which
+// libvirt-go-xml does not support yet
+type domainSysInfoFWCfg struct {
+	Type  string                    `xml:"type,attr"`
+	Entry []domainSysInfoFWCfgEntry `xml:"entry"`
+}
+
+type domainSysInfoFWCfgEntry struct {
+	Name string `xml:"name,attr"`
+	File string `xml:"file,attr"`
+}
+
+// domainWithFWCfg marshals a domain with firmware configuration entries in
+// addition to its sysinfo
+type domainWithFWCfg struct {
+	libvirtxml.Domain
+	SysInfo []interface{} `xml:"sysinfo"`
+}
+
+// withFWCfg returns the domain definition to marshal, including a fwcfg
+// sysinfo element with the entries if there are any
+func withFWCfg(domainDef libvirtxml.Domain, fwCfg []domainSysInfoFWCfgEntry) interface{} {
+	if len(fwCfg) == 0 {
+		return domainDef
+	}
+	def := domainWithFWCfg{Domain: domainDef}
+	if domainDef.SysInfo != nil {
+		def.SysInfo = append(def.SysInfo, domainDef.SysInfo)
+	}
+	def.SysInfo = append(def.SysInfo, domainSysInfoFWCfg{Type: "fwcfg", Entry: fwCfg})
+	return def
+}
+
+// ignitionDelivery returns the delivery of the ignition config, the
+// virtio-blk disk on architectures without firmware configuration device
+func ignitionDelivery(delivery providerconfigv1.IgnitionDelivery, arch string) (providerconfigv1.IgnitionDelivery, error) {
+	noFWCfg := strings.HasPrefix(arch, "s390") || strings.HasPrefix(arch, "ppc64")
+	switch delivery {
+	case "":
+		if noFWCfg {
+			return providerconfigv1.IgnitionDeliveryDisk, nil
+		}
+		return providerconfigv1.IgnitionDeliveryQEMUCommandLine, nil
+	case providerconfigv1.IgnitionDeliveryQEMUCommandLine, providerconfigv1.IgnitionDeliveryFirmwareConfig:
+		if noFWCfg {
+			return "", fmt.Errorf("ignition delivery %s is not supported on %s", delivery, arch)
+		}
+		return delivery, nil
+	case providerconfigv1.IgnitionDeliveryDisk:
+		return delivery, nil
+	default:
+		return "", fmt.Errorf("unsupported ignition delivery %q", delivery)
+	}
+}
+
+func setCoreOSIgnition(domainDef *libvirtxml.Domain, fwCfg *[]domainSysInfoFWCfgEntry, ignKey string, arch string, delivery providerconfigv1.IgnitionDelivery) error {
 	if ignKey == "" {
 		return fmt.Errorf("error setting coreos ignition, ignKey is empty")
 	}
-	if strings.HasPrefix(arch, "s390") || strings.HasPrefix(arch, "ppc64") {
+	delivery, err := ignitionDelivery(delivery, arch)
+	if err != nil {
+		return err
+	}
+	switch delivery {
+	case providerconfigv1.IgnitionDeliveryDisk:
 		// System Z and PowerPC do not support the Firmware Configuration
 		// device. After a discussion about the best way to support a similar
 		// method for qemu in https://github.com/coreos/ignition/issues/928,
@@ -223,7 +287,7 @@ func setCoreOSIgnition(domainDef *libvirtxml.Domain, ignKey string, arch string)
 				},
 			},
 			Target: &libvirtxml.DomainDiskTarget{
-				Dev: "vdb",
+				Dev: fmt.Sprintf("vd%s", diskLetterForIndex(nextVirtioDiskIndex(domainDef))),
 				Bus: "virtio",
 			},
 			Driver: &libvirtxml.DomainDiskDriver{
@@ -234,7 +298,14 @@ func setCoreOSIgnition(domainDef *libvirtxml.Domain, ignKey string, arch string)
 			Serial:   "ignition",
 		}
 		domainDef.Devices.Disks = append(domainDef.Devices.Disks, igndisk)
-	} else {
+	case providerconfigv1.IgnitionDeliveryFirmwareConfig:
+		// libvirt adds the entry to the firmware configuration device itself,
+		// so the domain needs no QEMU command line passthrough
+		*fwCfg = append(*fwCfg, domainSysInfoFWCfgEntry{
+			Name: fwCfgIgnitionName,
+			File: ignKey,
+		})
+	default:
 		domainDef.QEMUCommandline = &libvirtxml.DomainQEMUCommandline{
 			Args: []libvirtxml.DomainQEMUCommandlineArg{
 				{
@@ -242,7 +313,7 @@ func setCoreOSIgnition(domainDef *libvirtxml.Domain, ignKey string, arch string)
 					Value: "-fw_cfg",
 				},
 				{
-					Value: fmt.Sprintf("name=opt/com.coreos/config,file=%s", ignKey),
+					Value: fmt.Sprintf("name=%s,file=%s", fwCfgIgnitionName, ignKey),
 				},
 			},
 		}
@@ -291,19 +362,55 @@ func randomWWN(strlen int) string {
 	return oui + string(result)
 }
 
-func setDisks(domainDef *libvirtxml.Domain, diskVolume *libvirt.StorageVol) error {
-	disk := newDefDisk(0)
+func setDisk(domainDef *libvirtxml.Domain, diskVolume *libvirt.StorageVol) error {
+	disk := newDefDisk(nextVirtioDiskIndex(domainDef))
 	glog.Info("Getting disk volume")
 	diskVolumeFile, err := diskVolume.GetPath()
 	if err != nil {
 		return fmt.Errorf("Error retrieving volume file: %s", err)
 	}
 
+	diskVolumeDef, err := newDefVolumeFromLibvirt(diskVolume)
+	if err != nil {
+		return fmt.Errorf("Error retrieving volume definition: %s", err)
+	}
+	if diskVolumeDef.Target != nil && diskVolumeDef.Target.Format != nil && diskVolumeDef.Target.Format.Type != "" {
+		disk.Driver.Type = diskVolumeDef.Target.Format.Type
+	}
+	if diskVolumeDef.Target != nil {
+		disk.Encryption = newDefDiskEncryption(diskVolumeDef.Target.Encryption)
+	}
+
+	diskPool, err := diskVolume.LookupPoolByVolume()
+	if err != nil {
+		return fmt.Errorf("Error retrieving volume pool: %s", err)
+	}
+	defer diskPool.Free()
+	diskPoolDef, err := newDefPoolFromLibvirt(diskPool)
+	if err != nil {
+		return err
+	}
+
 	glog.Info("Constructing domain disk source")
-	disk.Source = &libvirtxml.DomainDiskSource{
-		File: &libvirtxml.DomainDiskSourceFile{
-			File: diskVolumeFile,
-		},
+	if networkPoolTypes[diskPoolDef.Type] {
+		// volumes of network pools are not files on the host, qemu
+		// accesses them through the pool. They are raw unless the pool
+		// reports a format.
+		if diskVolumeDef.Target == nil || diskVolumeDef.Target.Format == nil || diskVolumeDef.Target.Format.Type == "" {
+			disk.Driver.Type = "raw"
+		}
+		disk.Source = &libvirtxml.DomainDiskSource{
+			Volume: &libvirtxml.DomainDiskSourceVolume{
+				Pool:   diskPoolDef.Name,
+				Volume: diskVolumeDef.Name,
+			},
+		}
+	} else {
+		disk.Source = &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: diskVolumeFile,
+			},
+		}
 	}
 
 	domainDef.Devices.Disks = append(domainDef.Devices.Disks, disk)
@@ -311,6 +418,54 @@ func setDisks(domainDef *libvirtxml.Domain, diskVolume *libvirt.StorageVol) erro
 	return nil
 }
 
+// nextVirtioDiskIndex returns the index of the next free virtio disk name
+func nextVirtioDiskIndex(domainDef *libvirtxml.Domain) int {
+	i := 0
+	if domainDef.Devices == nil {
+		return i
+	}
+	for _, disk := range domainDef.Devices.Disks {
+		if disk.Target != nil && disk.Target.Bus == "virtio" {
+			i++
+		}
+	}
+	return i
+}
+
+// newDefDomainFromLibvirt returns the definition of a domain
+func newDefDomainFromLibvirt(domain *libvirt.Domain) (libvirtxml.Domain, error) {
+	domainXMLDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return libvirtxml.Domain{}, fmt.Errorf("could not get XML description for domain: %v", err)
+	}
+	var domainDef libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(domainXMLDesc), &domainDef); err != nil {
+		return libvirtxml.Domain{}, fmt.Errorf("could not parse XML description for domain: %v", err)
+	}
+	return domainDef, nil
+}
+
+// diskTargetByVolume returns the target device of the disk with the volume as
+// source, attached either by its file path or by its pool and volume name, or
+// an empty string if the domain has no such disk
+func diskTargetByVolume(domainDef libvirtxml.Domain, path string, poolName string, volumeName string) string {
+	if domainDef.Devices == nil {
+		return ""
+	}
+	for _, disk := range domainDef.Devices.Disks {
+		if disk.Source == nil || disk.Target == nil {
+			continue
+		}
+		if disk.Source.File != nil && disk.Source.File.File == path {
+			return disk.Target.Dev
+		}
+		if disk.Source.Volume != nil && disk.Source.Volume.Pool == poolName && disk.Source.Volume.Volume == volumeName {
+			return disk.Target.Dev
+		}
+	}
+	return ""
+}
+
 // return an indented XML
 func xmlMarshallIndented(b interface{}) (string, error) {
 	buf := new(bytes.Buffer)
@@ -328,9 +483,11 @@ func setNetworkInterfaces(
 	partialNetIfaces map[string]*pendingMapping,
 	waitForLeases *[]*libvirtxml.DomainInterface,
 	networkInterfaceHostname string,
+	networkInterfaceHostAliases []string,
 	networkInterfaceName string,
 	networkInterfaceAddress string,
 	reservedLeases *Leases,
+	networkInterfaceMTU uint,
 ) error {
 
 	// TODO: support more than 1 interface
@@ -351,6 +508,11 @@ func setNetworkInterfaces(
 		netIface.MAC = &libvirtxml.DomainInterfaceMAC{
 			Address: mac,
 		}
+		if networkInterfaceMTU != 0 {
+			netIface.MTU = &libvirtxml.DomainInterfaceMTU{
+				Size: networkInterfaceMTU,
+			}
+		}
 
 		if networkInterfaceName != "" {
 			// when using a "network_id" we are referring to a "network resource"
@@ -405,6 +567,12 @@ func setNetworkInterfaces(
 					if err := updateOrAddHost(network, ip.String(), mac, hostname); err != nil {
 						return err
 					}
+
+					hostnames := append([]string{hostname}, networkInterfaceHostAliases...)
+					glog.Infof("Adding DNS IP/hosts=%s/%v to %s", ip.String(), hostnames, networkName)
+					if err := updateOrAddDNSHost(network, ip.String(), hostnames); err != nil {
+						return err
+					}
 				} else {
 					// no IPs provided: if the hostname has been provided, wait until we get an IP
 					wait := false
@@ -440,6 +608,15 @@ func setNetworkInterfaces(
 	return nil
 }
 
+// networkInterfaceMTU returns the MTU of the network interface, 0 for the
+// default of the network
+func networkInterfaceMTU(config *providerconfigv1.NetworkInterfaceConfig) uint {
+	if config == nil || config.MTU <= 0 {
+		return 0
+	}
+	return uint(config.MTU)
+}
+
 // Config struct for the libvirt-provider
 type Config struct {
 	URI string
@@ -1,10 +1,13 @@
 package client
 
 import (
+	"fmt"
 	"runtime"
+	"strings"
 	"testing"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
 )
 
 func TestSetCoreOSIgnition(t *testing.T) {
@@ -28,8 +31,9 @@ func TestSetCoreOSIgnition(t *testing.T) {
 TestCases:
 	for i, tc := range testCases {
 		domainDef := libvirtxml.Domain{}
+		var fwCfg []domainSysInfoFWCfgEntry
 
-		err := setCoreOSIgnition(&domainDef, tc.ignKey, runtime.GOARCH)
+		err := setCoreOSIgnition(&domainDef, &fwCfg, tc.ignKey, runtime.GOARCH, "")
 		// if err, verify it returns expected error
 		if err != nil {
 			if err.Error() != tc.errorMessage {
@@ -48,3 +52,166 @@ TestCases:
 		}
 	}
 }
+
+func TestSetCoreOSIgnitionDelivery(t *testing.T) {
+	cases := []struct {
+		name           string
+		arch           string
+		delivery       providerconfigv1.IgnitionDelivery
+		expectQEMUArgs bool
+		expectFWCfg    bool
+		expectDisk     bool
+		expectError    bool
+	}{
+		{
+			name:           "default on x86_64",
+			arch:           "x86_64",
+			expectQEMUArgs: true,
+		},
+		{
+			name:       "default on s390x",
+			arch:       "s390x",
+			expectDisk: true,
+		},
+		{
+			name:        "firmware config on x86_64",
+			arch:        "x86_64",
+			delivery:    providerconfigv1.IgnitionDeliveryFirmwareConfig,
+			expectFWCfg: true,
+		},
+		{
+			name:       "disk on aarch64",
+			arch:       "aarch64",
+			delivery:   providerconfigv1.IgnitionDeliveryDisk,
+			expectDisk: true,
+		},
+		{
+			name:        "firmware config on ppc64le",
+			arch:        "ppc64le",
+			delivery:    providerconfigv1.IgnitionDeliveryFirmwareConfig,
+			expectError: true,
+		},
+		{
+			name:        "unsupported delivery",
+			arch:        "x86_64",
+			delivery:    "Floppy",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			domainDef := libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{}}
+			var fwCfg []domainSysInfoFWCfgEntry
+			err := setCoreOSIgnition(&domainDef, &fwCfg, "/var/lib/libvirt/images/worker.ign", tc.arch, tc.delivery)
+			if tc.expectError {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (domainDef.QEMUCommandline != nil) != tc.expectQEMUArgs {
+				t.Errorf("expected QEMU command line %v, got %+v", tc.expectQEMUArgs, domainDef.QEMUCommandline)
+			}
+			if (len(fwCfg) == 1) != tc.expectFWCfg {
+				t.Errorf("expected fwcfg entry %v, got %+v", tc.expectFWCfg, fwCfg)
+			}
+			if tc.expectFWCfg && (fwCfg[0].Name != "opt/com.coreos/config" || fwCfg[0].File != "/var/lib/libvirt/images/worker.ign") {
+				t.Errorf("unexpected fwcfg entry %+v", fwCfg[0])
+			}
+			if (len(domainDef.Devices.Disks) == 1) != tc.expectDisk {
+				t.Errorf("expected ignition disk %v, got %+v", tc.expectDisk, domainDef.Devices.Disks)
+			}
+			if tc.expectDisk && domainDef.Devices.Disks[0].Serial != "ignition" {
+				t.Errorf("unexpected ignition disk %+v", domainDef.Devices.Disks[0])
+			}
+		})
+	}
+}
+
+func TestWithFWCfg(t *testing.T) {
+	domainDef := libvirtxml.Domain{
+		Type: "kvm",
+		Name: "worker",
+		SysInfo: &libvirtxml.DomainSysInfo{
+			Type:   "smbios",
+			System: &libvirtxml.DomainSysInfoSystem{Entry: []libvirtxml.DomainSysInfoEntry{{Name: "serial", Value: "1234"}}},
+		},
+	}
+
+	data, err := xmlMarshallIndented(withFWCfg(domainDef, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(data, "fwcfg") {
+		t.Errorf("expected no fwcfg sysinfo without entries:\n%s", data)
+	}
+
+	data, err = xmlMarshallIndented(withFWCfg(domainDef, []domainSysInfoFWCfgEntry{{Name: "opt/com.coreos/config", File: "/var/lib/libvirt/images/worker.ign"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<domain type="kvm">`,
+		`<name>worker</name>`,
+		`<sysinfo type="smbios">`,
+		`<sysinfo type="fwcfg">`,
+		`<entry name="opt/com.coreos/config" file="/var/lib/libvirt/images/worker.ign"></entry>`,
+	} {
+		if !strings.Contains(data, expected) {
+			t.Errorf("expected %s in domain XML:\n%s", expected, data)
+		}
+	}
+}
+
+func TestDiskTargetByVolume(t *testing.T) {
+	domainDef := newDomainDef()
+	domainDef.Devices.Disks = nil
+	root := newDefDisk(0)
+	root.Source = &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker"}}
+	data := newDefDisk(1)
+	data.Source = &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker_data"}}
+	rbd := newDefDisk(2)
+	rbd.Source = &libvirtxml.DomainDiskSource{Volume: &libvirtxml.DomainDiskSourceVolume{Pool: "ceph", Volume: "worker_scratch"}}
+	domainDef.Devices.Disks = append(domainDef.Devices.Disks, root, data, rbd)
+
+	if target := diskTargetByVolume(domainDef, "/var/lib/libvirt/images/worker_data", "default", "worker_data"); target != "vdb" {
+		t.Errorf("expected target vdb, got %q", target)
+	}
+	if target := diskTargetByVolume(domainDef, "rbd/worker_scratch", "ceph", "worker_scratch"); target != "vdc" {
+		t.Errorf("expected target vdc for a volume source, got %q", target)
+	}
+	if target := diskTargetByVolume(domainDef, "rbd/worker_scratch", "other", "worker_scratch"); target != "" {
+		t.Errorf("expected no target for a volume of another pool, got %q", target)
+	}
+	if target := diskTargetByVolume(domainDef, "/var/lib/libvirt/images/other", "default", "other"); target != "" {
+		t.Errorf("expected no target, got %q", target)
+	}
+	if target := diskTargetByVolume(libvirtxml.Domain{}, "/var/lib/libvirt/images/worker", "default", "worker"); target != "" {
+		t.Errorf("expected no target for domain without devices, got %q", target)
+	}
+}
+
+func TestNextVirtioDiskIndex(t *testing.T) {
+	domainDef := libvirtxml.Domain{}
+	if i := nextVirtioDiskIndex(&domainDef); i != 0 {
+		t.Errorf("expected index 0 without devices, got %d", i)
+	}
+
+	domainDef.Devices = &libvirtxml.DomainDeviceList{
+		Disks: []libvirtxml.DomainDisk{
+			{Target: &libvirtxml.DomainDiskTarget{Dev: "vda", Bus: "virtio"}},
+			{Target: &libvirtxml.DomainDiskTarget{Dev: "hdd", Bus: "ide"}},
+			{Target: &libvirtxml.DomainDiskTarget{Dev: "vdb", Bus: "virtio"}},
+		},
+	}
+	if i := nextVirtioDiskIndex(&domainDef); i != 2 {
+		t.Errorf("expected index 2, got %d", i)
+	}
+	if dev := fmt.Sprintf("vd%s", diskLetterForIndex(nextVirtioDiskIndex(&domainDef))); dev != "vdc" {
+		t.Errorf("expected next disk vdc, got %s", dev)
+	}
+}
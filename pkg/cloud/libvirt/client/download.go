@@ -0,0 +1,393 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxRetryBackoff caps the delay between download retries
+const maxRetryBackoff = 5 * time.Minute
+
+// RetryError is returned when an operation did not complete yet and is to
+// be retried after a delay, e.g. a failed download which is resumed later
+type RetryError struct {
+	After time.Duration
+	Err   error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v, retrying in %s", e.Err, e.After)
+}
+
+// DownloadOptions configures the download of http(s) images
+type DownloadOptions struct {
+	// StagingDir as directory downloads are kept in until they are complete
+	StagingDir string
+
+	// Retries as number of times a failed download is resumed
+	Retries int
+
+	// RetryBackoff as delay before the first retry, doubled for every further retry
+	RetryBackoff time.Duration
+
+	// Timeout as maximum time to connect, to wait for a response or to wait for further data
+	Timeout time.Duration
+
+	// ProxyURL as proxy used for all downloads instead of the one from the environment
+	ProxyURL string
+
+	// CAFile as PEM bundle of CAs trusted in addition to the system CAs
+	CAFile string
+
+	// PlainHTTPRegistries as registries, host or host:port, images are pulled from over http instead of https
+	PlainHTTPRegistries []string
+}
+
+// DefaultDownloadOptions returns the options images are downloaded with unless configured otherwise
+func DefaultDownloadOptions() DownloadOptions {
+	return DownloadOptions{
+		StagingDir:   os.TempDir(),
+		Retries:      5,
+		RetryBackoff: 5 * time.Second,
+		Timeout:      time.Minute,
+	}
+}
+
+var (
+	defaultDownloaderLock sync.Mutex
+	defaultDownloader     = mustNewDownloader(DefaultDownloadOptions())
+)
+
+// SetDownloadOptions configures the download of http(s) images for all clients
+func SetDownloadOptions(options DownloadOptions) error {
+	d, err := newDownloader(options)
+	if err != nil {
+		return err
+	}
+	defaultDownloaderLock.Lock()
+	defer defaultDownloaderLock.Unlock()
+	defaultDownloader = d
+	return nil
+}
+
+func getDefaultDownloader() *downloader {
+	defaultDownloaderLock.Lock()
+	defer defaultDownloaderLock.Unlock()
+	return defaultDownloader
+}
+
+type downloader struct {
+	client  *http.Client
+	options DownloadOptions
+
+	// failures counts the failed attempts to download an URL in a row
+	failuresLock sync.Mutex
+	failures     map[string]int
+}
+
+func mustNewDownloader(options DownloadOptions) *downloader {
+	d, err := newDownloader(options)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func newDownloader(options DownloadOptions) (*downloader, error) {
+	proxy := http.ProxyFromEnvironment
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", options.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// the body of an image takes as long as it takes, so instead of limiting
+	// the whole request only the phases before it are limited here and
+	// stalled transfers are detected while reading it
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   options.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   options.Timeout,
+		ResponseHeaderTimeout: options.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &downloader{
+		client:   &http.Client{Transport: transport},
+		options:  options,
+		failures: map[string]int{},
+	}, nil
+}
+
+// remoteFile describes the content of an URL
+type remoteFile struct {
+	// size is -1 if the server does not send a Content-Length
+	size int64
+	// validator is the ETag or Last-Modified header identifying the content
+	validator string
+}
+
+func (d *downloader) stat(u string) (remoteFile, error) {
+	response, err := d.client.Head(u)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return remoteFile{}, fmt.Errorf("Error accessing remote resource: %s - %s", u, response.Status)
+	}
+
+	file := remoteFile{size: response.ContentLength}
+	// weak ETags can't be used for range requests
+	if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		file.validator = etag
+	} else {
+		file.validator = response.Header.Get("Last-Modified")
+	}
+	return file, nil
+}
+
+// stagingPath returns the path a download of the URL is kept at until it is
+// complete. The name starts with the stagingPrefix of the URL, followed by a
+// hash of the content of the URL.
+func (d *downloader) stagingPath(u string, file remoteFile) string {
+	hash := sha256.Sum256([]byte(u + "\n" + file.validator + "\n" + strconv.FormatInt(file.size, 10)))
+	return filepath.Join(d.options.StagingDir, fmt.Sprintf("%s%x.part", stagingPrefix(u), hash))
+}
+
+// stagingPrefix returns the prefix of the names of the staging files of the URL
+func stagingPrefix(u string) string {
+	hash := sha256.Sum256([]byte(u))
+	return fmt.Sprintf("image-%x-", hash[:8])
+}
+
+// pruneStagingFiles removes the staging files of earlier content of the URL,
+// which can't be resumed anymore once the content has changed
+func (d *downloader) pruneStagingFiles(u string, path string) {
+	stale, err := filepath.Glob(filepath.Join(d.options.StagingDir, stagingPrefix(u)+"*.part"))
+	if err != nil {
+		glog.Errorf("Error listing staging files of %s: %v", u, err)
+		return
+	}
+	for _, p := range stale {
+		if p != path {
+			glog.Infof("Removing stale staging file %s of %s", p, u)
+			removeStagingFile(p)
+		}
+	}
+}
+
+// download downloads the URL into a staging file and returns its path.
+// Downloads are resumed where they stopped as long as the content of the URL
+// has not changed. Instead of waiting for the backoff, a failed download
+// returns a RetryError until the retries are used up, so the caller can try
+// again later.
+func (d *downloader) download(u string) (string, error) {
+	file, err := d.stat(u)
+	if err != nil {
+		return "", err
+	}
+	return d.downloadFile(u, file, d.client.Do)
+}
+
+// downloadFile downloads the content of the URL described by the file like
+// download. Requests are sent with do, so callers like registries can
+// authenticate them.
+func (d *downloader) downloadFile(u string, file remoteFile, do func(*http.Request) (*http.Response, error)) (string, error) {
+	path := d.stagingPath(u, file)
+	d.pruneStagingFiles(u, path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("error opening staging file: %v", err)
+	}
+	defer f.Close()
+
+	err = d.fetch(u, f, file, do)
+	d.failuresLock.Lock()
+	defer d.failuresLock.Unlock()
+	if err == nil {
+		delete(d.failures, u)
+		return path, nil
+	}
+
+	d.failures[u]++
+	failures := d.failures[u]
+	if failures > d.options.Retries {
+		delete(d.failures, u)
+		return "", fmt.Errorf("Error while downloading %s after %d attempts: %v", u, failures, err)
+	}
+
+	backoff := d.options.RetryBackoff
+	for i := 1; i < failures && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	glog.Warningf("Error while downloading %s, resuming in %s: %v", u, backoff, err)
+	return "", &RetryError{After: backoff, Err: fmt.Errorf("Error while downloading %s: %v", u, err)}
+}
+
+// fetch downloads the rest of the URL into the staging file
+func (d *downloader) fetch(u string, f *os.File, file remoteFile, do func(*http.Request) (*http.Response, error)) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	// without a validator the staging file may hold other content of the
+	// same size
+	if file.validator == "" && offset > 0 {
+		if offset, err = truncate(f); err != nil {
+			return err
+		}
+	}
+	if file.size >= 0 && offset == file.size {
+		glog.Infof("Download of %s is already complete", u)
+		return nil
+	}
+	// resuming requires the size to tell where the download stopped
+	if file.size < 0 || offset > file.size {
+		if offset, err = truncate(f); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		glog.Infof("Resuming download of %s at %d bytes", u, offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if file.validator != "" {
+			req.Header.Set("If-Range", file.validator)
+		}
+	}
+
+	response, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			truncate(f)
+			return fmt.Errorf("unexpected content range %q", response.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// the server sends the whole content
+		if offset > 0 {
+			if offset, err = truncate(f); err != nil {
+				return err
+			}
+		}
+	default:
+		if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			truncate(f)
+		}
+		return fmt.Errorf("Error accessing remote resource: %s - %s", u, response.Status)
+	}
+
+	body := newIdleTimeoutReader(response.Body, d.options.Timeout, cancel)
+	defer body.stop()
+	n, err := io.Copy(f, body)
+	if err != nil {
+		if body.timedOut() {
+			return fmt.Errorf("no data received for %s after %d bytes", d.options.Timeout, offset+n)
+		}
+		return err
+	}
+	if file.size >= 0 && offset+n != file.size {
+		return fmt.Errorf("download stopped after %d of %d bytes", offset+n, file.size)
+	}
+	glog.Infof("Downloaded %d bytes of %s", offset+n, u)
+	return nil
+}
+
+func truncate(f *os.File) (int64, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	return f.Seek(0, io.SeekStart)
+}
+
+// idleTimeoutReader cancels a request when its body does not deliver data
+// for the timeout
+type idleTimeoutReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+
+	lock    sync.Mutex
+	expired bool
+}
+
+func newIdleTimeoutReader(reader io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	r := &idleTimeoutReader{reader: reader, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.lock.Lock()
+		r.expired = true
+		r.lock.Unlock()
+		cancel()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) stop() {
+	r.timer.Stop()
+}
+
+func (r *idleTimeoutReader) timedOut() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.expired
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadResumes(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1000)
+
+	var lock sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == "GET" {
+			ranges = append(ranges, r.Header.Get("Range"))
+			// cut the first download short
+			if len(ranges) == 1 {
+				w.Header().Set("Content-Length", "5000")
+				w.Write(content[:2000])
+				return
+			}
+		}
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	d, err := newDownloader(DownloadOptions{
+		StagingDir:   t.TempDir(),
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Timeout:      time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.download(server.URL)
+	if retry, ok := err.(*RetryError); !ok || retry.After != time.Millisecond {
+		t.Fatalf("expected retry error, got %v", err)
+	}
+	path, err := d.download(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	downloaded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Errorf("downloaded content does not match")
+	}
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "bytes=2000-" {
+		t.Errorf("expected download to be resumed at 2000 bytes, got ranges %q", ranges)
+	}
+
+	// a complete download is not downloaded again
+	if _, err := d.download(server.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ranges) != 2 {
+		t.Errorf("expected no further download, got ranges %q", ranges)
+	}
+}
+
+func TestDownloadPrunesStaleStagingFiles(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1000)
+
+	var lock sync.Mutex
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("ETag", etag)
+		// cut the download of the first version short
+		if r.Method == "GET" && etag == `"v1"` {
+			w.Header().Set("Content-Length", "5000")
+			w.Write(content[:2000])
+			return
+		}
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	d, err := newDownloader(DownloadOptions{
+		StagingDir:   dir,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Timeout:      time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, stagingPrefix(server.URL+"/other")+"0.part")
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.download(server.URL); err == nil {
+		t.Fatalf("expected error")
+	}
+	lock.Lock()
+	etag = `"v2"`
+	lock.Unlock()
+	path, err := d.download(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	expected := []string{path, other}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected staging files %q, got %q", expected, files)
+	}
+}
+
+func TestDownloadGivesUp(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		if r.Method == "GET" {
+			lock.Lock()
+			attempts++
+			lock.Unlock()
+			// stall after the first bytes
+			w.Write([]byte("image"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	d, err := newDownloader(DownloadOptions{
+		StagingDir:   t.TempDir(),
+		Retries:      1,
+		RetryBackoff: time.Millisecond,
+		Timeout:      100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.download(server.URL)
+	if _, ok := err.(*RetryError); !ok {
+		t.Fatalf("expected retry error, got %v", err)
+	}
+	_, err = d.download(server.URL)
+	if _, ok := err.(*RetryError); ok || err == nil || !strings.Contains(err.Error(), "no data received") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestNewDownloaderInvalidOptions(t *testing.T) {
+	if _, err := newDownloader(DownloadOptions{CAFile: "/nonexistent/ca.pem"}); err == nil {
+		t.Errorf("expected error for missing CA file")
+	}
+	if _, err := newDownloader(DownloadOptions{ProxyURL: "://proxy"}); err == nil {
+		t.Errorf("expected error for invalid proxy URL")
+	}
+}
@@ -16,7 +16,7 @@ import (
 	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
 )
 
-func setIgnition(ctx context.Context, domainDef *libvirtxml.Domain, client *libvirtClient, ignition *providerconfigv1.Ignition, kubeClient kubernetes.Interface, machineNamespace, volumeName string, arch string) error {
+func setIgnition(ctx context.Context, domainDef *libvirtxml.Domain, fwCfg *[]domainSysInfoFWCfgEntry, client *libvirtClient, ignition *providerconfigv1.Ignition, kubeClient kubernetes.Interface, machineNamespace, volumeName, hostName string, arch string) error {
 	glog.Info("Creating ignition file")
 	ignitionDef := newIgnitionDef()
 
@@ -33,23 +33,77 @@ func setIgnition(ctx context.Context, domainDef *libvirtxml.Domain, client *libv
 		return fmt.Errorf("can not retrieve user data secret '%v/%v' when constructing cloud init volume: key 'userData' not found in the secret", machineNamespace, ignition.UserDataSecret)
 	}
 
+	additions, err := getIgnitionAdditions(ctx, ignition, kubeClient, machineNamespace, hostName)
+	if err != nil {
+		return err
+	}
+	userData, err := mergeIgnition(userDataSecret, additions)
+	if err != nil {
+		return fmt.Errorf("user data secret '%v/%v': %v", machineNamespace, ignition.UserDataSecret, err)
+	}
+
 	ignitionDef.Name = volumeName
-	ignitionDef.PoolName = client.poolName
-	ignitionDef.Content = string(userDataSecret)
+	ignitionDef.PoolName = ignition.PoolName
+	ignitionDef.Content = string(userData)
 
-	glog.Infof("Ignition: %+v", ignitionDef)
+	glog.Infof("Ignition volume %s in pool %q with %d bytes", ignitionDef.Name, ignitionDef.PoolName, len(ignitionDef.Content))
 
 	ignitionVolumeName, err := ignitionDef.createAndUpload(client)
 	if err != nil {
 		return err
 	}
 
-	if err = setCoreOSIgnition(domainDef, ignitionVolumeName, arch); err != nil {
+	if err = setCoreOSIgnition(domainDef, fwCfg, ignitionVolumeName, arch, ignition.Delivery); err != nil {
 		return err
 	}
 	return nil
 }
 
+// getIgnitionAdditions collects the hostname, SSH keys and files the provider
+// merges into the Ignition config
+func getIgnitionAdditions(ctx context.Context, ignition *providerconfigv1.Ignition, kubeClient kubernetes.Interface, machineNamespace, hostName string) (ignitionAdditions, error) {
+	additions := ignitionAdditions{sshAuthorizedKeys: ignition.SSHAuthorizedKeys}
+	if ignition.SetHostname {
+		additions.hostname = hostName
+	}
+	for _, file := range ignition.Files {
+		var contents []byte
+		var err error
+		switch {
+		case file.ConfigMapRef != nil:
+			contents, err = getConfigMapData(ctx, kubeClient, machineNamespace, file.ConfigMapRef.Name, file.ConfigMapRef.Key)
+		case file.SecretRef != nil:
+			contents, err = getSecretData(ctx, kubeClient, machineNamespace, file.SecretRef.Name, file.SecretRef.Key)
+		default:
+			err = fmt.Errorf("file %s has neither a ConfigMap nor a Secret reference", file.Path)
+		}
+		if err != nil {
+			return additions, err
+		}
+		mode := ignitionDefaultFileMode
+		if file.Mode != nil {
+			mode = int(*file.Mode)
+		}
+		additions.files = append(additions.files, ignitionFile{path: file.Path, mode: mode, contents: contents})
+	}
+	return additions, nil
+}
+
+// getConfigMapData returns the data of a key of a ConfigMap, text or binary
+func getConfigMapData(ctx context.Context, kubeClient kubernetes.Interface, namespace, name, key string) ([]byte, error) {
+	configMap, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can not retrieve config map '%v/%v': %v", namespace, name, err)
+	}
+	if data, ok := configMap.Data[key]; ok {
+		return []byte(data), nil
+	}
+	if data, ok := configMap.BinaryData[key]; ok {
+		return data, nil
+	}
+	return nil, fmt.Errorf("key '%v' not found in config map '%v/%v'", key, namespace, name)
+}
+
 type defIgnition struct {
 	Name     string
 	PoolName string
@@ -79,7 +133,7 @@ func (ign *defIgnition) createAndUpload(client *libvirtClient) (string, error) {
 		}
 	}()
 
-	img, err := newImage(ignFile)
+	img, err := newImage(ignFile, nil)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// ignitionUser is the user SSH keys are authorized for
+	ignitionUser = "core"
+
+	// ignitionDefaultFileMode is the mode of added files, 0644
+	ignitionDefaultFileMode = 420
+)
+
+// ignitionFile is a file added to an Ignition config
+type ignitionFile struct {
+	path     string
+	mode     int
+	contents []byte
+}
+
+// ignitionAdditions are the provider generated parts merged into the
+// Ignition config of a machine
+type ignitionAdditions struct {
+	hostname          string
+	sshAuthorizedKeys []string
+	files             []ignitionFile
+}
+
+func (additions ignitionAdditions) empty() bool {
+	return additions.hostname == "" && len(additions.sshAuthorizedKeys) == 0 && len(additions.files) == 0
+}
+
+// ignitionConfig is a parsed Ignition config. It is kept as generic JSON, so
+// fields the provider does not know about are written back as they were.
+type ignitionConfig struct {
+	config map[string]interface{}
+	major  string
+}
+
+// parseIgnition parses and validates an Ignition config of spec version 2 or 3
+func parseIgnition(data []byte) (*ignitionConfig, error) {
+	var config map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid Ignition config: %v", err)
+	}
+
+	ignition, _ := config["ignition"].(map[string]interface{})
+	version, _ := ignition["version"].(string)
+	if version == "" {
+		return nil, fmt.Errorf("invalid Ignition config: ignition.version is missing")
+	}
+	major := strings.SplitN(version, ".", 2)[0]
+	if major != "2" && major != "3" {
+		return nil, fmt.Errorf("unsupported Ignition spec version %s", version)
+	}
+	ign := &ignitionConfig{config: config, major: major}
+	if err := ign.validate(); err != nil {
+		return nil, fmt.Errorf("invalid Ignition config: %v", err)
+	}
+	return ign, nil
+}
+
+// validate checks the files and users of the config
+func (ign *ignitionConfig) validate() error {
+	files, err := ign.list("storage", "files")
+	if err != nil {
+		return err
+	}
+	paths := map[string]bool{}
+	for _, f := range files {
+		file, ok := f.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("storage.files contains a non-object entry")
+		}
+		filePath, _ := file["path"].(string)
+		if !path.IsAbs(filePath) {
+			return fmt.Errorf("file path %q is not absolute", filePath)
+		}
+		// spec 3 does not allow a path to be configured twice
+		if ign.major == "3" && paths[filePath] {
+			return fmt.Errorf("file %s is configured twice", filePath)
+		}
+		paths[filePath] = true
+	}
+
+	users, err := ign.list("passwd", "users")
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		user, ok := u.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("passwd.users contains a non-object entry")
+		}
+		if name, _ := user["name"].(string); name == "" {
+			return fmt.Errorf("user without name")
+		}
+	}
+	return nil
+}
+
+// list returns the list at section.key, nil if it does not exist
+func (ign *ignitionConfig) list(section, key string) ([]interface{}, error) {
+	s, ok := ign.config[section]
+	if !ok {
+		return nil, nil
+	}
+	sectionMap, ok := s.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", section)
+	}
+	l, ok := sectionMap[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := l.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s.%s is not a list", section, key)
+	}
+	return list, nil
+}
+
+// setList sets the list at section.key, creating the section if missing
+func (ign *ignitionConfig) setList(section, key string, list []interface{}) {
+	sectionMap, ok := ign.config[section].(map[string]interface{})
+	if !ok {
+		sectionMap = map[string]interface{}{}
+		ign.config[section] = sectionMap
+	}
+	sectionMap[key] = list
+}
+
+// setFile adds a file, replacing files configured with the same path
+func (ign *ignitionConfig) setFile(file ignitionFile) {
+	files, _ := ign.list("storage", "files")
+	var merged []interface{}
+	for _, f := range files {
+		if existing, _ := f.(map[string]interface{}); existing["path"] != file.path {
+			merged = append(merged, f)
+		}
+	}
+
+	entry := map[string]interface{}{
+		"path": file.path,
+		"mode": file.mode,
+		"contents": map[string]interface{}{
+			"source": "data:;base64," + base64.StdEncoding.EncodeToString(file.contents),
+		},
+	}
+	if ign.major == "2" {
+		entry["filesystem"] = "root"
+	} else {
+		entry["overwrite"] = true
+	}
+	ign.setList("storage", "files", append(merged, entry))
+}
+
+// addSSHAuthorizedKeys authorizes the keys for a user, creating the user if
+// it is not configured yet
+func (ign *ignitionConfig) addSSHAuthorizedKeys(name string, keys []string) {
+	users, _ := ign.list("passwd", "users")
+	var user map[string]interface{}
+	for _, u := range users {
+		if existing := u.(map[string]interface{}); existing["name"] == name {
+			user = existing
+			break
+		}
+	}
+	if user == nil {
+		user = map[string]interface{}{"name": name}
+		users = append(users, user)
+	}
+
+	authorizedKeys, _ := user["sshAuthorizedKeys"].([]interface{})
+	for _, key := range keys {
+		found := false
+		for _, existing := range authorizedKeys {
+			if existing == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			authorizedKeys = append(authorizedKeys, key)
+		}
+	}
+	user["sshAuthorizedKeys"] = authorizedKeys
+	ign.setList("passwd", "users", users)
+}
+
+// mergeIgnition validates the Ignition config and merges the additions into
+// it. Configs without additions are returned as they are.
+func mergeIgnition(data []byte, additions ignitionAdditions) ([]byte, error) {
+	ign, err := parseIgnition(data)
+	if err != nil {
+		return nil, err
+	}
+	if additions.empty() {
+		return data, nil
+	}
+
+	if additions.hostname != "" {
+		ign.setFile(ignitionFile{
+			path:     "/etc/hostname",
+			mode:     ignitionDefaultFileMode,
+			contents: []byte(additions.hostname + "\n"),
+		})
+	}
+	for _, file := range additions.files {
+		ign.setFile(file)
+	}
+	if len(additions.sshAuthorizedKeys) > 0 {
+		ign.addSSHAuthorizedKeys(ignitionUser, additions.sshAuthorizedKeys)
+	}
+	return json.Marshal(ign.config)
+}
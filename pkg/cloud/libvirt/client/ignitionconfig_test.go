@@ -0,0 +1,151 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergeIgnition(t *testing.T) {
+	chrony := ignitionFile{path: "/etc/chrony.conf", mode: 384, contents: []byte("pool ntp.example.com\n")}
+
+	cases := []struct {
+		name          string
+		config        string
+		additions     ignitionAdditions
+		expectError   bool
+		expectedFiles map[string]string
+		expectedKeys  []string
+		checkEntry    func(t *testing.T, file map[string]interface{})
+	}{
+		{
+			name:   "no additions",
+			config: `{"ignition":{"version":"3.2.0"}}`,
+		},
+		{
+			name:        "missing version",
+			config:      `{"storage":{}}`,
+			expectError: true,
+		},
+		{
+			name:        "unsupported version",
+			config:      `{"ignition":{"version":"1.0.0"}}`,
+			expectError: true,
+		},
+		{
+			name:        "not json",
+			config:      `#cloud-config`,
+			expectError: true,
+		},
+		{
+			name:        "relative file path",
+			config:      `{"ignition":{"version":"3.2.0"},"storage":{"files":[{"path":"etc/motd"}]}}`,
+			expectError: true,
+		},
+		{
+			name:        "duplicate file path in v3",
+			config:      `{"ignition":{"version":"3.2.0"},"storage":{"files":[{"path":"/etc/motd"},{"path":"/etc/motd"}]}}`,
+			expectError: true,
+		},
+		{
+			name:        "user without name",
+			config:      `{"ignition":{"version":"3.2.0"},"passwd":{"users":[{"sshAuthorizedKeys":["ssh-rsa AAAA"]}]}}`,
+			expectError: true,
+		},
+		{
+			name:          "hostname in v2",
+			config:        `{"ignition":{"version":"2.2.0"}}`,
+			additions:     ignitionAdditions{hostname: "worker-0"},
+			expectedFiles: map[string]string{"/etc/hostname": "data:;base64,d29ya2VyLTAK"},
+			checkEntry: func(t *testing.T, file map[string]interface{}) {
+				if file["filesystem"] != "root" {
+					t.Errorf("expected root filesystem in v2 file %v", file)
+				}
+			},
+		},
+		{
+			name:          "file replaces existing path in v3",
+			config:        `{"ignition":{"version":"3.2.0"},"storage":{"files":[{"path":"/etc/chrony.conf","contents":{"source":"data:,old"}},{"path":"/etc/motd"}]}}`,
+			additions:     ignitionAdditions{files: []ignitionFile{chrony}},
+			expectedFiles: map[string]string{"/etc/motd": "", "/etc/chrony.conf": "data:;base64,cG9vbCBudHAuZXhhbXBsZS5jb20K"},
+			checkEntry: func(t *testing.T, file map[string]interface{}) {
+				if file["path"] == "/etc/chrony.conf" && (file["overwrite"] != true || file["mode"] != json.Number("384")) {
+					t.Errorf("unexpected v3 file %v", file)
+				}
+			},
+		},
+		{
+			name:         "keys added to existing core user",
+			config:       `{"ignition":{"version":"3.2.0"},"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["ssh-rsa AAAA"]}]}}`,
+			additions:    ignitionAdditions{sshAuthorizedKeys: []string{"ssh-rsa AAAA", "ssh-ed25519 BBBB"}},
+			expectedKeys: []string{"ssh-rsa AAAA", "ssh-ed25519 BBBB"},
+		},
+		{
+			name:         "core user created for keys",
+			config:       `{"ignition":{"version":"2.2.0"}}`,
+			additions:    ignitionAdditions{sshAuthorizedKeys: []string{"ssh-ed25519 BBBB"}},
+			expectedKeys: []string{"ssh-ed25519 BBBB"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, err := mergeIgnition([]byte(tc.config), tc.additions)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %s", merged)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.additions.empty() {
+				if string(merged) != tc.config {
+					t.Errorf("expected config to be unchanged, got %s", merged)
+				}
+				return
+			}
+
+			ign, err := parseIgnition(merged)
+			if err != nil {
+				t.Fatalf("merged config is invalid: %v", err)
+			}
+			if tc.expectedFiles != nil {
+				files, _ := ign.list("storage", "files")
+				if len(files) != len(tc.expectedFiles) {
+					t.Errorf("expected %d files, got %v", len(tc.expectedFiles), files)
+				}
+				for _, f := range files {
+					file := f.(map[string]interface{})
+					source, ok := tc.expectedFiles[file["path"].(string)]
+					if !ok {
+						t.Errorf("unexpected file %v", file)
+						continue
+					}
+					if source != "" {
+						if contents, _ := file["contents"].(map[string]interface{}); contents["source"] != source {
+							t.Errorf("expected source %s, got %v", source, file["contents"])
+						}
+						tc.checkEntry(t, file)
+					}
+				}
+			}
+			if tc.expectedKeys != nil {
+				users, _ := ign.list("passwd", "users")
+				if len(users) != 1 {
+					t.Fatalf("expected one user, got %v", users)
+				}
+				user := users[0].(map[string]interface{})
+				keys, _ := user["sshAuthorizedKeys"].([]interface{})
+				if user["name"] != ignitionUser || len(keys) != len(tc.expectedKeys) {
+					t.Fatalf("unexpected user %v", user)
+				}
+				for i, key := range tc.expectedKeys {
+					if keys[i] != key {
+						t.Errorf("expected key %d to be %s, got %v", i, key, keys[i])
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,12 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,19 +14,173 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/ulikunitz/xz"
 )
 
+const (
+	compressionGzip = "gzip"
+	compressionXz   = "xz"
+	compressionZstd = "zstd"
+)
+
+// compressionMagics contains the magic bytes compressed images start with
+var compressionMagics = []struct {
+	compression string
+	magic       []byte
+}{
+	{compression: compressionGzip, magic: []byte{0x1f, 0x8b}},
+	{compression: compressionXz, magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{compression: compressionZstd, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+const (
+	imageFormatRaw   = "raw"
+	imageFormatQcow2 = "qcow2"
+
+	// imageHeadSize is how much of an image is read to inspect its header.
+	// It covers the first blocks of compressed images.
+	imageHeadSize = 1 << 20
+)
+
+// baseVolumePrefix starts the names of the base volumes images are imported into
+const baseVolumePrefix = "base-"
+
+// qcow2Magic is the magic bytes qcow2 images start with
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
 type image interface {
 	size() (uint64, error)
 	importImage(func(io.Reader) error, libvirtxml.StorageVolume) error
 	string() string
+	// version identifies the current content of the image, it is empty if
+	// the content can't be identified without reading it
+	version() (string, error)
+	// digest returns a digest of the content of the image and whether it is
+	// the sha256 checksum of the content importImage reads
+	digest() (string, bool, error)
+	// head returns up to the first n bytes of the image
+	head(n int64) ([]byte, error)
+}
+
+// inspectImage detects the format of an image from its, possibly compressed,
+// header and returns its virtual size. The virtual size of raw images is the
+// size of their content, which is only known for uncompressed images. It is 0
+// for compressed raw images, which are sized once they are decompressed.
+func inspectImage(img image) (string, uint64, error) {
+	head, err := img.head(imageHeadSize)
+	if err != nil {
+		return "", 0, err
+	}
+
+	r, compression, err := decompress(bytes.NewReader(head))
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+
+	header := make([]byte, 32)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", 0, fmt.Errorf("error reading image header: %v", err)
+	}
+
+	format, virtualSize := parseImageHeader(header[:n])
+	if format == imageFormatRaw && compression == "" {
+		if virtualSize, err = img.size(); err != nil {
+			return "", 0, err
+		}
+	}
+	return format, virtualSize, nil
+}
+
+// parseImageHeader detects qcow2 images from their magic bytes and reads
+// their virtual size. Everything else is a raw image of unknown size.
+func parseImageHeader(header []byte) (string, uint64) {
+	if len(header) >= 32 && bytes.HasPrefix(header, qcow2Magic) {
+		return imageFormatQcow2, binary.BigEndian.Uint64(header[24:32])
+	}
+	return imageFormatRaw, 0
+}
+
+var (
+	// imageDigests caches the digests of images by source and version, so
+	// images are only read again to identify them once they changed
+	imageDigestsLock sync.Mutex
+	imageDigests     = map[string]string{}
+)
+
+// baseVolumeName returns the name of the base volume of the image, which is
+// derived from the digest of its content, and the checksum the import is
+// verified against. The checksum of the image is the digest if one is given.
+// Otherwise the image is read to compute the digest, so an image without
+// version is read every time, and a changed image can't be mistaken for the
+// one in the base volume. The same image served from two URLs is imported
+// into one base volume.
+func baseVolumeName(img image, checksumSpec string) (string, string, error) {
+	if checksumSpec != "" {
+		sum, err := newChecksum(checksumSpec, img)
+		if err != nil {
+			return "", "", err
+		}
+		verify := fmt.Sprintf("%s:%x", sum.algorithm, sum.digest)
+		return baseVolumePrefix + strings.Replace(verify, ":", "-", 1), verify, nil
+	}
+
+	version, err := img.version()
+	if err != nil {
+		return "", "", err
+	}
+	key := img.string() + "\n" + version
+	imageDigestsLock.Lock()
+	digest, ok := imageDigests[key]
+	imageDigestsLock.Unlock()
+	verifiable := true
+	if !ok || version == "" {
+		if digest, verifiable, err = img.digest(); err != nil {
+			return "", "", err
+		}
+		if version != "" && verifiable {
+			imageDigestsLock.Lock()
+			imageDigests[key] = digest
+			imageDigestsLock.Unlock()
+		}
+	}
+
+	name := baseVolumePrefix + strings.Replace(digest, ":", "-", 1)
+	if !verifiable {
+		return name, "", nil
+	}
+	return name, digest, nil
+}
+
+// fileDigest returns the sha256 digest of the content of a file
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Error while opening %s: %s", path, err)
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("Error while reading %s: %s", path, err)
+	}
+	return fmt.Sprintf("%s:%x", checksumSHA256, h.Sum(nil)), nil
+}
+
+// isBaseVolumeName returns whether the volume is a base volume imported from
+// an image
+func isBaseVolumeName(name string) bool {
+	return strings.HasPrefix(name, baseVolumePrefix)
 }
 
 type httpImage struct {
-	url *url.URL
+	url        *url.URL
+	downloader *downloader
 }
 
 func (i *httpImage) string() string {
@@ -28,63 +188,119 @@ func (i *httpImage) string() string {
 }
 
 func (i *httpImage) size() (uint64, error) {
-	response, err := http.Head(i.url.String())
+	file, err := i.downloader.stat(i.url.String())
 	if err != nil {
 		return 0, err
 	}
-	if response.StatusCode != 200 {
-		return 0,
-			fmt.Errorf(
-				"Error accessing remote resource: %s - %s",
-				i.url.String(),
-				response.Status)
+	if file.size < 0 {
+		return 0, fmt.Errorf("Error while getting Content-Length of %q", i.url.String())
 	}
+	return uint64(file.size), nil
+}
 
-	length, err := strconv.Atoi(response.Header.Get("Content-Length"))
+func (i *httpImage) version() (string, error) {
+	file, err := i.downloader.stat(i.url.String())
 	if err != nil {
-		err = fmt.Errorf(
-			"Error while getting Content-Length of %q: %v - got %s",
-			i.url.String(),
-			err,
-			response.Header.Get("Content-Length"))
-		return 0, err
+		return "", err
+	}
+	if file.validator == "" {
+		glog.Infof("%s has neither an ETag nor a Last-Modified header, it is downloaded to identify its content", i.url.String())
+		return "", nil
 	}
-	return uint64(length), nil
+	return file.validator + "\n" + strconv.FormatInt(file.size, 10), nil
 }
 
-func (i *httpImage) importImage(copier func(io.Reader) error, vol libvirtxml.StorageVolume) error {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", i.url.String(), nil)
+// digest downloads the image into its staging file, which the import reads
+// again without downloading it once more
+func (i *httpImage) digest() (string, bool, error) {
+	path, err := i.downloader.download(i.url.String())
+	if err != nil {
+		return "", false, err
+	}
+	digest, err := fileDigest(path)
+	return digest, true, err
+}
+
+func (i *httpImage) head(n int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", i.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	response, err := i.downloader.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error while downloading %s: %s", i.url.String(), err)
+	}
+	defer response.Body.Close()
+	// servers which do not support ranges send the whole image
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("Error accessing remote resource: %s - %s", i.url.String(), response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, n))
+}
 
+func (i *httpImage) importImage(copier func(io.Reader) error, vol libvirtxml.StorageVolume) error {
 	if vol.Target.Timestamps != nil && vol.Target.Timestamps.Mtime != "" {
+		req, _ := http.NewRequest("HEAD", i.url.String(), nil)
 		req.Header.Set("If-Modified-Since", timeFromEpoch(vol.Target.Timestamps.Mtime).UTC().Format(http.TimeFormat))
+		response, err := i.downloader.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("Error while downloading %s: %s", i.url.String(), err)
+		}
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotModified {
+			return nil
+		}
 	}
-	response, err := client.Do(req)
 
+	// the download is staged in a local file, so failed downloads can be
+	// resumed and failed uploads do not need to download the image again
+	path, err := i.downloader.download(i.url.String())
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("Error while downloading %s: %s", i.url.String(), err)
+		return fmt.Errorf("Error while opening %s: %s", path, err)
 	}
+	defer file.Close()
 
-	defer response.Body.Close()
-	if response.StatusCode == http.StatusNotModified {
-		return nil
+	if err := copier(file); err != nil {
+		var mismatch *checksumMismatchError
+		if errors.As(err, &mismatch) {
+			// the download is corrupt, start over next time
+			removeStagingFile(path)
+		}
+		return err
 	}
+	removeStagingFile(path)
+	return nil
+}
 
-	return copier(response.Body)
+func removeStagingFile(path string) {
+	if err := os.Remove(path); err != nil {
+		glog.Errorf("Error removing staging file %s: %v", path, err)
+	}
 }
 
 type localImage struct {
 	path string
 }
 
-func newImage(source string) (image, error) {
+// newImage returns the image at the source. The pull secret holds the
+// credentials for registry sources.
+func newImage(source string, pullSecret []byte) (image, error) {
+	if strings.HasPrefix(source, "registry://") || strings.HasPrefix(source, "docker://") {
+		return newRegistryImage(source, pullSecret)
+	}
+
 	url, err := url.Parse(source)
 	if err != nil {
 		return nil, fmt.Errorf("can't parse source %q as url: %v", source, err)
 	}
 
 	if strings.HasPrefix(url.Scheme, "http") {
-		return &httpImage{url: url}, nil
+		return &httpImage{url: url, downloader: getDefaultDownloader()}, nil
 	} else if url.Scheme == "file" || url.Scheme == "" {
 		return &localImage{path: url.Path}, nil
 	} else {
@@ -104,6 +320,28 @@ func (i *localImage) size() (uint64, error) {
 	return uint64(fi.Size()), nil
 }
 
+func (i *localImage) version() (string, error) {
+	fi, err := os.Stat(i.path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d\n%d", fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+func (i *localImage) digest() (string, bool, error) {
+	digest, err := fileDigest(i.path)
+	return digest, true, err
+}
+
+func (i *localImage) head(n int64) ([]byte, error) {
+	file, err := os.Open(i.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %s: %s", i.path, err)
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, n))
+}
+
 func (i *localImage) importImage(copier func(io.Reader) error, vol libvirtxml.StorageVolume) error {
 	file, err := os.Open(i.path)
 	defer file.Close()
@@ -125,3 +363,141 @@ func (i *localImage) importImage(copier func(io.Reader) error, vol libvirtxml.St
 
 	return copier(file)
 }
+
+// memoryImage is an image generated by the provider, e.g. a cloud init ISO,
+// which is uploaded from memory
+type memoryImage struct {
+	name string
+	data []byte
+}
+
+func (i *memoryImage) string() string {
+	return i.name
+}
+
+func (i *memoryImage) size() (uint64, error) {
+	return uint64(len(i.data)), nil
+}
+
+func (i *memoryImage) version() (string, error) {
+	return fmt.Sprintf("%x", sha256.Sum256(i.data)), nil
+}
+
+func (i *memoryImage) digest() (string, bool, error) {
+	return fmt.Sprintf("%s:%x", checksumSHA256, sha256.Sum256(i.data)), true, nil
+}
+
+func (i *memoryImage) head(n int64) ([]byte, error) {
+	if n > int64(len(i.data)) {
+		n = int64(len(i.data))
+	}
+	return i.data[:n], nil
+}
+
+func (i *memoryImage) importImage(copier func(io.Reader) error, vol libvirtxml.StorageVolume) error {
+	return copier(bytes.NewReader(i.data))
+}
+
+// decompress detects the compression of an image from its magic bytes and
+// returns a reader of the decompressed content along with the compression.
+// Uncompressed images are read unchanged and the compression is empty.
+func decompress(src io.Reader) (io.ReadCloser, string, error) {
+	var br io.Reader
+	var header []byte
+	if f, ok := src.(*os.File); ok {
+		// files are peeked at without consuming them, so uncompressed files
+		// can still be read as files
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, "", err
+		}
+		header = make([]byte, 8)
+		n, err := f.ReadAt(header, offset)
+		if err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		br, header = f, header[:n]
+	} else {
+		b := bufio.NewReader(src)
+		peeked, err := b.Peek(8)
+		if err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		br, header = b, peeked
+	}
+
+	var err error
+
+	compression := ""
+	for _, c := range compressionMagics {
+		if bytes.HasPrefix(header, c.magic) {
+			compression = c.compression
+			break
+		}
+	}
+
+	var r io.ReadCloser
+	switch compression {
+	case compressionGzip:
+		if r, err = gzip.NewReader(br); err != nil {
+			return nil, "", fmt.Errorf("error reading gzip image: %v", err)
+		}
+	case compressionXz:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading xz image: %v", err)
+		}
+		r = io.NopCloser(xr)
+	case compressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading zstd image: %v", err)
+		}
+		r = zr.IOReadCloser()
+	default:
+		return io.NopCloser(br), "", nil
+	}
+	return &drainingReader{ReadCloser: r, src: br}, compression, nil
+}
+
+// stageDecompressed writes the decompressed content of an image to a sparse
+// file in the directory and returns the file, positioned at its start, along
+// with the size of the content
+func stageDecompressed(r io.Reader, dir string) (*os.File, uint64, error) {
+	f, err := os.CreateTemp(dir, "decompressed-")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := copySparse(sparseFile{f}, r)
+	if err == nil {
+		// a trailing hole is only skipped over, it needs to be allocated
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		removeStagingFile(f.Name())
+		return nil, 0, err
+	}
+	return f, uint64(size), nil
+}
+
+// drainingReader reads the rest of the compressed source once the
+// decompressed content ends, so that readers wrapping the source, like
+// checksum verification, see all of it before the upload is finished
+type drainingReader struct {
+	io.ReadCloser
+	src io.Reader
+}
+
+func (r *drainingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, r.src); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
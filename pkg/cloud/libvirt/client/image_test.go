@@ -0,0 +1,410 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestBaseVolumeNameLocalImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+	if err := os.WriteFile(path, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := newImage("file://"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, checksum, err := baseVolumeName(img, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "base-sha256-6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Errorf("expected name from the content digest, got %q", name)
+	}
+	if checksum != "sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Errorf("expected the import to be verified against the content digest, got %q", checksum)
+	}
+	if !isBaseVolumeName(name) {
+		t.Errorf("expected %q to be a base volume name", name)
+	}
+
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	touched, _, err := baseVolumeName(img, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if touched != name {
+		t.Errorf("expected the same name for unchanged content, got %q", touched)
+	}
+
+	if err := os.WriteFile(path, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime = mtime.Add(time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	changed, _, err := baseVolumeName(img, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed == name {
+		t.Errorf("expected a new name for changed content, got %q", changed)
+	}
+
+	if _, _, err := baseVolumeName(&localImage{path: filepath.Join(t.TempDir(), "missing")}, ""); err == nil {
+		t.Errorf("expected error for missing image")
+	}
+}
+
+func TestBaseVolumeNameChecksum(t *testing.T) {
+	img := &localImage{path: filepath.Join(t.TempDir(), "missing")}
+	digest := "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"
+	name, checksum, err := baseVolumeName(img, digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the image is not read if its checksum is given
+	if name != "base-sha256-"+digest || checksum != "sha256:"+digest {
+		t.Errorf("expected name and checksum from the given checksum, got %q and %q", name, checksum)
+	}
+
+	if _, _, err := baseVolumeName(img, "sha256:invalid"); err == nil {
+		t.Errorf("expected error for invalid checksum")
+	}
+}
+
+func TestBaseVolumeNameHTTPImage(t *testing.T) {
+	options := DefaultDownloadOptions()
+	options.StagingDir = t.TempDir()
+	downloader := mustNewDownloader(options)
+
+	etag := `"v1"`
+	content := "image"
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.qcow2" && r.URL.Path != "/mirror/image.qcow2" {
+			http.NotFound(w, r)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if r.Method == http.MethodGet {
+			downloads++
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/image.qcow2")
+	img := &httpImage{url: u, downloader: downloader}
+	name, _, err := baseVolumeName(img, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := baseVolumeName(img, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if downloads != 1 {
+		t.Errorf("expected the image to be downloaded once while its ETag is unchanged, got %d downloads", downloads)
+	}
+
+	mirror, _ := url.Parse(server.URL + "/mirror/image.qcow2")
+	mirrored, _, err := baseVolumeName(&httpImage{url: mirror, downloader: downloader}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mirrored != name {
+		t.Errorf("expected the same name for the same content from another URL, got %q and %q", name, mirrored)
+	}
+
+	// without validators a change of the content of the same size is only
+	// noticed by reading the image
+	etag = ""
+	content = "other"
+	changed, _, err := baseVolumeName(img, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed == name {
+		t.Errorf("expected a new name for changed content, got %q", changed)
+	}
+
+	missing, _ := url.Parse(server.URL + "/missing.qcow2")
+	if _, _, err := baseVolumeName(&httpImage{url: missing, downloader: downloader}, ""); err == nil {
+		t.Errorf("expected error for missing image")
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1024)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+
+	var xzipped bytes.Buffer
+	xw, err := xz.NewWriter(&xzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(content)
+	xw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstded := zw.EncodeAll(content, nil)
+
+	cases := []struct {
+		name                string
+		source              []byte
+		expectedCompression string
+	}{
+		{
+			name:   "uncompressed",
+			source: content,
+		},
+		{
+			name:                "gzip",
+			source:              gzipped.Bytes(),
+			expectedCompression: compressionGzip,
+		},
+		{
+			name:                "xz",
+			source:              xzipped.Bytes(),
+			expectedCompression: compressionXz,
+		},
+		{
+			name:                "zstd",
+			source:              zstded,
+			expectedCompression: compressionZstd,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			src := bytes.NewReader(tc.source)
+			r, compression, err := decompress(src)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer r.Close()
+			if compression != tc.expectedCompression {
+				t.Errorf("expected compression %q, got %q", tc.expectedCompression, compression)
+			}
+			decompressed, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(decompressed, content) {
+				t.Errorf("decompressed content does not match")
+			}
+			if src.Len() != 0 {
+				t.Errorf("expected source to be read completely, %d bytes left", src.Len())
+			}
+		})
+	}
+}
+
+func TestInspectImage(t *testing.T) {
+	qcow2Header := make([]byte, 512)
+	copy(qcow2Header, qcow2Magic)
+	binary.BigEndian.PutUint32(qcow2Header[4:8], 3)
+	binary.BigEndian.PutUint64(qcow2Header[24:32], 16<<30)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(qcow2Header)
+	gw.Close()
+
+	raw := bytes.Repeat([]byte{0}, 4096)
+
+	var gzippedRaw bytes.Buffer
+	gw = gzip.NewWriter(&gzippedRaw)
+	gw.Write(raw)
+	gw.Close()
+
+	cases := []struct {
+		name                string
+		content             []byte
+		expectedFormat      string
+		expectedVirtualSize uint64
+	}{
+		{
+			name:                "qcow2",
+			content:             qcow2Header,
+			expectedFormat:      imageFormatQcow2,
+			expectedVirtualSize: 16 << 30,
+		},
+		{
+			name:                "compressed qcow2",
+			content:             gzipped.Bytes(),
+			expectedFormat:      imageFormatQcow2,
+			expectedVirtualSize: 16 << 30,
+		},
+		{
+			name:                "raw",
+			content:             raw,
+			expectedFormat:      imageFormatRaw,
+			expectedVirtualSize: 4096,
+		},
+		{
+			name:                "compressed raw",
+			content:             gzippedRaw.Bytes(),
+			expectedFormat:      imageFormatRaw,
+			expectedVirtualSize: 0,
+		},
+		{
+			name:                "tiny raw",
+			content:             []byte("raw"),
+			expectedFormat:      imageFormatRaw,
+			expectedVirtualSize: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image")
+			if err := os.WriteFile(path, tc.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			format, virtualSize, err := inspectImage(&localImage{path: path})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if format != tc.expectedFormat {
+				t.Errorf("expected format %q, got %q", tc.expectedFormat, format)
+			}
+			if virtualSize != tc.expectedVirtualSize {
+				t.Errorf("expected virtual size %d, got %d", tc.expectedVirtualSize, virtualSize)
+			}
+		})
+	}
+}
+
+func TestHTTPImageHead(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	head, err := (&httpImage{url: u, downloader: getDefaultDownloader()}).head(10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(head, content[:10]) {
+		t.Errorf("expected %q, got %q", content[:10], head)
+	}
+}
+
+func TestDecompressFile(t *testing.T) {
+	content := bytes.Repeat([]byte("image"), 1024)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+
+	for name, fileContent := range map[string][]byte{"uncompressed": content, "gzip": gzipped.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image")
+			if err := os.WriteFile(path, fileContent, 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			r, compression, err := decompress(f)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer r.Close()
+			// peeking must not consume uncompressed files
+			if offset, _ := f.Seek(0, io.SeekCurrent); compression == "" && offset != 0 {
+				t.Errorf("expected file at offset 0, got %d", offset)
+			}
+			decompressed, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(decompressed, content) {
+				t.Errorf("decompressed content does not match")
+			}
+		})
+	}
+}
+
+func TestStageDecompressed(t *testing.T) {
+	// a raw image with a hole in the middle and at its end
+	content := append(bytes.Repeat([]byte("image"), 1024), make([]byte, 3*sparseBlockSize)...)
+	content = append(content, bytes.Repeat([]byte("data"), 1024)...)
+	content = append(content, make([]byte, 2*sparseBlockSize)...)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+
+	r, _, err := decompress(bytes.NewReader(gzipped.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	f, size, err := stageDecompressed(r, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	if size != uint64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), size)
+	}
+	staged, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(staged, content) {
+		t.Errorf("staged content does not match")
+	}
+}
+
+func TestBaseVolumeImports(t *testing.T) {
+	if !startBaseVolumeImport("base-a") {
+		t.Fatalf("expected import of base-a to start")
+	}
+	if startBaseVolumeImport("base-a") {
+		t.Errorf("expected second import of base-a to wait")
+	}
+	if !startBaseVolumeImport("base-b") {
+		t.Errorf("expected import of base-b to start while base-a is imported")
+	}
+	finishBaseVolumeImport("base-a")
+	finishBaseVolumeImport("base-b")
+	if !startBaseVolumeImport("base-a") {
+		t.Errorf("expected import of base-a to start again")
+	}
+	finishBaseVolumeImport("base-a")
+}
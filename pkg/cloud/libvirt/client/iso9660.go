@@ -0,0 +1,369 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The ISO 9660 images written here hold a few small files in their root
+// directory, which is all cloud init NoCloud data sources need. The primary
+// volume descriptor names the files with Rock Ridge extensions and a Joliet
+// supplementary volume descriptor repeats them with UCS-2 names, like
+// mkisofs -joliet -rock does.
+
+const (
+	isoSectorSize = 2048
+
+	// sectors of the image, in order
+	isoPrimaryDescriptorSector = 16
+	isoJolietDescriptorSector  = 17
+	isoTerminatorSector        = 18
+	isoPrimaryPathTableSector  = 19 // little endian, big endian in the next sector
+	isoJolietPathTableSector   = 21 // little endian, big endian in the next sector
+	isoPrimaryRootSector       = 23
+	isoJolietRootSector        = 24
+	isoDataSector              = 25
+
+	// isoRootPathTableSize is the size of a path table with the root directory only
+	isoRootPathTableSize = 10
+
+	isoFlagDirectory = 2
+
+	// POSIX modes of the Rock Ridge PX entries
+	isoDirectoryMode = 040555
+	isoFileMode      = 0100444
+
+	rockRidgeID          = "RRIP_1991A"
+	rockRidgeDescription = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rockRidgeSource      = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE"
+
+	// jolietUCS2Level3 is the escape sequence of Joliet UCS-2 level 3
+	jolietUCS2Level3 = "%/E"
+)
+
+// isoFile is a file in the root directory of an ISO 9660 image
+type isoFile struct {
+	name string
+	data []byte
+}
+
+// isoEntry is a file placed in the image
+type isoEntry struct {
+	isoFile
+	sector uint32
+}
+
+// newISO9660 returns an ISO 9660 image with Joliet and Rock Ridge extensions
+// holding the files in its root directory
+func newISO9660(volumeID string, files []isoFile, now time.Time) ([]byte, error) {
+	entries := make([]isoEntry, len(files))
+	sector := uint32(isoDataSector)
+	for i, file := range files {
+		entries[i] = isoEntry{isoFile: file, sector: sector}
+		sector += isoSectors(len(file.data))
+	}
+	image := make([]byte, int(sector)*isoSectorSize)
+
+	primaryRoot, err := isoPrimaryDirectory(entries, now)
+	if err != nil {
+		return nil, err
+	}
+	jolietRoot, err := isoJolietDirectory(entries, now)
+	if err != nil {
+		return nil, err
+	}
+	copy(isoSector(image, isoPrimaryRootSector), primaryRoot)
+	copy(isoSector(image, isoJolietRootSector), jolietRoot)
+
+	isoVolumeDescriptor(isoSector(image, isoPrimaryDescriptorSector), 1, volumeID, isoPrimaryPathTableSector, isoPrimaryRootSector, sector, now, isoString)
+	isoVolumeDescriptor(isoSector(image, isoJolietDescriptorSector), 2, volumeID, isoJolietPathTableSector, isoJolietRootSector, sector, now, jolietString)
+	copy(isoSector(image, isoJolietDescriptorSector)[88:], jolietUCS2Level3)
+	terminator := isoSector(image, isoTerminatorSector)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	isoPathTables(image, isoPrimaryPathTableSector, isoPrimaryRootSector)
+	isoPathTables(image, isoJolietPathTableSector, isoJolietRootSector)
+
+	for _, entry := range entries {
+		copy(image[int(entry.sector)*isoSectorSize:], entry.data)
+	}
+	return image, nil
+}
+
+func isoSectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func isoSector(image []byte, sector int) []byte {
+	return image[sector*isoSectorSize : (sector+1)*isoSectorSize]
+}
+
+// isoVolumeDescriptor writes a primary (1) or supplementary (2) volume descriptor
+func isoVolumeDescriptor(d []byte, descriptorType byte, volumeID string, pathTableSector, rootSector int, volumeSectors uint32, now time.Time, str func([]byte, string)) {
+	d[0] = descriptorType
+	copy(d[1:], "CD001")
+	d[6] = 1
+	str(d[8:40], "")
+	str(d[40:72], volumeID)
+	bothEndian32(d[80:], volumeSectors)
+	bothEndian16(d[120:], 1)
+	bothEndian16(d[124:], 1)
+	bothEndian16(d[128:], isoSectorSize)
+	bothEndian32(d[132:], isoRootPathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], uint32(pathTableSector))
+	binary.BigEndian.PutUint32(d[148:], uint32(pathTableSector+1))
+	isoDirectoryRecord(d[156:190], rootSector, isoSectorSize, isoFlagDirectory, []byte{0}, nil, now)
+	str(d[190:318], "")
+	str(d[318:446], "")
+	str(d[446:574], "")
+	str(d[574:702], "")
+	str(d[702:739], "")
+	str(d[739:776], "")
+	str(d[776:813], "")
+	isoDecDateTime(d[813:830], now)
+	isoDecDateTime(d[830:847], now)
+	isoDecDateTime(d[847:864], time.Time{})
+	isoDecDateTime(d[864:881], time.Time{})
+	d[881] = 1
+}
+
+// isoPathTables writes the little and big endian path tables of a root directory
+func isoPathTables(image []byte, sector, rootSector int) {
+	l := isoSector(image, sector)
+	l[0] = 1
+	binary.LittleEndian.PutUint32(l[2:], uint32(rootSector))
+	binary.LittleEndian.PutUint16(l[6:], 1)
+	m := isoSector(image, sector+1)
+	m[0] = 1
+	binary.BigEndian.PutUint32(m[2:], uint32(rootSector))
+	binary.BigEndian.PutUint16(m[6:], 1)
+}
+
+// isoPrimaryDirectory returns the root directory of the primary volume
+// descriptor, with ISO 9660 level 1 names and Rock Ridge entries
+func isoPrimaryDirectory(entries []isoEntry, now time.Time) ([]byte, error) {
+	type record struct {
+		name []byte
+		isoEntry
+	}
+	var records []record
+	names := map[string]string{}
+	for _, entry := range entries {
+		name := isoName(entry.name)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("files %s and %s have the same ISO 9660 name %s", other, entry.name, name)
+		}
+		names[name] = entry.name
+		records = append(records, record{name: []byte(name), isoEntry: entry})
+	}
+	sort.Slice(records, func(i, j int) bool { return string(records[i].name) < string(records[j].name) })
+
+	dir := newISODirectory(now)
+	directoryPX := rockRidgePX(isoDirectoryMode, 2)
+	dot := append(append(rockRidgeSP(), directoryPX...), rockRidgeER()...)
+	dir.add(isoPrimaryRootSector, isoFlagDirectory, []byte{0}, dot, 0)
+	dir.add(isoPrimaryRootSector, isoFlagDirectory, []byte{1}, directoryPX, 0)
+	for _, r := range records {
+		systemUse := append(rockRidgePX(isoFileMode, 1), rockRidgeNM(r.isoEntry.name)...)
+		dir.add(int(r.sector), 0, r.name, systemUse, len(r.data))
+	}
+	return dir.bytes()
+}
+
+// isoJolietDirectory returns the root directory of the Joliet volume
+// descriptor, with UCS-2 names
+func isoJolietDirectory(entries []isoEntry, now time.Time) ([]byte, error) {
+	type record struct {
+		name []byte
+		isoEntry
+	}
+	var records []record
+	for _, entry := range entries {
+		name := utf16.Encode([]rune(entry.name))
+		if len(name) > 64 {
+			return nil, fmt.Errorf("file name %s is too long for Joliet", entry.name)
+		}
+		b := make([]byte, 2*len(name))
+		for i, c := range name {
+			binary.BigEndian.PutUint16(b[2*i:], c)
+		}
+		records = append(records, record{name: b, isoEntry: entry})
+	}
+	sort.Slice(records, func(i, j int) bool { return string(records[i].name) < string(records[j].name) })
+
+	dir := newISODirectory(now)
+	dir.add(isoJolietRootSector, isoFlagDirectory, []byte{0}, nil, 0)
+	dir.add(isoJolietRootSector, isoFlagDirectory, []byte{1}, nil, 0)
+	for _, r := range records {
+		dir.add(int(r.sector), 0, r.name, nil, len(r.data))
+	}
+	return dir.bytes()
+}
+
+// isoDirectory collects the records of a directory of a single sector
+type isoDirectory struct {
+	data []byte
+	now  time.Time
+	err  error
+}
+
+func newISODirectory(now time.Time) *isoDirectory {
+	return &isoDirectory{now: now}
+}
+
+func (dir *isoDirectory) add(sector int, flags byte, name, systemUse []byte, size int) {
+	length := 33 + len(name)
+	if length%2 == 1 {
+		length++
+	}
+	length += len(systemUse)
+	if length > 255 {
+		dir.err = fmt.Errorf("directory record of %q is too long", name)
+		return
+	}
+	if flags&isoFlagDirectory != 0 {
+		size = isoSectorSize
+	}
+	record := make([]byte, length)
+	isoDirectoryRecord(record, sector, uint32(size), flags, name, systemUse, dir.now)
+	dir.data = append(dir.data, record...)
+}
+
+func (dir *isoDirectory) bytes() ([]byte, error) {
+	if dir.err != nil {
+		return nil, dir.err
+	}
+	if len(dir.data) > isoSectorSize {
+		return nil, fmt.Errorf("too many files for an ISO 9660 directory")
+	}
+	return dir.data, nil
+}
+
+// isoDirectoryRecord writes a directory record into r, which has its length
+func isoDirectoryRecord(r []byte, sector int, size uint32, flags byte, name, systemUse []byte, now time.Time) {
+	r[0] = byte(len(r))
+	bothEndian32(r[2:], uint32(sector))
+	bothEndian32(r[10:], size)
+	isoRecordingDateTime(r[18:25], now)
+	r[25] = flags
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	copy(r[len(r)-len(systemUse):], systemUse)
+}
+
+// isoName returns the ISO 9660 level 1 name of a file, an uppercase 8.3 name
+// of d-characters with version 1
+func isoName(name string) string {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	dchars := func(s string, max int) string {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			default:
+				return '_'
+			}
+		}, s)
+		if len(s) > max {
+			s = s[:max]
+		}
+		return s
+	}
+	return dchars(base, 8) + "." + dchars(ext, 3) + ";1"
+}
+
+// rockRidgeSP returns the SUSP entry which marks the use of system use entries
+func rockRidgeSP() []byte {
+	return []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0}
+}
+
+// rockRidgeER returns the SUSP entry which identifies the Rock Ridge extensions
+func rockRidgeER() []byte {
+	e := []byte{'E', 'R', 0, 1, byte(len(rockRidgeID)), byte(len(rockRidgeDescription)), byte(len(rockRidgeSource)), 1}
+	e = append(e, rockRidgeID+rockRidgeDescription+rockRidgeSource...)
+	e[2] = byte(len(e))
+	return e
+}
+
+// rockRidgePX returns the POSIX attributes of a file
+func rockRidgePX(mode, links uint32) []byte {
+	e := make([]byte, 36)
+	copy(e, "PX")
+	e[2] = 36
+	e[3] = 1
+	bothEndian32(e[4:], mode)
+	bothEndian32(e[12:], links)
+	return e
+}
+
+// rockRidgeNM returns the POSIX name of a file
+func rockRidgeNM(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+// isoString writes s padded with spaces
+func isoString(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+// jolietString writes s in UCS-2 padded with spaces
+func jolietString(b []byte, s string) {
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = 0, ' '
+	}
+	for i, c := range utf16.Encode([]rune(s)) {
+		if 2*i+1 >= len(b) {
+			break
+		}
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+}
+
+// isoDecDateTime writes a volume descriptor date, all zeros for the zero time
+func isoDecDateTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		copy(b, "0000000000000000")
+		b[16] = 0
+		return
+	}
+	t = t.UTC()
+	copy(b, fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000))
+	b[16] = 0
+}
+
+// isoRecordingDateTime writes a directory record date
+func isoRecordingDateTime(b []byte, t time.Time) {
+	t = t.UTC()
+	b[0] = byte(t.Year() - 1900)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
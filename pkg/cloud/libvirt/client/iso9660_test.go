@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// readISODirectory returns the names and contents of the files of the root
+// directory of the volume descriptor in the sector. Rock Ridge names are used
+// if there are any.
+func readISODirectory(t *testing.T, iso []byte, descriptorSector int, joliet bool) map[string]string {
+	d := isoSector(iso, descriptorSector)
+	root := d[156:190]
+	rootSector := binary.LittleEndian.Uint32(root[2:])
+	if binary.BigEndian.Uint32(root[6:]) != rootSector {
+		t.Fatalf("root sector %d is not stored in both byte orders", rootSector)
+	}
+	dir := isoSector(iso, int(rootSector))
+
+	files := map[string]string{}
+	for offset := 0; offset < len(dir) && dir[offset] != 0; offset += int(dir[offset]) {
+		r := dir[offset : offset+int(dir[offset])]
+		nameLength := int(r[32])
+		name := r[33 : 33+nameLength]
+		if r[25]&isoFlagDirectory != 0 {
+			continue
+		}
+		var fileName string
+		if joliet {
+			u := make([]uint16, len(name)/2)
+			for i := range u {
+				u[i] = binary.BigEndian.Uint16(name[2*i:])
+			}
+			fileName = string(utf16.Decode(u))
+		} else {
+			fileName = string(name)
+			systemUse := r[33+nameLength+(nameLength+1)%2:]
+			for len(systemUse) >= 4 {
+				if string(systemUse[:2]) == "NM" {
+					fileName = string(systemUse[5:systemUse[2]])
+				}
+				systemUse = systemUse[systemUse[2]:]
+			}
+		}
+		sector := binary.LittleEndian.Uint32(r[2:])
+		size := binary.LittleEndian.Uint32(r[10:])
+		files[fileName] = string(iso[int(sector)*isoSectorSize : int(sector)*isoSectorSize+int(size)])
+	}
+	return files
+}
+
+func TestNewISO9660(t *testing.T) {
+	longUserData := strings.Repeat("#cloud-config\n", 200)
+	iso, err := newISO9660("cidata", []isoFile{
+		{name: "user-data", data: []byte(longUserData)},
+		{name: "meta-data", data: []byte("instance-id: worker-0\n")},
+		{name: "network-config", data: nil},
+	}, time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(iso)%isoSectorSize != 0 {
+		t.Errorf("image size %d is not a multiple of the sector size", len(iso))
+	}
+	// 25 sectors of descriptors, path tables and directories, 2 sectors of user-data, 1 of meta-data
+	if len(iso) != 28*isoSectorSize {
+		t.Errorf("expected 28 sectors, got %d bytes", len(iso))
+	}
+
+	primary := isoSector(iso, isoPrimaryDescriptorSector)
+	if primary[0] != 1 || string(primary[1:6]) != "CD001" {
+		t.Fatalf("no primary volume descriptor in sector 16")
+	}
+	if label := strings.TrimRight(string(primary[40:72]), " "); label != "cidata" {
+		t.Errorf("expected volume label cidata, got %q", label)
+	}
+	if sectors := binary.LittleEndian.Uint32(primary[80:]); int(sectors)*isoSectorSize != len(iso) {
+		t.Errorf("volume space size %d does not match image size %d", sectors, len(iso))
+	}
+
+	joliet := isoSector(iso, isoJolietDescriptorSector)
+	if joliet[0] != 2 || string(joliet[88:91]) != "%/E" {
+		t.Fatalf("no Joliet volume descriptor in sector 17")
+	}
+	if !bytes.HasPrefix(joliet[40:72], []byte{0, 'c', 0, 'i', 0, 'd', 0, 'a', 0, 't', 0, 'a'}) {
+		t.Errorf("unexpected Joliet volume label %q", joliet[40:72])
+	}
+	if terminator := isoSector(iso, isoTerminatorSector); terminator[0] != 255 {
+		t.Errorf("no volume descriptor set terminator in sector 18")
+	}
+
+	expected := map[string]string{
+		"user-data":      longUserData,
+		"meta-data":      "instance-id: worker-0\n",
+		"network-config": "",
+	}
+	for _, tc := range []struct {
+		name       string
+		descriptor int
+		joliet     bool
+	}{
+		{name: "rock ridge", descriptor: isoPrimaryDescriptorSector},
+		{name: "joliet", descriptor: isoJolietDescriptorSector, joliet: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := readISODirectory(t, iso, tc.descriptor, tc.joliet)
+			if len(files) != len(expected) {
+				t.Errorf("expected %d files, got %d", len(expected), len(files))
+			}
+			for name, content := range expected {
+				if files[name] != content {
+					t.Errorf("unexpected content of %s: %q", name, files[name])
+				}
+			}
+		})
+	}
+}
+
+func TestISOName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"user-data":      "USER_DAT.;1",
+		"network-config": "NETWORK_.;1",
+		"vendor.data":    "VENDOR.DAT;1",
+	} {
+		if isoName(name) != expected {
+			t.Errorf("expected ISO 9660 name %s for %s, got %s", expected, name, isoName(name))
+		}
+	}
+
+	if _, err := newISO9660("cidata", []isoFile{{name: "user-data"}, {name: "user-data2"}}, time.Now()); err == nil {
+		t.Error("expected error for files with the same ISO 9660 name")
+	}
+}
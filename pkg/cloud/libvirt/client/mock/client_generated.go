@@ -36,6 +36,20 @@ func (m *MockClient) EXPECT() *MockClientMockRecorder {
 	return m.recorder
 }
 
+// BackupVolumes mocks base method.
+func (m *MockClient) BackupVolumes(arg0 context.Context, arg1 client.BackupVolumesInput) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BackupVolumes", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// BackupVolumes indicates an expected call of BackupVolumes.
+func (mr *MockClientMockRecorder) BackupVolumes(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BackupVolumes", reflect.TypeOf((*MockClient)(nil).BackupVolumes), arg0, arg1)
+}
+
 // Close mocks base method.
 func (m *MockClient) Close() error {
 	m.ctrl.T.Helper()
@@ -64,6 +78,36 @@ func (mr *MockClientMockRecorder) CreateDomain(arg0, arg1 interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDomain", reflect.TypeOf((*MockClient)(nil).CreateDomain), arg0, arg1)
 }
 
+// CreateOrUpdateNetwork mocks base method.
+func (m *MockClient) CreateOrUpdateNetwork(arg0 client.CreateNetworkInput) (string, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateOrUpdateNetwork", arg0)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateOrUpdateNetwork indicates an expected call of CreateOrUpdateNetwork.
+func (mr *MockClientMockRecorder) CreateOrUpdateNetwork(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOrUpdateNetwork", reflect.TypeOf((*MockClient)(nil).CreateOrUpdateNetwork), arg0)
+}
+
+// CreateSnapshot mocks base method.
+func (m *MockClient) CreateSnapshot(domainName, snapshotName string, external bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSnapshot", domainName, snapshotName, external)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSnapshot indicates an expected call of CreateSnapshot.
+func (mr *MockClientMockRecorder) CreateSnapshot(domainName, snapshotName, external interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSnapshot", reflect.TypeOf((*MockClient)(nil).CreateSnapshot), domainName, snapshotName, external)
+}
+
 // CreateVolume mocks base method.
 func (m *MockClient) CreateVolume(arg0 client.CreateVolumeInput) error {
 	m.ctrl.T.Helper()
@@ -78,6 +122,20 @@ func (mr *MockClientMockRecorder) CreateVolume(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateVolume", reflect.TypeOf((*MockClient)(nil).CreateVolume), arg0)
 }
 
+// DeleteDNSHost mocks base method.
+func (m *MockClient) DeleteDNSHost(networkName, hostname string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteDNSHost", networkName, hostname)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDNSHost indicates an expected call of DeleteDNSHost.
+func (mr *MockClientMockRecorder) DeleteDNSHost(networkName, hostname interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDNSHost", reflect.TypeOf((*MockClient)(nil).DeleteDNSHost), networkName, hostname)
+}
+
 // DeleteDomain mocks base method.
 func (m *MockClient) DeleteDomain(name string) error {
 	m.ctrl.T.Helper()
@@ -92,18 +150,32 @@ func (mr *MockClientMockRecorder) DeleteDomain(name interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDomain", reflect.TypeOf((*MockClient)(nil).DeleteDomain), name)
 }
 
+// DeleteNetwork mocks base method.
+func (m *MockClient) DeleteNetwork(name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteNetwork", name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteNetwork indicates an expected call of DeleteNetwork.
+func (mr *MockClientMockRecorder) DeleteNetwork(name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteNetwork", reflect.TypeOf((*MockClient)(nil).DeleteNetwork), name)
+}
+
 // DeleteVolume mocks base method.
-func (m *MockClient) DeleteVolume(name string) error {
+func (m *MockClient) DeleteVolume(poolName, name string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteVolume", name)
+	ret := m.ctrl.Call(m, "DeleteVolume", poolName, name)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // DeleteVolume indicates an expected call of DeleteVolume.
-func (mr *MockClientMockRecorder) DeleteVolume(name interface{}) *gomock.Call {
+func (mr *MockClientMockRecorder) DeleteVolume(poolName, name interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteVolume", reflect.TypeOf((*MockClient)(nil).DeleteVolume), name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteVolume", reflect.TypeOf((*MockClient)(nil).DeleteVolume), poolName, name)
 }
 
 // DomainExists mocks base method.
@@ -121,6 +193,51 @@ func (mr *MockClientMockRecorder) DomainExists(name interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DomainExists", reflect.TypeOf((*MockClient)(nil).DomainExists), name)
 }
 
+// EnsureBaseVolume mocks base method.
+func (m *MockClient) EnsureBaseVolume(arg0 context.Context, arg1 client.BaseVolumeInput) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureBaseVolume", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EnsureBaseVolume indicates an expected call of EnsureBaseVolume.
+func (mr *MockClientMockRecorder) EnsureBaseVolume(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureBaseVolume", reflect.TypeOf((*MockClient)(nil).EnsureBaseVolume), arg0, arg1)
+}
+
+// EnsureStoragePool mocks base method.
+func (m *MockClient) EnsureStoragePool(arg0 client.CreateStoragePoolInput) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureStoragePool", arg0)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EnsureStoragePool indicates an expected call of EnsureStoragePool.
+func (mr *MockClientMockRecorder) EnsureStoragePool(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureStoragePool", reflect.TypeOf((*MockClient)(nil).EnsureStoragePool), arg0)
+}
+
+// EnsureVolumeSecret mocks base method.
+func (m *MockClient) EnsureVolumeSecret(arg0 context.Context, arg1 client.VolumeSecretInput) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnsureVolumeSecret", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EnsureVolumeSecret indicates an expected call of EnsureVolumeSecret.
+func (mr *MockClientMockRecorder) EnsureVolumeSecret(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureVolumeSecret", reflect.TypeOf((*MockClient)(nil).EnsureVolumeSecret), arg0, arg1)
+}
+
 // GetDHCPLeasesByNetwork mocks base method.
 func (m *MockClient) GetDHCPLeasesByNetwork(networkName string) ([]libvirt.NetworkDHCPLease, error) {
 	m.ctrl.T.Helper()
@@ -136,6 +253,21 @@ func (mr *MockClientMockRecorder) GetDHCPLeasesByNetwork(networkName interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDHCPLeasesByNetwork", reflect.TypeOf((*MockClient)(nil).GetDHCPLeasesByNetwork), networkName)
 }
 
+// ListSnapshots mocks base method.
+func (m *MockClient) ListSnapshots(domainName string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListSnapshots", domainName)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListSnapshots indicates an expected call of ListSnapshots.
+func (mr *MockClientMockRecorder) ListSnapshots(domainName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListSnapshots", reflect.TypeOf((*MockClient)(nil).ListSnapshots), domainName)
+}
+
 // LookupDomainByName mocks base method.
 func (m *MockClient) LookupDomainByName(name string) (*libvirt.Domain, error) {
 	m.ctrl.T.Helper()
@@ -166,17 +298,61 @@ func (mr *MockClientMockRecorder) LookupDomainHostnameByDHCPLease(domIPAddress,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LookupDomainHostnameByDHCPLease", reflect.TypeOf((*MockClient)(nil).LookupDomainHostnameByDHCPLease), domIPAddress, networkName)
 }
 
+// LookupNetworkNameByUUID mocks base method.
+func (m *MockClient) LookupNetworkNameByUUID(uuid string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LookupNetworkNameByUUID", uuid)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LookupNetworkNameByUUID indicates an expected call of LookupNetworkNameByUUID.
+func (mr *MockClientMockRecorder) LookupNetworkNameByUUID(uuid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LookupNetworkNameByUUID", reflect.TypeOf((*MockClient)(nil).LookupNetworkNameByUUID), uuid)
+}
+
+// ResizeVolume mocks base method.
+func (m *MockClient) ResizeVolume(domainName, poolName, volumeName string, size uint64) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResizeVolume", domainName, poolName, volumeName, size)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResizeVolume indicates an expected call of ResizeVolume.
+func (mr *MockClientMockRecorder) ResizeVolume(domainName, poolName, volumeName, size interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResizeVolume", reflect.TypeOf((*MockClient)(nil).ResizeVolume), domainName, poolName, volumeName, size)
+}
+
+// RevertSnapshot mocks base method.
+func (m *MockClient) RevertSnapshot(domainName, snapshotName string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevertSnapshot", domainName, snapshotName)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevertSnapshot indicates an expected call of RevertSnapshot.
+func (mr *MockClientMockRecorder) RevertSnapshot(domainName, snapshotName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevertSnapshot", reflect.TypeOf((*MockClient)(nil).RevertSnapshot), domainName, snapshotName)
+}
+
 // VolumeExists mocks base method.
-func (m *MockClient) VolumeExists(name string) (bool, error) {
+func (m *MockClient) VolumeExists(poolName, name string) (bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "VolumeExists", name)
+	ret := m.ctrl.Call(m, "VolumeExists", poolName, name)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // VolumeExists indicates an expected call of VolumeExists.
-func (mr *MockClientMockRecorder) VolumeExists(name interface{}) *gomock.Call {
+func (mr *MockClientMockRecorder) VolumeExists(poolName, name interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VolumeExists", reflect.TypeOf((*MockClient)(nil).VolumeExists), name)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VolumeExists", reflect.TypeOf((*MockClient)(nil).VolumeExists), poolName, name)
 }
@@ -2,14 +2,17 @@ package client
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"sync"
 
 	"github.com/golang/glog"
 
 	libvirt "github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/openshift/cluster-api-provider-libvirt/lib/cidr"
 )
 
 const (
@@ -20,6 +23,9 @@ const (
 	workerIPCidr    = 51
 )
 
+// ErrNetworkNotFound is returned when a network is not found
+var ErrNetworkNotFound = errors.New("Network not found")
+
 // Leases contains list of DHCP leases
 type Leases struct {
 	Items map[string]string
@@ -32,7 +38,13 @@ type Network interface {
 }
 
 func newDefNetworkfromLibvirt(network Network) (libvirtxml.Network, error) {
-	networkXMLDesc, err := network.GetXMLDesc(0)
+	return newDefNetworkfromLibvirtFlags(network, 0)
+}
+
+// newDefNetworkfromLibvirtFlags returns the running definition of an active
+// network, or with NETWORK_XML_INACTIVE the one it is started with next
+func newDefNetworkfromLibvirtFlags(network Network, flags libvirt.NetworkXMLFlags) (libvirtxml.Network, error) {
+	networkXMLDesc, err := network.GetXMLDesc(flags)
 	if err != nil {
 		return libvirtxml.Network{}, fmt.Errorf("Error retrieving libvirt domain XML description: %s", err)
 	}
@@ -54,23 +66,295 @@ func HasDHCP(net libvirtxml.Network) bool {
 	return false
 }
 
+// newDefNetwork creates a network definition from CreateNetworkInput
+func newDefNetwork(input CreateNetworkInput) (libvirtxml.Network, error) {
+	if input.Name == "" {
+		return libvirtxml.Network{}, fmt.Errorf("network name is empty")
+	}
+
+	networkDef := libvirtxml.Network{
+		Name: input.Name,
+	}
+
+	mode := input.ForwardMode
+	if mode == "" {
+		mode = netModeNat
+	}
+	switch mode {
+	case netModeIsolated:
+	case netModeNat, netModeRoute:
+		networkDef.Forward = &libvirtxml.NetworkForward{
+			Mode: mode,
+		}
+	case netModeBridge:
+		if input.Bridge == "" {
+			return libvirtxml.Network{}, fmt.Errorf("network %s: forward mode %q requires a bridge", input.Name, mode)
+		}
+		if len(input.CIDRs) > 0 {
+			return libvirtxml.Network{}, fmt.Errorf("network %s: forward mode %q does not support CIDRs", input.Name, mode)
+		}
+		networkDef.Forward = &libvirtxml.NetworkForward{
+			Mode: mode,
+		}
+	default:
+		return libvirtxml.Network{}, fmt.Errorf("network %s: unknown forward mode %q", input.Name, mode)
+	}
+
+	if input.Bridge != "" {
+		networkDef.Bridge = &libvirtxml.NetworkBridge{
+			Name: input.Bridge,
+		}
+		if mode != netModeBridge {
+			networkDef.Bridge.STP = "on"
+		}
+	}
+
+	if input.DNSDomain != "" {
+		networkDef.Domain = &libvirtxml.NetworkDomain{
+			Name:      input.DNSDomain,
+			LocalOnly: "yes",
+		}
+	}
+
+	dhcpRangeAssigned := false
+	for _, c := range input.CIDRs {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return libvirtxml.Network{}, fmt.Errorf("network %s: failed to parse CIDR %q: %v", input.Name, c, err)
+		}
+		// the host takes the first address of the range
+		address, err := cidr.GenerateIP(ipNet, 1)
+		if err != nil {
+			return libvirtxml.Network{}, fmt.Errorf("network %s: failed to generate host address for %q: %v", input.Name, c, err)
+		}
+		prefix, _ := ipNet.Mask.Size()
+		ip := libvirtxml.NetworkIP{
+			Address: address.String(),
+			Prefix:  uint(prefix),
+		}
+		if ipNet.IP.To4() == nil {
+			ip.Family = "ipv6"
+		}
+
+		if input.DHCPRangeStart != "" && ipNet.Contains(net.ParseIP(input.DHCPRangeStart)) {
+			if !ipNet.Contains(net.ParseIP(input.DHCPRangeEnd)) {
+				return libvirtxml.Network{}, fmt.Errorf("network %s: DHCP range end %q is not within %q", input.Name, input.DHCPRangeEnd, c)
+			}
+			ip.DHCP = &libvirtxml.NetworkDHCP{
+				Ranges: []libvirtxml.NetworkDHCPRange{
+					{
+						Start: input.DHCPRangeStart,
+						End:   input.DHCPRangeEnd,
+					},
+				},
+			}
+			dhcpRangeAssigned = true
+		}
+		networkDef.IPs = append(networkDef.IPs, ip)
+	}
+
+	if input.DHCPRangeStart != "" && !dhcpRangeAssigned {
+		return libvirtxml.Network{}, fmt.Errorf("network %s: DHCP range start %q is not within any of the network CIDRs", input.Name, input.DHCPRangeStart)
+	}
+
+	return networkDef, nil
+}
+
+// updateDefNetwork updates the fields managed by the provider in an existing
+// network definition. Static DHCP hosts and DNS records of the existing
+// definition are kept, so machines stay resolvable.
+func updateDefNetwork(networkDef *libvirtxml.Network, desired libvirtxml.Network) {
+	networkDef.Forward = desired.Forward
+	// keep the bridge libvirt picked if none was requested
+	if desired.Bridge != nil {
+		networkDef.Bridge = desired.Bridge
+	}
+	networkDef.Domain = desired.Domain
+
+	for i := range desired.IPs {
+		for _, ip := range networkDef.IPs {
+			if ip.Address != desired.IPs[i].Address || ip.DHCP == nil || len(ip.DHCP.Hosts) == 0 {
+				continue
+			}
+			if desired.IPs[i].DHCP == nil {
+				desired.IPs[i].DHCP = &libvirtxml.NetworkDHCP{}
+			}
+			desired.IPs[i].DHCP.Hosts = ip.DHCP.Hosts
+		}
+	}
+	networkDef.IPs = desired.IPs
+}
+
+// networkDHCPRangeUpdate is a change of a DHCP range of a running network
+type networkDHCPRangeUpdate struct {
+	command libvirt.NetworkUpdateCommand
+	// ipIndex is the index of the IP element of the range
+	ipIndex   int
+	dhcpRange libvirtxml.NetworkDHCPRange
+}
+
+// dhcpRangeUpdates returns the changes which make the DHCP ranges of a
+// running network match its new definition. Ranges of addresses the running
+// network does not have yet are left for its restart.
+func dhcpRangeUpdates(live, networkDef libvirtxml.Network) []networkDHCPRangeUpdate {
+	var updates []networkDHCPRangeUpdate
+	for i, ip := range live.IPs {
+		var liveRanges, ranges []libvirtxml.NetworkDHCPRange
+		if ip.DHCP != nil {
+			liveRanges = ip.DHCP.Ranges
+		}
+		for _, defIP := range networkDef.IPs {
+			if defIP.Address == ip.Address && defIP.DHCP != nil {
+				ranges = defIP.DHCP.Ranges
+			}
+		}
+
+		for _, r := range liveRanges {
+			if !containsDHCPRange(ranges, r) {
+				updates = append(updates, networkDHCPRangeUpdate{command: libvirt.NETWORK_UPDATE_COMMAND_DELETE, ipIndex: i, dhcpRange: r})
+			}
+		}
+		for _, r := range ranges {
+			if !containsDHCPRange(liveRanges, r) {
+				updates = append(updates, networkDHCPRangeUpdate{command: libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, ipIndex: i, dhcpRange: r})
+			}
+		}
+	}
+	return updates
+}
+
+func containsDHCPRange(ranges []libvirtxml.NetworkDHCPRange, r libvirtxml.NetworkDHCPRange) bool {
+	for _, other := range ranges {
+		if other.Start == r.Start && other.End == r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// networkRestartPending reports whether a running network differs from its
+// new definition in the fields managed by the provider which libvirt cannot
+// change without restarting the network
+func networkRestartPending(live, networkDef libvirtxml.Network) bool {
+	forwardMode := func(n libvirtxml.Network) string {
+		if n.Forward == nil {
+			return ""
+		}
+		return n.Forward.Mode
+	}
+	if forwardMode(live) != forwardMode(networkDef) {
+		return true
+	}
+
+	if (live.Domain == nil) != (networkDef.Domain == nil) {
+		return true
+	}
+	if live.Domain != nil && (live.Domain.Name != networkDef.Domain.Name || live.Domain.LocalOnly != networkDef.Domain.LocalOnly) {
+		return true
+	}
+
+	if networkDef.Bridge != nil && (live.Bridge == nil || live.Bridge.Name != networkDef.Bridge.Name) {
+		return true
+	}
+
+	if len(live.IPs) != len(networkDef.IPs) {
+		return true
+	}
+	for i, ip := range live.IPs {
+		defIP := networkDef.IPs[i]
+		if ip.Address != defIP.Address || ip.Prefix != defIP.Prefix || ip.Family != defIP.Family {
+			return true
+		}
+	}
+	return false
+}
+
+func getDHCPRangeXMLDesc(dhcpRange libvirtxml.NetworkDHCPRange) (string, error) {
+	xml, err := xmlMarshallIndented(dhcpRange)
+	if err != nil {
+		return "", fmt.Errorf("could not marshall: %v", err)
+	}
+	return xml, nil
+}
+
+// updateLiveNetwork applies the DHCP ranges of a new network definition to
+// the running network and returns whether other changes wait for a restart
+// of the network. Restarting it here would disconnect the running machines.
+func updateLiveNetwork(n *libvirt.Network, networkDef libvirtxml.Network) (bool, error) {
+	live, err := newDefNetworkfromLibvirt(n)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving network definition: %v", err)
+	}
+
+	for _, update := range dhcpRangeUpdates(live, networkDef) {
+		xmlDesc, err := getDHCPRangeXMLDesc(update.dhcpRange)
+		if err != nil {
+			return false, fmt.Errorf("error getting dhcp range xml desc: %v", err)
+		}
+		glog.Infof("Updating DHCP range of the running network with XML:\n%s", xmlDesc)
+		if err := n.Update(update.command, libvirt.NETWORK_SECTION_IP_DHCP_RANGE, update.ipIndex, xmlDesc, libvirt.NETWORK_UPDATE_AFFECT_LIVE); err != nil {
+			return false, fmt.Errorf("can't update DHCP range %s-%s: %v", update.dhcpRange.Start, update.dhcpRange.End, err)
+		}
+	}
+
+	return networkRestartPending(live, networkDef), nil
+}
+
+// networkUpdateTarget is a definition of a network updates are applied to
+type networkUpdateTarget struct {
+	flags    libvirt.NetworkUpdateFlags
+	xmlFlags libvirt.NetworkXMLFlags
+}
+
+// networkUpdateTargets returns the definitions of the running network and of
+// the network it is started with next, so updates take effect right away and
+// survive restarts of the network. Both are updated separately, as records
+// added to the running network only are missing from the persistent one.
+func networkUpdateTargets(n *libvirt.Network) ([]networkUpdateTarget, error) {
+	var targets []networkUpdateTarget
+	active, err := n.IsActive()
+	if err != nil {
+		return nil, fmt.Errorf("can't check if network is active: %v", err)
+	}
+	if active {
+		targets = append(targets, networkUpdateTarget{flags: libvirt.NETWORK_UPDATE_AFFECT_LIVE})
+	}
+	persistent, err := n.IsPersistent()
+	if err != nil {
+		return nil, fmt.Errorf("can't check if network is persistent: %v", err)
+	}
+	if persistent {
+		targets = append(targets, networkUpdateTarget{flags: libvirt.NETWORK_UPDATE_AFFECT_CONFIG, xmlFlags: libvirt.NETWORK_XML_INACTIVE})
+	}
+	return targets, nil
+}
+
 // Tries to update first, if that fails, it will add it
 func updateOrAddHost(n *libvirt.Network, ip, mac, name string) error {
-	err := updateHost(n, ip, mac, name)
-	if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_OPERATION_INVALID && virErr.Domain == libvirt.FROM_NETWORK {
-		return addHost(n, ip, mac, name)
+	targets, err := networkUpdateTargets(n)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		err := updateHost(n, ip, mac, name, target.flags)
+		if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_OPERATION_INVALID && virErr.Domain == libvirt.FROM_NETWORK {
+			err = addHost(n, ip, mac, name, target.flags)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 // Adds a new static host to the network
-func addHost(n *libvirt.Network, ip, mac, name string) error {
+func addHost(n *libvirt.Network, ip, mac, name string, flags libvirt.NetworkUpdateFlags) error {
 	xmlDesc, err := getHostXMLDesc(ip, mac, name)
 	if err != nil {
 		return fmt.Errorf("error getting host xml desc: %v", err)
 	}
 	glog.Infof("Adding host with XML:\n%s", xmlDesc)
-	return n.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, xmlDesc, libvirt.NETWORK_UPDATE_AFFECT_CURRENT)
+	return n.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, xmlDesc, flags)
 }
 
 func getHostXMLDesc(ip, mac, name string) (string, error) {
@@ -91,13 +375,127 @@ func getHostXMLDesc(ip, mac, name string) (string, error) {
 }
 
 // Update a static host from the network
-func updateHost(n *libvirt.Network, ip, mac, name string) error {
+func updateHost(n *libvirt.Network, ip, mac, name string, flags libvirt.NetworkUpdateFlags) error {
 	xmlDesc, err := getHostXMLDesc(ip, mac, name)
 	if err != nil {
 		return fmt.Errorf("error getting host xml desc: %v", err)
 	}
 	glog.Infof("Updating host with XML:\n%s", xmlDesc)
-	return n.Update(libvirt.NETWORK_UPDATE_COMMAND_MODIFY, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, xmlDesc, libvirt.NETWORK_UPDATE_AFFECT_CURRENT)
+	return n.Update(libvirt.NETWORK_UPDATE_COMMAND_MODIFY, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, xmlDesc, flags)
+}
+
+// Replaces the DNS host records for the given IP and hostnames, adding it if
+// missing. libvirt does not support modifying DNS host records and refuses to
+// add a record whose IP or hostnames are used by another one, so the
+// conflicting records are removed first.
+func updateOrAddDNSHost(n *libvirt.Network, ip string, hostnames []string) error {
+	targets, err := networkUpdateTargets(n)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		networkDef, err := newDefNetworkfromLibvirtFlags(n, target.xmlFlags)
+		if err != nil {
+			return fmt.Errorf("error retrieving network definition: %v", err)
+		}
+		for _, host := range conflictingDNSHosts(networkDef, ip, hostnames) {
+			if err := removeDNSHost(n, host.IP, target.flags); err != nil {
+				return err
+			}
+		}
+		if err := addDNSHost(n, ip, hostnames, target.flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a new DNS host record to the network
+func addDNSHost(n *libvirt.Network, ip string, hostnames []string, flags libvirt.NetworkUpdateFlags) error {
+	xmlDesc, err := getDNSHostXMLDesc(ip, hostnames)
+	if err != nil {
+		return fmt.Errorf("error getting dns host xml desc: %v", err)
+	}
+	glog.Infof("Adding DNS host with XML:\n%s", xmlDesc)
+	return n.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_DNS_HOST, -1, xmlDesc, flags)
+}
+
+// Removes the DNS host record with the IP from the network. The record is
+// matched by its IP only, as libvirt deletes nothing if the hostnames match
+// other records as well.
+func removeDNSHost(n *libvirt.Network, ip string, flags libvirt.NetworkUpdateFlags) error {
+	xmlDesc, err := getDNSHostXMLDesc(ip, nil)
+	if err != nil {
+		return fmt.Errorf("error getting dns host xml desc: %v", err)
+	}
+	glog.Infof("Removing DNS host with XML:\n%s", xmlDesc)
+	return n.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_DNS_HOST, -1, xmlDesc, flags)
+}
+
+func getDNSHostXMLDesc(ip string, hostnames []string) (string, error) {
+	networkDNSHost := libvirtxml.NetworkDNSHost{
+		IP: ip,
+	}
+	for _, hostname := range hostnames {
+		networkDNSHost.Hostnames = append(networkDNSHost.Hostnames, libvirtxml.NetworkDNSHostHostname{
+			Hostname: hostname,
+		})
+	}
+	xml, err := xmlMarshallIndented(networkDNSHost)
+	if err != nil {
+		return "", fmt.Errorf("could not marshall: %v", err)
+	}
+	return xml, nil
+}
+
+// dnsHostsByHostname returns the DNS host records of the network
+// which contain the given hostname
+func dnsHostsByHostname(net libvirtxml.Network, hostname string) []libvirtxml.NetworkDNSHost {
+	var hosts []libvirtxml.NetworkDNSHost
+	if net.DNS == nil {
+		return hosts
+	}
+	for _, host := range net.DNS.Host {
+		for _, h := range host.Hostnames {
+			if h.Hostname == hostname {
+				hosts = append(hosts, host)
+				break
+			}
+		}
+	}
+	return hosts
+}
+
+// conflictingDNSHosts returns the DNS host records of the network which have
+// the IP or one of the hostnames
+func conflictingDNSHosts(net libvirtxml.Network, ip string, hostnames []string) []libvirtxml.NetworkDNSHost {
+	var hosts []libvirtxml.NetworkDNSHost
+	if net.DNS == nil {
+		return hosts
+	}
+	names := map[string]bool{}
+	for _, hostname := range hostnames {
+		names[hostname] = true
+	}
+	for _, host := range net.DNS.Host {
+		conflicting := sameIP(host.IP, ip)
+		for _, h := range host.Hostnames {
+			conflicting = conflicting || names[h.Hostname]
+		}
+		if conflicting {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// sameIP reports whether two addresses are equal, also in different notations
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
 }
 
 // randomMACAddress returns a randomized MAC address
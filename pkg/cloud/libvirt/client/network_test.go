@@ -0,0 +1,425 @@
+package client
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestGetDNSHostXMLDesc(t *testing.T) {
+	xmlDesc, err := getDNSHostXMLDesc("192.168.124.51", []string{"worker-0", "etcd-0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	host := libvirtxml.NetworkDNSHost{}
+	if err := xml.Unmarshal([]byte(xmlDesc), &host); err != nil {
+		t.Fatalf("failed to unmarshal %q: %v", xmlDesc, err)
+	}
+	if host.IP != "192.168.124.51" {
+		t.Errorf("expected IP 192.168.124.51, got %q", host.IP)
+	}
+	if len(host.Hostnames) != 2 || host.Hostnames[0].Hostname != "worker-0" || host.Hostnames[1].Hostname != "etcd-0" {
+		t.Errorf("unexpected hostnames: %+v", host.Hostnames)
+	}
+}
+
+func TestDNSHostsByHostname(t *testing.T) {
+	networkDef := libvirtxml.Network{
+		DNS: &libvirtxml.NetworkDNS{
+			Host: []libvirtxml.NetworkDNSHost{
+				{
+					IP:        "192.168.124.51",
+					Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: "worker-0"}, {Hostname: "etcd-0"}},
+				},
+				{
+					IP:        "192.168.124.52",
+					Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: "worker-1"}},
+				},
+			},
+		},
+	}
+
+	hosts := dnsHostsByHostname(networkDef, "etcd-0")
+	if len(hosts) != 1 || hosts[0].IP != "192.168.124.51" {
+		t.Errorf("expected host 192.168.124.51, got %+v", hosts)
+	}
+
+	if hosts := dnsHostsByHostname(networkDef, "worker-2"); len(hosts) != 0 {
+		t.Errorf("expected no hosts, got %+v", hosts)
+	}
+
+	if hosts := dnsHostsByHostname(libvirtxml.Network{}, "worker-0"); len(hosts) != 0 {
+		t.Errorf("expected no hosts for network without DNS, got %+v", hosts)
+	}
+}
+
+func TestConflictingDNSHosts(t *testing.T) {
+	networkDef := libvirtxml.Network{
+		DNS: &libvirtxml.NetworkDNS{
+			Host: []libvirtxml.NetworkDNSHost{
+				{
+					IP:        "192.168.124.51",
+					Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: "worker-0"}},
+				},
+				{
+					IP:        "192.168.124.52",
+					Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: "worker-1"}, {Hostname: "etcd-0"}},
+				},
+				{
+					IP:        "fd00::53",
+					Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: "worker-2"}},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name      string
+		ip        string
+		hostnames []string
+		expected  []string
+	}{
+		{
+			name:      "no conflict",
+			ip:        "192.168.124.54",
+			hostnames: []string{"worker-3"},
+		},
+		{
+			name:      "same IP",
+			ip:        "192.168.124.51",
+			hostnames: []string{"worker-3"},
+			expected:  []string{"192.168.124.51"},
+		},
+		{
+			name:      "IP and alias of different records",
+			ip:        "192.168.124.51",
+			hostnames: []string{"worker-0", "etcd-0"},
+			expected:  []string{"192.168.124.51", "192.168.124.52"},
+		},
+		{
+			name:      "IPv6 in another notation",
+			ip:        "fd00:0:0::53",
+			hostnames: []string{"worker-3"},
+			expected:  []string{"fd00::53"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ips []string
+			for _, host := range conflictingDNSHosts(networkDef, tc.ip, tc.hostnames) {
+				ips = append(ips, host.IP)
+			}
+			if !reflect.DeepEqual(ips, tc.expected) {
+				t.Errorf("expected conflicting hosts %v, got %v", tc.expected, ips)
+			}
+		})
+	}
+
+	if hosts := conflictingDNSHosts(libvirtxml.Network{}, "192.168.124.51", []string{"worker-0"}); len(hosts) != 0 {
+		t.Errorf("expected no hosts for network without DNS, got %+v", hosts)
+	}
+}
+
+func TestNewDefNetwork(t *testing.T) {
+	testCases := []struct {
+		name         string
+		input        CreateNetworkInput
+		expected     libvirtxml.Network
+		errorMessage string
+	}{
+		{
+			name: "nat network with DHCP",
+			input: CreateNetworkInput{
+				Name:           "cluster",
+				Bridge:         "tt0",
+				CIDRs:          []string{"192.168.126.0/24", "fd00::/64"},
+				DNSDomain:      "cluster.example.com",
+				DHCPRangeStart: "192.168.126.50",
+				DHCPRangeEnd:   "192.168.126.250",
+			},
+			expected: libvirtxml.Network{
+				Name:    "cluster",
+				Forward: &libvirtxml.NetworkForward{Mode: "nat"},
+				Bridge:  &libvirtxml.NetworkBridge{Name: "tt0", STP: "on"},
+				Domain:  &libvirtxml.NetworkDomain{Name: "cluster.example.com", LocalOnly: "yes"},
+				IPs: []libvirtxml.NetworkIP{
+					{
+						Address: "192.168.126.1",
+						Prefix:  24,
+						DHCP: &libvirtxml.NetworkDHCP{
+							Ranges: []libvirtxml.NetworkDHCPRange{{Start: "192.168.126.50", End: "192.168.126.250"}},
+						},
+					},
+					{
+						Address: "fd00::1",
+						Prefix:  64,
+						Family:  "ipv6",
+					},
+				},
+			},
+		},
+		{
+			name: "isolated network",
+			input: CreateNetworkInput{
+				Name:        "isolated",
+				CIDRs:       []string{"10.0.0.0/16"},
+				ForwardMode: "none",
+			},
+			expected: libvirtxml.Network{
+				Name: "isolated",
+				IPs: []libvirtxml.NetworkIP{
+					{
+						Address: "10.0.0.1",
+						Prefix:  16,
+					},
+				},
+			},
+		},
+		{
+			name: "bridge without bridge name",
+			input: CreateNetworkInput{
+				Name:        "bridged",
+				ForwardMode: "bridge",
+			},
+			errorMessage: `network bridged: forward mode "bridge" requires a bridge`,
+		},
+		{
+			name: "DHCP range outside of CIDRs",
+			input: CreateNetworkInput{
+				Name:           "cluster",
+				CIDRs:          []string{"192.168.126.0/24"},
+				DHCPRangeStart: "192.168.127.50",
+				DHCPRangeEnd:   "192.168.127.250",
+			},
+			errorMessage: `network cluster: DHCP range start "192.168.127.50" is not within any of the network CIDRs`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			networkDef, err := newDefNetwork(tc.input)
+			if tc.errorMessage != "" {
+				if err == nil || err.Error() != tc.errorMessage {
+					t.Fatalf("expected error %q, got %v", tc.errorMessage, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, _ := xmlMarshallIndented(networkDef)
+			expected, _ := xmlMarshallIndented(tc.expected)
+			if got != expected {
+				t.Errorf("expected network:\n%s\ngot:\n%s", expected, got)
+			}
+		})
+	}
+}
+
+func TestUpdateDefNetworkKeepsHosts(t *testing.T) {
+	dhcpHost := libvirtxml.NetworkDHCPHost{MAC: "52:54:00:00:00:01", IP: "192.168.126.51", Name: "worker-0"}
+	networkDef := libvirtxml.Network{
+		Name:   "cluster",
+		UUID:   "6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43",
+		Bridge: &libvirtxml.NetworkBridge{Name: "virbr1", STP: "on"},
+		DNS: &libvirtxml.NetworkDNS{
+			Host: []libvirtxml.NetworkDNSHost{{IP: "192.168.126.51", Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: "worker-0"}}}},
+		},
+		IPs: []libvirtxml.NetworkIP{
+			{
+				Address: "192.168.126.1",
+				Prefix:  24,
+				DHCP:    &libvirtxml.NetworkDHCP{Hosts: []libvirtxml.NetworkDHCPHost{dhcpHost}},
+			},
+		},
+	}
+
+	desired, err := newDefNetwork(CreateNetworkInput{
+		Name:      "cluster",
+		CIDRs:     []string{"192.168.126.0/24"},
+		DNSDomain: "cluster.example.com",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updateDefNetwork(&networkDef, desired)
+
+	if networkDef.UUID != "6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43" {
+		t.Errorf("expected UUID to be kept, got %q", networkDef.UUID)
+	}
+	if networkDef.Bridge == nil || networkDef.Bridge.Name != "virbr1" {
+		t.Errorf("expected bridge virbr1 to be kept, got %+v", networkDef.Bridge)
+	}
+	if networkDef.Domain == nil || networkDef.Domain.Name != "cluster.example.com" {
+		t.Errorf("expected domain cluster.example.com, got %+v", networkDef.Domain)
+	}
+	if len(networkDef.DNS.Host) != 1 {
+		t.Errorf("expected DNS hosts to be kept, got %+v", networkDef.DNS)
+	}
+	if networkDef.IPs[0].DHCP == nil || len(networkDef.IPs[0].DHCP.Hosts) != 1 || networkDef.IPs[0].DHCP.Hosts[0] != dhcpHost {
+		t.Errorf("expected DHCP hosts to be kept, got %+v", networkDef.IPs[0].DHCP)
+	}
+}
+
+func TestDHCPRangeUpdates(t *testing.T) {
+	live := libvirtxml.Network{
+		IPs: []libvirtxml.NetworkIP{
+			{
+				Address: "192.168.126.1",
+				Prefix:  24,
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: "192.168.126.50", End: "192.168.126.250"}},
+				},
+			},
+			{
+				Address: "fd00::1",
+				Prefix:  64,
+				Family:  "ipv6",
+			},
+		},
+	}
+
+	if updates := dhcpRangeUpdates(live, live); len(updates) != 0 {
+		t.Errorf("expected no updates, got %+v", updates)
+	}
+
+	networkDef := libvirtxml.Network{
+		IPs: []libvirtxml.NetworkIP{
+			{
+				Address: "192.168.126.1",
+				Prefix:  24,
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: "192.168.126.100", End: "192.168.126.250"}},
+				},
+			},
+			{
+				Address: "fd00::1",
+				Prefix:  64,
+				Family:  "ipv6",
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: "fd00::100", End: "fd00::1ff"}},
+				},
+			},
+			{
+				Address: "10.0.0.1",
+				Prefix:  16,
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: "10.0.0.50", End: "10.0.0.250"}},
+				},
+			},
+		},
+	}
+	expected := []networkDHCPRangeUpdate{
+		{command: libvirt.NETWORK_UPDATE_COMMAND_DELETE, ipIndex: 0, dhcpRange: libvirtxml.NetworkDHCPRange{Start: "192.168.126.50", End: "192.168.126.250"}},
+		{command: libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, ipIndex: 0, dhcpRange: libvirtxml.NetworkDHCPRange{Start: "192.168.126.100", End: "192.168.126.250"}},
+		{command: libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, ipIndex: 1, dhcpRange: libvirtxml.NetworkDHCPRange{Start: "fd00::100", End: "fd00::1ff"}},
+	}
+	if updates := dhcpRangeUpdates(live, networkDef); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("expected updates %+v, got %+v", expected, updates)
+	}
+}
+
+func TestNetworkRestartPending(t *testing.T) {
+	// as reported by libvirt for a running network
+	live := libvirtxml.Network{
+		Name: "cluster",
+		Forward: &libvirtxml.NetworkForward{
+			Mode: "nat",
+			NAT:  &libvirtxml.NetworkForwardNAT{Ports: []libvirtxml.NetworkForwardNATPort{{Start: 1024, End: 65535}}},
+		},
+		Bridge: &libvirtxml.NetworkBridge{Name: "virbr1", STP: "on", Delay: "0"},
+		Domain: &libvirtxml.NetworkDomain{Name: "cluster.example.com", LocalOnly: "yes"},
+		IPs: []libvirtxml.NetworkIP{
+			{
+				Address: "192.168.126.1",
+				Prefix:  24,
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: "192.168.126.50", End: "192.168.126.250"}},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		input    CreateNetworkInput
+		expected bool
+	}{
+		{
+			name: "unchanged",
+			input: CreateNetworkInput{
+				Name:           "cluster",
+				CIDRs:          []string{"192.168.126.0/24"},
+				DNSDomain:      "cluster.example.com",
+				DHCPRangeStart: "192.168.126.50",
+				DHCPRangeEnd:   "192.168.126.250",
+			},
+		},
+		{
+			name: "DHCP range changed",
+			input: CreateNetworkInput{
+				Name:           "cluster",
+				CIDRs:          []string{"192.168.126.0/24"},
+				DNSDomain:      "cluster.example.com",
+				DHCPRangeStart: "192.168.126.100",
+				DHCPRangeEnd:   "192.168.126.200",
+			},
+		},
+		{
+			name: "DNS domain changed",
+			input: CreateNetworkInput{
+				Name:      "cluster",
+				CIDRs:     []string{"192.168.126.0/24"},
+				DNSDomain: "other.example.com",
+			},
+			expected: true,
+		},
+		{
+			name: "CIDR added",
+			input: CreateNetworkInput{
+				Name:      "cluster",
+				CIDRs:     []string{"192.168.126.0/24", "fd00::/64"},
+				DNSDomain: "cluster.example.com",
+			},
+			expected: true,
+		},
+		{
+			name: "forward mode changed",
+			input: CreateNetworkInput{
+				Name:        "cluster",
+				CIDRs:       []string{"192.168.126.0/24"},
+				DNSDomain:   "cluster.example.com",
+				ForwardMode: "route",
+			},
+			expected: true,
+		},
+		{
+			name: "bridge changed",
+			input: CreateNetworkInput{
+				Name:      "cluster",
+				Bridge:    "tt0",
+				CIDRs:     []string{"192.168.126.0/24"},
+				DNSDomain: "cluster.example.com",
+			},
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			desired, err := newDefNetwork(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pending := networkRestartPending(live, desired); pending != tc.expected {
+				t.Errorf("expected restart pending %v, got %v", tc.expected, pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// networkDiskKey is the key of the CHAP password or cephx key in network disk secrets
+	networkDiskKey = "key"
+
+	secretTypeCeph  = "ceph"
+	secretTypeISCSI = "iscsi"
+)
+
+// networkDiskSecretsLock keeps libvirt secrets of network disks from being
+// deleted as unreferenced while a domain using them is being defined
+var networkDiskSecretsLock sync.RWMutex
+
+// networkPoolTypes are the storage pool types whose volumes are not files on
+// the libvirt host and have to be attached by pool and volume name
+var networkPoolTypes = map[string]bool{
+	"rbd":          true,
+	"iscsi":        true,
+	"iscsi-direct": true,
+	"gluster":      true,
+	"sheepdog":     true,
+}
+
+// newDefDiskSourceNetwork returns the source of a network disk
+func newDefDiskSourceNetwork(source *providerconfigv1.NetworkDiskSource) *libvirtxml.DomainDiskSourceNetwork {
+	sourceDef := &libvirtxml.DomainDiskSourceNetwork{
+		Protocol: string(source.Protocol),
+		Name:     source.Name,
+	}
+	for _, host := range source.Hosts {
+		sourceDef.Hosts = append(sourceDef.Hosts, libvirtxml.DomainDiskSourceHost{
+			Name: host.Name,
+			Port: host.Port,
+		})
+	}
+	return sourceDef
+}
+
+// networkDiskSecretType returns the libvirt secret type of the credentials of
+// a network disk protocol
+func networkDiskSecretType(protocol providerconfigv1.NetworkDiskProtocol) (string, libvirt.SecretUsageType, error) {
+	switch protocol {
+	case providerconfigv1.NetworkDiskProtocolRBD:
+		return secretTypeCeph, libvirt.SECRET_USAGE_TYPE_CEPH, nil
+	case providerconfigv1.NetworkDiskProtocolISCSI:
+		return secretTypeISCSI, libvirt.SECRET_USAGE_TYPE_ISCSI, nil
+	default:
+		return "", 0, fmt.Errorf("protocol %q does not support authentication", protocol)
+	}
+}
+
+// newDefNetworkDiskSecret returns the definition of the libvirt secret holding
+// the credentials of network disks, identified by the usage name
+func newDefNetworkDiskSecret(secretType string, usageName string) libvirtxml.Secret {
+	usage := &libvirtxml.SecretUsage{Type: secretType}
+	if secretType == secretTypeISCSI {
+		usage.Target = usageName
+	} else {
+		usage.Name = usageName
+	}
+	return libvirtxml.Secret{
+		Ephemeral:   "no",
+		Private:     "yes",
+		Description: fmt.Sprintf("credentials of network disks %s", usageName),
+		Usage:       usage,
+	}
+}
+
+// networkDiskSecretValue returns the value of the libvirt secret from the key
+// stored in the kubernetes secret. cephx keys are stored base64 encoded, the
+// way ceph prints them, while libvirt keeps them raw.
+func networkDiskSecretValue(secretType string, key []byte) ([]byte, error) {
+	if secretType != secretTypeCeph {
+		return key, nil
+	}
+	value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil {
+		return nil, fmt.Errorf("cephx key is not base64 encoded: %v", err)
+	}
+	return value, nil
+}
+
+// setNetworkDisk adds a network block device as virtio disk. Credentials
+// are read from the kubernetes secret and registered as libvirt secret shared
+// by all disks using the same kubernetes secret. The secret is deleted with
+// the last domain referencing it, see deleteUnusedNetworkDiskSecrets. The
+// caller has to hold networkDiskSecretsLock for reading until the domain is
+// defined.
+func (client *libvirtClient) setNetworkDisk(ctx context.Context, domainDef *libvirtxml.Domain, source *providerconfigv1.NetworkDiskSource, kubeClient kubernetes.Interface, namespace string) error {
+	disk := newDefDisk(nextVirtioDiskIndex(domainDef))
+	disk.Driver.Type = "raw"
+	disk.Source = &libvirtxml.DomainDiskSource{
+		Network: newDefDiskSourceNetwork(source),
+	}
+
+	if source.Auth != nil {
+		secretType, usageType, err := networkDiskSecretType(source.Protocol)
+		if err != nil {
+			return err
+		}
+		key, err := getSecretData(ctx, kubeClient, namespace, source.Auth.SecretName, networkDiskKey)
+		if err != nil {
+			return err
+		}
+		value, err := networkDiskSecretValue(secretType, key)
+		if err != nil {
+			return fmt.Errorf("invalid secret %s: %v", source.Auth.SecretName, err)
+		}
+		usageName := fmt.Sprintf("%s/%s", namespace, source.Auth.SecretName)
+		secretUUID, err := client.ensureSecret(newDefNetworkDiskSecret(secretType, usageName), usageType, usageName, value)
+		if err != nil {
+			return err
+		}
+		disk.Source.Network.Auth = &libvirtxml.DomainDiskAuth{
+			Username: source.Auth.Username,
+			Secret: &libvirtxml.DomainDiskSecret{
+				Type: secretType,
+				UUID: secretUUID,
+			},
+		}
+	}
+
+	domainDef.Devices.Disks = append(domainDef.Devices.Disks, disk)
+	return nil
+}
+
+// networkDiskSecretUUIDs returns the UUIDs of the libvirt secrets used by the
+// network disks of a domain
+func networkDiskSecretUUIDs(domainDef libvirtxml.Domain) []string {
+	if domainDef.Devices == nil {
+		return nil
+	}
+	var uuids []string
+	for _, disk := range domainDef.Devices.Disks {
+		if disk.Source != nil && disk.Source.Network != nil && disk.Source.Network.Auth != nil && disk.Source.Network.Auth.Secret != nil {
+			uuids = append(uuids, disk.Source.Network.Auth.Secret.UUID)
+		}
+	}
+	return uuids
+}
+
+// deleteUnusedNetworkDiskSecrets deletes the libvirt secrets of network disks
+// which are no longer referenced by any domain defined on the host
+func (client *libvirtClient) deleteUnusedNetworkDiskSecrets(uuids []string) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	networkDiskSecretsLock.Lock()
+	defer networkDiskSecretsLock.Unlock()
+
+	domains, err := client.connection.ListAllDomains(0)
+	if err != nil {
+		return fmt.Errorf("error listing domains: %v", err)
+	}
+	defer func() {
+		for i := range domains {
+			domains[i].Free()
+		}
+	}()
+
+	used := map[string]bool{}
+	for i := range domains {
+		domainXMLDesc, err := domains[i].GetXMLDesc(0)
+		if err != nil {
+			// the domain was undefined in the meantime
+			if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_DOMAIN {
+				continue
+			}
+			return fmt.Errorf("could not get XML description for domain: %v", err)
+		}
+		var domainDef libvirtxml.Domain
+		if err := xml.Unmarshal([]byte(domainXMLDesc), &domainDef); err != nil {
+			return fmt.Errorf("could not parse XML description for domain: %v", err)
+		}
+		for _, uuid := range networkDiskSecretUUIDs(domainDef) {
+			used[uuid] = true
+		}
+	}
+
+	for _, uuid := range uuids {
+		if used[uuid] {
+			glog.Infof("Libvirt secret %s is still used by other domains", uuid)
+			continue
+		}
+		if err := client.deleteSecret(uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+)
+
+func TestNewDefDiskSourceNetwork(t *testing.T) {
+	sourceDef := newDefDiskSourceNetwork(&providerconfigv1.NetworkDiskSource{
+		Protocol: providerconfigv1.NetworkDiskProtocolRBD,
+		Name:     "rbd/worker-data",
+		Hosts: []providerconfigv1.NetworkDiskHost{
+			{Name: "mon1", Port: "6789"},
+			{Name: "mon2"},
+		},
+	})
+
+	if sourceDef.Protocol != "rbd" || sourceDef.Name != "rbd/worker-data" {
+		t.Errorf("unexpected source %+v", sourceDef)
+	}
+	if len(sourceDef.Hosts) != 2 || sourceDef.Hosts[0].Name != "mon1" || sourceDef.Hosts[0].Port != "6789" || sourceDef.Hosts[1].Port != "" {
+		t.Errorf("unexpected hosts %+v", sourceDef.Hosts)
+	}
+}
+
+func TestNewDefNetworkDiskSecret(t *testing.T) {
+	cases := []struct {
+		protocol    providerconfigv1.NetworkDiskProtocol
+		expected    string
+		expectError bool
+	}{
+		{
+			protocol: providerconfigv1.NetworkDiskProtocolRBD,
+			expected: `<usage type="ceph"><name>test/storage-key</name></usage>`,
+		},
+		{
+			protocol: providerconfigv1.NetworkDiskProtocolISCSI,
+			expected: `<usage type="iscsi"><target>test/storage-key</target></usage>`,
+		},
+		{
+			protocol:    providerconfigv1.NetworkDiskProtocolNBD,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(string(tc.protocol), func(t *testing.T) {
+			secretType, _, err := networkDiskSecretType(tc.protocol)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			secretDef, err := xml.Marshal(newDefNetworkDiskSecret(secretType, "test/storage-key"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(string(secretDef), tc.expected) {
+				t.Errorf("expected %s in %s", tc.expected, secretDef)
+			}
+		})
+	}
+}
+
+func TestNetworkDiskSecretValue(t *testing.T) {
+	value, err := networkDiskSecretValue(secretTypeCeph, []byte("c2VjcmV0\n"))
+	if err != nil || string(value) != "secret" {
+		t.Errorf("expected decoded cephx key, got %q, %v", value, err)
+	}
+	if _, err := networkDiskSecretValue(secretTypeCeph, []byte("not base64!")); err == nil {
+		t.Errorf("expected error for invalid cephx key")
+	}
+	value, err = networkDiskSecretValue(secretTypeISCSI, []byte("password"))
+	if err != nil || string(value) != "password" {
+		t.Errorf("expected CHAP password as is, got %q, %v", value, err)
+	}
+}
+
+func TestNetworkDiskSecretUUIDs(t *testing.T) {
+	domainDef := newDomainDef()
+	domainDef.Devices.Disks = nil
+	root := newDefDisk(0)
+	root.Source = &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker"}}
+	nbd := newDefDisk(1)
+	nbd.Source = &libvirtxml.DomainDiskSource{Network: &libvirtxml.DomainDiskSourceNetwork{Protocol: "nbd", Name: "scratch"}}
+	iscsi := newDefDisk(2)
+	iscsi.Source = &libvirtxml.DomainDiskSource{Network: &libvirtxml.DomainDiskSourceNetwork{
+		Protocol: "iscsi",
+		Name:     "iqn.2013-06.com.example:storage/1",
+		Auth: &libvirtxml.DomainDiskAuth{
+			Username: "worker",
+			Secret:   &libvirtxml.DomainDiskSecret{Type: secretTypeISCSI, UUID: "2c5b6a1e-3f0d-4d8e-9b7a-6c1e2f3a4b5c"},
+		},
+	}}
+	domainDef.Devices.Disks = append(domainDef.Devices.Disks, root, nbd, iscsi)
+
+	uuids := networkDiskSecretUUIDs(domainDef)
+	if len(uuids) != 1 || uuids[0] != "2c5b6a1e-3f0d-4d8e-9b7a-6c1e2f3a4b5c" {
+		t.Errorf("expected the secret of the iSCSI disk, got %v", uuids)
+	}
+	if uuids := networkDiskSecretUUIDs(libvirtxml.Domain{}); len(uuids) != 0 {
+		t.Errorf("expected no secrets for domain without devices, got %v", uuids)
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	poolTypeDir = "dir"
+)
+
+// PoolPathInUseError is returned when the path of a storage pool is the
+// target of other storage pools
+type PoolPathInUseError struct {
+	Name  string
+	Path  string
+	Pools []string
+}
+
+func (e *PoolPathInUseError) Error() string {
+	return fmt.Sprintf("path %s of storage pool %s is used by storage pool %s", e.Path, e.Name, strings.Join(e.Pools, ", "))
+}
+
+// poolsWithPath returns the names of the other storage pools with the path
+// as target
+func poolsWithPath(poolDefs []libvirtxml.StoragePool, name string, path string) []string {
+	var pools []string
+	for _, poolDef := range poolDefs {
+		if poolDef.Name != name && poolDef.Target != nil && filepath.Clean(poolDef.Target.Path) == filepath.Clean(path) {
+			pools = append(pools, poolDef.Name)
+		}
+	}
+	return pools
+}
+
+// newDefPool creates a dir-type storage pool definition from CreateStoragePoolInput
+func newDefPool(input CreateStoragePoolInput) (libvirtxml.StoragePool, error) {
+	if input.Name == "" {
+		return libvirtxml.StoragePool{}, fmt.Errorf("storage pool name is empty")
+	}
+	if input.Path == "" {
+		return libvirtxml.StoragePool{}, fmt.Errorf("storage pool %s: path is empty", input.Name)
+	}
+
+	poolDef := libvirtxml.StoragePool{
+		Type: poolTypeDir,
+		Name: input.Name,
+		Target: &libvirtxml.StoragePoolTarget{
+			Path: input.Path,
+		},
+	}
+	if input.Permissions != "" || input.Owner != "" || input.Group != "" {
+		poolDef.Target.Permissions = &libvirtxml.StoragePoolTargetPermissions{
+			Mode:  input.Permissions,
+			Owner: input.Owner,
+			Group: input.Group,
+		}
+	}
+	return poolDef, nil
+}
+
+func newDefPoolFromLibvirt(pool *libvirt.StoragePool) (libvirtxml.StoragePool, error) {
+	poolXMLDesc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return libvirtxml.StoragePool{}, fmt.Errorf("error retrieving libvirt storage pool XML description: %v", err)
+	}
+	poolDef := libvirtxml.StoragePool{}
+	if err := xml.Unmarshal([]byte(poolXMLDesc), &poolDef); err != nil {
+		return libvirtxml.StoragePool{}, fmt.Errorf("error reading libvirt storage pool XML description: %v", err)
+	}
+	return poolDef, nil
+}
+
+// validatePool checks that an existing pool matches the requested one and
+// has enough space available
+func validatePool(poolDef libvirtxml.StoragePool, info *libvirt.StoragePoolInfo, input CreateStoragePoolInput) error {
+	if poolDef.Type != poolTypeDir {
+		return fmt.Errorf("storage pool %s has type %q, expected %q", input.Name, poolDef.Type, poolTypeDir)
+	}
+	if poolDef.Target == nil || poolDef.Target.Path != input.Path {
+		return fmt.Errorf("storage pool %s does not use path %q", input.Name, input.Path)
+	}
+	if info.State != libvirt.STORAGE_POOL_RUNNING {
+		return fmt.Errorf("storage pool %s is not running", input.Name)
+	}
+	if info.Available < input.MinimumAvailable {
+		return fmt.Errorf("storage pool %s has %d bytes available, %d bytes are required", input.Name, info.Available, input.MinimumAvailable)
+	}
+	return nil
+}
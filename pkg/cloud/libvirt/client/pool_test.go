@@ -0,0 +1,105 @@
+package client
+
+import (
+	"testing"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestNewDefPool(t *testing.T) {
+	poolDef, err := newDefPool(CreateStoragePoolInput{
+		Name:        "cluster",
+		Path:        "/var/lib/libvirt/cluster",
+		Permissions: "0711",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if poolDef.Type != "dir" || poolDef.Name != "cluster" || poolDef.Target.Path != "/var/lib/libvirt/cluster" {
+		t.Errorf("unexpected pool definition: %+v", poolDef)
+	}
+	if poolDef.Target.Permissions == nil || poolDef.Target.Permissions.Mode != "0711" {
+		t.Errorf("expected permissions 0711, got %+v", poolDef.Target.Permissions)
+	}
+
+	if _, err := newDefPool(CreateStoragePoolInput{Name: "cluster"}); err == nil {
+		t.Errorf("expected error for pool without path")
+	}
+}
+
+func TestValidatePool(t *testing.T) {
+	input := CreateStoragePoolInput{
+		Name:             "cluster",
+		Path:             "/var/lib/libvirt/cluster",
+		MinimumAvailable: 1024,
+	}
+	poolDef, _ := newDefPool(input)
+
+	testCases := []struct {
+		name         string
+		poolDef      libvirtxml.StoragePool
+		info         libvirt.StoragePoolInfo
+		errorMessage string
+	}{
+		{
+			name:    "valid pool",
+			poolDef: poolDef,
+			info:    libvirt.StoragePoolInfo{State: libvirt.STORAGE_POOL_RUNNING, Available: 2048},
+		},
+		{
+			name:         "pool not running",
+			poolDef:      poolDef,
+			info:         libvirt.StoragePoolInfo{State: libvirt.STORAGE_POOL_INACTIVE, Available: 2048},
+			errorMessage: "storage pool cluster is not running",
+		},
+		{
+			name:         "not enough space",
+			poolDef:      poolDef,
+			info:         libvirt.StoragePoolInfo{State: libvirt.STORAGE_POOL_RUNNING, Available: 512},
+			errorMessage: "storage pool cluster has 512 bytes available, 1024 bytes are required",
+		},
+		{
+			name: "different path",
+			poolDef: libvirtxml.StoragePool{
+				Type:   "dir",
+				Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/libvirt/images"},
+			},
+			info:         libvirt.StoragePoolInfo{State: libvirt.STORAGE_POOL_RUNNING, Available: 2048},
+			errorMessage: `storage pool cluster does not use path "/var/lib/libvirt/cluster"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePool(tc.poolDef, &tc.info, input)
+			if tc.errorMessage == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.errorMessage {
+				t.Errorf("expected error %q, got %v", tc.errorMessage, err)
+			}
+		})
+	}
+}
+
+func TestPoolsWithPath(t *testing.T) {
+	poolDefs := []libvirtxml.StoragePool{
+		{Name: "default", Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/libvirt/images"}},
+		{Name: "cluster", Target: &libvirtxml.StoragePoolTarget{Path: "/var/lib/libvirt/cluster"}},
+		{Name: "iscsi"},
+	}
+
+	if pools := poolsWithPath(poolDefs, "cluster", "/var/lib/libvirt/images/"); len(pools) != 1 || pools[0] != "default" {
+		t.Errorf("expected pool default, got %v", pools)
+	}
+	if pools := poolsWithPath(poolDefs, "cluster", "/var/lib/libvirt/cluster"); len(pools) != 0 {
+		t.Errorf("expected the pool itself to be ignored, got %v", pools)
+	}
+	if pools := poolsWithPath(poolDefs, "machines", "/var/lib/libvirt/machines"); len(pools) != 0 {
+		t.Errorf("expected no pools, got %v", pools)
+	}
+}
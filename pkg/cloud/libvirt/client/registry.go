@@ -0,0 +1,561 @@
+package client
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	// maxManifestSize limits how much of a manifest or token response is read
+	maxManifestSize = 4 << 20
+)
+
+// registryImage is a disk image in a container registry. It is either the
+// single blob of an OCI artifact, or the file below /disk of an image layer
+// as in KubeVirt containerDisk images.
+type registryImage struct {
+	registry   string
+	repository string
+	reference  string
+
+	downloader  *downloader
+	credentials *registryCredentials
+	token       string
+
+	// stagingFiles are the paths of the blobs pulled into staging files
+	stagingFiles []string
+}
+
+type registryCredentials struct {
+	username string
+	password string
+}
+
+// registryDescriptor refers to a manifest or blob
+type registryDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// registryManifest is an image manifest or an index of manifests
+type registryManifest struct {
+	MediaType string               `json:"mediaType"`
+	Manifests []registryDescriptor `json:"manifests"`
+	Layers    []registryDescriptor `json:"layers"`
+}
+
+// newRegistryImage parses an image reference like
+// registry://quay.io/org/image:tag or docker://quay.io/org/image@sha256:...
+// and looks up the credentials for its registry in the pull secret.
+func newRegistryImage(source string, pullSecret []byte) (*registryImage, error) {
+	ref := source[strings.Index(source, "://")+3:]
+
+	img := &registryImage{
+		registry:   dockerHubRegistry,
+		downloader: getDefaultDownloader(),
+	}
+	if i := strings.Index(ref, "/"); i >= 0 {
+		host := ref[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			img.registry = host
+			ref = ref[i+1:]
+		}
+	}
+	if img.registry == dockerHubRegistry && !strings.Contains(ref, "/") {
+		ref = "library/" + ref
+	}
+
+	if i := strings.Index(ref, "@"); i >= 0 {
+		img.repository, img.reference = ref[:i], ref[i+1:]
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		img.repository, img.reference = ref[:i], ref[i+1:]
+	} else {
+		img.repository, img.reference = ref, "latest"
+	}
+	if img.repository == "" || img.reference == "" {
+		return nil, fmt.Errorf("invalid image reference %q", source)
+	}
+
+	if len(pullSecret) > 0 {
+		credentials, err := credentialsFromPullSecret(pullSecret, img.registry)
+		if err != nil {
+			return nil, err
+		}
+		img.credentials = credentials
+	}
+	return img, nil
+}
+
+// credentialsFromPullSecret returns the credentials for the registry from
+// the content of a .dockerconfigjson pull secret
+func credentialsFromPullSecret(pullSecret []byte, registry string) (*registryCredentials, error) {
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(pullSecret, &config); err != nil {
+		return nil, fmt.Errorf("error parsing pull secret: %v", err)
+	}
+
+	for server, auth := range config.Auths {
+		host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+		host = strings.SplitN(host, "/", 2)[0]
+		if host == "index.docker.io" || host == "docker.io" {
+			host = dockerHubRegistry
+		}
+		if host != registry {
+			continue
+		}
+
+		if auth.Auth == "" {
+			return &registryCredentials{username: auth.Username, password: auth.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding pull secret auth for %s: %v", registry, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid pull secret auth for %s", registry)
+		}
+		return &registryCredentials{username: parts[0], password: parts[1]}, nil
+	}
+
+	glog.Infof("Pull secret has no credentials for %s, pulling anonymously", registry)
+	return nil, nil
+}
+
+func (i *registryImage) string() string {
+	separator := ":"
+	if strings.Contains(i.reference, ":") {
+		separator = "@"
+	}
+	return i.registry + "/" + i.repository + separator + i.reference
+}
+
+func (i *registryImage) size() (uint64, error) {
+	r, size, err := i.open()
+	if err != nil {
+		return 0, err
+	}
+	r.Close()
+	return uint64(size), nil
+}
+
+func (i *registryImage) version() (string, error) {
+	manifest, err := i.resolveManifest()
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest, nil
+}
+
+// digest returns the digest of the manifest, as pulling the disk image just to
+// identify it would take as long as importing it. The blobs are verified
+// against their digests on their own.
+func (i *registryImage) digest() (string, bool, error) {
+	digest, err := i.version()
+	return digest, false, err
+}
+
+func (i *registryImage) head(n int64) ([]byte, error) {
+	r, _, err := i.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, n))
+}
+
+func (i *registryImage) importImage(copier func(io.Reader) error, vol libvirtxml.StorageVolume) error {
+	r, _, err := i.open()
+	if err != nil {
+		return err
+	}
+	err = copier(r)
+	r.Close()
+	if err != nil {
+		var mismatch *checksumMismatchError
+		if errors.As(err, &mismatch) {
+			// the blob is corrupt, pull it again next time
+			i.removeStagingFiles()
+		}
+		return err
+	}
+	i.removeStagingFiles()
+	return nil
+}
+
+func (i *registryImage) removeStagingFiles() {
+	for _, path := range i.stagingFiles {
+		removeStagingFile(path)
+	}
+	i.stagingFiles = nil
+}
+
+// open returns a reader of the disk image and its size. The blob holding it
+// is verified against its digest while it is read.
+func (i *registryImage) open() (io.ReadCloser, int64, error) {
+	descriptor, err := i.resolveManifest()
+	if err != nil {
+		return nil, 0, err
+	}
+	manifest, err := i.getManifest(descriptor.Digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, 0, fmt.Errorf("image %s has no layers", i.string())
+	}
+
+	// an OCI artifact carries the disk image as a blob of its own
+	for _, layer := range manifest.Layers {
+		if !strings.Contains(layer.MediaType, "tar") {
+			blob, err := i.getBlob(layer)
+			if err != nil {
+				return nil, 0, err
+			}
+			return blob, layer.Size, nil
+		}
+	}
+
+	// a containerDisk carries it in a layer, usually the last one
+	for l := len(manifest.Layers) - 1; l >= 0; l-- {
+		r, size, err := i.openDiskFromLayer(manifest.Layers[l])
+		if err != nil {
+			return nil, 0, err
+		}
+		if r != nil {
+			return r, size, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("image %s has no disk image below /disk", i.string())
+}
+
+// openDiskFromLayer returns a reader of the first file below /disk of the
+// layer, or nil if there is none
+func (i *registryImage) openDiskFromLayer(layer registryDescriptor) (io.ReadCloser, int64, error) {
+	blob, err := i.getBlob(layer)
+	if err != nil {
+		return nil, 0, err
+	}
+	layerReader, _, err := decompress(blob)
+	if err != nil {
+		blob.Close()
+		return nil, 0, err
+	}
+
+	tr := tar.NewReader(layerReader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			closers{layerReader, blob}.Close()
+			return nil, 0, nil
+		}
+		if err != nil {
+			closers{layerReader, blob}.Close()
+			return nil, 0, fmt.Errorf("error reading layer %s: %v", layer.Digest, err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if header.Typeflag == tar.TypeReg && path.Dir(name) == "disk" {
+			glog.Infof("Found disk image %s in layer %s of %s", name, layer.Digest, i.string())
+			// the rest of the layer is read once the disk image ends, so the
+			// layer can be verified against its digest
+			return &drainingReader{ReadCloser: readCloser{Reader: tr, Closer: closers{layerReader, blob}}, src: layerReader}, header.Size, nil
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers closes all of its closers
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var err error
+	for _, closer := range c {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// resolveManifest returns the descriptor of the image manifest, picking the
+// one for the architecture of the manager from an index
+func (i *registryImage) resolveManifest() (registryDescriptor, error) {
+	data, descriptor, err := i.fetchManifest(i.reference)
+	if err != nil {
+		return registryDescriptor{}, err
+	}
+	if descriptor.MediaType != mediaTypeOCIIndex && descriptor.MediaType != mediaTypeDockerManifestList {
+		return descriptor, nil
+	}
+
+	var index registryManifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		return registryDescriptor{}, fmt.Errorf("error parsing manifest index of %s: %v", i.string(), err)
+	}
+	for _, m := range index.Manifests {
+		if m.Platform == nil || (m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH) {
+			return m, nil
+		}
+	}
+	return registryDescriptor{}, fmt.Errorf("image %s has no manifest for linux/%s", i.string(), runtime.GOARCH)
+}
+
+func (i *registryImage) getManifest(digest string) (registryManifest, error) {
+	data, _, err := i.fetchManifest(digest)
+	if err != nil {
+		return registryManifest{}, err
+	}
+	var manifest registryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return registryManifest{}, fmt.Errorf("error parsing manifest of %s: %v", i.string(), err)
+	}
+	return manifest, nil
+}
+
+// fetchManifest returns a manifest and its descriptor
+func (i *registryImage) fetchManifest(reference string) ([]byte, registryDescriptor, error) {
+	response, err := i.get("manifests/"+reference, strings.Join([]string{
+		mediaTypeOCIManifest, mediaTypeOCIIndex, mediaTypeDockerManifest, mediaTypeDockerManifestList,
+	}, ", "))
+	if err != nil {
+		return nil, registryDescriptor{}, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxManifestSize))
+	if err != nil {
+		return nil, registryDescriptor{}, err
+	}
+
+	descriptor := registryDescriptor{
+		MediaType: response.Header.Get("Content-Type"),
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:      int64(len(data)),
+	}
+	if descriptor.MediaType == "" || descriptor.MediaType == "application/json" {
+		var m registryManifest
+		if err := json.Unmarshal(data, &m); err == nil {
+			descriptor.MediaType = m.MediaType
+		}
+	}
+	if strings.HasPrefix(reference, "sha256:") && reference != descriptor.Digest {
+		return nil, registryDescriptor{}, fmt.Errorf("manifest of %s does not match its digest %s", i.string(), reference)
+	}
+	return data, descriptor, nil
+}
+
+// getBlob pulls the blob into a staging file, so interrupted pulls are
+// resumed like downloads, and returns a reader of it which fails if the blob
+// does not match its digest
+func (i *registryImage) getBlob(descriptor registryDescriptor) (io.ReadCloser, error) {
+	if !strings.HasPrefix(descriptor.Digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest %q", descriptor.Digest)
+	}
+	digest, err := hex.DecodeString(strings.TrimPrefix(descriptor.Digest, "sha256:"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %v", descriptor.Digest, err)
+	}
+
+	// the digest identifies the content of the blob
+	path, err := i.downloader.downloadFile(i.url("blobs/"+descriptor.Digest), remoteFile{size: descriptor.Size, validator: descriptor.Digest}, i.do)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %s: %s", path, err)
+	}
+	if !containsString(i.stagingFiles, path) {
+		i.stagingFiles = append(i.stagingFiles, path)
+	}
+	sum := &checksum{algorithm: checksumSHA256, digest: digest}
+	return readCloser{
+		Reader: &verifyingReader{reader: f, hash: sha256.New(), checksum: sum},
+		Closer: f,
+	}, nil
+}
+
+// url returns the URL of a path below /v2/<repository>/ of the registry
+func (i *registryImage) url(p string) string {
+	scheme := "https"
+	if containsString(i.downloader.options.PlainHTTPRegistries, i.registry) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, i.registry, i.repository, p)
+}
+
+// get requests a path below /v2/<repository>/ of the registry
+func (i *registryImage) get(p string, accept string) (*http.Response, error) {
+	u := i.url(p)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	response, err := i.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error while pulling %s: %v", i.string(), err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("Error while pulling %s: %s - %s", i.string(), u, response.Status)
+	}
+	return response, nil
+}
+
+// do sends a request to the registry, authenticating as requested by the
+// registry
+func (i *registryImage) do(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if i.token != "" {
+			req.Header.Set("Authorization", "Bearer "+i.token)
+		} else if i.credentials != nil {
+			req.SetBasicAuth(i.credentials.username, i.credentials.password)
+		}
+
+		response, err := i.downloader.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		challenge := response.Header.Get("WWW-Authenticate")
+		if response.StatusCode != http.StatusUnauthorized || attempt > 0 || !strings.HasPrefix(challenge, "Bearer ") {
+			return response, nil
+		}
+		response.Body.Close()
+
+		if err := i.authenticate(challenge); err != nil {
+			return nil, fmt.Errorf("Error authenticating to %s: %v", i.registry, err)
+		}
+	}
+}
+
+// authenticate gets a token from the realm of a bearer challenge
+func (i *registryImage) authenticate(challenge string) error {
+	params := parseChallenge(strings.TrimPrefix(challenge, "Bearer "))
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid realm in challenge %q", challenge)
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", i.repository)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if i.credentials != nil {
+		req.SetBasicAuth(i.credentials.username, i.credentials.password)
+	}
+	response, err := i.downloader.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed: %s", response.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxManifestSize)).Decode(&token); err != nil {
+		return fmt.Errorf("error parsing token response: %v", err)
+	}
+	i.token = token.Token
+	if i.token == "" {
+		i.token = token.AccessToken
+	}
+	if i.token == "" {
+		return fmt.Errorf("token response has no token")
+	}
+	return nil
+}
+
+// parseChallenge parses the comma separated key="value" parameters of a
+// WWW-Authenticate challenge
+func parseChallenge(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma >= 0 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = value
+	}
+	return params
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRegistry is a minimal registry serving manifests and blobs of a single
+// repository to clients with a bearer token
+type testRegistry struct {
+	server    *httptest.Server
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{}
+	r.server = httptest.NewTLSServer(r.handler())
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// newPlainHTTPTestRegistry returns a test registry served over http
+func newPlainHTTPTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{}
+	r.server = httptest.NewServer(r.handler())
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testRegistry) handler() http.Handler {
+	r.manifests = map[string][]byte{}
+	r.blobs = map[string][]byte{}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token": "test-token"}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer test-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:disks/rhcos:pull"`, r.server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/v2/disks/rhcos/manifests/"):
+			manifest, ok := r.manifests[strings.TrimPrefix(req.URL.Path, "/v2/disks/rhcos/manifests/")]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Write(manifest)
+		case strings.HasPrefix(req.URL.Path, "/v2/disks/rhcos/blobs/"):
+			blob, ok := r.blobs[strings.TrimPrefix(req.URL.Path, "/v2/disks/rhcos/blobs/")]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(blob)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "https://"), "http://")
+}
+
+func (r *testRegistry) addImage(t *testing.T, tag string, mediaType string, layer []byte) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	r.blobs[digest] = layer
+	manifest, err := json.Marshal(registryManifest{
+		MediaType: mediaTypeOCIManifest,
+		Layers:    []registryDescriptor{{MediaType: mediaType, Digest: digest, Size: int64(len(layer))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.manifests[tag] = manifest
+	r.manifests[fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))] = manifest
+}
+
+func (r *testRegistry) image(t *testing.T, source string) *registryImage {
+	pullSecret := fmt.Sprintf(`{"auths": {"%s": {"auth": "dXNlcjpzZWNyZXQ="}}}`, r.host())
+	img, err := newRegistryImage(source, []byte(pullSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultDownloadOptions()
+	options.StagingDir = t.TempDir()
+	if strings.HasPrefix(r.server.URL, "http://") {
+		options.PlainHTTPRegistries = []string{r.host()}
+	}
+	img.downloader, err = newDownloader(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.downloader.client = r.server.Client()
+	return img
+}
+
+func containerDiskLayer(t *testing.T, disk []byte) []byte {
+	var layer bytes.Buffer
+	gw := gzip.NewWriter(&layer)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "disk/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "disk/rhcos.qcow2", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(disk))})
+	tw.Write(disk)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gw.Close()
+	return layer.Bytes()
+}
+
+func TestRegistryImage(t *testing.T) {
+	disk := bytes.Repeat([]byte("disk"), 1000)
+	registry := newTestRegistry(t)
+	registry.addImage(t, "artifact", "application/vnd.example.disk.qcow2", disk)
+	registry.addImage(t, "containerdisk", "application/vnd.oci.image.layer.v1.tar+gzip", containerDiskLayer(t, disk))
+
+	cases := []struct {
+		name        string
+		source      string
+		expectError bool
+	}{
+		{
+			name:   "OCI artifact",
+			source: "registry://" + registry.host() + "/disks/rhcos:artifact",
+		},
+		{
+			name:   "containerDisk",
+			source: "docker://" + registry.host() + "/disks/rhcos:containerdisk",
+		},
+		{
+			name:        "missing tag",
+			source:      "registry://" + registry.host() + "/disks/rhcos:missing",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			img := registry.image(t, tc.source)
+
+			size, err := img.size()
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if size != uint64(len(disk)) {
+				t.Errorf("expected size %d, got %d", len(disk), size)
+			}
+
+			var imported []byte
+			err = img.importImage(func(r io.Reader) error {
+				imported, err = io.ReadAll(r)
+				return err
+			}, newDefVolume("base"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(imported, disk) {
+				t.Errorf("imported content does not match")
+			}
+
+			version, err := img.version()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.HasPrefix(version, "sha256:") {
+				t.Errorf("expected manifest digest as version, got %q", version)
+			}
+		})
+	}
+}
+
+func TestRegistryImagePlainHTTP(t *testing.T) {
+	disk := bytes.Repeat([]byte("disk"), 1000)
+	registry := newPlainHTTPTestRegistry(t)
+	registry.addImage(t, "artifact", "application/vnd.example.disk.qcow2", disk)
+
+	img := registry.image(t, "registry://"+registry.host()+"/disks/rhcos:artifact")
+	var imported []byte
+	err := img.importImage(func(r io.Reader) error {
+		var err error
+		imported, err = io.ReadAll(r)
+		return err
+	}, newDefVolume("base"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(imported, disk) {
+		t.Errorf("imported content does not match")
+	}
+
+	// the staged blob is removed once it is imported
+	files, err := filepath.Glob(filepath.Join(img.downloader.options.StagingDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no staging files, got %q", files)
+	}
+}
+
+func TestRegistryImageCorruptBlob(t *testing.T) {
+	disk := bytes.Repeat([]byte("disk"), 1000)
+	registry := newTestRegistry(t)
+	registry.addImage(t, "artifact", "application/vnd.example.disk.qcow2", disk)
+	for digest := range registry.blobs {
+		registry.blobs[digest] = bytes.Repeat([]byte("evil"), 1000)
+	}
+
+	img := registry.image(t, "registry://"+registry.host()+"/disks/rhcos:artifact")
+	err := img.importImage(func(r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}, newDefVolume("base"))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestNewRegistryImage(t *testing.T) {
+	cases := []struct {
+		source             string
+		expectedRegistry   string
+		expectedRepository string
+		expectedReference  string
+	}{
+		{
+			source:             "docker://fedora",
+			expectedRegistry:   dockerHubRegistry,
+			expectedRepository: "library/fedora",
+			expectedReference:  "latest",
+		},
+		{
+			source:             "registry://quay.io/containerdisks/fedora:38",
+			expectedRegistry:   "quay.io",
+			expectedRepository: "containerdisks/fedora",
+			expectedReference:  "38",
+		},
+		{
+			source:             "registry://localhost:5000/rhcos@sha256:0123",
+			expectedRegistry:   "localhost:5000",
+			expectedRepository: "rhcos",
+			expectedReference:  "sha256:0123",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.source, func(t *testing.T) {
+			img, err := newRegistryImage(tc.source, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if img.registry != tc.expectedRegistry || img.repository != tc.expectedRepository || img.reference != tc.expectedReference {
+				t.Errorf("expected %s/%s:%s, got %s/%s:%s", tc.expectedRegistry, tc.expectedRepository, tc.expectedReference, img.registry, img.repository, img.reference)
+			}
+		})
+	}
+}
+
+func TestCredentialsFromPullSecret(t *testing.T) {
+	pullSecret := []byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOnB3"},
+		"quay.io": {"username": "quay", "password": "pw"}
+	}}`)
+
+	credentials, err := credentialsFromPullSecret(pullSecret, dockerHubRegistry)
+	if err != nil || credentials == nil || credentials.username != "hub" || credentials.password != "pw" {
+		t.Errorf("unexpected docker hub credentials %+v, %v", credentials, err)
+	}
+	credentials, err = credentialsFromPullSecret(pullSecret, "quay.io")
+	if err != nil || credentials == nil || credentials.username != "quay" {
+		t.Errorf("unexpected quay.io credentials %+v, %v", credentials, err)
+	}
+	credentials, err = credentialsFromPullSecret(pullSecret, "registry.example.com")
+	if err != nil || credentials != nil {
+		t.Errorf("expected no credentials, got %+v, %v", credentials, err)
+	}
+	if _, err := credentialsFromPullSecret([]byte("not json"), "quay.io"); err == nil {
+		t.Errorf("expected error for invalid pull secret")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	params := parseChallenge(`realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull"`)
+	if params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:a/b:pull" {
+		t.Errorf("unexpected challenge parameters %v", params)
+	}
+}
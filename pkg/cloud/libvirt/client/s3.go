@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// s3PartSize is the size of the parts of multipart uploads, so uploads of
+	// up to 10000 parts fit volumes of 625Gi
+	s3PartSize = 64 << 20
+
+	s3DefaultRegion = "us-east-1"
+)
+
+// s3Uploader uploads objects to an S3 compatible object store
+type s3Uploader struct {
+	uploader *s3manager.Uploader
+}
+
+// newS3Uploader returns an uploader to AWS S3 or the object store at the
+// endpoint. Objects are addressed path-style, which other object stores
+// expect. Without access keys the default credentials of the AWS SDK are
+// used.
+func newS3Uploader(endpoint, region, accessKeyID, secretAccessKey string) (s3Uploader, error) {
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	config := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(true)
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if accessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""))
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return s3Uploader{}, fmt.Errorf("invalid S3 configuration: %v", err)
+	}
+	// parts are buffered in memory, so they are uploaded one at a time
+	return s3Uploader{uploader: s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s3PartSize
+		u.Concurrency = 1
+	})}, nil
+}
+
+// upload stores the content of the reader as an object. Failed multipart
+// uploads are aborted, so the object only appears once it is complete.
+func (u s3Uploader) upload(ctx context.Context, bucket, key string, r io.Reader) error {
+	_, err := u.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	if err != nil {
+		return fmt.Errorf("can't upload s3://%s/%s: %v", bucket, key, err)
+	}
+	return nil
+}
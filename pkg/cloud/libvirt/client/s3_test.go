@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// testObjectStore is a minimal S3 compatible object store serving uploads of
+// a single bucket
+type testObjectStore struct {
+	server  *httptest.Server
+	lock    sync.Mutex
+	parts   map[string][]byte
+	objects map[string][]byte
+	aborted bool
+}
+
+func newTestObjectStore(t *testing.T) *testObjectStore {
+	s := &testObjectStore{
+		parts:   map[string][]byte{},
+		objects: map[string][]byte{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !strings.HasPrefix(req.URL.Path, "/backups/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		key := strings.TrimPrefix(req.URL.Path, "/backups/")
+		query := req.URL.Query()
+		switch {
+		case req.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>backups</Bucket><Key>`+key+`</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case req.Method == http.MethodPut && query.Get("uploadId") == "upload-1":
+			part, _ := io.ReadAll(req.Body)
+			s.parts[query.Get("partNumber")] = part
+			w.Header().Set("ETag", fmt.Sprintf(`"etag-%s"`, query.Get("partNumber")))
+		case req.Method == http.MethodPost && query.Get("uploadId") == "upload-1":
+			var complete s3CompleteMultipartUpload
+			body, _ := io.ReadAll(req.Body)
+			if err := xml.Unmarshal(body, &complete); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var object []byte
+			for _, part := range complete.Parts {
+				if part.ETag != fmt.Sprintf(`"etag-%d"`, part.PartNumber) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				object = append(object, s.parts[fmt.Sprint(part.PartNumber)]...)
+			}
+			s.objects[key] = object
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>backups</Bucket><Key>`+key+`</Key></CompleteMultipartUploadResult>`)
+		case req.Method == http.MethodDelete && query.Get("uploadId") == "upload-1":
+			s.aborted = true
+			w.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodPut:
+			object, _ := io.ReadAll(req.Body)
+			s.objects[key] = object
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// failingReader fails after returning its content
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, fmt.Errorf("stream failed")
+	}
+	return n, err
+}
+
+func TestS3Uploader(t *testing.T) {
+	store := newTestObjectStore(t)
+	uploader, err := newS3Uploader(store.server.URL, "", "minio", "minio123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader.uploader.PartSize = s3manager.MinUploadPartSize
+
+	small := []byte("volume")
+	if err := uploader.upload(context.TODO(), "backups", "worker/crash/worker_data", bytes.NewReader(small)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(store.objects["worker/crash/worker_data"], small) {
+		t.Errorf("uploaded object does not match")
+	}
+
+	large := bytes.Repeat([]byte("volume"), int(s3manager.MinUploadPartSize/4))
+	if err := uploader.upload(context.TODO(), "backups", "worker/crash/worker", bytes.NewReader(large)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.parts) != 2 {
+		t.Errorf("expected 2 parts, got %d", len(store.parts))
+	}
+	if !bytes.Equal(store.objects["worker/crash/worker"], large) {
+		t.Errorf("uploaded object does not match")
+	}
+
+	err = uploader.upload(context.TODO(), "backups", "worker/failed/worker", &failingReader{r: bytes.NewReader(large)})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !store.aborted {
+		t.Errorf("expected upload to be aborted")
+	}
+	if _, ok := store.objects["worker/failed/worker"]; ok {
+		t.Errorf("expected no object of a failed upload")
+	}
+
+	unauthorized, err := newS3Uploader(store.server.URL, "", "other", "other123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unauthorized.upload(context.TODO(), "backups", "worker/crash/worker", bytes.NewReader(small)); err == nil {
+		t.Errorf("expected error for unauthorized upload")
+	}
+}
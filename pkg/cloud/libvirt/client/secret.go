@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"path"
+
+	"github.com/golang/glog"
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// volumePassphraseKey is the key of the passphrase in volume encryption secrets
+	volumePassphraseKey = "passphrase"
+
+	encryptionFormatLUKS = "luks"
+	secretTypePassphrase = "passphrase"
+)
+
+// getSecretData returns the value of a key of a kubernetes secret
+func getSecretData(ctx context.Context, kubeClient kubernetes.Interface, namespace, name, key string) ([]byte, error) {
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can not retrieve secret '%v/%v': %v", namespace, name, err)
+	}
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("can not retrieve secret '%v/%v': key '%v' not found in the secret", namespace, name, key)
+	}
+	return data, nil
+}
+
+// newDefVolumeSecret returns the definition of the libvirt secret holding the
+// passphrase of the volume at the path
+func newDefVolumeSecret(volumePath string) libvirtxml.Secret {
+	return libvirtxml.Secret{
+		Ephemeral:   "no",
+		Private:     "yes",
+		Description: fmt.Sprintf("passphrase of volume %s", path.Base(volumePath)),
+		Usage: &libvirtxml.SecretUsage{
+			Type:   "volume",
+			Volume: volumePath,
+		},
+	}
+}
+
+// newDefVolumeEncryption returns the LUKS encryption of a volume with the
+// passphrase in the libvirt secret
+func newDefVolumeEncryption(secretUUID string) *libvirtxml.StorageEncryption {
+	return &libvirtxml.StorageEncryption{
+		Format: encryptionFormatLUKS,
+		Secret: &libvirtxml.StorageEncryptionSecret{
+			Type: secretTypePassphrase,
+			UUID: secretUUID,
+		},
+	}
+}
+
+// newDefDiskEncryption returns the encryption of a domain disk matching the
+// encryption of its volume
+func newDefDiskEncryption(volumeEncryption *libvirtxml.StorageEncryption) *libvirtxml.DomainDiskEncryption {
+	if volumeEncryption == nil || volumeEncryption.Secret == nil {
+		return nil
+	}
+	return &libvirtxml.DomainDiskEncryption{
+		Format: volumeEncryption.Format,
+		Secret: &libvirtxml.DomainDiskSecret{
+			Type: volumeEncryption.Secret.Type,
+			UUID: volumeEncryption.Secret.UUID,
+		},
+	}
+}
+
+// volumePath returns the path a volume of the pool is created at
+func (client *libvirtClient) volumePath(poolName string, volumeName string) (string, error) {
+	pool, err := client.lookupPool(poolName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.Free()
+
+	poolDef, err := newDefPoolFromLibvirt(pool)
+	if err != nil {
+		return "", err
+	}
+	if poolDef.Target == nil || poolDef.Target.Path == "" {
+		return "", fmt.Errorf("storage pool %s has no target path", poolDef.Name)
+	}
+	return path.Join(poolDef.Target.Path, volumeName), nil
+}
+
+// ensureVolumeSecret defines the libvirt secret of a volume if missing, sets
+// its value to the passphrase and returns its UUID
+func (client *libvirtClient) ensureVolumeSecret(volumePath string, passphrase []byte) (string, error) {
+	return client.ensureSecret(newDefVolumeSecret(volumePath), libvirt.SECRET_USAGE_TYPE_VOLUME, volumePath, passphrase)
+}
+
+// ensureSecret defines the libvirt secret with the usage if missing, sets its
+// value and returns its UUID
+func (client *libvirtClient) ensureSecret(secretDef libvirtxml.Secret, usageType libvirt.SecretUsageType, usageID string, value []byte) (string, error) {
+	secret, err := client.connection.LookupSecretByUsage(usageType, usageID)
+	if err != nil {
+		secretDefXML, err := xml.Marshal(secretDef)
+		if err != nil {
+			return "", fmt.Errorf("Error serializing libvirt secret: %v", err)
+		}
+		glog.Infof("Defining libvirt secret for %s", usageID)
+		secret, err = client.connection.SecretDefineXML(string(secretDefXML), 0)
+		if err != nil {
+			return "", fmt.Errorf("Error defining libvirt secret: %v", err)
+		}
+	}
+	defer secret.Free()
+
+	if err := secret.SetValue(value, 0); err != nil {
+		return "", fmt.Errorf("Error setting value of libvirt secret: %v", err)
+	}
+	uuid, err := secret.GetUUIDString()
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving libvirt secret UUID: %v", err)
+	}
+	return uuid, nil
+}
+
+// deleteSecret undefines a libvirt secret if it exists
+func (client *libvirtClient) deleteSecret(uuid string) error {
+	secret, err := client.connection.LookupSecretByUUIDString(uuid)
+	if err != nil {
+		glog.Infof("Libvirt secret %s does not exist", uuid)
+		return nil
+	}
+	defer secret.Free()
+
+	glog.Infof("Deleting libvirt secret %s", uuid)
+	if err := secret.Undefine(); err != nil {
+		return fmt.Errorf("Can't delete libvirt secret %s: %v", uuid, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetSecretData(t *testing.T) {
+	kubeClient := kubernetesfake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "volume-key", Namespace: "test"},
+		Data:       map[string][]byte{volumePassphraseKey: []byte("secret")},
+	})
+
+	cases := []struct {
+		name        string
+		secretName  string
+		key         string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:       "key found",
+			secretName: "volume-key",
+			key:        volumePassphraseKey,
+			expected:   "secret",
+		},
+		{
+			name:        "key missing",
+			secretName:  "volume-key",
+			key:         "other",
+			expectError: true,
+		},
+		{
+			name:        "secret missing",
+			secretName:  "missing",
+			key:         volumePassphraseKey,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := getSecretData(context.TODO(), kubeClient, "test", tc.secretName, tc.key)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(data) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, data)
+			}
+		})
+	}
+}
+
+func TestNewDefVolumeSecret(t *testing.T) {
+	secretDef := newDefVolumeSecret("/var/lib/libvirt/images/worker")
+	if secretDef.Private != "yes" || secretDef.Ephemeral != "no" {
+		t.Errorf("expected private persistent secret, got %+v", secretDef)
+	}
+	if secretDef.Usage == nil || secretDef.Usage.Type != "volume" || secretDef.Usage.Volume != "/var/lib/libvirt/images/worker" {
+		t.Errorf("expected volume usage, got %+v", secretDef.Usage)
+	}
+}
+
+func TestNewDefDiskEncryption(t *testing.T) {
+	if encryption := newDefDiskEncryption(nil); encryption != nil {
+		t.Errorf("expected no encryption for unencrypted volume, got %+v", encryption)
+	}
+
+	encryption := newDefDiskEncryption(newDefVolumeEncryption("a7e4ae08-d5e1-4b1e-9b4a-7ad2b3d1c4e5"))
+	if encryption == nil || encryption.Format != "luks" || encryption.Secret == nil {
+		t.Fatalf("expected luks encryption, got %+v", encryption)
+	}
+	if encryption.Secret.Type != "passphrase" || encryption.Secret.UUID != "a7e4ae08-d5e1-4b1e-9b4a-7ad2b3d1c4e5" {
+		t.Errorf("expected passphrase secret, got %+v", encryption.Secret)
+	}
+}
@@ -0,0 +1,386 @@
+package client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	snapshotInternal = "internal"
+	snapshotExternal = "external"
+	snapshotNo       = "no"
+
+	// snapshotOverlaySuffix ends the names of the overlays the disks of a
+	// domain are switched to by external snapshots and their reverts
+	snapshotOverlaySuffix = ".overlay"
+)
+
+// snapshotOverlayPath returns the path of the overlay of a disk of a domain,
+// next to the file the overlay is put on top of
+func snapshotOverlayPath(domainName string, dev string, name string, path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("%s.%s.%s%s", domainName, dev, name, snapshotOverlaySuffix))
+}
+
+// isSnapshotOverlay returns whether the file is an overlay of an external
+// snapshot of the domain or of a revert to one
+func isSnapshotOverlay(domainName string, path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, domainName+".") && strings.HasSuffix(name, snapshotOverlaySuffix)
+}
+
+// newDefSnapshot returns the definition of a snapshot of a domain.
+// Internal snapshots are kept inside the qcow2 disks and include the memory of
+// running domains, so all writable disks have to be qcow2 disks for the
+// snapshot to be consistent. External snapshots only save the disks: the
+// files of the writable disks are frozen and the domain continues on new
+// qcow2 overlays next to them, so the disks have to be files but may have any
+// format. Read-only disks like the configuration volumes are left out.
+func newDefSnapshot(name string, domainDef libvirtxml.Domain, external bool) (libvirtxml.DomainSnapshot, error) {
+	snapshotDef := libvirtxml.DomainSnapshot{
+		Name:  name,
+		Disks: &libvirtxml.DomainSnapshotDisks{},
+	}
+	if domainDef.Devices == nil {
+		return snapshotDef, nil
+	}
+	for _, disk := range domainDef.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+		snapshotDisk := libvirtxml.DomainSnapshotDisk{
+			Name:     disk.Target.Dev,
+			Snapshot: snapshotNo,
+		}
+		switch {
+		case disk.Device != "disk" || disk.ReadOnly != nil:
+		case external:
+			if disk.Source == nil || disk.Source.File == nil {
+				return libvirtxml.DomainSnapshot{}, fmt.Errorf("disk %s is not a file and can't be part of an external snapshot", disk.Target.Dev)
+			}
+			snapshotDisk.Snapshot = snapshotExternal
+			snapshotDisk.Driver = &libvirtxml.DomainSnapshotDiskDriver{Type: "qcow2"}
+			snapshotDisk.Source = &libvirtxml.DomainDiskSource{
+				File: &libvirtxml.DomainDiskSourceFile{
+					File: snapshotOverlayPath(domainDef.Name, disk.Target.Dev, name, disk.Source.File.File),
+				},
+			}
+		default:
+			if disk.Driver == nil || disk.Driver.Type != "qcow2" {
+				return libvirtxml.DomainSnapshot{}, fmt.Errorf("disk %s is not a qcow2 disk and can't be part of an internal snapshot", disk.Target.Dev)
+			}
+			snapshotDisk.Snapshot = snapshotInternal
+		}
+		snapshotDef.Disks.Disks = append(snapshotDef.Disks.Disks, snapshotDisk)
+	}
+	return snapshotDef, nil
+}
+
+// newDefSnapshotFromLibvirt returns the definition of a snapshot
+func newDefSnapshotFromLibvirt(snapshot *libvirt.DomainSnapshot) (libvirtxml.DomainSnapshot, error) {
+	snapshotXMLDesc, err := snapshot.GetXMLDesc(0)
+	if err != nil {
+		return libvirtxml.DomainSnapshot{}, fmt.Errorf("could not get XML description for snapshot: %v", err)
+	}
+	var snapshotDef libvirtxml.DomainSnapshot
+	if err := xml.Unmarshal([]byte(snapshotXMLDesc), &snapshotDef); err != nil {
+		return libvirtxml.DomainSnapshot{}, fmt.Errorf("could not parse XML description for snapshot: %v", err)
+	}
+	return snapshotDef, nil
+}
+
+// externalSnapshotStates returns the files holding the state of the disks
+// saved by an external snapshot by their target device. These are the files
+// the disks used when the snapshot was taken, as recorded in the domain
+// definition saved with the snapshot.
+func externalSnapshotStates(snapshotDef libvirtxml.DomainSnapshot) (map[string]string, error) {
+	states := map[string]string{}
+	if snapshotDef.Disks == nil {
+		return states, nil
+	}
+	for _, snapshotDisk := range snapshotDef.Disks.Disks {
+		if snapshotDisk.Snapshot != snapshotExternal {
+			continue
+		}
+		if snapshotDef.Domain != nil && snapshotDef.Domain.Devices != nil {
+			for _, disk := range snapshotDef.Domain.Devices.Disks {
+				if disk.Target != nil && disk.Target.Dev == snapshotDisk.Name && disk.Source != nil && disk.Source.File != nil {
+					states[snapshotDisk.Name] = disk.Source.File.File
+				}
+			}
+		}
+		if states[snapshotDisk.Name] == "" {
+			return nil, fmt.Errorf("snapshot %s has no file for disk %s", snapshotDef.Name, snapshotDisk.Name)
+		}
+	}
+	return states, nil
+}
+
+// snapshotOverlays returns the overlays of the external snapshots of a
+// domain, taken from the disks of the domain and of its snapshots. Files which
+// aren't named like overlays of the domain, like the volumes the first
+// snapshot was put on top of, are left out.
+func snapshotOverlays(domainName string, domainDef libvirtxml.Domain, snapshotDefs []libvirtxml.DomainSnapshot) []string {
+	var overlays []string
+	add := func(source *libvirtxml.DomainDiskSource) {
+		if source == nil || source.File == nil || !isSnapshotOverlay(domainName, source.File.File) {
+			return
+		}
+		for _, overlay := range overlays {
+			if overlay == source.File.File {
+				return
+			}
+		}
+		overlays = append(overlays, source.File.File)
+	}
+	addDisks := func(domainDef *libvirtxml.Domain) {
+		if domainDef == nil || domainDef.Devices == nil {
+			return
+		}
+		for _, disk := range domainDef.Devices.Disks {
+			add(disk.Source)
+		}
+	}
+
+	addDisks(&domainDef)
+	for _, snapshotDef := range snapshotDefs {
+		if snapshotDef.Disks != nil {
+			for _, disk := range snapshotDef.Disks.Disks {
+				add(disk.Source)
+			}
+		}
+		addDisks(snapshotDef.Domain)
+	}
+	return overlays
+}
+
+// CreateSnapshot creates an internal or external snapshot of a domain
+func (client *libvirtClient) CreateSnapshot(domainName string, snapshotName string, external bool) error {
+	domain, err := client.connection.LookupDomainByName(domainName)
+	if err != nil {
+		return fmt.Errorf("Error retrieving libvirt domain %s: %v", domainName, err)
+	}
+	defer domain.Free()
+
+	domainDef, err := newDefDomainFromLibvirt(domain)
+	if err != nil {
+		return err
+	}
+	snapshot, err := newDefSnapshot(snapshotName, domainDef, external)
+	if err != nil {
+		return fmt.Errorf("Can't create snapshot %s of domain %s: %v", snapshotName, domainName, err)
+	}
+	snapshotDef, err := xml.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("Error serializing libvirt snapshot: %v", err)
+	}
+
+	var flags libvirt.DomainSnapshotCreateFlags
+	if external {
+		flags = libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY | libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC
+	}
+
+	glog.Infof("Creating snapshot %s of domain %s", snapshotName, domainName)
+	created, err := domain.CreateSnapshotXML(string(snapshotDef), flags)
+	if err != nil {
+		return fmt.Errorf("Error creating snapshot %s of domain %s: %v", snapshotName, domainName, err)
+	}
+	return created.Free()
+}
+
+// RevertSnapshot reverts a domain to an internal or external snapshot and
+// leaves it running
+func (client *libvirtClient) RevertSnapshot(domainName string, snapshotName string) error {
+	domain, err := client.connection.LookupDomainByName(domainName)
+	if err != nil {
+		return fmt.Errorf("Error retrieving libvirt domain %s: %v", domainName, err)
+	}
+	defer domain.Free()
+
+	snapshot, err := domain.SnapshotLookupByName(snapshotName, 0)
+	if err != nil {
+		return fmt.Errorf("Error retrieving snapshot %s of domain %s: %v", snapshotName, domainName, err)
+	}
+	defer snapshot.Free()
+
+	snapshotDef, err := newDefSnapshotFromLibvirt(snapshot)
+	if err != nil {
+		return err
+	}
+	states, err := externalSnapshotStates(snapshotDef)
+	if err != nil {
+		return err
+	}
+	if len(states) > 0 {
+		glog.Infof("Reverting domain %s to external snapshot %s", domainName, snapshotName)
+		return client.revertExternalSnapshot(domain, domainName, states)
+	}
+
+	glog.Infof("Reverting domain %s to snapshot %s", domainName, snapshotName)
+	if err := snapshot.RevertToSnapshot(libvirt.DOMAIN_SNAPSHOT_REVERT_RUNNING); err != nil {
+		return fmt.Errorf("Error reverting domain %s to snapshot %s: %v", domainName, snapshotName, err)
+	}
+	return nil
+}
+
+// ListSnapshots returns the names of the snapshots of a domain
+func (client *libvirtClient) ListSnapshots(domainName string) ([]string, error) {
+	domain, err := client.connection.LookupDomainByName(domainName)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving libvirt domain %s: %v", domainName, err)
+	}
+	defer domain.Free()
+
+	names, err := domain.SnapshotListNames(libvirt.DOMAIN_SNAPSHOT_LIST_TOPOLOGICAL)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing snapshots of domain %s: %v", domainName, err)
+	}
+	return names, nil
+}
+
+// revertExternalSnapshot reverts a domain to an external snapshot by
+// switching its disks to new overlays on top of the files holding the state
+// of the snapshot and starting it again. The overlays the domain used so far
+// are deleted, the files holding the state of snapshots are never written to
+// again and are kept.
+func (client *libvirtClient) revertExternalSnapshot(domain *libvirt.Domain, domainName string, states map[string]string) error {
+	active, err := domain.IsActive()
+	if err != nil {
+		return fmt.Errorf("Error retrieving state of domain %s: %v", domainName, err)
+	}
+	if active {
+		if err := domain.Destroy(); err != nil {
+			return fmt.Errorf("Couldn't destroy libvirt domain %s: %v", domainName, err)
+		}
+	}
+
+	domainDef, err := newDefDomainFromLibvirt(domain)
+	if err != nil {
+		return err
+	}
+	if domainDef.Devices == nil {
+		return fmt.Errorf("domain %s has no disks", domainName)
+	}
+	revert := fmt.Sprintf("revert-%d", time.Now().Unix())
+	var replaced []string
+	for i := range domainDef.Devices.Disks {
+		disk := &domainDef.Devices.Disks[i]
+		if disk.Target == nil || states[disk.Target.Dev] == "" {
+			continue
+		}
+		if disk.Source == nil || disk.Source.File == nil {
+			return fmt.Errorf("disk %s of domain %s is not a file", disk.Target.Dev, domainName)
+		}
+		state := states[disk.Target.Dev]
+		overlay, err := client.createOverlay(state, filepath.Base(snapshotOverlayPath(domainName, disk.Target.Dev, revert, state)))
+		if err != nil {
+			return fmt.Errorf("Error creating overlay of disk %s of domain %s: %v", disk.Target.Dev, domainName, err)
+		}
+		replaced = append(replaced, disk.Source.File.File)
+		disk.Source.File.File = overlay
+		disk.BackingStore = nil
+		if disk.Driver == nil {
+			disk.Driver = &libvirtxml.DomainDiskDriver{Name: "qemu"}
+		}
+		disk.Driver.Type = "qcow2"
+	}
+
+	domainXML, err := xmlMarshallIndented(domainDef)
+	if err != nil {
+		return fmt.Errorf("Error serializing libvirt domain: %v", err)
+	}
+	defined, err := client.connection.DomainDefineXML(domainXML)
+	if err != nil {
+		return fmt.Errorf("Error defining libvirt domain %s: %v", domainName, err)
+	}
+	defined.Free()
+
+	// the domain already uses the new overlays, so the old ones are only
+	// left behind if they can't be deleted
+	for _, path := range replaced {
+		if !isSnapshotOverlay(domainName, path) {
+			continue
+		}
+		if err := client.deleteVolumeByPath(path); err != nil {
+			glog.Errorf("Couldn't delete overlay %s of domain %s: %v", path, domainName, err)
+		}
+	}
+
+	if err := domain.Create(); err != nil {
+		return fmt.Errorf("Error starting libvirt domain %s: %v", domainName, err)
+	}
+	return nil
+}
+
+// createOverlay creates a qcow2 volume with the file as backing store in the
+// pool of the file and returns its path
+func (client *libvirtClient) createOverlay(backingPath string, name string) (string, error) {
+	backingVolume, err := client.lookupVolumeByPath(backingPath)
+	if err != nil {
+		return "", err
+	}
+	defer backingVolume.Free()
+
+	pool, err := backingVolume.LookupPoolByVolume()
+	if err != nil {
+		return "", fmt.Errorf("Can't retrieve pool of volume %s: %v", backingPath, err)
+	}
+	defer pool.Free()
+
+	info, err := backingVolume.GetInfo()
+	if err != nil {
+		return "", fmt.Errorf("Can't retrieve volume info %s: %v", backingPath, err)
+	}
+	backingStoreDef, err := newDefBackingStoreFromLibvirt(backingVolume)
+	if err != nil {
+		return "", err
+	}
+	volumeDef := newDefVolume(name)
+	volumeDef.Capacity.Value = info.Capacity
+	volumeDef.BackingStore = &backingStoreDef
+
+	volumeDefXML, err := xml.Marshal(volumeDef)
+	if err != nil {
+		return "", fmt.Errorf("Error serializing libvirt volume: %v", err)
+	}
+	volume, err := pool.StorageVolCreateXML(string(volumeDefXML), 0)
+	if err != nil {
+		return "", fmt.Errorf("Error creating libvirt volume %s: %v", name, err)
+	}
+	defer volume.Free()
+
+	path, err := volume.GetPath()
+	if err != nil {
+		return "", fmt.Errorf("Can't retrieve path of volume %s: %v", name, err)
+	}
+	return path, nil
+}
+
+// listSnapshotDefs returns the definitions of the snapshots of a domain
+func listSnapshotDefs(domain *libvirt.Domain) ([]libvirtxml.DomainSnapshot, error) {
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing snapshots: %v", err)
+	}
+	defer func() {
+		for i := range snapshots {
+			snapshots[i].Free()
+		}
+	}()
+
+	var snapshotDefs []libvirtxml.DomainSnapshot
+	for i := range snapshots {
+		snapshotDef, err := newDefSnapshotFromLibvirt(&snapshots[i])
+		if err != nil {
+			return nil, err
+		}
+		snapshotDefs = append(snapshotDefs, snapshotDef)
+	}
+	return snapshotDefs, nil
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestNewDefSnapshot(t *testing.T) {
+	root := libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{Type: "qcow2"},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker"}},
+		Target: &libvirtxml.DomainDiskTarget{Dev: "vda"},
+	}
+	data := libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{Type: "qcow2"},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker_data"}},
+		Target: &libvirtxml.DomainDiskTarget{Dev: "vdb"},
+	}
+	raw := libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{Type: "raw"},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker_scratch"}},
+		Target: &libvirtxml.DomainDiskTarget{Dev: "vdc"},
+	}
+	network := libvirtxml.DomainDisk{
+		Device: "disk",
+		Driver: &libvirtxml.DomainDiskDriver{Type: "raw"},
+		Source: &libvirtxml.DomainDiskSource{Network: &libvirtxml.DomainDiskSourceNetwork{Protocol: "nbd"}},
+		Target: &libvirtxml.DomainDiskTarget{Dev: "vdc"},
+	}
+	cloudInit := libvirtxml.DomainDisk{
+		Device:   "cdrom",
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+		Source:   &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/var/lib/libvirt/images/worker-cloudinit"}},
+		Target:   &libvirtxml.DomainDiskTarget{Dev: "hdd"},
+	}
+
+	cases := []struct {
+		name             string
+		disks            []libvirtxml.DomainDisk
+		external         bool
+		expected         map[string]string
+		expectedOverlays map[string]string
+		expectError      bool
+	}{
+		{
+			name:     "qcow2 disks",
+			disks:    []libvirtxml.DomainDisk{root, data, cloudInit},
+			expected: map[string]string{"vda": "internal", "vdb": "internal", "hdd": "no"},
+		},
+		{
+			name:     "external snapshot",
+			disks:    []libvirtxml.DomainDisk{root, raw, cloudInit},
+			external: true,
+			expected: map[string]string{"vda": "external", "vdc": "external", "hdd": "no"},
+			expectedOverlays: map[string]string{
+				"vda": "/var/lib/libvirt/images/worker.vda.installed.overlay",
+				"vdc": "/var/lib/libvirt/images/worker.vdc.installed.overlay",
+			},
+		},
+		{
+			name:        "external snapshot of network disk",
+			disks:       []libvirtxml.DomainDisk{root, network},
+			external:    true,
+			expectError: true,
+		},
+		{
+			name:        "raw disk",
+			disks:       []libvirtxml.DomainDisk{root, raw, cloudInit},
+			expectError: true,
+		},
+		{
+			name:        "network disk",
+			disks:       []libvirtxml.DomainDisk{root, network},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			domainDef := libvirtxml.Domain{Name: "worker", Devices: &libvirtxml.DomainDeviceList{Disks: tc.disks}}
+			snapshotDef, err := newDefSnapshot("installed", domainDef, tc.external)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %+v", snapshotDef)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if snapshotDef.Name != "installed" {
+				t.Errorf("expected name installed, got %s", snapshotDef.Name)
+			}
+			if snapshotDef.Memory != nil {
+				t.Errorf("expected memory to be saved, got %+v", snapshotDef.Memory)
+			}
+			if len(snapshotDef.Disks.Disks) != len(tc.expected) {
+				t.Fatalf("expected %d disks, got %d", len(tc.expected), len(snapshotDef.Disks.Disks))
+			}
+			for _, disk := range snapshotDef.Disks.Disks {
+				if disk.Snapshot != tc.expected[disk.Name] {
+					t.Errorf("expected snapshot %q of disk %s, got %q", tc.expected[disk.Name], disk.Name, disk.Snapshot)
+				}
+				var overlay string
+				if disk.Source != nil && disk.Source.File != nil {
+					overlay = disk.Source.File.File
+				}
+				if overlay != tc.expectedOverlays[disk.Name] {
+					t.Errorf("expected overlay %q of disk %s, got %q", tc.expectedOverlays[disk.Name], disk.Name, overlay)
+				}
+			}
+		})
+	}
+}
+
+func fileDisk(dev string, path string) libvirtxml.DomainDisk {
+	return libvirtxml.DomainDisk{
+		Device: "disk",
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: path}},
+		Target: &libvirtxml.DomainDiskTarget{Dev: dev},
+	}
+}
+
+func TestExternalSnapshotStates(t *testing.T) {
+	cases := []struct {
+		name        string
+		snapshotDef libvirtxml.DomainSnapshot
+		expected    map[string]string
+		expectError bool
+	}{
+		{
+			name: "internal snapshot",
+			snapshotDef: libvirtxml.DomainSnapshot{
+				Name:  "installed",
+				Disks: &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{{Name: "vda", Snapshot: "internal"}}},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "external snapshot",
+			snapshotDef: libvirtxml.DomainSnapshot{
+				Name: "configured",
+				Disks: &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{
+					{Name: "vda", Snapshot: "external", Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/pool/worker.vda.configured.overlay"}}},
+					{Name: "hdd", Snapshot: "no"},
+				}},
+				Domain: &libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+					fileDisk("vda", "/pool/worker.vda.installed.overlay"),
+					fileDisk("hdd", "/pool/worker-cloudinit"),
+				}}},
+			},
+			expected: map[string]string{"vda": "/pool/worker.vda.installed.overlay"},
+		},
+		{
+			name: "disk missing in domain",
+			snapshotDef: libvirtxml.DomainSnapshot{
+				Name:   "installed",
+				Disks:  &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{{Name: "vda", Snapshot: "external"}}},
+				Domain: &libvirtxml.Domain{},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			states, err := externalSnapshotStates(tc.snapshotDef)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %v", states)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(states, tc.expected) {
+				t.Errorf("expected states %v, got %v", tc.expected, states)
+			}
+		})
+	}
+}
+
+func TestSnapshotOverlays(t *testing.T) {
+	domainDef := libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+		fileDisk("vda", "/pool/worker.vda.revert-1700000000.overlay"),
+		fileDisk("hdd", "/pool/worker-cloudinit"),
+	}}}
+	snapshotDefs := []libvirtxml.DomainSnapshot{
+		{
+			Name: "installed",
+			Disks: &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{
+				{Name: "vda", Snapshot: "external", Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/pool/worker.vda.installed.overlay"}}},
+			}},
+			Domain: &libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+				fileDisk("vda", "/pool/worker"),
+			}}},
+		},
+		{
+			Name: "configured",
+			Disks: &libvirtxml.DomainSnapshotDisks{Disks: []libvirtxml.DomainSnapshotDisk{
+				{Name: "vda", Snapshot: "external", Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: "/pool/worker.vda.configured.overlay"}}},
+			}},
+			Domain: &libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{Disks: []libvirtxml.DomainDisk{
+				fileDisk("vda", "/pool/worker.vda.installed.overlay"),
+			}}},
+		},
+	}
+
+	overlays := snapshotOverlays("worker", domainDef, snapshotDefs)
+	expected := []string{
+		"/pool/worker.vda.revert-1700000000.overlay",
+		"/pool/worker.vda.installed.overlay",
+		"/pool/worker.vda.configured.overlay",
+	}
+	if !reflect.DeepEqual(overlays, expected) {
+		t.Errorf("expected overlays %v, got %v", expected, overlays)
+	}
+}
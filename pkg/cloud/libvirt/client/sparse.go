@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sparseBlockSize is the granularity zero runs are detected with
+	sparseBlockSize = 4096
+
+	// sparseBufferSize is how much is read at once while detecting zero runs
+	sparseBufferSize = 1 << 20
+)
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// sparseWriter is a destination which can skip holes instead of having
+// zeros written to it
+type sparseWriter interface {
+	io.Writer
+	// WriteHole skips length bytes which read as zeros
+	WriteHole(length int64) error
+}
+
+// sparseFile writes holes to a file by seeking over them
+type sparseFile struct {
+	*os.File
+}
+
+func (f sparseFile) WriteHole(length int64) error {
+	_, err := f.Seek(length, io.SeekCurrent)
+	return err
+}
+
+// copySparse copies the source to the destination, sending holes instead of
+// zeros. The holes of local files are found with SEEK_DATA and SEEK_HOLE,
+// and runs of zeros are detected in everything else. It returns the number
+// of bytes copied including holes.
+func copySparse(dst sparseWriter, src io.Reader) (int64, error) {
+	if f, ok := src.(*os.File); ok {
+		return copyExtents(dst, f)
+	}
+	return copyZeroRuns(dst, src)
+}
+
+// copyExtents copies the data extents of a file and skips its holes. Zero
+// runs are detected in the data extents as well, so dense files like
+// downloads still profit.
+func copyExtents(dst sparseWriter, f *os.File) (int64, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return copyZeroRuns(dst, f)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := fi.Size()
+
+	var written int64
+	offset := start
+	for offset < end {
+		data, err := f.Seek(offset, unix.SEEK_DATA)
+		if err == unix.ENXIO || (err == nil && data >= end) {
+			// the rest of the file is a hole
+			data = end
+		} else if err != nil {
+			// the file system does not know about holes
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return written, err
+			}
+			n, err := copyZeroRuns(dst, f)
+			return written + n, err
+		}
+
+		if data > offset {
+			if err := dst.WriteHole(data - offset); err != nil {
+				return written, err
+			}
+			written += data - offset
+		}
+		if data == end {
+			break
+		}
+
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return written, err
+		}
+		n, err := copyZeroRuns(dst, io.NewSectionReader(f, data, hole-data))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		offset = hole
+	}
+
+	// leave the file where a plain copy would have left it
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// copyZeroRuns copies the source and sends holes for blocks of zeros
+func copyZeroRuns(dst sparseWriter, src io.Reader) (int64, error) {
+	buf := make([]byte, sparseBufferSize)
+	var written, hole int64
+
+	flushHole := func() error {
+		if hole == 0 {
+			return nil
+		}
+		if err := dst.WriteHole(hole); err != nil {
+			return err
+		}
+		written += hole
+		hole = 0
+		return nil
+	}
+
+	for {
+		n, rerr := io.ReadFull(src, buf)
+		data := buf[:n]
+		for len(data) > 0 {
+			zero := isZeroBlock(nextBlock(data))
+			run := len(nextBlock(data))
+			for run < len(data) && isZeroBlock(nextBlock(data[run:])) == zero {
+				run += len(nextBlock(data[run:]))
+			}
+
+			if zero {
+				hole += int64(run)
+			} else {
+				if err := flushHole(); err != nil {
+					return written, err
+				}
+				w, err := dst.Write(data[:run])
+				written += int64(w)
+				if err != nil {
+					return written, err
+				}
+				if w != run {
+					return written, io.ErrShortWrite
+				}
+			}
+			data = data[run:]
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+
+	// a trailing hole still counts towards the size of the content
+	return written, flushHole()
+}
+
+func nextBlock(data []byte) []byte {
+	if len(data) > sparseBlockSize {
+		return data[:sparseBlockSize]
+	}
+	return data
+}
+
+func isZeroBlock(block []byte) bool {
+	return bytes.Equal(block, zeroBlock[:len(block)])
+}
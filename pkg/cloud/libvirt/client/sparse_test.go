@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordingWriter reassembles sparse content and counts what was sent
+type recordingWriter struct {
+	content   bytes.Buffer
+	dataBytes int64
+	holeBytes int64
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.dataBytes += int64(len(p))
+	return w.content.Write(p)
+}
+
+func (w *recordingWriter) WriteHole(length int64) error {
+	w.holeBytes += length
+	w.content.Write(make([]byte, length))
+	return nil
+}
+
+func TestCopyZeroRuns(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), sparseBlockSize/4)
+	cases := []struct {
+		name              string
+		content           []byte
+		expectedDataBytes int64
+	}{
+		{
+			name:              "data only",
+			content:           data,
+			expectedDataBytes: int64(len(data)),
+		},
+		{
+			name:              "zeros only",
+			content:           make([]byte, 3*sparseBufferSize),
+			expectedDataBytes: 0,
+		},
+		{
+			name:              "data between zeros",
+			content:           append(append(make([]byte, 2*sparseBlockSize), data...), make([]byte, sparseBufferSize+10)...),
+			expectedDataBytes: int64(len(data)),
+		},
+		{
+			name:              "partial block",
+			content:           append(make([]byte, sparseBlockSize), 'x'),
+			expectedDataBytes: 1,
+		},
+		{
+			name:              "empty",
+			content:           []byte{},
+			expectedDataBytes: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &recordingWriter{}
+			n, err := copyZeroRuns(w, bytes.NewReader(tc.content))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n != int64(len(tc.content)) {
+				t.Errorf("expected %d bytes copied, got %d", len(tc.content), n)
+			}
+			if !bytes.Equal(w.content.Bytes(), tc.content) {
+				t.Errorf("copied content does not match")
+			}
+			if w.dataBytes != tc.expectedDataBytes {
+				t.Errorf("expected %d data bytes, got %d", tc.expectedDataBytes, w.dataBytes)
+			}
+		})
+	}
+}
+
+func TestCopySparseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// a 16M file with 64K of data in the middle
+	size := int64(16 << 20)
+	data := bytes.Repeat([]byte("data"), 16<<10)
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data, 8<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &recordingWriter{}
+	n, err := copySparse(w, f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != size {
+		t.Errorf("expected %d bytes copied, got %d", size, n)
+	}
+	if w.dataBytes != int64(len(data)) {
+		t.Errorf("expected %d data bytes, got %d", len(data), w.dataBytes)
+	}
+
+	expected := make([]byte, size)
+	copy(expected[8<<20:], data)
+	if !bytes.Equal(w.content.Bytes(), expected) {
+		t.Errorf("copied content does not match")
+	}
+
+	if offset, _ := f.Seek(0, io.SeekCurrent); offset != size {
+		t.Errorf("expected file to be read to its end, at %d", offset)
+	}
+}
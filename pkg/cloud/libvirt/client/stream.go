@@ -14,6 +14,7 @@ type streamIO struct {
 var _ io.Writer = &streamIO{}
 var _ io.Reader = &streamIO{}
 var _ io.Closer = &streamIO{}
+var _ sparseWriter = &streamIO{}
 
 // NewStreamIO returns libvirt StreamIO
 func newStreamIO(s libvirt.Stream) *streamIO {
@@ -28,6 +29,11 @@ func (sio *streamIO) Write(p []byte) (int, error) {
 	return sio.stream.Send(p)
 }
 
+// WriteHole sends a hole of length bytes through a sparse stream
+func (sio *streamIO) WriteHole(length int64) error {
+	return sio.stream.SendHole(length, 0)
+}
+
 // Close closes the stream
 func (sio *streamIO) Close() error {
 	return sio.stream.Finish()
@@ -1,10 +1,13 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +24,43 @@ const (
 // ErrVolumeNotFound is returned when a domain is not found
 var ErrVolumeNotFound = errors.New("Domain not found")
 
+// VolumeInUseError is returned when a volume can't be deleted because other
+// volumes are backed by it
+type VolumeInUseError struct {
+	Name     string
+	Overlays []string
+}
+
+func (e *VolumeInUseError) Error() string {
+	return fmt.Sprintf("volume %s is the backing store of %s", e.Name, strings.Join(e.Overlays, ", "))
+}
+
+// VolumeShrinkError is returned when a volume would have to shrink to the
+// requested size
+type VolumeShrinkError struct {
+	Name     string
+	Capacity uint64
+	Size     uint64
+}
+
+func (e *VolumeShrinkError) Error() string {
+	return fmt.Sprintf("volume %s can't shrink from %d to %d bytes", e.Name, e.Capacity, e.Size)
+}
+
+// VolumeSnapshotsError is returned when a volume of a domain with snapshots
+// would have to be resized. qemu refuses to resize qcow2 images holding
+// internal snapshots, and external snapshots froze the volume below the
+// overlays the domain writes to.
+type VolumeSnapshotsError struct {
+	Name      string
+	Domain    string
+	Snapshots []string
+}
+
+func (e *VolumeSnapshotsError) Error() string {
+	return fmt.Sprintf("volume %s can't be resized while domain %s has snapshots %s", e.Name, e.Domain, strings.Join(e.Snapshots, ", "))
+}
+
 var waitSleepInterval = 1 * time.Second
 
 // waitTimeout time
@@ -79,6 +119,81 @@ func newDefBackingStoreFromLibvirt(baseVolume *libvirt.StorageVol) (libvirtxml.S
 	return backingStoreDef, nil
 }
 
+// newDefCloneVolume returns the definition of a copy of the base volume.
+// Unless it is flattened, the copy keeps the backing store of the base volume.
+func newDefCloneVolume(volumeDef, baseVolumeDef libvirtxml.StorageVolume, flatten bool) libvirtxml.StorageVolume {
+	volumeDef.BackingStore = nil
+	if !flatten && baseVolumeDef.BackingStore != nil && baseVolumeDef.BackingStore.Path != "" {
+		backingStoreDef := *baseVolumeDef.BackingStore
+		volumeDef.BackingStore = &backingStoreDef
+	}
+	return volumeDef
+}
+
+// setVolumeOptions applies the preallocation mode and the qcow2 options to
+// the volume definition and returns the flags the volume is created with
+func setVolumeOptions(volumeDef *libvirtxml.StorageVolume, preallocation string, lazyRefcounts bool) (libvirt.StorageVolCreateFlags, error) {
+	var flags libvirt.StorageVolCreateFlags
+	qcow2 := volumeDef.Target.Format != nil && volumeDef.Target.Format.Type == "qcow2"
+
+	switch preallocation {
+	case "", "none":
+	case "metadata":
+		if !qcow2 {
+			return 0, fmt.Errorf("metadata preallocation requires the qcow2 format")
+		}
+		flags |= libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+	case "full":
+		// an allocation of the whole capacity makes libvirt fallocate the
+		// volume, qcow2 volumes need their metadata preallocated as well
+		volumeDef.Allocation = &libvirtxml.StorageVolumeSize{
+			Unit:  volumeDef.Capacity.Unit,
+			Value: volumeDef.Capacity.Value,
+		}
+		if qcow2 {
+			flags |= libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+		}
+	default:
+		return 0, fmt.Errorf("unsupported preallocation %q", preallocation)
+	}
+
+	if lazyRefcounts {
+		if !qcow2 {
+			return 0, fmt.Errorf("lazy refcounts require the qcow2 format")
+		}
+		// lazy refcounts were introduced with qcow2 version 3
+		volumeDef.Target.Compat = "1.1"
+		volumeDef.Target.Features = append(volumeDef.Target.Features, libvirtxml.StorageVolumeTargetFeature{
+			LazyRefcounts: &struct{}{},
+		})
+	}
+	return flags, nil
+}
+
+// marshalVolumeDef returns the XML of the volume definition with the cluster
+// size, which libvirt-go-xml does not know about yet, added to its target
+func marshalVolumeDef(volumeDef libvirtxml.StorageVolume, clusterSize uint64) (string, error) {
+	volumeDefXML, err := xml.Marshal(volumeDef)
+	if err != nil {
+		return "", err
+	}
+	if clusterSize == 0 {
+		return string(volumeDefXML), nil
+	}
+
+	s := string(volumeDefXML)
+	i := strings.Index(s, "</target>")
+	if i < 0 {
+		return "", fmt.Errorf("volume %s has no target", volumeDef.Name)
+	}
+	return fmt.Sprintf("%s<clusterSize unit=\"B\">%d</clusterSize>%s", s[:i], clusterSize, s[i:]), nil
+}
+
+// isBackedBy returns whether the path is the backing store of the volume
+func isBackedBy(volumeDef libvirtxml.StorageVolume, path string) bool {
+	return volumeDef.BackingStore != nil && volumeDef.BackingStore.Path == path
+}
+
 func newDefVolumeFromLibvirt(volume *libvirt.StorageVol) (libvirtxml.StorageVolume, error) {
 	name, err := volume.GetName()
 	if err != nil {
@@ -118,9 +233,9 @@ func timeFromEpoch(str string) time.Time {
 }
 
 func uploadVolume(poolName string, client *libvirtClient, volumeDef libvirtxml.StorageVolume, img image) (string, error) {
-	pool, err := client.connection.LookupStoragePoolByName(poolName)
+	pool, err := client.lookupPool(poolName)
 	if err != nil {
-		return "", fmt.Errorf("can't find storage pool %q", poolName)
+		return "", err
 	}
 	defer pool.Free()
 
@@ -161,8 +276,58 @@ func uploadVolume(poolName string, client *libvirtClient, volumeDef libvirtxml.S
 	return volumeKey, nil
 }
 
+// newDecompressingCopier returns a copier which decompresses compressed images
+// on the fly. qcow2 images carry their virtual size, which the volume was
+// created with. The size of raw images is only known once they are
+// decompressed, so they are staged and the volume is grown to their size
+// before the upload.
+func newDecompressingCopier(virConn *libvirt.Connect, volume *libvirt.StorageVol, size uint64) func(src io.Reader) error {
+	return func(src io.Reader) error {
+		r, compression, err := decompress(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		if compression == "" {
+			// local files are passed on as they are, so their holes can be found
+			if f, ok := src.(*os.File); ok {
+				return newCopier(virConn, volume, size)(f)
+			}
+			return newCopier(virConn, volume, size)(r)
+		}
+		glog.Infof("Decompressing %s image", compression)
+		br := bufio.NewReader(r)
+		if header, _ := br.Peek(len(qcow2Magic)); bytes.HasPrefix(header, qcow2Magic) {
+			return newCopier(virConn, volume, 0)(br)
+		}
+
+		f, decompressedSize, err := stageDecompressed(br, getDefaultDownloader().options.StagingDir)
+		if err != nil {
+			return fmt.Errorf("error staging decompressed %s image: %v", compression, err)
+		}
+		defer removeStagingFile(f.Name())
+		defer f.Close()
+
+		info, err := volume.GetInfo()
+		if err != nil {
+			return fmt.Errorf("error getting volume info: %v", err)
+		}
+		if decompressedSize > info.Capacity {
+			glog.Infof("Growing volume from %d to %d bytes for the decompressed image", info.Capacity, decompressedSize)
+			if err := volume.Resize(decompressedSize, 0); err != nil {
+				return fmt.Errorf("error resizing volume to %d bytes: %v", decompressedSize, err)
+			}
+		}
+		return newCopier(virConn, volume, decompressedSize)(f)
+	}
+}
+
+// newCopier returns a copier which uploads size bytes into the volume. A size
+// of 0 uploads everything until the end of the source. Holes and runs of
+// zeros are sent as holes of a sparse stream instead of being transferred.
 func newCopier(virConn *libvirt.Connect, volume *libvirt.StorageVol, size uint64) func(src io.Reader) error {
-	copier := func(src io.Reader) error {
+	copier := func(src io.Reader) (err error) {
 		var bytesCopied int64
 
 		stream, err := virConn.NewStream(0)
@@ -170,20 +335,27 @@ func newCopier(virConn *libvirt.Connect, volume *libvirt.StorageVol, size uint64
 			return err
 		}
 
+		// abort the upload of incomplete or rejected content. Finish reports
+		// whether libvirt stored the content, e.g. failed sparse uploads.
 		defer func() {
-			if uint64(bytesCopied) != size {
+			if err == nil && size != 0 && uint64(bytesCopied) != size {
+				err = fmt.Errorf("uploaded %d of %d bytes", bytesCopied, size)
+			}
+			if err != nil {
 				stream.Abort()
-			} else {
-				stream.Finish()
+			} else if finishErr := stream.Finish(); finishErr != nil {
+				err = fmt.Errorf("error finishing upload: %v", finishErr)
 			}
 			stream.Free()
 		}()
 
-		volume.Upload(stream, 0, size, 0)
+		if err := volume.Upload(stream, 0, size, libvirt.STORAGE_VOL_UPLOAD_SPARSE_STREAM); err != nil {
+			return err
+		}
 
 		sio := newStreamIO(*stream)
 
-		bytesCopied, err = io.Copy(sio, src)
+		bytesCopied, err = copySparse(sio, src)
 		if err != nil {
 			return err
 		}
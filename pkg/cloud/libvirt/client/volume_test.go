@@ -0,0 +1,184 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestNewDefCloneVolume(t *testing.T) {
+	backingStore := &libvirtxml.StorageVolumeBackingStore{
+		Path:   "/var/lib/libvirt/images/rhcos",
+		Format: &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+	}
+
+	cases := []struct {
+		name                 string
+		baseBackingStore     *libvirtxml.StorageVolumeBackingStore
+		flatten              bool
+		expectedBackingStore string
+	}{
+		{
+			name:                 "clone keeps backing store",
+			baseBackingStore:     backingStore,
+			expectedBackingStore: "/var/lib/libvirt/images/rhcos",
+		},
+		{
+			name:             "flat clone drops backing store",
+			baseBackingStore: backingStore,
+			flatten:          true,
+		},
+		{
+			name: "clone of standalone volume",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			baseVolumeDef := newDefVolume("base")
+			baseVolumeDef.BackingStore = tc.baseBackingStore
+
+			volumeDef := newDefCloneVolume(newDefVolume("worker"), baseVolumeDef, tc.flatten)
+			if volumeDef.Name != "worker" {
+				t.Errorf("expected name worker, got %s", volumeDef.Name)
+			}
+			path := ""
+			if volumeDef.BackingStore != nil {
+				path = volumeDef.BackingStore.Path
+			}
+			if path != tc.expectedBackingStore {
+				t.Errorf("expected backing store %q, got %q", tc.expectedBackingStore, path)
+			}
+			if volumeDef.BackingStore != nil && volumeDef.BackingStore == baseVolumeDef.BackingStore {
+				t.Errorf("expected backing store to be copied")
+			}
+		})
+	}
+}
+
+func TestIsBackedBy(t *testing.T) {
+	overlay := newDefVolume("worker")
+	overlay.BackingStore = &libvirtxml.StorageVolumeBackingStore{Path: "/var/lib/libvirt/images/base"}
+
+	if !isBackedBy(overlay, "/var/lib/libvirt/images/base") {
+		t.Errorf("expected overlay to be backed by the base volume")
+	}
+	if isBackedBy(overlay, "/var/lib/libvirt/images/other") {
+		t.Errorf("expected overlay not to be backed by another volume")
+	}
+	if isBackedBy(newDefVolume("standalone"), "/var/lib/libvirt/images/base") {
+		t.Errorf("expected standalone volume not to be backed by any volume")
+	}
+}
+
+func TestSetVolumeOptions(t *testing.T) {
+	cases := []struct {
+		name                 string
+		format               string
+		preallocation        string
+		lazyRefcounts        bool
+		expectedFlags        libvirt.StorageVolCreateFlags
+		expectedAllocation   bool
+		expectedLazyRefcount bool
+		expectError          bool
+	}{
+		{
+			name:   "defaults",
+			format: "qcow2",
+		},
+		{
+			name:          "qcow2 metadata",
+			format:        "qcow2",
+			preallocation: "metadata",
+			expectedFlags: libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA,
+		},
+		{
+			name:               "qcow2 full",
+			format:             "qcow2",
+			preallocation:      "full",
+			expectedFlags:      libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA,
+			expectedAllocation: true,
+		},
+		{
+			name:               "raw full",
+			format:             "raw",
+			preallocation:      "full",
+			expectedAllocation: true,
+		},
+		{
+			name:          "raw metadata",
+			format:        "raw",
+			preallocation: "metadata",
+			expectError:   true,
+		},
+		{
+			name:                 "qcow2 lazy refcounts",
+			format:               "qcow2",
+			lazyRefcounts:        true,
+			expectedLazyRefcount: true,
+		},
+		{
+			name:          "raw lazy refcounts",
+			format:        "raw",
+			lazyRefcounts: true,
+			expectError:   true,
+		},
+		{
+			name:          "unsupported preallocation",
+			format:        "qcow2",
+			preallocation: "falloc",
+			expectError:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			volumeDef := newDefVolume("worker")
+			volumeDef.Target.Format.Type = tc.format
+			volumeDef.Capacity.Value = 1 << 30
+
+			flags, err := setVolumeOptions(&volumeDef, tc.preallocation, tc.lazyRefcounts)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if flags != tc.expectedFlags {
+				t.Errorf("expected flags %v, got %v", tc.expectedFlags, flags)
+			}
+			if allocated := volumeDef.Allocation != nil && volumeDef.Allocation.Value == 1<<30; allocated != tc.expectedAllocation {
+				t.Errorf("expected full allocation %v, got %+v", tc.expectedAllocation, volumeDef.Allocation)
+			}
+			lazyRefcounts := len(volumeDef.Target.Features) == 1 && volumeDef.Target.Features[0].LazyRefcounts != nil
+			if lazyRefcounts != tc.expectedLazyRefcount {
+				t.Errorf("expected lazy refcounts %v, got %+v", tc.expectedLazyRefcount, volumeDef.Target.Features)
+			}
+		})
+	}
+}
+
+func TestMarshalVolumeDef(t *testing.T) {
+	volumeDef := newDefVolume("worker")
+
+	s, err := marshalVolumeDef(volumeDef, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(s, "clusterSize") {
+		t.Errorf("expected no cluster size, got %s", s)
+	}
+
+	s, err = marshalVolumeDef(volumeDef, 65536)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(s, `<clusterSize unit="B">65536</clusterSize></target>`) {
+		t.Errorf("expected cluster size in target, got %s", s)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	clusteractuator "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/actuators/cluster"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	controllerName = "libvirt-cluster-controller"
+
+	// clusterFinalizer keeps the cluster ConfigMap around until the libvirt
+	// resources of the cluster have been torn down
+	clusterFinalizer = "libvirtproviderconfig.openshift.io/cluster"
+)
+
+// Add creates a new cluster controller and adds it to the manager. The
+// controller reconciles ConfigMaps holding a LibvirtClusterProviderConfig.
+func Add(mgr manager.Manager, actuator *clusteractuator.Actuator) error {
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		return err
+	}
+
+	r := &ReconcileCluster{
+		client:        mgr.GetClient(),
+		actuator:      actuator,
+		codec:         codec,
+		eventRecorder: mgr.GetEventRecorderFor(controllerName),
+	}
+
+	c, err := controller.New(controllerName, mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	return c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestForObject{}, predicate.NewPredicateFuncs(isClusterConfigMap))
+}
+
+// isClusterConfigMap checks if the object is a ConfigMap named after the
+// cluster ID it is labeled with and holding a cluster provider config
+func isClusterConfigMap(obj client.Object) bool {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return false
+	}
+	if cm.Labels[providerconfigv1.ClusterIDLabel] != cm.Name {
+		return false
+	}
+	_, ok = cm.Data[providerconfigv1.ClusterProviderSpecKey]
+	return ok
+}
+
+var _ reconcile.Reconciler = &ReconcileCluster{}
+
+// ReconcileCluster reconciles the libvirt resources of a cluster
+type ReconcileCluster struct {
+	client        client.Client
+	actuator      *clusteractuator.Actuator
+	codec         *providerconfigv1.LibvirtProviderConfigCodec
+	eventRecorder record.EventRecorder
+}
+
+// Reconcile reads the cluster provider config from a cluster ConfigMap and
+// makes the libvirt resources match it
+func (r *ReconcileCluster) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	cm := &corev1.ConfigMap{}
+	if err := r.client.Get(ctx, request.NamespacedName, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	config, err := clusteractuator.ProviderConfigCluster(r.codec, cm)
+	if err != nil {
+		glog.Errorf("Unable to get provider config from cluster %s: %v", cm.Name, err)
+		r.eventRecorder.Eventf(cm, corev1.EventTypeWarning, "InvalidConfiguration", "%v", err)
+		// there is nothing we can tear down without a valid config
+		if !cm.DeletionTimestamp.IsZero() && hasFinalizer(cm) {
+			removeFinalizer(cm)
+			return reconcile.Result{}, r.client.Update(ctx, cm)
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !cm.DeletionTimestamp.IsZero() {
+		if !hasFinalizer(cm) {
+			return reconcile.Result{}, nil
+		}
+		if err := r.actuator.Delete(cm.Name, config); err != nil {
+			r.eventRecorder.Eventf(cm, corev1.EventTypeWarning, "FailedDelete", "%v", err)
+			return reconcile.Result{}, err
+		}
+		removeFinalizer(cm)
+		return reconcile.Result{}, r.client.Update(ctx, cm)
+	}
+
+	if !hasFinalizer(cm) {
+		cm.Finalizers = append(cm.Finalizers, clusterFinalizer)
+		if err := r.client.Update(ctx, cm); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	status, err := clusteractuator.ProviderStatusFromCluster(r.codec, cm)
+	if err != nil {
+		glog.Errorf("Unable to get provider status from cluster %s: %v", cm.Name, err)
+		return reconcile.Result{}, err
+	}
+
+	if err := r.actuator.Reconcile(cm.Name, config, status); err != nil {
+		r.eventRecorder.Eventf(cm, corev1.EventTypeWarning, "FailedReconcile", "%v", err)
+		return reconcile.Result{}, err
+	}
+
+	rawStatus, err := clusteractuator.EncodeProviderStatus(r.codec, status)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if cm.Data[providerconfigv1.ClusterProviderStatusKey] == rawStatus {
+		return reconcile.Result{}, nil
+	}
+
+	glog.Infof("Cluster %s status has changed", cm.Name)
+	cm.Data[providerconfigv1.ClusterProviderStatusKey] = rawStatus
+	if err := r.client.Update(ctx, cm); err != nil {
+		return reconcile.Result{}, err
+	}
+	r.eventRecorder.Eventf(cm, corev1.EventTypeNormal, "Reconciled", "Reconciled cluster %v", cm.Name)
+
+	return reconcile.Result{}, nil
+}
+
+func hasFinalizer(cm *corev1.ConfigMap) bool {
+	for _, f := range cm.Finalizers {
+		if f == clusterFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(cm *corev1.ConfigMap) {
+	finalizers := []string{}
+	for _, f := range cm.Finalizers {
+		if f != clusterFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	cm.Finalizers = finalizers
+}
@@ -0,0 +1,297 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	providerconfigv1 "github.com/openshift/cluster-api-provider-libvirt/pkg/apis/libvirtproviderconfig/v1beta1"
+	clusteractuator "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/actuators/cluster"
+	libvirtclient "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client"
+	mocklibvirt "github.com/openshift/cluster-api-provider-libvirt/pkg/cloud/libvirt/client/mock"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	testClusterName = "libvirt-actuator-cluster"
+	testNetworkUUID = "6bc6fa2c-0e46-4d9b-9c1b-9e1d7f2a5a43"
+
+	testProviderSpec = `
+uri: qemu:///system
+network:
+  name: libvirt-actuator-cluster
+  cidrs:
+  - 192.168.126.0/24
+`
+)
+
+// fakeClient implements the client methods used by the reconciler on a
+// single ConfigMap
+type fakeClient struct {
+	client.Client
+	cm      *corev1.ConfigMap
+	updates int
+}
+
+func (c *fakeClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if c.cm == nil || key.Name != c.cm.Name || key.Namespace != c.cm.Namespace {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, key.Name)
+	}
+	c.cm.DeepCopyInto(obj.(*corev1.ConfigMap))
+	return nil
+}
+
+func (c *fakeClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.updates++
+	c.cm = obj.(*corev1.ConfigMap).DeepCopy()
+	return nil
+}
+
+func stubClusterConfigMap(spec string, deleting bool, finalizers ...string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       testClusterName,
+			Namespace:  "default",
+			Labels:     map[string]string{providerconfigv1.ClusterIDLabel: testClusterName},
+			Finalizers: finalizers,
+		},
+		Data: map[string]string{providerconfigv1.ClusterProviderSpecKey: spec},
+	}
+	if deleting {
+		now := metav1.Now()
+		cm.DeletionTimestamp = &now
+	}
+	return cm
+}
+
+func TestReconcile(t *testing.T) {
+	cases := []struct {
+		name               string
+		cm                 *corev1.ConfigMap
+		networkErr         error
+		deleteErr          error
+		expectNetwork      bool
+		expectDelete       bool
+		expectErr          bool
+		expectedFinalizers []string
+		expectedStatus     string
+		expectedEvent      string
+	}{
+		{
+			name: "ConfigMap is gone",
+		},
+		{
+			name:               "Network is created",
+			cm:                 stubClusterConfigMap(testProviderSpec, false),
+			expectNetwork:      true,
+			expectedFinalizers: []string{clusterFinalizer},
+			expectedStatus:     testNetworkUUID,
+			expectedEvent:      "Normal Reconciled",
+		},
+		{
+			name:               "Network creation fails",
+			cm:                 stubClusterConfigMap(testProviderSpec, false),
+			networkErr:         fmt.Errorf("error"),
+			expectNetwork:      true,
+			expectErr:          true,
+			expectedFinalizers: []string{clusterFinalizer},
+			expectedEvent:      "Warning FailedReconcile",
+		},
+		{
+			name:               "Invalid configuration",
+			cm:                 stubClusterConfigMap("uri: [", false),
+			expectedFinalizers: []string{},
+			expectedEvent:      "Warning InvalidConfiguration",
+		},
+		{
+			name:               "Network is deleted",
+			cm:                 stubClusterConfigMap(testProviderSpec, true, "other", clusterFinalizer),
+			expectDelete:       true,
+			expectedFinalizers: []string{"other"},
+		},
+		{
+			name:               "Network deletion fails",
+			cm:                 stubClusterConfigMap(testProviderSpec, true, clusterFinalizer),
+			deleteErr:          fmt.Errorf("error"),
+			expectDelete:       true,
+			expectErr:          true,
+			expectedFinalizers: []string{clusterFinalizer},
+			expectedEvent:      "Warning FailedDelete",
+		},
+		{
+			name:               "Deleted without valid configuration",
+			cm:                 stubClusterConfigMap("uri: [", true, clusterFinalizer),
+			expectedFinalizers: []string{},
+			expectedEvent:      "Warning InvalidConfiguration",
+		},
+		{
+			name:               "Deleted without finalizer",
+			cm:                 stubClusterConfigMap(testProviderSpec, true, "other"),
+			expectedFinalizers: []string{"other"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+			if tc.expectNetwork || tc.expectDelete {
+				mockLibvirtClient.EXPECT().Close()
+			}
+			if tc.expectNetwork {
+				mockLibvirtClient.EXPECT().CreateOrUpdateNetwork(gomock.Any()).Return(testNetworkUUID, false, tc.networkErr)
+			}
+			if tc.expectDelete {
+				mockLibvirtClient.EXPECT().DeleteNetwork(testClusterName).Return(tc.deleteErr)
+			}
+
+			actuator, _ := clusteractuator.NewActuator(clusteractuator.ActuatorParams{
+				ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+					return mockLibvirtClient, nil
+				},
+			})
+			codec, err := providerconfigv1.NewCodec()
+			if err != nil {
+				t.Fatalf("unable to build codec: %v", err)
+			}
+			eventRecorder := record.NewFakeRecorder(2)
+			fake := &fakeClient{cm: tc.cm}
+			r := &ReconcileCluster{
+				client:        fake,
+				actuator:      actuator,
+				codec:         codec,
+				eventRecorder: eventRecorder,
+			}
+
+			_, err = r.Reconcile(context.TODO(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: testClusterName}})
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("expected error: %v, got %v", tc.expectErr, err)
+			}
+
+			if tc.cm == nil {
+				if fake.updates != 0 {
+					t.Errorf("expected no updates, got %d", fake.updates)
+				}
+				return
+			}
+			if len(fake.cm.Finalizers) != len(tc.expectedFinalizers) {
+				t.Errorf("expected finalizers %v, got %v", tc.expectedFinalizers, fake.cm.Finalizers)
+			}
+			for i := range tc.expectedFinalizers {
+				if i < len(fake.cm.Finalizers) && fake.cm.Finalizers[i] != tc.expectedFinalizers[i] {
+					t.Errorf("expected finalizers %v, got %v", tc.expectedFinalizers, fake.cm.Finalizers)
+				}
+			}
+			if status := fake.cm.Data[providerconfigv1.ClusterProviderStatusKey]; !strings.Contains(status, tc.expectedStatus) || tc.expectedStatus == "" && status != "" {
+				t.Errorf("expected status with %q, got %q", tc.expectedStatus, status)
+			}
+
+			select {
+			case event := <-eventRecorder.Events:
+				if tc.expectedEvent == "" || !strings.HasPrefix(event, tc.expectedEvent) {
+					t.Errorf("expected event %q, got %q", tc.expectedEvent, event)
+				}
+			default:
+				if tc.expectedEvent != "" {
+					t.Errorf("expected event %q, got none", tc.expectedEvent)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileKeepsUnchangedStatus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockLibvirtClient := mocklibvirt.NewMockClient(mockCtrl)
+	mockLibvirtClient.EXPECT().Close().Times(2)
+	mockLibvirtClient.EXPECT().CreateOrUpdateNetwork(gomock.Any()).Return(testNetworkUUID, false, nil).Times(2)
+
+	actuator, _ := clusteractuator.NewActuator(clusteractuator.ActuatorParams{
+		ClientBuilder: func(uri string, pool string) (libvirtclient.Client, error) {
+			return mockLibvirtClient, nil
+		},
+	})
+	codec, err := providerconfigv1.NewCodec()
+	if err != nil {
+		t.Fatalf("unable to build codec: %v", err)
+	}
+	fake := &fakeClient{cm: stubClusterConfigMap(testProviderSpec, false)}
+	r := &ReconcileCluster{
+		client:        fake,
+		actuator:      actuator,
+		codec:         codec,
+		eventRecorder: record.NewFakeRecorder(2),
+	}
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: testClusterName}}
+	if _, err := r.Reconcile(context.TODO(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updates := fake.updates
+	if _, err := r.Reconcile(context.TODO(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.updates != updates {
+		t.Errorf("expected no update of an unchanged cluster, got %d", fake.updates-updates)
+	}
+}
+
+func TestIsClusterConfigMap(t *testing.T) {
+	cases := []struct {
+		name     string
+		obj      client.Object
+		expected bool
+	}{
+		{
+			name:     "cluster ConfigMap",
+			obj:      stubClusterConfigMap(testProviderSpec, false),
+			expected: true,
+		},
+		{
+			name: "label does not match the name",
+			obj: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   testClusterName,
+					Labels: map[string]string{providerconfigv1.ClusterIDLabel: "other"},
+				},
+				Data: map[string]string{providerconfigv1.ClusterProviderSpecKey: testProviderSpec},
+			},
+		},
+		{
+			name: "no provider spec",
+			obj: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   testClusterName,
+					Labels: map[string]string{providerconfigv1.ClusterIDLabel: testClusterName},
+				},
+			},
+		},
+		{
+			name: "not a ConfigMap",
+			obj: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   testClusterName,
+					Labels: map[string]string{providerconfigv1.ClusterIDLabel: testClusterName},
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isClusterConfigMap(tc.obj); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}